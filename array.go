@@ -0,0 +1,420 @@
+package tojvm
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Array is an array of references created by ANEWARRAY. It records its type,
+// so that storing an element of the wrong class throws ArrayStoreException.
+// Arrays of primitives are typed slices: []int32 for ints, []int64 for longs,
+// []float32, []float64, []int16 for shorts, []uint16 for chars, []byte for
+// bytes and boolArray for booleans. Arrays passed from Go may also be []Value.
+type Array struct {
+	Desc   string // array type descriptor, such as "[Ljava/lang/String;"
+	Values []Value
+	mon    *monitor
+}
+
+// boolArray is the backing of a boolean array, which holds 0 or 1 per element
+// like a byte array.
+type boolArray []byte
+
+// primitiveArrays maps the Go types of primitive arrays to their descriptors.
+var primitiveArrays = map[reflect.Type]string{
+	reflect.TypeOf([]int32(nil)):   "[I",
+	reflect.TypeOf([]int64(nil)):   "[J",
+	reflect.TypeOf([]float32(nil)): "[F",
+	reflect.TypeOf([]float64(nil)): "[D",
+	reflect.TypeOf([]int16(nil)):   "[S",
+	reflect.TypeOf([]uint16(nil)):  "[C",
+	reflect.TypeOf([]byte(nil)):    "[B",
+	reflect.TypeOf(boolArray(nil)): "[Z",
+}
+
+// arrayKey identifies a primitive array or a []Value array by its backing.
+// Slices with no capacity have no backing of their own, so the VM allocates
+// empty arrays with a capacity of one, see arrayCap.
+type arrayKey struct {
+	t    reflect.Type
+	p    uintptr
+	n, c int
+}
+
+// keyOf returns the key of a primitive array or a []Value array, or false
+// for other values.
+func keyOf(v Value) (arrayKey, bool) {
+	if a, ok := v.([]Value); ok {
+		return arrayKey{valuesType, reflect.ValueOf(a).Pointer(), len(a), cap(a)}, true
+	}
+	if _, ok := primitiveArrays[reflect.TypeOf(v)]; ok {
+		rv := reflect.ValueOf(v)
+		return arrayKey{rv.Type(), rv.Pointer(), rv.Len(), rv.Cap()}, true
+	}
+	return arrayKey{}, false
+}
+
+// arrayCap returns the capacity of a new array of n elements.
+func arrayCap(n int) int {
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+// ownArray returns a new empty array in place of a slice with no capacity
+// passed from Go, so that it has an identity. Other values are returned as is.
+func ownArray(v Value) Value {
+	if k, ok := keyOf(v); ok && k.c == 0 {
+		return reflect.MakeSlice(k.t, 0, 1).Interface()
+	}
+	return v
+}
+
+// arrayTypes are the descriptors of primitive arrays by NEWARRAY atype.
+var arrayTypes = [...]string{4: "[Z", 5: "[C", 6: "[F", 7: "[D", 8: "[B", 9: "[S", 10: "[I", 11: "[J"}
+
+// newArray returns a zeroed primitive array for a descriptor such as "[I".
+func newArray(desc string, n int) Value {
+	switch desc {
+	case "[I":
+		return make([]int32, n, arrayCap(n))
+	case "[J":
+		return make([]int64, n, arrayCap(n))
+	case "[F":
+		return make([]float32, n, arrayCap(n))
+	case "[D":
+		return make([]float64, n, arrayCap(n))
+	case "[S":
+		return make([]int16, n, arrayCap(n))
+	case "[C":
+		return make([]uint16, n, arrayCap(n))
+	case "[B":
+		return make([]byte, n, arrayCap(n))
+	case "[Z":
+		return make(boolArray, n, arrayCap(n))
+	}
+	return nil
+}
+
+// arrayValues returns the elements of an array of references.
+func arrayValues(v Value) ([]Value, bool) {
+	switch a := v.(type) {
+	case []Value:
+		return a, true
+	case *Array:
+		if a != nil {
+			return a.Values, true
+		}
+	}
+	return nil, false
+}
+
+// arrayLength returns the length of an array of any representation.
+func arrayLength(v Value) (int, bool) {
+	switch a := v.(type) {
+	case []int32:
+		return len(a), true
+	case []int64:
+		return len(a), true
+	case []float32:
+		return len(a), true
+	case []float64:
+		return len(a), true
+	case []int16:
+		return len(a), true
+	case []uint16:
+		return len(a), true
+	case []byte:
+		return len(a), true
+	case boolArray:
+		return len(a), true
+	}
+	a, ok := arrayValues(v)
+	return len(a), ok
+}
+
+// element returns an element of a primitive array as it is pushed on the
+// stack.
+func element(v Value, i int) Value {
+	switch a := v.(type) {
+	case []int32:
+		return a[i]
+	case []int64:
+		return a[i]
+	case []float32:
+		return a[i]
+	case []float64:
+		return a[i]
+	case []int16:
+		return int32(a[i])
+	case []uint16:
+		return int32(a[i])
+	case []byte:
+		return int32(int8(a[i]))
+	case boolArray:
+		return int32(a[i])
+	}
+	return nil
+}
+
+// setElement stores a value of the component type in a primitive array,
+// truncating ints to the size of the component.
+func setElement(v Value, i int, e Value) {
+	switch a := v.(type) {
+	case []int32:
+		a[i] = e.(int32)
+	case []int64:
+		a[i] = e.(int64)
+	case []float32:
+		a[i] = e.(float32)
+	case []float64:
+		a[i] = e.(float64)
+	case []int16:
+		a[i] = int16(e.(int32))
+	case []uint16:
+		a[i] = uint16(e.(int32))
+	case []byte:
+		a[i] = byte(e.(int32))
+	case boolArray:
+		a[i] = 0
+		if e.(int32) != 0 {
+			a[i] = 1
+		}
+	}
+}
+
+// arrayElements returns the elements of an array of any representation, as
+// they would be pushed on the stack. Primitive arrays are copied.
+func arrayElements(v Value) ([]Value, bool) {
+	if a, ok := arrayValues(v); ok {
+		return a, true
+	}
+	n, ok := arrayLength(v)
+	if !ok {
+		return nil, false
+	}
+	a := make([]Value, n)
+	for i := range a {
+		a[i] = element(v, i)
+	}
+	return a, true
+}
+
+// isAssignable reports whether instances of class c can be used as instances
+// of class target, which may be one of its superclasses or interfaces.
+func (vm *VM) isAssignable(c, target *Object) bool {
+	if target.Name == "java/lang/Object" {
+		return true
+	}
+	for k := c; k != nil; k = k.SuperInstance {
+		if k == target || k.Name == target.Name {
+			return true
+		}
+		for _, name := range k.Interfaces {
+			if name == target.Name {
+				return true
+			}
+			if i, err := vm.resolve(name); err == nil && vm.isAssignable(i, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canStore reports whether v can be stored in an array with the given
+// component type descriptor, which is also what CHECKCAST checks. Null can be
+// stored in any array of references.
+func (vm *VM) canStore(v Value, desc string) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case *Object:
+		if v == nil {
+			return true
+		}
+		c := v.ClassInstance
+		if c == nil || desc[0] != 'L' {
+			return false
+		}
+		target, err := vm.resolve(desc[1 : len(desc)-1])
+		return err == nil && vm.isAssignable(c, target)
+	case *Array:
+		return v == nil || vm.assignableType(v.Desc, desc)
+	case []Value:
+		// Arrays passed from Go don't know their component type.
+		return desc[0] == '[' || vm.assignableType("[", desc)
+	}
+	if t, ok := primitiveArrays[reflect.TypeOf(v)]; ok {
+		return vm.assignableType(t, desc)
+	}
+	return false
+}
+
+// assignableType reports whether values of the reference type descriptor from
+// can be used as values of type to.
+func (vm *VM) assignableType(from, to string) bool {
+	switch {
+	case from == to:
+		return true
+	case from[0] == '[':
+		switch to {
+		case "Ljava/lang/Object;", "Ljava/lang/Cloneable;", "Ljava/io/Serializable;":
+			return true
+		}
+		if to[0] != '[' || len(from) < 2 || len(to) < 2 {
+			return false
+		}
+		if (from[1] == 'L' || from[1] == '[') && (to[1] == 'L' || to[1] == '[') {
+			return vm.assignableType(from[1:], to[1:])
+		}
+		return false
+	case from[0] == 'L' && to[0] == 'L':
+		c, err := vm.resolve(from[1 : len(from)-1])
+		if err != nil {
+			return false
+		}
+		target, err := vm.resolve(to[1 : len(to)-1])
+		return err == nil && vm.isAssignable(c, target)
+	}
+	return false
+}
+
+// classType returns the type descriptor of a class constant, which names
+// either a class or an array type, and loads the class.
+func (vm *VM) classType(name string) (string, error) {
+	if name[0] == '[' {
+		return name, nil
+	}
+	if _, err := vm.resolve(name); err != nil {
+		return "", err
+	}
+	return "L" + name + ";", nil
+}
+
+// checkIndex checks the array and the index on the stack of an array load or
+// store, and returns the class and message of the exception to throw, if any.
+// Other errors are left for the opcode to report.
+func checkIndex(f *Frame, store bool) (string, string) {
+	n := 1
+	if store {
+		n = 2
+	}
+	if f.SP <= n {
+		return "", ""
+	}
+	ref, i := f.Stack[f.SP-n-1], f.Stack[f.SP-n]
+	if sameRef(ref, nil) {
+		return "java/lang/NullPointerException", "array is null"
+	}
+	length, ok := arrayLength(ref)
+	if index, isInt := i.(int32); ok && isInt && (index < 0 || int(index) >= length) {
+		return "java/lang/ArrayIndexOutOfBoundsException", fmt.Sprintf("Index %d out of bounds for length %d", index, length)
+	}
+	return "", ""
+}
+
+// arrayDesc returns the type descriptor of an array.
+func arrayDesc(v Value) string {
+	if a, ok := v.(*Array); ok {
+		return a.Desc
+	} else if t, ok := primitiveArrays[reflect.TypeOf(v)]; ok {
+		return t
+	}
+	return "[Ljava/lang/Object;"
+}
+
+// cloneArray returns a shallow copy of an array, of the same type.
+func cloneArray(v Value) Value {
+	switch a := v.(type) {
+	case *Array:
+		return &Array{Desc: a.Desc, Values: append([]Value{}, a.Values...)}
+	case []Value:
+		return append(make([]Value, 0, arrayCap(len(a))), a...)
+	}
+	src := reflect.ValueOf(v)
+	dst := reflect.MakeSlice(src.Type(), src.Len(), arrayCap(src.Len()))
+	reflect.Copy(dst, src)
+	return dst.Interface()
+}
+
+// arrayMethod calls a method on an array, which is the first of args. Arrays
+// implement clone, and inherit the other methods of Object.
+func (vm *VM) arrayMethod(t *thread, name, desc string, args []Value) (Value, error) {
+	if _, ok := arrayLength(args[0]); !ok {
+		if sameRef(args[0], nil) {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/NullPointerException", "invoke "+name)}
+		}
+		return nil, fmt.Errorf("%s on %T", name, args[0])
+	}
+	if name == "clone" && desc == "()Ljava/lang/Object;" {
+		return cloneArray(args[0]), nil
+	}
+	m, err := vm.objectClass.Method(name, desc)
+	if err != nil {
+		return nil, fmt.Errorf("array method %s%s: %v", name, desc, err)
+	}
+	return vm.callNative(t, vm.objectClass, m, args)
+}
+
+// typeName returns the name of the class of a reference, for error messages.
+func typeName(v Value) string {
+	switch v := v.(type) {
+	case *Object:
+		if v.ClassInstance != nil {
+			return v.ClassInstance.Name
+		}
+		return v.Name
+	case *Array:
+		return v.Desc
+	}
+	return "array"
+}
+
+// arraycopy copies n elements of array src starting at srcPos to array dst
+// starting at dstPos, like System.arraycopy. The arrays may be the same.
+func (vm *VM) arraycopy(src Value, srcPos int, dst Value, dstPos, n int) error {
+	fail := func(class, msg string) error {
+		return &Exception{Object: vm.newThrowable(class, msg)}
+	}
+	if src == nil || dst == nil {
+		return fail("java/lang/NullPointerException", "arraycopy")
+	}
+	srcLen, srcOK := arrayLength(src)
+	dstLen, dstOK := arrayLength(dst)
+	if !srcOK || !dstOK {
+		return fail("java/lang/ArrayStoreException", "arraycopy: not an array")
+	}
+	srcType, dstType := reflect.TypeOf(src), reflect.TypeOf(dst)
+	_, srcPrimitive := primitiveArrays[srcType]
+	_, dstPrimitive := primitiveArrays[dstType]
+	if (srcPrimitive || dstPrimitive) && srcType != dstType {
+		return fail("java/lang/ArrayStoreException", "arraycopy: type mismatch")
+	}
+	if srcPos < 0 || dstPos < 0 || n < 0 || srcPos > srcLen-n || dstPos > dstLen-n {
+		return fail("java/lang/ArrayIndexOutOfBoundsException", "arraycopy: last index out of bounds")
+	}
+	if srcPrimitive {
+		reflect.Copy(reflect.ValueOf(dst).Slice(dstPos, dstPos+n), reflect.ValueOf(src).Slice(srcPos, srcPos+n))
+		return nil
+	}
+	s, _ := arrayValues(src)
+	d, _ := arrayValues(dst)
+	a, checked := dst.(*Array)
+	if b, ok := src.(*Array); ok && checked && vm.assignableType(b.Desc, a.Desc) {
+		checked = false
+	}
+	if !checked {
+		copy(d[dstPos:dstPos+n], s[srcPos:srcPos+n])
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		v := s[srcPos+i]
+		if !vm.canStore(v, a.Desc[1:]) {
+			return fail("java/lang/ArrayStoreException", "arraycopy: element type mismatch")
+		}
+		d[dstPos+i] = v
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package tojvm
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Assembler emits bytecode and, optionally, a whole class with its constant
+// pool. The zero value is ready to use. Code is accumulated until Method is
+// called, which turns it into a method with a Code attribute.
+type Assembler struct {
+	cp       ConstPool
+	consts   map[Const]uint16
+	code     []byte
+	handlers []handler
+	fields   []Field
+	methods  []Field
+}
+
+type handler struct {
+	start, end, target *Label
+	class              string
+}
+
+// Label is a branch target, see Assembler.Label and Assembler.Mark.
+type Label struct {
+	pos   int
+	fixes []int
+}
+
+func (a *Assembler) constant(c Const) uint16 {
+	if a.consts == nil {
+		a.consts = map[Const]uint16{}
+	}
+	// Floats are compared by their bits, so that 0.0 and -0.0 are different
+	// constants and NaN can be found again.
+	key := c
+	switch c.Tag {
+	case TagFloat:
+		key.Float, key.Integer = 0, int32(math.Float32bits(c.Float))
+	case TagDouble:
+		key.Double, key.Long = 0, int64(math.Float64bits(c.Double))
+	}
+	if i, ok := a.consts[key]; ok {
+		return i
+	}
+	a.cp = append(a.cp, c)
+	i := uint16(len(a.cp))
+	if c.Tag == TagLong || c.Tag == TagDouble {
+		a.cp = append(a.cp, Const{Tag: TagInteger})
+	}
+	a.consts[key] = i
+	return i
+}
+
+func (a *Assembler) ConstUTF8(s string) uint16 {
+	return a.constant(Const{Tag: TagUTF8, String: s})
+}
+
+func (a *Assembler) ConstClass(name string) uint16 {
+	return a.constant(Const{Tag: TagClass, NameIndex: a.ConstUTF8(name)})
+}
+
+func (a *Assembler) ConstString(s string) uint16 {
+	return a.constant(Const{Tag: TagString, StringIndex: a.ConstUTF8(s)})
+}
+
+func (a *Assembler) ConstInt(n int32) uint16 {
+	return a.constant(Const{Tag: TagInteger, Integer: n})
+}
+
+func (a *Assembler) ConstFloat(f float32) uint16 {
+	return a.constant(Const{Tag: TagFloat, Float: f})
+}
+
+func (a *Assembler) ConstLong(n int64) uint16 {
+	return a.constant(Const{Tag: TagLong, Long: n})
+}
+
+func (a *Assembler) ConstDouble(f float64) uint16 {
+	return a.constant(Const{Tag: TagDouble, Double: f})
+}
+
+func (a *Assembler) ConstNameAndType(name, desc string) uint16 {
+	return a.constant(Const{Tag: TagNameAndType, NameIndex: a.ConstUTF8(name), DescIndex: a.ConstUTF8(desc)})
+}
+
+// ConstRef adds a field, method or interface method reference, depending on tag.
+func (a *Assembler) ConstRef(tag Tag, class, name, desc string) uint16 {
+	return a.constant(Const{Tag: tag, ClassIndex: a.ConstClass(class), NameAndTypeIndex: a.ConstNameAndType(name, desc)})
+}
+
+// Code returns the bytecode emitted since the last call to Method.
+func (a *Assembler) Code() []byte {
+	return a.code
+}
+
+// Op emits an arbitrary opcode followed by its raw operand bytes.
+func (a *Assembler) Op(op byte, operands ...byte) *Assembler {
+	a.code = append(a.code, op)
+	a.code = append(a.code, operands...)
+	return a
+}
+
+func (a *Assembler) op2(op byte, n uint16) *Assembler {
+	return a.Op(op, byte(n>>8), byte(n))
+}
+
+func (a *Assembler) Iconst(n int32) *Assembler {
+	switch {
+	case n >= -1 && n <= 5:
+		return a.Op(byte(0x03 + n)) // ICONST_M1 .. ICONST_5
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return a.Op(0x10, byte(n)) // BIPUSH
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return a.op2(0x11, uint16(n)) // SIPUSH
+	}
+	return a.Ldc(n)
+}
+
+// Ldc emits LDC, LDC_W or LDC2_W for an int32, float32, int64, float64 or
+// string constant.
+func (a *Assembler) Ldc(v Value) *Assembler {
+	var i uint16
+	switch v := v.(type) {
+	case int32:
+		i = a.ConstInt(v)
+	case float32:
+		i = a.ConstFloat(v)
+	case string:
+		i = a.ConstString(v)
+	case int64:
+		return a.op2(0x14, a.ConstLong(v)) // LDC2_W
+	case float64:
+		return a.op2(0x14, a.ConstDouble(v)) // LDC2_W
+	default:
+		panic("unsupported constant")
+	}
+	if i <= math.MaxUint8 {
+		return a.Op(0x12, byte(i)) // LDC
+	}
+	return a.op2(0x13, i) // LDC_W
+}
+
+func (a *Assembler) local(op, op0 byte, n int) *Assembler {
+	if n <= 3 {
+		return a.Op(op0 + byte(n))
+	}
+	return a.Op(op, byte(n))
+}
+
+func (a *Assembler) Iload(n int) *Assembler  { return a.local(0x15, 0x1A, n) }
+func (a *Assembler) Lload(n int) *Assembler  { return a.local(0x16, 0x1E, n) }
+func (a *Assembler) Fload(n int) *Assembler  { return a.local(0x17, 0x22, n) }
+func (a *Assembler) Dload(n int) *Assembler  { return a.local(0x18, 0x26, n) }
+func (a *Assembler) Aload(n int) *Assembler  { return a.local(0x19, 0x2A, n) }
+func (a *Assembler) Istore(n int) *Assembler { return a.local(0x36, 0x3B, n) }
+func (a *Assembler) Lstore(n int) *Assembler { return a.local(0x37, 0x3F, n) }
+func (a *Assembler) Fstore(n int) *Assembler { return a.local(0x38, 0x43, n) }
+func (a *Assembler) Dstore(n int) *Assembler { return a.local(0x39, 0x47, n) }
+func (a *Assembler) Astore(n int) *Assembler { return a.local(0x3A, 0x4B, n) }
+
+func (a *Assembler) Iinc(n int, delta int8) *Assembler { return a.Op(0x84, byte(n), byte(delta)) }
+
+func (a *Assembler) Iadd() *Assembler    { return a.Op(0x60) }
+func (a *Assembler) Isub() *Assembler    { return a.Op(0x64) }
+func (a *Assembler) Imul() *Assembler    { return a.Op(0x68) }
+func (a *Assembler) Dup() *Assembler     { return a.Op(0x59) }
+func (a *Assembler) Pop() *Assembler     { return a.Op(0x57) }
+func (a *Assembler) Ireturn() *Assembler { return a.Op(0xAC) }
+func (a *Assembler) Lreturn() *Assembler { return a.Op(0xAD) }
+func (a *Assembler) Freturn() *Assembler { return a.Op(0xAE) }
+func (a *Assembler) Dreturn() *Assembler { return a.Op(0xAF) }
+func (a *Assembler) Areturn() *Assembler { return a.Op(0xB0) }
+func (a *Assembler) Return() *Assembler  { return a.Op(0xB1) }
+func (a *Assembler) Athrow() *Assembler  { return a.Op(0xBF) }
+
+// Invoke emits one of INVOKEVIRTUAL, INVOKESPECIAL, INVOKESTATIC or
+// INVOKEINTERFACE with a reference to the given method. The count operand of
+// INVOKEINTERFACE is the number of argument slots plus one for the receiver.
+func (a *Assembler) Invoke(op byte, class, name, desc string) *Assembler {
+	if op == 0xB9 { // INVOKEINTERFACE
+		a.op2(op, a.ConstRef(TagInterfaceMethodRef, class, name, desc))
+		return a.Op(byte(argSlots(desc)+1), 0)
+	}
+	return a.op2(op, a.ConstRef(TagMethodRef, class, name, desc))
+}
+
+// FieldOp emits one of GETSTATIC, PUTSTATIC, GETFIELD or PUTFIELD.
+func (a *Assembler) FieldOp(op byte, class, name, desc string) *Assembler {
+	return a.op2(op, a.ConstRef(TagFieldRef, class, name, desc))
+}
+
+func (a *Assembler) Getstatic(class, name, desc string) *Assembler {
+	return a.FieldOp(0xB2, class, name, desc)
+}
+func (a *Assembler) Putstatic(class, name, desc string) *Assembler {
+	return a.FieldOp(0xB3, class, name, desc)
+}
+func (a *Assembler) Getfield(class, name, desc string) *Assembler {
+	return a.FieldOp(0xB4, class, name, desc)
+}
+func (a *Assembler) Putfield(class, name, desc string) *Assembler {
+	return a.FieldOp(0xB5, class, name, desc)
+}
+
+// ClassOp emits an opcode taking a class reference, such as NEW or CHECKCAST.
+func (a *Assembler) ClassOp(op byte, class string) *Assembler {
+	return a.op2(op, a.ConstClass(class))
+}
+
+func (a *Assembler) New(class string) *Assembler { return a.ClassOp(0xBB, class) }
+
+// Anewarray emits ANEWARRAY for an array of class, which may be an array type.
+func (a *Assembler) Anewarray(class string) *Assembler { return a.ClassOp(0xBD, class) }
+
+// Newarray emits NEWARRAY for a primitive array type, such as 10 for T_INT.
+func (a *Assembler) Newarray(atype byte) *Assembler { return a.Op(0xBC, atype) }
+
+// Label creates a new unbound label.
+func (a *Assembler) Label() *Label {
+	return &Label{pos: -1}
+}
+
+// Mark binds the label to the current code position.
+func (a *Assembler) Mark(l *Label) *Assembler {
+	l.pos = len(a.code)
+	for _, at := range l.fixes {
+		binary.BigEndian.PutUint16(a.code[at+1:], uint16(l.pos-at))
+	}
+	l.fixes = nil
+	return a
+}
+
+// Branch emits a branch instruction with a 16-bit offset, such as GOTO or any
+// of the IF* opcodes, jumping to the label.
+func (a *Assembler) Branch(op byte, l *Label) *Assembler {
+	at := len(a.code)
+	if l.pos < 0 {
+		l.fixes = append(l.fixes, at)
+		return a.op2(op, 0)
+	}
+	return a.op2(op, uint16(l.pos-at))
+}
+
+func (a *Assembler) Goto(l *Label) *Assembler { return a.Branch(0xA7, l) }
+
+// Catch adds an exception handler at target for the code between start and
+// end. An empty class catches everything, like a finally block.
+func (a *Assembler) Catch(start, end, target *Label, class string) *Assembler {
+	a.handlers = append(a.handlers, handler{start, end, target, class})
+	return a
+}
+
+// Field declares a field of the assembled class.
+func (a *Assembler) Field(flags uint16, name, desc string) *Assembler {
+	a.fields = append(a.fields, Field{Flags: flags, Name: name, Descriptor: desc})
+	return a
+}
+
+// ConstField declares a field with a ConstantValue attribute, which must be an
+// int32, float32, int64, float64 or string.
+func (a *Assembler) ConstField(flags uint16, name, desc string, value Value) *Assembler {
+	var i uint16
+	switch v := value.(type) {
+	case int32:
+		i = a.ConstInt(v)
+	case float32:
+		i = a.ConstFloat(v)
+	case int64:
+		i = a.ConstLong(v)
+	case float64:
+		i = a.ConstDouble(v)
+	case string:
+		i = a.ConstString(v)
+	default:
+		panic("unsupported constant")
+	}
+	a.ConstUTF8("ConstantValue")
+	a.fields = append(a.fields, Field{Flags: flags, Name: name, Descriptor: desc, Attributes: []Attribute{
+		{Name: "ConstantValue", Data: []byte{byte(i >> 8), byte(i)}},
+	}})
+	return a
+}
+
+// Method turns the code emitted so far into a method of the assembled class.
+// If no code was emitted the method has no Code attribute, as abstract and
+// native methods do.
+func (a *Assembler) Method(flags uint16, name, desc string, maxStack, maxLocals int) *Assembler {
+	m := Field{Flags: flags, Name: name, Descriptor: desc}
+	if len(a.code) > 0 {
+		data := make([]byte, 8, 12+len(a.code))
+		binary.BigEndian.PutUint16(data[0:], uint16(maxStack))
+		binary.BigEndian.PutUint16(data[2:], uint16(maxLocals))
+		binary.BigEndian.PutUint32(data[4:], uint32(len(a.code)))
+		data = append(data, a.code...)
+		data = append(data, byte(len(a.handlers)>>8), byte(len(a.handlers)))
+		for _, h := range a.handlers {
+			var catchType uint16
+			if h.class != "" {
+				catchType = a.ConstClass(h.class)
+			}
+			for _, n := range []uint16{uint16(h.start.pos), uint16(h.end.pos), uint16(h.target.pos), catchType} {
+				data = append(data, byte(n>>8), byte(n))
+			}
+		}
+		data = append(data, 0, 0) // attributes
+		m.Attributes = []Attribute{{Name: "Code", Data: data}}
+		a.ConstUTF8("Code")
+	}
+	a.ConstUTF8(name)
+	a.ConstUTF8(desc)
+	a.methods = append(a.methods, m)
+	a.code, a.handlers = nil, nil
+	return a
+}
+
+// Class returns the assembled class with its fields, methods and constant
+// pool, as if it was read by Load.
+func (a *Assembler) Class(flags uint16, name, super string, interfaces ...string) Class {
+	a.ConstClass(name)
+	if super != "" {
+		a.ConstClass(super)
+	}
+	for _, i := range interfaces {
+		a.ConstClass(i)
+	}
+	for _, f := range a.fields {
+		a.ConstUTF8(f.Name)
+		a.ConstUTF8(f.Descriptor)
+	}
+	return Class{
+		ConstPool:  a.cp,
+		Name:       name,
+		Super:      super,
+		Flags:      flags,
+		Interfaces: interfaces,
+		Fields:     a.fields,
+		Methods:    a.methods,
+	}
+}
@@ -0,0 +1,77 @@
+package tojvm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAssembleCode(t *testing.T) {
+	a := &Assembler{}
+	code := a.Iload(0).Iload(1).Iadd().Ireturn().Code()
+	if !bytes.Equal(code, []byte{0x1A, 0x1B, 0x60, 0xAC}) {
+		t.Fatal(code)
+	}
+	if res, err := New().EvalMethod(code, 2, 2, int32(20), int32(22)); err != nil {
+		t.Error(err)
+	} else if res != int32(42) {
+		t.Error(res)
+	}
+	if code := (&Assembler{}).Iconst(-1).Iconst(5).Iconst(100).Iconst(1000).Code(); !bytes.Equal(code, []byte{0x02, 0x08, 0x10, 100, 0x11, 0x03, 0xE8}) {
+		t.Error(code)
+	}
+}
+
+func TestAssembleClass(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0x0008, "n", "I")
+	a.Iconst(0).Putstatic("Counter", "n", "I").Return().
+		Method(0x0008, "<clinit>", "()V", 1, 0)
+	a.Getstatic("Counter", "n", "I").Iconst(1).Iadd().Putstatic("Counter", "n", "I").Return().
+		Method(0x0009, "inc", "()V", 2, 0)
+	a.Invoke(0xB8, "Counter", "inc", "()V").
+		Invoke(0xB8, "Counter", "inc", "()V").
+		Getstatic("Counter", "n", "I").Ireturn().
+		Method(0x0009, "run", "()I", 1, 0)
+	a.Iconst(100000).Ireturn().Method(0x0009, "big", "()I", 1, 0)
+	a.Ldc(int64(1)<<40).Lreturn().Method(0x0009, "wide", "()J", 2, 0)
+	a.Method(0x0109, "native", "()V", 0, 0)
+	c := a.Class(0x0021, "Counter", "java/lang/Object")
+	if c.Name != "Counter" || c.Super != "java/lang/Object" || len(c.Methods) != 6 || len(c.Fields) != 1 {
+		t.Fatal(c)
+	}
+	if len(c.Methods[5].Attributes) != 0 {
+		t.Error(c.Methods[5])
+	}
+
+	vm := New()
+	if _, err := vm.DefineClass(c); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Counter", "run"); err != nil || res != int32(2) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Counter", "big"); err != nil || res != int32(100000) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Counter", "wide"); err != nil || res != int64(1)<<40 {
+		t.Error(res, err)
+	}
+}
+
+func TestAssembleBranch(t *testing.T) {
+	a := &Assembler{}
+	skip, back := a.Label(), a.Label()
+	a.Goto(skip).Iconst(1).Ireturn().Mark(back).Iconst(2).Ireturn().Mark(skip).Goto(back)
+	if code := a.Code(); !bytes.Equal(code, []byte{0xA7, 0, 7, 0x04, 0xAC, 0x05, 0xAC, 0xA7, 0xFF, 0xFE}) {
+		t.Error(code)
+	}
+}
+
+func TestAssembleInvokeInterface(t *testing.T) {
+	for desc, count := range map[string]byte{"()V": 1, "(I)V": 2, "(JD)V": 5, "([JLjava/lang/Object;D)I": 5} {
+		code := (&Assembler{}).Invoke(0xB9, "Shape", "m", desc).Code()
+		if len(code) != 5 || code[0] != 0xB9 || code[3] != count || code[4] != 0 {
+			t.Error(desc, code)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package tojvm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	objectType = reflect.TypeOf((*Object)(nil))
+	valuesType = reflect.TypeOf([]Value(nil))
+	arrayType  = reflect.TypeOf((*Array)(nil))
+	boolsType  = reflect.TypeOf([]bool(nil))
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Bind sets the Go function variable pointed to by fnPtr to a wrapper calling
+// the method, which is resolved once by name and descriptor. The function
+// takes the method arguments, preceded by an *Object receiver for instance
+// methods, and returns the method result, if any, optionally followed by an
+// error. The Go signature is checked against the method descriptor. If the
+// function has no error result, failed calls panic.
+//
+//	var add func(int32, int32) (int32, error)
+//	err := vm.Bind("FieldsAndMethods", "add", "(II)I", &add)
+func (vm *VM) Bind(class, method, desc string, fnPtr interface{}) error {
+	p := reflect.ValueOf(fnPtr)
+	if p.Kind() != reflect.Ptr || p.Elem().Kind() != reflect.Func {
+		return fmt.Errorf("cannot bind to %T", fnPtr)
+	}
+	c, err := vm.Class(class)
+	if err != nil {
+		return err
+	}
+	m, err := c.Method(method, desc)
+	if err != nil {
+		return fmt.Errorf("%s.%s%s: %v", class, method, desc, err)
+	}
+	params, ret, err := parseDescriptor(m.Descriptor)
+	if err != nil {
+		return err
+	}
+	ft := p.Elem().Type()
+	if err := checkSignature(ft, m, params, ret); err != nil {
+		return fmt.Errorf("cannot bind %s.%s%s to %s: %v", class, method, m.Descriptor, ft, err)
+	}
+	receiver := ft.NumIn() - len(params)
+	hasErr := ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType
+	p.Elem().Set(reflect.MakeFunc(ft, func(in []reflect.Value) []reflect.Value {
+		out := make([]reflect.Value, ft.NumOut())
+		for i := range out {
+			out[i] = reflect.New(ft.Out(i)).Elem()
+		}
+		fail := func(err error) []reflect.Value {
+			if !hasErr {
+				panic(err)
+			}
+			out[len(out)-1] = reflect.ValueOf(&err).Elem()
+			return out
+		}
+		args := make([]Value, len(in))
+		for i, v := range in {
+			if i < receiver {
+				if !v.IsNil() {
+					args[i] = v.Interface()
+				}
+				continue
+			}
+			arg, err := vm.convertArg(goValue(v), params[i-receiver])
+			if err != nil {
+				return fail(fmt.Errorf("argument %d of %s%s: %v", i-receiver+1, m.Name, m.Descriptor, err))
+			}
+			args[i] = arg
+		}
+		res, err := vm.callMethod(c, m, args...)
+		if err != nil {
+			return fail(err)
+		}
+		if ret != "V" {
+			if err := vm.unmarshalValue(res, out[0]); err != nil {
+				return fail(fmt.Errorf("result of %s%s: %v", m.Name, m.Descriptor, err))
+			}
+		}
+		return out
+	}))
+	return nil
+}
+
+// checkSignature reports whether Go functions of type ft can wrap method m.
+func checkSignature(ft reflect.Type, m Field, params []string, ret string) error {
+	in := ft.NumIn()
+	if in == len(params)+1 && ft.In(0) == objectType {
+		if m.Flags&0x0008 != 0 { // ACC_STATIC
+			return errors.New("static method has no receiver")
+		}
+	} else if in != len(params) {
+		return fmt.Errorf("want %d arguments", len(params))
+	}
+	for i, param := range params {
+		if t := ft.In(in - len(params) + i); !fits(t, param, false) {
+			return fmt.Errorf("cannot use %s as %s", t, param)
+		}
+	}
+	out := ft.NumOut()
+	if out > 0 && ft.Out(out-1) == errorType {
+		out--
+	}
+	switch {
+	case ret == "V" && out != 0:
+		return errors.New("void method has no result")
+	case ret != "V" && out != 1:
+		return errors.New("want a single result")
+	case ret != "V" && !fits(ft.Out(0), ret, true):
+		return fmt.Errorf("cannot use %s as %s", ft.Out(0), ret)
+	}
+	return nil
+}
+
+// fits reports whether values of Go type t can be converted to the Java type
+// desc, or from it if result is set.
+func fits(t reflect.Type, desc string, result bool) bool {
+	switch k := t.Kind(); desc[0] {
+	case 'Z':
+		return k == reflect.Bool
+	case 'B', 'C', 'S', 'I', 'J':
+		return k >= reflect.Int && k <= reflect.Uint64
+	case 'F', 'D':
+		return k == reflect.Float32 || k == reflect.Float64
+	default:
+		switch {
+		case t == objectType || k == reflect.Interface:
+			return true
+		case k == reflect.String:
+			return desc == "Ljava/lang/String;" || desc == "Ljava/lang/Object;" || desc == "Ljava/lang/CharSequence;"
+		case desc[0] == '[':
+			return t == valuesType || t == arrayType || primitiveArrays[t] == desc || (t == boolsType && desc == "[Z") || (result && (k == reflect.Slice || k == reflect.Array))
+		}
+		return result && (k == reflect.Struct || (k == reflect.Ptr && t.Elem().Kind() == reflect.Struct))
+	}
+}
+
+// goValue returns the value of v as one of the basic Go types understood by
+// convertArg, so that named types like `type Celsius float64` work as well.
+func goValue(v reflect.Value) Value {
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > 1<<63-1 {
+			return v.Uint()
+		}
+		return int64(v.Uint())
+	case reflect.Float32:
+		return float32(v.Float())
+	case reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	}
+	return v.Interface()
+}
+
+// BindNatives is the reverse of Bind: it registers each exported method of
+// receiver as a native method of the class, named like the Go method with its
+// first letter lowercased. Descriptors are inferred from the Go parameter and
+// result types: bool, int8 or byte, uint16, int16, int32 or int, int64,
+// float32 and float64 are the Java primitive types, string is String, *Object
+// and interface{} are Object, and slices of these are arrays. Methods may
+// return an error after their result; an *Exception error, e.g. from Throw,
+// is thrown. The natives can be instance or static methods: the Java receiver
+// isn't passed. Nothing is registered if a method has other types.
+//
+//	type Calc struct{}
+//	func (Calc) Add(a, b int32) int32 { return a + b } // static native int add(int a, int b);
+//	err := vm.BindNatives("Calc", Calc{})
+func (vm *VM) BindNatives(class string, receiver interface{}) error {
+	v := reflect.ValueOf(receiver)
+	if !v.IsValid() {
+		return errors.New("cannot bind natives to nil")
+	}
+	descs := make([]string, v.NumMethod())
+	for i := range descs {
+		desc, err := goDescriptor(v.Method(i).Type())
+		if err != nil {
+			return fmt.Errorf("cannot bind %s to %s: %v", v.Type().Method(i).Name, class, err)
+		}
+		descs[i] = desc
+	}
+	for i, desc := range descs {
+		desc := desc
+		name := v.Type().Method(i).Name
+		fn := v.Method(i)
+		ft := fn.Type()
+		ret := desc[strings.IndexByte(desc, ')')+1:]
+		hasErr := ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType
+		method := strings.ToLower(name[:1]) + name[1:]
+		vm.RegisterNativeFunc(class, method, desc, func(ctx *NativeContext, args ...Value) (Value, error) {
+			if len(args) == ft.NumIn()+1 {
+				args = args[1:]
+			}
+			in := make([]reflect.Value, len(args))
+			for i, arg := range args {
+				in[i] = reflect.New(ft.In(i)).Elem()
+				if err := vm.unmarshalValue(arg, in[i]); err != nil {
+					return nil, fmt.Errorf("argument %d of %s%s: %v", i+1, method, desc, err)
+				}
+			}
+			out := fn.Call(in)
+			if hasErr {
+				if err, _ := out[len(out)-1].Interface().(error); err != nil {
+					return nil, err
+				}
+			}
+			if ret == "V" {
+				return nil, nil
+			}
+			return vm.marshalValue(out[0], ret)
+		})
+	}
+	return nil
+}
+
+// goDescriptor infers the method descriptor of Go functions of type ft.
+func goDescriptor(ft reflect.Type) (string, error) {
+	var params []string
+	for i := 0; i < ft.NumIn(); i++ {
+		desc, ok := goTypeDesc(ft.In(i))
+		if !ok {
+			return "", fmt.Errorf("no Java type for %s", ft.In(i))
+		}
+		params = append(params, desc)
+	}
+	out := ft.NumOut()
+	if out > 0 && ft.Out(out-1) == errorType {
+		out--
+	}
+	ret := "V"
+	if out > 1 {
+		return "", errors.New("want a single result")
+	} else if out == 1 {
+		desc, ok := goTypeDesc(ft.Out(0))
+		if !ok {
+			return "", fmt.Errorf("no Java type for %s", ft.Out(0))
+		}
+		ret = desc
+	}
+	return "(" + strings.Join(params, "") + ")" + ret, nil
+}
+
+// goTypeDesc returns the Java type descriptor for the Go type t.
+func goTypeDesc(t reflect.Type) (string, bool) {
+	if t == objectType {
+		return "Ljava/lang/Object;", true
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "Z", true
+	case reflect.Int8, reflect.Uint8:
+		return "B", true
+	case reflect.Uint16:
+		return "C", true
+	case reflect.Int16:
+		return "S", true
+	case reflect.Int32, reflect.Int:
+		return "I", true
+	case reflect.Int64:
+		return "J", true
+	case reflect.Float32:
+		return "F", true
+	case reflect.Float64:
+		return "D", true
+	case reflect.String:
+		return "Ljava/lang/String;", true
+	case reflect.Interface:
+		return "Ljava/lang/Object;", t.NumMethod() == 0
+	case reflect.Slice:
+		desc, ok := goTypeDesc(t.Elem())
+		return "[" + desc, ok
+	}
+	return "", false
+}
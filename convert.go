@@ -0,0 +1,355 @@
+package tojvm
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"unicode/utf16"
+)
+
+// parseDescriptor splits a method descriptor into parameter and return type
+// descriptors.
+func parseDescriptor(desc string) (params []string, ret string, err error) {
+	if len(desc) == 0 || desc[0] != '(' {
+		return nil, "", fmt.Errorf("bad method descriptor %q", desc)
+	}
+	for i := 1; i < len(desc); {
+		if desc[i] == ')' {
+			ret = desc[i+1:]
+			if ret != "V" && fieldType(ret) != len(ret) {
+				break
+			}
+			return params, ret, nil
+		}
+		n := fieldType(desc[i:])
+		if n == 0 {
+			break
+		}
+		params = append(params, desc[i:i+n])
+		i = i + n
+	}
+	return nil, "", fmt.Errorf("bad method descriptor %q", desc)
+}
+
+// fieldType returns the length of the field type descriptor at the start of s,
+// or 0 if there is none.
+func fieldType(s string) int {
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		i++
+	}
+	if i == len(s) {
+		return 0
+	}
+	switch s[i] {
+	case 'B', 'C', 'D', 'F', 'I', 'J', 'S', 'Z':
+		return i + 1
+	case 'L':
+		for j := i + 1; j < len(s); j++ {
+			if s[j] == ';' {
+				return j + 1
+			}
+		}
+	}
+	return 0
+}
+
+// intRange holds the bounds of the integer types, by descriptor.
+var intRange = map[byte][2]int64{
+	'B': {math.MinInt8, math.MaxInt8},
+	'C': {0, math.MaxUint16},
+	'S': {math.MinInt16, math.MaxInt16},
+	'I': {math.MinInt32, math.MaxInt32},
+	'J': {math.MinInt64, math.MaxInt64},
+}
+
+// convertArgs converts Go values passed to Call into the values expected by
+// the method descriptor. Instance methods take the receiver as the first
+// argument, which is passed as is. The number of arguments must match the
+// descriptor, and a missing receiver is an error. The args slice is copied
+// before anything is converted.
+func (vm *VM) convertArgs(m Field, args []Value) ([]Value, error) {
+	params, _, err := parseDescriptor(m.Descriptor)
+	if err != nil {
+		return nil, err
+	}
+	return vm.convertParams(m, params, args)
+}
+
+// convertParams is like convertArgs, with the parameter types of the method
+// already parsed.
+func (vm *VM) convertParams(m Field, params []string, args []Value) ([]Value, error) {
+	offset := 0
+	if m.Flags&0x0008 == 0 { // ACC_STATIC
+		offset = 1
+	}
+	if err := checkArgc(m, args); err != nil {
+		return nil, err
+	}
+	copied := false
+	for i := offset; i < len(args); i++ {
+		v, err := vm.convertArg(args[i], params[i-offset])
+		if err != nil {
+			return nil, fmt.Errorf("argument %d of %s%s: %v", i-offset+1, m.Name, m.Descriptor, err)
+		}
+		if !sameRef(v, args[i]) {
+			if !copied {
+				args, copied = append([]Value{}, args...), true
+			}
+			args[i] = v
+		}
+	}
+	return args, nil
+}
+
+// convertArg converts a single Go value to the type described by desc. Go
+// slices of the primitive array type, such as []int32 for int[], are passed as
+// is, so that the method can change them, other slices are copied. Slices with
+// no capacity are replaced by new empty arrays, see sameRef.
+func (vm *VM) convertArg(v Value, desc string) (Value, error) {
+	switch desc[0] {
+	case 'Z':
+		switch b := v.(type) {
+		case bool:
+			return boolValue(b), nil
+		case int32:
+			if b == 0 || b == 1 {
+				return b, nil
+			}
+		}
+	case 'B', 'C', 'S', 'I', 'J':
+		n, ok := goInt(v)
+		if !ok {
+			break
+		}
+		if r := intRange[desc[0]]; n < r[0] || n > r[1] {
+			return nil, fmt.Errorf("%v overflows %s", v, desc)
+		}
+		if desc[0] == 'J' {
+			return n, nil
+		}
+		return int32(n), nil
+	case 'F':
+		switch f := v.(type) {
+		case float32:
+			return f, nil
+		case float64:
+			return float32(f), nil
+		}
+		if n, ok := goInt(v); ok {
+			return float32(n), nil
+		}
+	case 'D':
+		switch f := v.(type) {
+		case float32:
+			return float64(f), nil
+		case float64:
+			return f, nil
+		}
+		if n, ok := goInt(v); ok {
+			return float64(n), nil
+		}
+	case 'L', '[':
+		switch r := v.(type) {
+		case nil:
+			return nil, nil
+		case *Object:
+			if r == nil {
+				return nil, nil
+			}
+			return r, nil
+		case []Value:
+			if len(desc) == 2 {
+				break // copied into a primitive array below
+			}
+			if desc[0] == '[' || desc == "Ljava/lang/Object;" {
+				return ownArray(r), nil
+			}
+		case *Array:
+			if r == nil {
+				return nil, nil
+			}
+			if vm.canStore(r, desc) {
+				return r, nil
+			}
+		case string:
+			switch desc {
+			case "Ljava/lang/String;", "Ljava/lang/Object;", "Ljava/lang/CharSequence;":
+				return vm.InternString(r), nil
+			case "[C":
+				return ownArray(utf16.Encode([]rune(r))), nil
+			}
+		}
+		if _, ok := primitiveArrays[reflect.TypeOf(v)]; ok {
+			if vm.canStore(v, desc) {
+				return ownArray(v), nil
+			}
+		} else if rv := reflect.ValueOf(v); desc[0] == '[' && (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) {
+			return vm.marshalValue(rv, desc)
+		}
+	}
+	return nil, fmt.Errorf("cannot use %T as %s", v, desc)
+}
+
+// boolValue returns the int32 that represents a boolean on the stack and in
+// fields.
+func boolValue(b bool) Value {
+	if b {
+		return int32(1)
+	}
+	return int32(0)
+}
+
+// AsBool returns the value of a boolean, which is an int32 0 or 1 in the
+// interpreter. Go bools and boxed Booleans are accepted as well.
+func AsBool(v Value) (bool, bool) {
+	if obj, ok := v.(*Object); ok && obj != nil && obj.ClassInstance != nil && obj.Name == "java/lang/Boolean" {
+		v = obj.Field("value")
+	}
+	switch b := v.(type) {
+	case int32:
+		return b != 0, b == 0 || b == 1
+	case bool:
+		return b, true
+	}
+	return false, false
+}
+
+// goInt returns the value of any Go integer type as int64.
+func goInt(v Value) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), uint64(n) <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// boxes lists the wrapper classes of primitive types.
+var boxes = map[string]bool{
+	"java/lang/Boolean": true, "java/lang/Byte": true, "java/lang/Character": true,
+	"java/lang/Short": true, "java/lang/Integer": true, "java/lang/Long": true,
+	"java/lang/Float": true, "java/lang/Double": true,
+}
+
+// ToGo converts a value returned by the interpreter into a plain Go value.
+// Strings become string, boxed primitives are unboxed, with Boolean becoming
+// bool, and arrays become []interface{} with their elements converted. Chars
+// are int32, like other integers, and so are booleans, unless they are boolean
+// array elements. Use ToGoType to convert values of a known type.
+// Primitives and other objects are returned as is.
+func (vm *VM) ToGo(v Value) interface{} {
+	switch v := v.(type) {
+	case *Object:
+		if s, ok := vm.GoString(v); ok {
+			return s
+		}
+		if v != nil && v.ClassInstance != nil && boxes[v.Name] {
+			if v.Name == "java/lang/Boolean" {
+				b, _ := AsBool(v.Field("value"))
+				return b
+			}
+			return v.Field("value")
+		}
+	default:
+		if s, ok := vm.GoSlice(v); ok {
+			return s
+		}
+	}
+	return v
+}
+
+// ToGoType is like ToGo, but converts values of the field type desc, such as
+// a method result, so that booleans become bool.
+func (vm *VM) ToGoType(v Value, desc string) interface{} {
+	if desc == "Z" {
+		if b, ok := AsBool(v); ok {
+			return b
+		}
+	}
+	return vm.ToGo(v)
+}
+
+// GoString returns the contents of a java/lang/String object.
+func (vm *VM) GoString(v Value) (string, bool) {
+	if obj, ok := v.(*Object); ok && obj != nil && obj.ClassInstance != nil && obj.Name == "java/lang/String" {
+		s, ok := obj.Field("value").(string)
+		return s, ok
+	}
+	return "", false
+}
+
+// GoInt returns the value of an int, long, short, byte or char, either
+// primitive or boxed.
+func (vm *VM) GoInt(v Value) (int64, bool) {
+	if obj, ok := v.(*Object); ok && obj != nil && obj.ClassInstance != nil && boxes[obj.Name] {
+		v = obj.Field("value")
+	}
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// GoSlice converts an array into a slice, converting its elements with ToGo.
+func (vm *VM) GoSlice(v Value) ([]interface{}, bool) {
+	a, ok := arrayElements(v)
+	if !ok {
+		return nil, false
+	}
+	_, bools := v.(boolArray)
+	s := make([]interface{}, len(a))
+	for i, e := range a {
+		if bools {
+			s[i] = e != int32(0)
+		} else {
+			s[i] = vm.ToGo(e)
+		}
+	}
+	return s, true
+}
+
+// GoMap converts an object into a map of its field values, converted with
+// ToGo. Objects referenced by fields are converted to maps as well, unless
+// they were already visited higher up, in which case the *Object is kept.
+func (vm *VM) GoMap(v Value) (map[string]interface{}, bool) {
+	obj, ok := v.(*Object)
+	if !ok || obj == nil {
+		return nil, false
+	}
+	return vm.goMap(obj, map[*Object]bool{}), true
+}
+
+func (vm *VM) goMap(obj *Object, visiting map[*Object]bool) map[string]interface{} {
+	visiting[obj] = true
+	defer delete(visiting, obj)
+	m := map[string]interface{}{}
+	for name, value := range obj.copyFields() {
+		v := vm.ToGo(value)
+		if o, ok := v.(*Object); ok && o != nil && !visiting[o] {
+			v = vm.goMap(o, visiting)
+		}
+		m[name] = v
+	}
+	return m
+}
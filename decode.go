@@ -0,0 +1,273 @@
+package tojvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Instruction is a single decoded opcode with its operands. Branch targets are
+// absolute and use the same units as Frame.IP: bytecode offsets when
+// executing raw bytecode, instruction indices when executing a decoded method.
+type Instruction struct {
+	Op      byte
+	IP      uint32   // bytecode offset of the opcode
+	Arg     int32    // immediate value, local variable or constant pool index
+	Arg2    int32    // IINC increment, INVOKEINTERFACE count, MULTIANEWARRAY dimensions
+	Target  uint32   // branch target, or the default target of a switch
+	Keys    []int32  // switch keys, in the order of Targets
+	Targets []uint32 // switch targets
+	Const   Value    // resolved LDC constant
+	Ref     *Ref     // resolved class, field or method reference, or LDC class
+}
+
+// Ref is a symbolic reference from the constant pool. Only names are
+// resolved, classes are loaded when the instruction executes.
+type Ref struct {
+	Class string
+	Name  string
+	Desc  string
+}
+
+var errEndOfCode = errors.New("unexpected end of code")
+
+// branchTarget returns the bytecode offset that a branch or switch whose
+// opcode is at opcodeIP jumps to. Offsets are relative to the opcode, not to
+// the end of its operands.
+func branchTarget(opcodeIP uint32, offset int32) uint32 {
+	return uint32(int32(opcodeIP) + offset)
+}
+
+func isBranch(op byte) bool {
+	return (op >= 0x99 && op <= 0xA8) || op == 0xC6 || op == 0xC7 || op == 0xC8 || op == 0xC9
+}
+
+// decode reads the instruction at ip into ins and returns its length in bytes.
+func decode(ins *Instruction, class *Object, code []byte, ip uint32) (uint32, error) {
+	if int(ip) >= len(code) {
+		return 0, errEndOfCode
+	}
+	*ins = Instruction{Op: code[ip], IP: ip}
+	operands := func(n uint32) ([]byte, error) {
+		if uint64(ip)+1+uint64(n) > uint64(len(code)) {
+			return nil, fmt.Errorf("truncated operands of opcode 0x%02x at %d", ins.Op, ip)
+		}
+		return code[ip+1 : ip+1+n], nil
+	}
+	cpindex := func(i uint16) error {
+		if i == 0 || int(i) > len(class.ConstPool) {
+			return fmt.Errorf("bad constant pool index %d at %d", i, ip)
+		}
+		ins.Arg = int32(i)
+		return nil
+	}
+	switch op := ins.Op; {
+	case op == 0x10: // BIPUSH
+		b, err := operands(1)
+		if err != nil {
+			return 0, err
+		}
+		ins.Arg = int32(int8(b[0]))
+		return 2, nil
+	case op == 0x11: // SIPUSH
+		b, err := operands(2)
+		if err != nil {
+			return 0, err
+		}
+		ins.Arg = int32(int16(binary.BigEndian.Uint16(b)))
+		return 3, nil
+	case op == 0x12, op == 0x13, op == 0x14: // LDC, LDC_W, LDC2_W
+		n := uint32(2)
+		if op == 0x12 {
+			n = 1
+		}
+		b, err := operands(n)
+		if err != nil {
+			return 0, err
+		}
+		i := uint16(b[0])
+		if n == 2 {
+			i = binary.BigEndian.Uint16(b)
+		}
+		if err := cpindex(i); err != nil {
+			return 0, err
+		}
+		if class.ConstPool[i-1].Tag == TagClass {
+			ins.Ref = &Ref{Class: class.ConstPool.Resolve(i)}
+		} else {
+			ins.Const = class.Const(i)
+		}
+		return n + 1, nil
+	case (op >= 0x15 && op <= 0x19) || (op >= 0x36 && op <= 0x3A) || op == 0xA9 || op == 0xBC:
+		// xLOAD, xSTORE, RET, NEWARRAY
+		b, err := operands(1)
+		if err != nil {
+			return 0, err
+		}
+		ins.Arg = int32(b[0])
+		return 2, nil
+	case op == 0x84: // IINC
+		b, err := operands(2)
+		if err != nil {
+			return 0, err
+		}
+		ins.Arg, ins.Arg2 = int32(b[0]), int32(int8(b[1]))
+		return 3, nil
+	case op == 0xC4: // WIDE
+		b, err := operands(3)
+		if err != nil {
+			return 0, err
+		}
+		ins.Op, ins.Arg = b[0], int32(binary.BigEndian.Uint16(b[1:]))
+		switch {
+		case (b[0] >= 0x15 && b[0] <= 0x19) || (b[0] >= 0x36 && b[0] <= 0x3A) || b[0] == 0xA9:
+			return 4, nil
+		case b[0] == 0x84:
+			b, err := operands(5)
+			if err != nil {
+				return 0, err
+			}
+			ins.Arg2 = int32(int16(binary.BigEndian.Uint16(b[3:])))
+			return 6, nil
+		}
+		return 0, fmt.Errorf("bad wide opcode 0x%02x at %d", b[0], ip)
+	case op == 0xC8 || op == 0xC9: // GOTO_W, JSR_W
+		b, err := operands(4)
+		if err != nil {
+			return 0, err
+		}
+		ins.Target = branchTarget(ip, int32(binary.BigEndian.Uint32(b)))
+		return 5, nil
+	case isBranch(op):
+		b, err := operands(2)
+		if err != nil {
+			return 0, err
+		}
+		ins.Target = branchTarget(ip, int32(int16(binary.BigEndian.Uint16(b))))
+		return 3, nil
+	case op == 0xAA || op == 0xAB: // TABLESWITCH, LOOKUPSWITCH
+		pad := 3 - ip%4
+		b, err := operands(pad + 12)
+		if err != nil {
+			return 0, err
+		}
+		b = b[pad:]
+		target := func(b []byte) uint32 {
+			return branchTarget(ip, int32(binary.BigEndian.Uint32(b)))
+		}
+		ins.Target = target(b)
+		a, c := int32(binary.BigEndian.Uint32(b[4:])), int32(binary.BigEndian.Uint32(b[8:]))
+		var count uint64
+		if op == 0xAA {
+			if c < a {
+				return 0, fmt.Errorf("bad tableswitch range at %d", ip)
+			}
+			count = uint64(int64(c)-int64(a)) + 1
+		} else {
+			if a < 0 {
+				return 0, fmt.Errorf("bad lookupswitch size at %d", ip)
+			}
+			count = uint64(a)
+		}
+		entry := uint32(4)
+		if op == 0xAB {
+			entry = 8
+		}
+		// Check the size in 64 bits first, so that a huge count can't wrap.
+		if uint64(ip)+1+uint64(pad)+12+count*uint64(entry) > uint64(len(code)) {
+			return 0, fmt.Errorf("truncated operands of opcode 0x%02x at %d", op, ip)
+		}
+		n := uint32(count)
+		b, err = operands(pad + 12 + n*entry)
+		if err != nil {
+			return 0, err
+		}
+		b = b[pad+12:]
+		for i := uint32(0); i < n; i++ {
+			if op == 0xAA {
+				ins.Keys = append(ins.Keys, a+int32(i))
+				ins.Targets = append(ins.Targets, target(b[i*4:]))
+			} else {
+				ins.Keys = append(ins.Keys, int32(binary.BigEndian.Uint32(b[i*8:])))
+				ins.Targets = append(ins.Targets, target(b[i*8+4:]))
+			}
+		}
+		return 1 + pad + 12 + n*entry, nil
+	case (op >= 0xB2 && op <= 0xBB) || op == 0xBD || op == 0xC0 || op == 0xC1 || op == 0xC5:
+		// Field and method references, NEW, ANEWARRAY, CHECKCAST, INSTANCEOF, MULTIANEWARRAY
+		n := uint32(2)
+		if op == 0xB9 || op == 0xBA {
+			n = 4
+		} else if op == 0xC5 {
+			n = 3
+		}
+		b, err := operands(n)
+		if err != nil {
+			return 0, err
+		}
+		if err := cpindex(binary.BigEndian.Uint16(b)); err != nil {
+			return 0, err
+		}
+		if n > 2 {
+			ins.Arg2 = int32(b[2])
+		}
+		cp := class.ConstPool
+		c := cp[ins.Arg-1]
+		if c.Tag == TagClass {
+			ins.Ref = &Ref{Class: cp.Resolve(uint16(ins.Arg))}
+		} else if op != 0xBA {
+			if c.NameAndTypeIndex == 0 || int(c.NameAndTypeIndex) > len(cp) {
+				return 0, fmt.Errorf("bad constant pool index %d at %d", c.NameAndTypeIndex, ip)
+			}
+			nt := cp[c.NameAndTypeIndex-1]
+			ins.Ref = &Ref{
+				Class: cp.Resolve(c.ClassIndex),
+				Name:  cp.Resolve(nt.NameIndex),
+				Desc:  cp.Resolve(nt.DescIndex),
+			}
+		}
+		return n + 1, nil
+	case op > 0xC9:
+		return 0, fmt.Errorf("bad opcode 0x%02x at %d", op, ip)
+	}
+	return 1, nil
+}
+
+// decodeMethod decodes the whole code array, rewriting branch targets from
+// bytecode offsets into instruction indices.
+func decodeMethod(class *Object, code []byte) ([]Instruction, error) {
+	insns := []Instruction{}
+	index := map[uint32]uint32{}
+	for ip := uint32(0); int(ip) < len(code); {
+		ins := Instruction{}
+		n, err := decode(&ins, class, code, ip)
+		if err != nil {
+			return nil, err
+		}
+		index[ip] = uint32(len(insns))
+		insns = append(insns, ins)
+		ip = ip + n
+	}
+	target := func(t uint32) (uint32, error) {
+		i, ok := index[t]
+		if !ok {
+			return 0, fmt.Errorf("bad branch target %d", t)
+		}
+		return i, nil
+	}
+	var err error
+	for i := range insns {
+		ins := &insns[i]
+		if isBranch(ins.Op) || ins.Op == 0xAA || ins.Op == 0xAB {
+			if ins.Target, err = target(ins.Target); err != nil {
+				return nil, err
+			}
+			for j := range ins.Targets {
+				if ins.Targets[j], err = target(ins.Targets[j]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return insns, nil
+}
@@ -0,0 +1,168 @@
+package tojvm
+
+import (
+	"testing"
+)
+
+// loopClass assembles a class with a static method equivalent to:
+//
+//	static int loop(int n) {
+//		int sum = 0;
+//		while (n != 0) {
+//			sum += n * 3;
+//			n--;
+//		}
+//		return sum;
+//	}
+func loopClass() Class {
+	a := &Assembler{}
+	start, end := a.Label(), a.Label()
+	a.Iconst(0).Istore(1).
+		Mark(start).Iload(0).Branch(0x99, end). // IFEQ
+		Iload(1).Iload(0).Iconst(3).Imul().Iadd().Istore(1).
+		Iinc(0, -1).Goto(start).
+		Mark(end).Iload(1).Ireturn().
+		Method(0x0009, "loop", "(I)I", 3, 2)
+	return a.Class(0x0021, "Loop", "java/lang/Object")
+}
+
+func TestDecode(t *testing.T) {
+	c := &Object{Class: loopClass()}
+	m, _ := c.Method("loop", "(I)I")
+	insns, err := decodeMethod(c, m.Attributes[0].Data[8:len(m.Attributes[0].Data)-4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insns) != 14 {
+		t.Fatal(insns)
+	}
+	// IFEQ jumps to the final ILOAD_1, GOTO jumps back to the ILOAD_0
+	if insns[3].Op != 0x99 || insns[3].Target != 12 || insns[3].IP != 3 {
+		t.Error(insns[3])
+	}
+	if insns[11].Op != 0xA7 || insns[11].Target != 2 || insns[11].IP != 15 {
+		t.Error(insns[11])
+	}
+
+	var ins Instruction
+	// WIDE ILOAD 300
+	if n, err := decode(&ins, c, []byte{0xC4, 0x15, 0x01, 0x2C}, 0); err != nil || n != 4 || ins.Op != 0x15 || ins.Arg != 300 {
+		t.Error(n, err, ins)
+	}
+	// WIDE IINC 1 -1000
+	if n, err := decode(&ins, c, []byte{0xC4, 0x84, 0x00, 0x01, 0xFC, 0x18}, 0); err != nil || n != 6 || ins.Op != 0x84 || ins.Arg != 1 || ins.Arg2 != -1000 {
+		t.Error(n, err, ins)
+	}
+	// NOP, TABLESWITCH (2 bytes of padding) default=+20, 1..2 -> +30, +40
+	code := []byte{0x00, 0xAA, 0, 0, 0, 0, 0, 20, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 30, 0, 0, 0, 40}
+	if n, err := decode(&ins, c, code, 1); err != nil || n != 23 || ins.Target != 21 ||
+		len(ins.Keys) != 2 || ins.Keys[1] != 2 || ins.Targets[0] != 31 || ins.Targets[1] != 41 {
+		t.Error(n, err, ins)
+	}
+	// TABLESWITCH and LOOKUPSWITCH with entry counts whose size wraps in 32 bits
+	for _, code := range [][]byte{
+		{0xAA, 0, 0, 0, 0, 0, 0, 20, 0, 0, 0, 0, 0x40, 0, 0, 0, 0, 0, 0, 0},
+		{0xAA, 0, 0, 0, 0, 0, 0, 20, 0x80, 0, 0, 0, 0x7F, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0},
+		{0xAB, 0, 0, 0, 0, 0, 0, 20, 0x20, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, err := decode(&ins, c, code, 0); err == nil {
+			t.Error("expected error", code)
+		}
+	}
+	// truncated SIPUSH
+	if _, err := decode(&ins, c, []byte{0x11, 0x01}, 0); err == nil {
+		t.Error("expected error")
+	}
+	// branch into the middle of an instruction
+	if _, err := decodeMethod(c, []byte{0xA7, 0x00, 0x04, 0x11, 0x00, 0x01, 0xB1}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDecodedMatchesRaw(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		vm := New("testdata")
+		vm.RawBytecode = raw
+		if _, err := vm.DefineClass(loopClass()); err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int32{0, 1, 10, 1000} {
+			if res, err := vm.Call("Loop", "loop", n); err != nil {
+				t.Error(err)
+			} else if res != 3*n*(n+1)/2 {
+				t.Error(raw, n, res)
+			}
+		}
+		if res, err := vm.Call("FieldsAndMethods", "sub", int32(2), int32(3)); err != nil || res != int32(-1) {
+			t.Error(raw, res, err)
+		}
+		c, _ := vm.Class("Loop")
+		if cached := c.code[[2]string{"loop", "(I)I"}]; cached == nil {
+			t.Error(raw, cached)
+		}
+	}
+}
+
+func benchmarkLoop(b *testing.B, raw bool) {
+	vm := New()
+	vm.RawBytecode = raw
+	if _, err := vm.DefineClass(loopClass()); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		if _, err := vm.Call("Loop", "loop", int32(1000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoopDecoded(b *testing.B) { benchmarkLoop(b, false) }
+func BenchmarkLoopRaw(b *testing.B)     { benchmarkLoop(b, true) }
+
+func TestBranchOffsets(t *testing.T) {
+	c := &Object{}
+	var ins Instruction
+	for _, test := range []struct {
+		code   []byte
+		ip     uint32
+		n      uint32
+		target uint32
+	}{
+		{[]byte{0, 0, 0, 0, 0, 0xA7, 0x00, 0x08}, 5, 3, 13},                               // GOTO +8
+		{[]byte{0, 0, 0, 0, 0, 0xA7, 0xFF, 0xFB}, 5, 3, 0},                                // GOTO -5
+		{[]byte{0, 0, 0xA7, 0x00, 0x00}, 2, 3, 2},                                         // GOTO +0
+		{[]byte{0, 0, 0, 0x99, 0xFF, 0xFE}, 3, 3, 1},                                      // IFEQ -2
+		{[]byte{0, 0xC6, 0x00, 0x03}, 1, 3, 4},                                            // IFNULL +3
+		{[]byte{0, 0, 0xC8, 0x00, 0x01, 0x00, 0x00}, 2, 5, 65538},                         // GOTO_W +65536
+		{[]byte{0, 0, 0, 0, 0xC8, 0xFF, 0xFF, 0xFF, 0xFC}, 4, 5, 0},                       // GOTO_W -4
+		{[]byte{0, 0, 0xAB, 0, 0xFF, 0xFF, 0xFF, 0xFE, 0, 0, 0, 0, 0, 0, 0, 0}, 2, 14, 0}, // LOOKUPSWITCH default -2
+	} {
+		if n, err := decode(&ins, c, test.code, test.ip); err != nil || n != test.n || ins.Target != test.target {
+			t.Error(test.code, n, err, ins.Target)
+		}
+	}
+
+	// A loop with a forward GOTO over dead code and a backward IF_ICMPLT:
+	//
+	//	 0: iconst_0
+	//	 1: istore_0
+	//	 2: goto 8
+	//	 5: iinc 0, 100
+	//	 8: iinc 0, 1
+	//	11: iload_0
+	//	12: iconst_3
+	//	13: if_icmplt 8
+	//	16: iload_0
+	//	17: ireturn
+	code := []byte{
+		0x03, 0x3B, 0xA7, 0x00, 0x06, 0x84, 0x00, 0x64, 0x84, 0x00, 0x01,
+		0x1A, 0x06, 0xA1, 0xFF, 0xFB, 0x1A, 0xAC,
+	}
+	for _, raw := range []bool{false, true} {
+		vm := New()
+		vm.RawBytecode = raw
+		if res, err := vm.EvalMethod(code, 1, 2); err != nil || res != int32(3) {
+			t.Error(raw, res, err)
+		}
+	}
+}
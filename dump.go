@@ -0,0 +1,126 @@
+package tojvm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldNames returns the keys of the object's Fields in a stable order: the
+// instance fields in the order they are declared, superclass fields first,
+// followed by the keys set without a declaration, sorted. For a class, they
+// are its static fields.
+func (o *Object) FieldNames() []string {
+	o.fieldsMu.RLock()
+	defer o.fieldsMu.RUnlock()
+	var names []string
+	seen := map[string]bool{}
+	add := func(key string) {
+		if _, ok := o.Fields[key]; ok && !seen[key] {
+			seen[key] = true
+			names = append(names, key)
+		}
+	}
+	if o.ClassInstance == nil {
+		for _, f := range o.Class.Fields {
+			if f.Flags&0x0008 != 0 { // ACC_STATIC
+				add(f.Name)
+			}
+		}
+	} else {
+		var chain []*Object
+		for c := o.ClassInstance; c != nil; c = c.SuperInstance {
+			chain = append(chain, c)
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			for _, f := range chain[i].Class.Fields {
+				if f.Flags&0x0008 == 0 {
+					add(chain[i].slot(f.Name))
+				}
+			}
+		}
+	}
+	var rest []string
+	for key := range o.Fields {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+// Dump formats a value for debugging and golden tests, the same way for
+// equal values: objects are written as their class name followed by their
+// fields in the order of FieldNames, strings are quoted and arrays list their
+// elements. Objects referring back to an object being dumped write it as
+// Class{...}.
+//
+//	Point{x=1, y=2, label="origin", next=null}
+func (vm *VM) Dump(v Value) string {
+	var b strings.Builder
+	vm.dump(&b, v, map[*Object]bool{})
+	return b.String()
+}
+
+func (vm *VM) dump(b *strings.Builder, v Value, visiting map[*Object]bool) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("null")
+		return
+	case int32:
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+		return
+	case int64:
+		b.WriteString(strconv.FormatInt(v, 10) + "L")
+		return
+	case float32:
+		b.WriteString(javaFloat(float64(v), 32) + "F")
+		return
+	case float64:
+		b.WriteString(javaFloat(v, 64))
+		return
+	case *Object:
+		if v == nil {
+			b.WriteString("null")
+			return
+		} else if s, ok := vm.GoString(v); ok {
+			b.WriteString(strconv.Quote(s))
+			return
+		}
+		b.WriteString(v.Name)
+		if visiting[v] {
+			b.WriteString("{...}")
+			return
+		}
+		visiting[v] = true
+		defer delete(visiting, v)
+		b.WriteString("{")
+		for i, name := range v.FieldNames() {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(name + "=")
+			vm.dump(b, v.getField(name), visiting)
+		}
+		b.WriteString("}")
+		return
+	}
+	if a, ok := arrayElements(v); ok {
+		b.WriteString("[")
+		for i, e := range a {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			vm.dump(b, e, visiting)
+		}
+		b.WriteString("]")
+		return
+	}
+	if s, ok := v.(string); ok {
+		b.WriteString(strconv.Quote(s))
+	} else {
+		fmt.Fprint(b, v)
+	}
+}
@@ -0,0 +1,148 @@
+package tojvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Exception is a Java exception that was thrown and not caught by the
+// interpreted code. It is the Err of the VMError returned by Call.
+type Exception struct {
+	Object *Object
+}
+
+func (e *Exception) Error() string {
+	if msg, ok := e.Object.Field("message").(*Object); ok && msg != nil {
+		return e.Object.Name + ": " + msg.String()
+	}
+	return e.Object.Name
+}
+
+// newThrowable returns a new instance of a built-in exception class, which
+// always resolves.
+func (vm *VM) newThrowable(class, msg string) *Object {
+	obj, err := vm.throwable(class, msg)
+	if err != nil {
+		panic(err)
+	}
+	return obj
+}
+
+// throwable returns a new instance of an exception class with an optional
+// message, resolving and initializing the class.
+func (vm *VM) throwable(class, msg string) (*Object, error) {
+	c, err := vm.resolveClass(class)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.initialize(nil, c); err != nil {
+		return nil, err
+	}
+	throwable, _ := vm.resolveClass("java/lang/Throwable")
+	obj := c.New()
+	if !instanceOf(obj, throwable) {
+		return nil, fmt.Errorf("%s is not a java/lang/Throwable", class)
+	}
+	if msg != "" {
+		obj.SetField("message", vm.newString(msg))
+	}
+	return obj, nil
+}
+
+// Throw returns an error throwing a new exception of a built-in class, such
+// as java/lang/OutOfMemoryError, or of a class on the class path, with an
+// optional message. It can be returned by natives and Heap methods. If the
+// class can't be resolved or initialized, or isn't a Throwable, the error
+// returned tells why instead.
+func (vm *VM) Throw(class, msg string) error {
+	obj, err := vm.throwable(class, msg)
+	if err != nil {
+		return err
+	}
+	return &Exception{Object: obj}
+}
+
+// instanceOf reports whether obj is an instance of class c or its subclasses.
+func instanceOf(obj, c *Object) bool {
+	for k := obj.ClassInstance; k != nil; k = k.SuperInstance {
+		if k == c {
+			return true
+		}
+	}
+	return false
+}
+
+// throw transfers control to the innermost exception handler for exc, popping
+// the frames that don't have one, and returns the frame to continue with. If
+// nothing catches the exception, an error wrapping an Exception is returned
+// and the frames are left in place.
+func (vm *VM) throw(t *thread, exc *Object) (*Frame, error) {
+	for i := len(t.frames) - 1; i >= 0; i-- {
+		f := t.frames[i]
+		ip, ok, err := vm.handler(f, exc)
+		if err != nil {
+			return nil, t.fail("", err)
+		}
+		if !ok {
+			continue
+		}
+		for len(t.frames)-1 > i {
+			top := t.frames[len(t.frames)-1]
+			vm.exit(top.Class.Name, top.Method, nil, &Exception{Object: exc})
+			t.release(top)
+			freeFrame(top)
+			t.frames[len(t.frames)-1] = nil
+			t.frames = t.frames[:len(t.frames)-1]
+		}
+		for f.SP > 0 {
+			f.pop()
+		}
+		f.push(exc)
+		f.IP = ip
+		return f, nil
+	}
+	return nil, t.fail("", &Exception{Object: exc})
+}
+
+// handler searches the exception table of the frame's method for a handler of
+// exc covering the current instruction, and returns its address.
+func (vm *VM) handler(f *Frame, exc *Object) (uint32, bool, error) {
+	data, ok := codeAttribute(f.Method)
+	if !ok {
+		return 0, false, nil
+	}
+	table := data[8+len(f.Code):]
+	if len(table) < 2 || len(table) < 2+8*int(binary.BigEndian.Uint16(table)) {
+		return 0, false, errors.New("bad exception table")
+	}
+	for n, e := int(binary.BigEndian.Uint16(table)), table[2:]; n > 0; n, e = n-1, e[8:] {
+		start, end := uint32(binary.BigEndian.Uint16(e)), uint32(binary.BigEndian.Uint16(e[2:]))
+		if f.at < start || f.at >= end {
+			continue
+		}
+		if catchType := binary.BigEndian.Uint16(e[6:]); catchType != 0 {
+			if int(catchType) > len(f.Class.ConstPool) {
+				return 0, false, errors.New("bad exception table")
+			}
+			c, err := vm.resolve(f.Class.ConstPool.Resolve(catchType))
+			if err != nil {
+				return 0, false, err
+			}
+			if !instanceOf(exc, c) {
+				continue
+			}
+		}
+		ip := uint32(binary.BigEndian.Uint16(e[4:]))
+		if f.Instructions == nil {
+			return ip, true, nil
+		}
+		i := sort.Search(len(f.Instructions), func(i int) bool { return f.Instructions[i].IP >= ip })
+		if i == len(f.Instructions) || f.Instructions[i].IP != ip {
+			return 0, false, errors.New("bad exception handler")
+		}
+		return uint32(i), true, nil
+	}
+	return 0, false, nil
+}
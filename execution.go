@@ -0,0 +1,178 @@
+package tojvm
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// errSuspended is returned by exec when the budget of its thread runs
+	// out or a native suspends it.
+	errSuspended = errors.New("suspended")
+	// errNativeSuspended is returned by natives calling Suspend.
+	errNativeSuspended = errors.New("native suspended")
+)
+
+// Execution is a call started by Start, which runs in slices of a bounded
+// number of instructions. Between slices, its frames with their instruction
+// pointers, locals and operand stacks are kept in the Execution, as well as
+// the monitors they hold. Methods called from natives and static
+// initializers run to completion within a slice, like natives themselves.
+// Until it's done or stopped, the execution counts as running for Reset,
+// Snapshot and Restore. Natives it calls may suspend it, see
+// NativeContext.Suspend: Run then does nothing until ResumeWith is called.
+type Execution struct {
+	mu      sync.Mutex
+	vm      *VM
+	class   *Object
+	method  Field
+	args    []Value // of a native method, which is called by the first Run
+	t       *thread
+	waiting *waitingNative
+	ran     bool
+	done    bool
+	result  Value
+	err     error
+}
+
+// waitingNative is a native that suspended an Execution.
+type waitingNative struct {
+	class  *Object
+	method Field
+}
+
+// Start prepares a call of a static method like Call, initializing its class
+// if needed, but doesn't run it: Run does.
+func (vm *VM) Start(class, method string, args ...Value) (*Execution, error) {
+	c, err := vm.Class(class)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.Method(method, "")
+	if err != nil {
+		return nil, err
+	}
+	if args, err = vm.convertArgs(m, args); err != nil {
+		return nil, err
+	}
+	if err := checkArgc(m, args); err != nil {
+		return nil, err
+	}
+	ex := &Execution{vm: vm, class: c, method: m}
+	code, ok := c.codeOf(m)
+	if !ok {
+		ex.args = args
+		return ex, nil
+	}
+	frame, err := vm.methodFrame(c, m, code, args)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&vm.running, 1)
+	ex.t = &thread{watched: true, limited: true, ex: ex}
+	ex.t.push(frame)
+	return ex, nil
+}
+
+// Run executes at most n more instructions of the call, and reports whether
+// it returned or failed, with its result or error. Once done, Run returns the
+// same result again.
+func (ex *Execution) Run(n int) (done bool, result Value, err error) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if ex.done {
+		return true, ex.result, ex.err
+	} else if ex.waiting != nil {
+		return false, nil, nil
+	}
+	vm := ex.vm
+	atomic.AddInt32(&vm.running, 1)
+	defer atomic.AddInt32(&vm.running, -1)
+	if ex.t == nil {
+		ex.result, ex.err = vm.callMethod(ex.class, ex.method, ex.args...)
+		ex.done, ex.args = true, nil
+		return true, ex.result, ex.err
+	}
+	if !ex.ran {
+		ex.ran = true
+		vm.enter(ex.class.Name, ex.method)
+	}
+	ex.t.budget = int64(n)
+	res, err := vm.exec(ex.t)
+	if err == errSuspended {
+		return false, nil, nil
+	}
+	ex.finish(res, err)
+	return true, res, err
+}
+
+// finish pops the frames of the call when it returned or failed.
+func (ex *Execution) finish(res Value, err error) {
+	ex.vm.unwind(ex.t, err)
+	ex.vm.exit(ex.class.Name, ex.method, res, err)
+	atomic.AddInt32(&ex.vm.running, -1)
+	ex.done, ex.result, ex.err, ex.t = true, res, err, nil
+}
+
+// Suspended reports whether a native suspended the call and ResumeWith wasn't
+// called yet.
+func (ex *Execution) Suspended() bool {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	return ex.waiting != nil
+}
+
+// ResumeWith completes the native that suspended the call, which returns the
+// result to its caller, or fails with err: an *Exception, e.g. from Throw, is
+// thrown to the handlers of the calling frames, and if none catches it, or
+// the error is another one, the call fails like Run would. Execution
+// continues with the next Run. ResumeWith may be called from any goroutine,
+// and fails if the call isn't suspended.
+func (ex *Execution) ResumeWith(result Value, err error) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	w := ex.waiting
+	if w == nil {
+		return errors.New("execution isn't suspended")
+	}
+	ex.waiting = nil
+	vm, t := ex.vm, ex.t
+	if b, ok := result.(bool); ok {
+		result = boolValue(b)
+	}
+	vm.exit(w.class.Name, w.method, result, err)
+	if exc, ok := err.(*Exception); ok {
+		if _, err := vm.throw(t, exc.Object); err != nil {
+			ex.finish(nil, err)
+		}
+		return nil
+	} else if err != nil {
+		ex.finish(nil, t.fail("", err))
+		return nil
+	}
+	if desc := w.method.Descriptor; desc[len(desc)-1] != 'V' {
+		t.frames[len(t.frames)-1].push(result)
+	}
+	return nil
+}
+
+// Stop abandons the call if it isn't done, exiting the monitors held by its
+// frames. Run then fails.
+func (ex *Execution) Stop() {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if ex.done {
+		return
+	}
+	ex.waiting = nil
+	ex.done, ex.err, ex.args = true, errors.New("execution stopped"), nil
+	if ex.t != nil {
+		ex.vm.unwind(ex.t, ex.err)
+		if ex.ran {
+			ex.vm.exit(ex.class.Name, ex.method, nil, ex.err)
+		}
+		atomic.AddInt32(&ex.vm.running, -1)
+		ex.t = nil
+	}
+}
@@ -0,0 +1,64 @@
+package tojvm
+
+import (
+	"runtime"
+	"sync"
+)
+
+var (
+	finalizersMu sync.Mutex
+	unreachable  []func() // finalizers of collected objects, run by Collect
+)
+
+// OnFinalize registers a function to release Go resources held by the
+// object, such as the state of a native class. It runs once, either on the
+// first Collect after the object becomes unreachable or on Release.
+func (o *Object) OnFinalize(f func()) {
+	finalizersMu.Lock()
+	defer finalizersMu.Unlock()
+	if o.finalizers == nil {
+		runtime.SetFinalizer(o, func(o *Object) {
+			finalizersMu.Lock()
+			unreachable = append(unreachable, o.finalizers...)
+			o.finalizers = nil
+			finalizersMu.Unlock()
+		})
+	}
+	o.finalizers = append(o.finalizers, f)
+}
+
+// Release runs the finalizers of the object now, in the order they were
+// registered, instead of waiting for it to be collected.
+func (o *Object) Release() {
+	finalizersMu.Lock()
+	fs := o.finalizers
+	o.finalizers = nil
+	runtime.SetFinalizer(o, nil)
+	finalizersMu.Unlock()
+	for _, f := range fs {
+		f()
+	}
+}
+
+// Collect runs a garbage collection and then, on the calling goroutine, the
+// finalizers of objects found unreachable. Objects are shared with Go, so an
+// object is unreachable only when neither Java nor Go code refers to it.
+// Finalizers of objects from all VMs run, as the Go heap is shared too.
+func (vm *VM) Collect() {
+	// Go runs finalizers on a goroutine of its own; wait for the ones queued
+	// by the collection. A sentinel finalizer may run before others queued at
+	// the same time, but not before those queued by an earlier collection.
+	for i := 0; i < 2; i++ {
+		done := make(chan struct{})
+		runtime.SetFinalizer(&struct{ _ *int }{}, func(interface{}) { close(done) })
+		runtime.GC()
+		<-done
+	}
+	finalizersMu.Lock()
+	fs := unreachable
+	unreachable = nil
+	finalizersMu.Unlock()
+	for _, f := range fs {
+		f()
+	}
+}
@@ -0,0 +1,27 @@
+package tojvm
+
+// Heap allocates the objects and arrays created by bytecode with NEW,
+// NEWARRAY and ANEWARRAY, so that embedders can count or limit allocations.
+// Returning an *Exception, such as java/lang/OutOfMemoryError from VM.Throw,
+// throws it in Java; other errors fail the thread.
+type Heap interface {
+	// Alloc returns a new instance of the class, see Object.New.
+	Alloc(class *Object) (*Object, error)
+	// AllocArray returns a new array of type desc, like "[I" or
+	// "[Ljava/lang/String;", with n zero elements.
+	AllocArray(desc string, n int) (Value, error)
+}
+
+// goHeap is the default Heap, allocating from the Go heap without limits.
+type goHeap struct{}
+
+func (goHeap) Alloc(class *Object) (*Object, error) {
+	return class.New(), nil
+}
+
+func (goHeap) AllocArray(desc string, n int) (Value, error) {
+	if a := newArray(desc, n); a != nil {
+		return a, nil
+	}
+	return &Array{Desc: desc, Values: make([]Value, n)}, nil
+}
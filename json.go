@@ -0,0 +1,165 @@
+package tojvm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+)
+
+var tagNames = map[Tag]string{
+	TagClass: "Class", TagFieldRef: "Fieldref", TagMethodRef: "Methodref",
+	TagInterfaceMethodRef: "InterfaceMethodref", TagString: "String", TagInteger: "Integer",
+	TagFloat: "Float", TagLong: "Long", TagDouble: "Double", TagNameAndType: "NameAndType",
+	TagUTF8: "Utf8", TagMethodHandle: "MethodHandle", TagMethodType: "MethodType",
+	TagInvokeDynamic: "InvokeDynamic",
+}
+
+type jsonClass struct {
+	Name       string          `json:"name"`
+	Super      string          `json:"super,omitempty"`
+	Flags      uint16          `json:"flags"`
+	Interfaces []string        `json:"interfaces"`
+	Constants  []jsonConst     `json:"constants"`
+	Fields     []jsonMember    `json:"fields"`
+	Methods    []jsonMember    `json:"methods"`
+	Attributes []jsonAttribute `json:"attributes"`
+}
+
+type jsonConst struct {
+	Index      int         `json:"index"`
+	Tag        string      `json:"tag"`
+	Value      interface{} `json:"value,omitempty"`
+	Class      string      `json:"class,omitempty"`
+	Name       string      `json:"name,omitempty"`
+	Descriptor string      `json:"descriptor,omitempty"`
+}
+
+type jsonMember struct {
+	Flags      uint16          `json:"flags"`
+	Name       string          `json:"name"`
+	Descriptor string          `json:"descriptor"`
+	Attributes []jsonAttribute `json:"attributes"`
+}
+
+type jsonAttribute struct {
+	Name      string      `json:"name"`
+	Data      []byte      `json:"data"`
+	Value     interface{} `json:"value,omitempty"`
+	MaxStack  *uint16     `json:"maxStack,omitempty"`
+	MaxLocals *uint16     `json:"maxLocals,omitempty"`
+}
+
+// MarshalJSON encodes the class structure: the constant pool, fields, methods
+// and attributes. Constant pool references are resolved to names, attribute
+// data is included as base64, with the value of ConstantValue, Signature and
+// SourceFile and the limits of Code attributes decoded. Float and double constants that are NaN or
+// infinite, which JSON numbers can't represent, are encoded as the strings
+// "NaN", "Infinity" and "-Infinity". Since Object embeds Class, class objects
+// and instances encode as their class.
+func (c Class) MarshalJSON() ([]byte, error) {
+	jc := jsonClass{
+		Name:       c.Name,
+		Super:      c.Super,
+		Flags:      c.Flags,
+		Interfaces: append([]string{}, c.Interfaces...),
+		Constants:  []jsonConst{},
+		Fields:     c.jsonMembers(c.Fields),
+		Methods:    c.jsonMembers(c.Methods),
+		Attributes: c.jsonAttributes(c.Attributes),
+	}
+	for i := 0; i < len(c.ConstPool); i++ {
+		k := c.ConstPool[i]
+		jk := jsonConst{Index: i + 1, Tag: tagNames[k.Tag]}
+		switch k.Tag {
+		case TagUTF8:
+			jk.Value = k.String
+		case TagInteger:
+			jk.Value = k.Integer
+		case TagFloat:
+			jk.Value = jsonFloat(k.Float)
+		case TagLong:
+			jk.Value = k.Long
+			i++
+		case TagDouble:
+			jk.Value = jsonFloat(k.Double)
+			i++
+		case TagString, TagClass:
+			jk.Value = c.ConstPool.Resolve(uint16(i + 1))
+		case TagNameAndType:
+			jk.Name, jk.Descriptor = c.ConstPool.Resolve(k.NameIndex), c.ConstPool.Resolve(k.DescIndex)
+		case TagFieldRef, TagMethodRef, TagInterfaceMethodRef:
+			jk.Class = c.ConstPool.Resolve(k.ClassIndex)
+			if int(k.NameAndTypeIndex) >= 1 && int(k.NameAndTypeIndex) <= len(c.ConstPool) {
+				nt := c.ConstPool[k.NameAndTypeIndex-1]
+				jk.Name, jk.Descriptor = c.ConstPool.Resolve(nt.NameIndex), c.ConstPool.Resolve(nt.DescIndex)
+			}
+		}
+		jc.Constants = append(jc.Constants, jk)
+	}
+	return json.Marshal(jc)
+}
+
+func (c Class) jsonMembers(fields []Field) []jsonMember {
+	members := []jsonMember{}
+	for _, f := range fields {
+		members = append(members, jsonMember{
+			Flags:      f.Flags,
+			Name:       f.Name,
+			Descriptor: f.Descriptor,
+			Attributes: c.jsonAttributes(f.Attributes),
+		})
+	}
+	return members
+}
+
+func (c Class) jsonAttributes(attrs []Attribute) []jsonAttribute {
+	ja := []jsonAttribute{}
+	for _, a := range attrs {
+		j := jsonAttribute{Name: a.Name, Data: a.Data}
+		switch {
+		case a.Name == "ConstantValue" && len(a.Data) == 2:
+			if i := binary.BigEndian.Uint16(a.Data); i >= 1 && int(i) <= len(c.ConstPool) {
+				switch k := c.ConstPool[i-1]; k.Tag {
+				case TagInteger:
+					j.Value = k.Integer
+				case TagFloat:
+					j.Value = jsonFloat(k.Float)
+				case TagLong:
+					j.Value = k.Long
+				case TagDouble:
+					j.Value = jsonFloat(k.Double)
+				case TagString:
+					j.Value = c.ConstPool.Resolve(i)
+				}
+			}
+		case (a.Name == "Signature" || a.Name == "SourceFile") && len(a.Data) == 2:
+			j.Value = c.ConstPool.Resolve(binary.BigEndian.Uint16(a.Data))
+		case a.Name == "Code" && len(a.Data) >= 4:
+			maxStack, maxLocals := binary.BigEndian.Uint16(a.Data), binary.BigEndian.Uint16(a.Data[2:])
+			j.MaxStack, j.MaxLocals = &maxStack, &maxLocals
+		}
+		ja = append(ja, j)
+	}
+	return ja
+}
+
+// jsonFloat returns a float32 or float64 as is, or as a string if it's NaN or
+// infinite.
+func jsonFloat(v interface{}) interface{} {
+	var f float64
+	switch x := v.(type) {
+	case float32:
+		f = float64(x)
+	case float64:
+		f = x
+	}
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return v
+}
@@ -0,0 +1,469 @@
+package tojvm
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// String returns the contents of a java/lang/String object, or the class name
+// and address for any other object, much like the default Object.toString.
+func (o *Object) String() string {
+	if s, ok := o.getField("value").(string); ok && o.Name == "java/lang/String" {
+		return s
+	}
+	return fmt.Sprintf("%s@%p", o.Name, o)
+}
+
+func (vm *VM) defineLang() {
+	vm.Classes = append(vm.Classes, newClass(Class{
+		Name:  "java/lang/String",
+		Super: "java/lang/Object",
+		Methods: []Field{
+			{Name: "<init>", Descriptor: "(Ljava/lang/String;)V"},
+			{Name: "<init>", Descriptor: "([C)V"},
+			{Name: "intern", Descriptor: "()Ljava/lang/String;"},
+			{Name: "length", Descriptor: "()I"},
+			{Name: "charAt", Descriptor: "(I)C"},
+			{Name: "toCharArray", Descriptor: "()[C"},
+			{Flags: 0x0008, Name: "valueOf", Descriptor: "(C)Ljava/lang/String;"},
+		},
+	}, vm.Classes[0]))
+	vm.stringClass = vm.Classes[len(vm.Classes)-1]
+	vm.RegisterNative("java/lang/String", "<init>", "(Ljava/lang/String;)V", func(args ...Value) Value {
+		args[0].(*Object).putField("value", args[1].(*Object).String())
+		return nil
+	})
+	vm.RegisterNative("java/lang/String", "intern", "()Ljava/lang/String;", func(args ...Value) Value {
+		return vm.InternString(args[0].(*Object).String())
+	})
+	vm.defineChars()
+	vm.defineStringBuilder()
+	vm.defineClone()
+	vm.defineMirrors()
+	for _, c := range throwables {
+		super, _ := vm.Class(c[1])
+		vm.Classes = append(vm.Classes, newClass(Class{
+			Name:  c[0],
+			Super: c[1],
+			Methods: []Field{
+				{Name: "<init>", Descriptor: "()V"},
+				{Name: "<init>", Descriptor: "(Ljava/lang/String;)V"},
+				{Name: "getMessage", Descriptor: "()Ljava/lang/String;"},
+			},
+		}, super))
+		vm.RegisterNative(c[0], "<init>", "", func(args ...Value) Value {
+			if len(args) > 1 {
+				args[0].(*Object).SetField("message", args[1])
+			}
+			return nil
+		})
+		vm.RegisterNative(c[0], "getMessage", "()Ljava/lang/String;", func(args ...Value) Value {
+			return args[0].(*Object).Field("message")
+		})
+	}
+	vm.defineWait()
+	vm.defineThread()
+	vm.defineSystem()
+}
+
+// defineChars defines the String methods working with chars, which are
+// UTF-16 code units of the string, and java/lang/Character.
+func (vm *VM) defineChars() {
+	chars := func(s Value) []uint16 {
+		return utf16.Encode([]rune(s.(*Object).String()))
+	}
+	vm.registerNative("java/lang/String", "<init>([C)V", func(t *thread, args ...Value) (Value, error) {
+		args[0].(*Object).putField("value", string(utf16.Decode(args[1].([]uint16))))
+		return nil, nil
+	})
+	vm.registerNative("java/lang/String", "length", func(t *thread, args ...Value) (Value, error) {
+		return int32(len(chars(args[0]))), nil
+	})
+	vm.registerNative("java/lang/String", "charAt", func(t *thread, args ...Value) (Value, error) {
+		s, i := chars(args[0]), args[1].(int32)
+		if i < 0 || int(i) >= len(s) {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/StringIndexOutOfBoundsException", fmt.Sprint(i))}
+		}
+		return int32(s[i]), nil
+	})
+	vm.registerNative("java/lang/String", "toCharArray", func(t *thread, args ...Value) (Value, error) {
+		return ownArray(chars(args[0])), nil
+	})
+	vm.registerNative("java/lang/String", "valueOf(C)Ljava/lang/String;", func(t *thread, args ...Value) (Value, error) {
+		return vm.newString(string(utf16.Decode([]uint16{uint16(args[0].(int32))}))), nil
+	})
+
+	c := &Assembler{}
+	for _, p := range []struct {
+		name string
+		f    func(rune) bool
+	}{{"isDigit", unicode.IsDigit}, {"isLetter", unicode.IsLetter}} {
+		f := p.f
+		c.Method(0x0109, p.name, "(C)Z", 0, 0)
+		vm.registerNative("java/lang/Character", p.name, func(t *thread, args ...Value) (Value, error) {
+			return boolValue(f(rune(args[0].(int32)))), nil
+		})
+	}
+	for _, p := range []struct {
+		name string
+		f    func(rune) rune
+	}{{"toUpperCase", unicode.ToUpper}, {"toLowerCase", unicode.ToLower}} {
+		f := p.f
+		c.Method(0x0109, p.name, "(C)C", 0, 0)
+		vm.registerNative("java/lang/Character", p.name, func(t *thread, args ...Value) (Value, error) {
+			if r := f(rune(args[0].(int32))); r <= 0xFFFF {
+				return int32(r), nil
+			}
+			return args[0], nil // not representable as a char
+		})
+	}
+	vm.Classes = append(vm.Classes, newClass(c.Class(0x0031, "java/lang/Character", "java/lang/Object"), vm.Classes[0]))
+}
+
+// appendDescs are the argument descriptors of the StringBuilder append
+// methods, as chosen by javac for string concatenation.
+var appendDescs = []string{
+	"Ljava/lang/String;", "Ljava/lang/Object;", "Ljava/lang/CharSequence;", "[C", "Z", "C", "I", "J", "F", "D",
+}
+
+// defineStringBuilder defines java/lang/StringBuilder, which compiled string
+// concatenation uses. Values are appended as formatted by String.valueOf.
+func (vm *VM) defineStringBuilder() {
+	c := &Assembler{}
+	for _, desc := range []string{"()V", "(I)V", "(Ljava/lang/String;)V"} {
+		c.Method(0x0001, "<init>", desc, 0, 0)
+	}
+	for _, desc := range appendDescs {
+		c.Method(0x0101, "append", "("+desc+")Ljava/lang/StringBuilder;", 0, 0)
+	}
+	c.Method(0x0101, "length", "()I", 0, 0)
+	c.Method(0x0101, "toString", "()Ljava/lang/String;", 0, 0)
+	vm.Classes = append(vm.Classes, newClass(c.Class(0x0031, "java/lang/StringBuilder", "java/lang/Object"), vm.objectClass))
+
+	vm.cloners["java/lang/StringBuilder"] = func(v interface{}) interface{} {
+		b := &strings.Builder{}
+		b.WriteString(v.(*strings.Builder).String())
+		return b
+	}
+	builder := func(v Value) *strings.Builder {
+		obj := v.(*Object)
+		if obj.payload == nil {
+			obj.payload = &strings.Builder{}
+		}
+		return obj.payload.(*strings.Builder)
+	}
+	vm.registerNative("java/lang/StringBuilder", "<init>", func(t *thread, args ...Value) (Value, error) {
+		b := builder(args[0])
+		if len(args) < 2 {
+			return nil, nil
+		} else if _, ok := args[1].(int32); ok {
+			return nil, nil // initial capacity
+		}
+		s, ok := vm.GoString(args[1])
+		if !ok {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/NullPointerException", "")}
+		}
+		b.WriteString(s)
+		return nil, nil
+	})
+	for _, desc := range appendDescs {
+		desc := desc
+		vm.registerNative("java/lang/StringBuilder", "append("+desc+")Ljava/lang/StringBuilder;", func(t *thread, args ...Value) (Value, error) {
+			if chars, ok := args[1].([]uint16); ok {
+				builder(args[0]).WriteString(string(utf16.Decode(chars)))
+				return args[0], nil
+			}
+			s, err := vm.printString(t, args[1], desc)
+			if err != nil {
+				return nil, err
+			}
+			builder(args[0]).WriteString(s)
+			return args[0], nil
+		})
+	}
+	vm.registerNative("java/lang/StringBuilder", "length", func(t *thread, args ...Value) (Value, error) {
+		return int32(len(utf16.Encode([]rune(builder(args[0]).String())))), nil
+	})
+	vm.registerNative("java/lang/StringBuilder", "toString", func(t *thread, args ...Value) (Value, error) {
+		return vm.newString(builder(args[0]).String()), nil
+	})
+}
+
+// defineClone defines java/lang/Cloneable and Object.clone, which makes a
+// shallow copy of an array or of an object whose class implements Cloneable.
+func (vm *VM) defineClone() {
+	cloneable := newClass((&Assembler{}).Class(0x0601, "java/lang/Cloneable", "java/lang/Object"), vm.objectClass)
+	vm.Classes = append(vm.Classes, cloneable)
+	vm.registerNative("java/lang/Object", "clone", func(t *thread, args ...Value) (Value, error) {
+		obj, ok := args[0].(*Object)
+		if !ok {
+			return cloneArray(args[0]), nil
+		}
+		c := obj.ClassInstance
+		if c == nil || !vm.isAssignable(c, cloneable) {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/CloneNotSupportedException", obj.Name)}
+		}
+		clone := c.New()
+		clone.Fields = obj.copyFields()
+		if obj.payload == nil {
+			return clone, nil
+		}
+		if cloner := vm.cloner(c); cloner != nil {
+			clone.payload = cloner(obj.payload)
+		}
+		return clone, nil
+	})
+}
+
+// primitiveNames are the Java names of primitive types, by descriptor.
+var primitiveNames = map[byte]string{
+	'B': "byte", 'C': "char", 'D': "double", 'F': "float",
+	'I': "int", 'J': "long", 'S': "short", 'Z': "boolean",
+}
+
+// defineMirrors defines java/lang/Class, whose instances represent classes
+// and array types, and Object.getClass. The payload of a Class object is the
+// class object it represents, or the descriptor of an array type.
+func (vm *VM) defineMirrors() {
+	c := &Assembler{}
+	c.Method(0x0101, "getName", "()Ljava/lang/String;", 0, 0)
+	c.Method(0x0101, "getSimpleName", "()Ljava/lang/String;", 0, 0)
+	c.Method(0x0101, "isInterface", "()Z", 0, 0)
+	c.Method(0x0101, "isArray", "()Z", 0, 0)
+	c.Method(0x0101, "getSuperclass", "()Ljava/lang/Class;", 0, 0)
+	c.Method(0x0101, "toString", "()Ljava/lang/String;", 0, 0)
+	c.Method(0x0109, "forName", "(Ljava/lang/String;)Ljava/lang/Class;", 0, 0)
+	c.Method(0x0101, "newInstance", "()Ljava/lang/Object;", 0, 0)
+	c.Method(0x0181, "getDeclaredConstructor", "([Ljava/lang/Class;)Ljava/lang/reflect/Constructor;", 0, 0)
+	vm.classClass = newClass(c.Class(0x0031, "java/lang/Class", "java/lang/Object"), vm.objectClass)
+	ctor := &Assembler{}
+	ctor.Method(0x0181, "newInstance", "([Ljava/lang/Object;)Ljava/lang/Object;", 0, 0)
+	ctorClass := newClass(ctor.Class(0x0031, "java/lang/reflect/Constructor", "java/lang/Object"), vm.objectClass)
+	vm.Classes = append(vm.Classes, vm.classClass, ctorClass)
+	vm.arrayMirrors = map[string]*Object{}
+
+	vm.registerNative("java/lang/Object", "getClass", func(t *thread, args ...Value) (Value, error) {
+		if obj, ok := args[0].(*Object); ok && obj.ClassInstance != nil {
+			return vm.mirror(obj.ClassInstance), nil
+		} else if ok {
+			return vm.mirror(obj), nil
+		}
+		return vm.arrayMirror(arrayDesc(args[0])), nil
+	})
+	vm.registerNative("java/lang/Class", "getName", func(t *thread, args ...Value) (Value, error) {
+		return vm.newString(strings.Replace(mirrorName(args[0].(*Object)), "/", ".", -1)), nil
+	})
+	vm.registerNative("java/lang/Class", "getSimpleName", func(t *thread, args ...Value) (Value, error) {
+		return vm.newString(simpleName(args[0].(*Object).payload)), nil
+	})
+	vm.registerNative("java/lang/Class", "isInterface", func(t *thread, args ...Value) (Value, error) {
+		c, ok := args[0].(*Object).payload.(*Object)
+		return boolValue(ok && c.Flags&0x0200 != 0), nil // ACC_INTERFACE
+	})
+	vm.registerNative("java/lang/Class", "isArray", func(t *thread, args ...Value) (Value, error) {
+		_, ok := args[0].(*Object).payload.(string)
+		return boolValue(ok), nil
+	})
+	vm.registerNative("java/lang/Class", "getSuperclass", func(t *thread, args ...Value) (Value, error) {
+		c, ok := args[0].(*Object).payload.(*Object)
+		switch {
+		case !ok:
+			return vm.mirror(vm.objectClass), nil
+		case c.Flags&0x0200 != 0 || c.SuperInstance == nil:
+			return nil, nil
+		}
+		return vm.mirror(c.SuperInstance), nil
+	})
+	vm.registerNative("java/lang/Class", "toString", func(t *thread, args ...Value) (Value, error) {
+		kind := "class "
+		if c, ok := args[0].(*Object).payload.(*Object); ok && c.Flags&0x0200 != 0 {
+			kind = "interface "
+		}
+		return vm.newString(kind + strings.Replace(mirrorName(args[0].(*Object)), "/", ".", -1)), nil
+	})
+	vm.registerNative("java/lang/Class", "forName", func(t *thread, args ...Value) (Value, error) {
+		if obj, _ := args[0].(*Object); obj == nil {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/NullPointerException", "")}
+		}
+		return vm.forName(t, args[0].(*Object).String())
+	})
+	vm.registerNative("java/lang/Class", "newInstance", func(t *thread, args ...Value) (Value, error) {
+		return vm.newInstance(t, args[0].(*Object))
+	})
+	vm.registerNative("java/lang/Class", "getDeclaredConstructor", func(t *thread, args ...Value) (Value, error) {
+		if n, _ := arrayLength(args[1]); n > 0 {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/NoSuchMethodException",
+				"only no-arg constructors are supported")}
+		}
+		obj := ctorClass.New()
+		obj.payload = args[0]
+		return obj, nil
+	})
+	vm.registerNative("java/lang/reflect/Constructor", "newInstance", func(t *thread, args ...Value) (Value, error) {
+		if n, _ := arrayLength(args[1]); n > 0 {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/IllegalArgumentException", "wrong number of arguments")}
+		}
+		return vm.newInstance(t, args[0].(*Object).payload.(*Object))
+	})
+}
+
+// forName returns the Class object of a class or array type given its binary
+// name with dots, initializing the class, or throws ClassNotFoundException.
+func (vm *VM) forName(t *thread, name string) (Value, error) {
+	internal := strings.Replace(name, ".", "/", -1)
+	if elem := strings.TrimLeft(internal, "["); elem != internal {
+		if len(elem) == 1 && primitiveNames[elem[0]] != "" {
+			return vm.arrayMirror(internal), nil
+		} else if len(elem) > 2 && elem[0] == 'L' && elem[len(elem)-1] == ';' {
+			if _, err := vm.resolve(elem[1 : len(elem)-1]); err == nil {
+				return vm.arrayMirror(internal), nil
+			}
+		}
+		return nil, &Exception{Object: vm.newThrowable("java/lang/ClassNotFoundException", name)}
+	}
+	c, err := vm.resolve(internal)
+	if err != nil {
+		return nil, &Exception{Object: vm.newThrowable("java/lang/ClassNotFoundException", name)}
+	}
+	if err := vm.initialize(t, c); err != nil {
+		return nil, err
+	}
+	return vm.mirror(c), nil
+}
+
+// newInstance creates an object of the class represented by a Class object
+// and runs its no-arg constructor, like Class.newInstance.
+func (vm *VM) newInstance(t *thread, mirror *Object) (Value, error) {
+	c, ok := mirror.payload.(*Object)
+	if !ok || c.Flags&0x0600 != 0 { // ACC_INTERFACE, ACC_ABSTRACT
+		return nil, &Exception{Object: vm.newThrowable("java/lang/InstantiationException",
+			strings.Replace(mirrorName(mirror), "/", ".", -1))}
+	}
+	init, err := c.Method("<init>", "()V")
+	if err != nil {
+		return nil, &Exception{Object: vm.newThrowable("java/lang/NoSuchMethodException",
+			strings.Replace(c.Name, "/", ".", -1)+".<init>()")}
+	}
+	if err := vm.initialize(t, c); err != nil {
+		return nil, err
+	}
+	obj := c.New()
+	if _, err := vm.callFrom(t, c, init, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// mirror returns the java/lang/Class object of class c, creating it on first
+// use.
+func (vm *VM) mirror(c *Object) *Object {
+	vm.mirrorsMu.Lock()
+	defer vm.mirrorsMu.Unlock()
+	if c.mirror == nil {
+		c.mirror = vm.classClass.New()
+		c.mirror.payload = c
+	}
+	return c.mirror
+}
+
+// arrayMirror returns the java/lang/Class object of an array type.
+func (vm *VM) arrayMirror(desc string) *Object {
+	vm.mirrorsMu.Lock()
+	defer vm.mirrorsMu.Unlock()
+	m, ok := vm.arrayMirrors[desc]
+	if !ok {
+		m = vm.classClass.New()
+		m.payload = desc
+		vm.arrayMirrors[desc] = m
+	}
+	return m
+}
+
+// mirrorName returns the binary name of the class or array type represented
+// by a Class object, with slashes.
+func mirrorName(m *Object) string {
+	if c, ok := m.payload.(*Object); ok {
+		return c.Name
+	}
+	return m.payload.(string)
+}
+
+// simpleName returns the name of a class as written in the source, given the
+// class object or an array type descriptor. Nested classes are named after
+// the InnerClasses attribute, which leaves anonymous classes unnamed.
+func simpleName(v interface{}) string {
+	switch v := v.(type) {
+	case *Object:
+		for _, ic := range v.InnerClasses {
+			if ic.Inner == v.Name {
+				return ic.Name
+			}
+		}
+		return v.Name[strings.LastIndex(v.Name, "/")+1:]
+	case string:
+		switch v[1] {
+		case '[':
+			return simpleName(v[1:]) + "[]"
+		case 'L':
+			name := v[2 : len(v)-1]
+			return name[strings.LastIndex(name, "/")+1:] + "[]"
+		}
+		return primitiveNames[v[1]] + "[]"
+	}
+	return ""
+}
+
+// throwables are the built-in exception classes and their superclasses. Each
+// of them can be constructed with an optional message.
+var throwables = [][2]string{
+	{"java/lang/Throwable", "java/lang/Object"},
+	{"java/lang/Exception", "java/lang/Throwable"},
+	{"java/lang/Error", "java/lang/Throwable"},
+	{"java/lang/OutOfMemoryError", "java/lang/Error"},
+	{"java/lang/LinkageError", "java/lang/Error"},
+	{"java/lang/IncompatibleClassChangeError", "java/lang/LinkageError"},
+	{"java/lang/InstantiationError", "java/lang/IncompatibleClassChangeError"},
+	{"java/lang/RuntimeException", "java/lang/Exception"},
+	{"java/lang/InterruptedException", "java/lang/Exception"},
+	{"java/lang/CloneNotSupportedException", "java/lang/Exception"},
+	{"java/lang/ReflectiveOperationException", "java/lang/Exception"},
+	{"java/lang/ClassNotFoundException", "java/lang/ReflectiveOperationException"},
+	{"java/lang/InstantiationException", "java/lang/ReflectiveOperationException"},
+	{"java/lang/NoSuchMethodException", "java/lang/ReflectiveOperationException"},
+	{"java/lang/NullPointerException", "java/lang/RuntimeException"},
+	{"java/lang/ArrayStoreException", "java/lang/RuntimeException"},
+	{"java/lang/ClassCastException", "java/lang/RuntimeException"},
+	{"java/lang/IllegalArgumentException", "java/lang/RuntimeException"},
+	{"java/lang/UnsupportedOperationException", "java/lang/RuntimeException"},
+	{"java/lang/NegativeArraySizeException", "java/lang/RuntimeException"},
+	{"java/lang/IndexOutOfBoundsException", "java/lang/RuntimeException"},
+	{"java/lang/ArrayIndexOutOfBoundsException", "java/lang/IndexOutOfBoundsException"},
+	{"java/lang/StringIndexOutOfBoundsException", "java/lang/IndexOutOfBoundsException"},
+	{"java/lang/IllegalMonitorStateException", "java/lang/RuntimeException"},
+	{"java/lang/IllegalThreadStateException", "java/lang/IllegalArgumentException"},
+}
+
+// newString returns a new java/lang/String object, which is not interned. It
+// doesn't look up the class, so that string constants can be created while a
+// class is being defined.
+func (vm *VM) newString(s string) *Object {
+	obj := vm.stringClass.New()
+	obj.Fields["value"] = s
+	return obj
+}
+
+// InternString returns the canonical java/lang/String object for s. The same
+// object is used for all string literals and constants equal to s, and is
+// returned by String.intern(). It is safe for concurrent use.
+func (vm *VM) InternString(s string) *Object {
+	vm.stringsMu.Lock()
+	defer vm.stringsMu.Unlock()
+	if obj, ok := vm.strings[s]; ok {
+		return obj
+	}
+	obj := vm.newString(s)
+	vm.strings[s] = obj
+	return obj
+}
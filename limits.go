@@ -0,0 +1,133 @@
+package tojvm
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// timeoutCheck is the number of instructions between checks of the deadline
+// of a call.
+const timeoutCheck = 1024
+
+// callLimits are the limits of a call from Go, shared by the threads running
+// the methods it calls.
+type callLimits struct {
+	deadline   time.Time
+	timeout    time.Duration
+	maxObjects int64
+	maxBytes   int64
+	objects    int64 // allocated so far, updated atomically
+	bytes      int64
+}
+
+// TimeoutError is the Err of the VMError returned by a call that ran out of
+// time, at the instruction where it was interrupted.
+type TimeoutError struct {
+	Timeout time.Duration
+	Elapsed time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("call timed out after %v", e.Elapsed)
+}
+
+// CallTimeout is like Call, but interrupts the method if it runs longer than
+// d, including the methods it calls, and fails with a TimeoutError. The
+// deadline is checked between instructions, so natives that block, and
+// threads started by the method, aren't interrupted. The monitors held by the
+// interrupted frames are released.
+func (vm *VM) CallTimeout(d time.Duration, class, method string, args ...Value) (Value, error) {
+	c, err := vm.Class(class)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.Method(method, "")
+	if err != nil {
+		return nil, err
+	}
+	if args, err = vm.convertArgs(m, args); err != nil {
+		return nil, err
+	}
+	return vm.callLimited(d, c, m, args...)
+}
+
+// callLimited calls the method from Go, with a timeout if d is positive and
+// the allocation limits of the VM. The limits are kept in a thread without
+// frames, that the thread running the method is nested in.
+func (vm *VM) callLimited(d time.Duration, obj *Object, m Field, args ...Value) (Value, error) {
+	if d <= 0 && vm.MaxCallAllocations <= 0 && vm.MaxCallAllocatedBytes <= 0 {
+		return vm.callFrom(nil, obj, m, args...)
+	}
+	l := &callLimits{maxObjects: vm.MaxCallAllocations, maxBytes: vm.MaxCallAllocatedBytes}
+	if d > 0 {
+		l.deadline, l.timeout = time.Now().Add(d), d
+	}
+	return vm.callFrom(&thread{limits: l}, obj, m, args...)
+}
+
+// tick counts an instruction executed by a watched thread, and fails when the
+// budget of an Execution is exhausted or the deadline of a call has passed.
+func (t *thread) tick() error {
+	if t.limited {
+		if t.budget <= 0 {
+			return errSuspended
+		}
+		t.budget--
+	}
+	if t.limits == nil || t.limits.deadline.IsZero() {
+		return nil
+	}
+	if t.ticks++; t.ticks%timeoutCheck == 0 {
+		l := t.limits
+		if now := time.Now(); now.After(l.deadline) {
+			return &TimeoutError{Timeout: l.timeout, Elapsed: now.Sub(l.deadline.Add(-l.timeout))}
+		}
+	}
+	return nil
+}
+
+// alloc and allocArray allocate an object or an array created by bytecode
+// with the Heap, within the allocation limits of the call.
+func (vm *VM) alloc(t *thread, c *Object) (*Object, error) {
+	if err := vm.countAlloc(t, 0); err != nil {
+		return nil, err
+	}
+	return vm.Heap.Alloc(c)
+}
+
+func (vm *VM) allocArray(t *thread, desc string, n int) (Value, error) {
+	if err := vm.countAlloc(t, arrayBytes(desc, n)); err != nil {
+		return nil, err
+	}
+	return vm.Heap.AllocArray(desc, n)
+}
+
+func (vm *VM) countAlloc(t *thread, bytes int64) error {
+	l := t.limits
+	if l == nil {
+		return nil
+	}
+	if n := atomic.AddInt64(&l.objects, 1); l.maxObjects > 0 && n > l.maxObjects {
+		return vm.Throw("java/lang/OutOfMemoryError", fmt.Sprintf("allocation limit of %d objects exceeded", l.maxObjects))
+	}
+	if n := atomic.AddInt64(&l.bytes, bytes); l.maxBytes > 0 && n > l.maxBytes {
+		return vm.Throw("java/lang/OutOfMemoryError", fmt.Sprintf("allocation limit of %d bytes exceeded", l.maxBytes))
+	}
+	return nil
+}
+
+// arrayBytes estimates the size of an array, with a 16 bytes header and
+// 8 bytes references.
+func arrayBytes(desc string, n int) int64 {
+	size := int64(8)
+	switch desc[1] {
+	case 'Z', 'B':
+		size = 1
+	case 'C', 'S':
+		size = 2
+	case 'I', 'F':
+		size = 4
+	}
+	return 16 + size*int64(n)
+}
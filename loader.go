@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 )
 
@@ -16,8 +17,69 @@ type Class struct {
 	Fields     []Field
 	Methods    []Field
 	Attributes []Attribute
+	// InnerClasses lists the nested classes that the class refers to, as
+	// recorded by the InnerClasses attribute.
+	InnerClasses []InnerClass
+	// Signature is the generic signature of a generic class, or of a class
+	// extending or implementing a parameterized type, from the Signature
+	// attribute. The VM ignores it, as generics are erased.
+	Signature string
 }
 
+// InnerClass describes a nested class. Outer is empty for local and anonymous
+// classes, and Name is empty for anonymous classes.
+type InnerClass struct {
+	Inner string
+	Outer string
+	Name  string
+	Flags uint16
+}
+
+// MethodNames returns the names of the methods declared by the class, in
+// declaration order. Overloaded methods are listed once.
+func (c Class) MethodNames() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, m := range c.Methods {
+		if !seen[m.Name] {
+			seen[m.Name] = true
+			names = append(names, m.Name)
+		}
+	}
+	return names
+}
+
+// IsPublic, IsFinal, IsInterface, and so on decode the access flags of the
+// class, as listed in Table 4.1-B.
+func (c Class) IsPublic() bool     { return c.Flags&0x0001 != 0 } // ACC_PUBLIC
+func (c Class) IsFinal() bool      { return c.Flags&0x0010 != 0 } // ACC_FINAL
+func (c Class) IsSuper() bool      { return c.Flags&0x0020 != 0 } // ACC_SUPER
+func (c Class) IsInterface() bool  { return c.Flags&0x0200 != 0 } // ACC_INTERFACE
+func (c Class) IsAbstract() bool   { return c.Flags&0x0400 != 0 } // ACC_ABSTRACT
+func (c Class) IsSynthetic() bool  { return c.Flags&0x1000 != 0 } // ACC_SYNTHETIC
+func (c Class) IsAnnotation() bool { return c.Flags&0x2000 != 0 } // ACC_ANNOTATION
+func (c Class) IsEnum() bool       { return c.Flags&0x4000 != 0 } // ACC_ENUM
+
+// IsPublic, IsStatic, IsFinal, and so on decode the access flags of the
+// field or method, as listed in Tables 4.5-A and 4.6-A. Some bits mean
+// different things for fields and methods: IsVolatile and IsBridge test the
+// same bit, as do IsTransient and IsVarargs.
+func (f Field) IsPublic() bool       { return f.Flags&0x0001 != 0 } // ACC_PUBLIC
+func (f Field) IsPrivate() bool      { return f.Flags&0x0002 != 0 } // ACC_PRIVATE
+func (f Field) IsProtected() bool    { return f.Flags&0x0004 != 0 } // ACC_PROTECTED
+func (f Field) IsStatic() bool       { return f.Flags&0x0008 != 0 } // ACC_STATIC
+func (f Field) IsFinal() bool        { return f.Flags&0x0010 != 0 } // ACC_FINAL
+func (f Field) IsSynchronized() bool { return f.Flags&0x0020 != 0 } // ACC_SYNCHRONIZED
+func (f Field) IsVolatile() bool     { return f.Flags&0x0040 != 0 } // ACC_VOLATILE
+func (f Field) IsBridge() bool       { return f.Flags&0x0040 != 0 } // ACC_BRIDGE
+func (f Field) IsTransient() bool    { return f.Flags&0x0080 != 0 } // ACC_TRANSIENT
+func (f Field) IsVarargs() bool      { return f.Flags&0x0080 != 0 } // ACC_VARARGS
+func (f Field) IsNative() bool       { return f.Flags&0x0100 != 0 } // ACC_NATIVE
+func (f Field) IsAbstract() bool     { return f.Flags&0x0400 != 0 } // ACC_ABSTRACT
+func (f Field) IsStrict() bool       { return f.Flags&0x0800 != 0 } // ACC_STRICT
+func (f Field) IsSynthetic() bool    { return f.Flags&0x1000 != 0 } // ACC_SYNTHETIC
+func (f Field) IsEnum() bool         { return f.Flags&0x4000 != 0 } // ACC_ENUM
+
 type Tag byte
 
 // From Table 4.4-A
@@ -57,6 +119,9 @@ type Field struct {
 	Name       string
 	Descriptor string
 	Attributes []Attribute
+	// Signature is the generic signature of a field or method with generic
+	// types, such as "<T:Ljava/lang/Object;>(TT;)TT;", or empty.
+	Signature string
 }
 
 type Attribute struct {
@@ -67,6 +132,9 @@ type Attribute struct {
 type ConstPool []Const
 
 func (cp ConstPool) Resolve(index uint16) string {
+	if index == 0 || int(index) > len(cp) {
+		return ""
+	}
 	if cp[index-1].Tag == TagUTF8 {
 		return cp[index-1].String
 	} else if cp[index-1].Tag == TagString {
@@ -82,12 +150,23 @@ type loader struct {
 	err error
 }
 
+// bytes reads n bytes. The buffer grows as the data is read, so that a corrupt
+// length doesn't allocate more memory than the class file has. After an error
+// only the fixed size reads of u1 to u8 get zeroes.
 func (l *loader) bytes(n int) []byte {
-	b := make([]byte, n, n)
 	if l.err == nil {
-		_, l.err = io.ReadFull(l.r, b)
+		b, err := ioutil.ReadAll(io.LimitReader(l.r, int64(n)))
+		if err == nil && len(b) < n {
+			err = io.ErrUnexpectedEOF
+		}
+		if l.err = err; err == nil {
+			return b
+		}
+	}
+	if n > 8 {
+		return nil
 	}
-	return b
+	return make([]byte, n, n)
 }
 func (l *loader) u1() uint8  { return l.bytes(1)[0] }
 func (l *loader) u2() uint16 { return binary.BigEndian.Uint16(l.bytes(2)) }
@@ -142,12 +221,14 @@ func (l *loader) interfaces(cp ConstPool) (interfaces []string) {
 func (l *loader) fields(cp ConstPool) (fields []Field) {
 	fieldsCount := l.u2()
 	for i := uint16(0); i < fieldsCount; i++ {
-		fields = append(fields, Field{
+		f := Field{
 			Flags:      l.u2(),
 			Name:       cp.Resolve(l.u2()),
 			Descriptor: cp.Resolve(l.u2()),
 			Attributes: l.attrs(cp),
-		})
+		}
+		f.Signature = signature(f.Attributes, cp)
+		fields = append(fields, f)
 	}
 	return fields
 }
@@ -155,14 +236,66 @@ func (l *loader) fields(cp ConstPool) (fields []Field) {
 func (l *loader) attrs(cp ConstPool) (attrs []Attribute) {
 	attributesCount := l.u2()
 	for i := uint16(0); i < attributesCount; i++ {
-		attrs = append(attrs, Attribute{
+		a := Attribute{
 			Name: cp.Resolve(l.u2()),
 			Data: l.bytes(int(l.u4())),
-		})
+		}
+		if l.err == nil {
+			if n, ok := attrLength(a); !ok || n != len(a.Data) {
+				l.err = fmt.Errorf("bad %s attribute length %d", a.Name, len(a.Data))
+			}
+		}
+		attrs = append(attrs, a)
 	}
 	return attrs
 }
 
+// attrLength returns the length of a structured attribute as implied by its
+// contents, so that it can be checked against the declared length. Other
+// attributes are opaque and their declared length is returned as is.
+func attrLength(a Attribute) (int, bool) {
+	data := a.Data
+	switch a.Name {
+	case "ConstantValue", "SourceFile", "Signature":
+		return 2, true
+	case "Exceptions":
+		if len(data) < 2 {
+			return 0, false
+		}
+		return 2 + 2*int(binary.BigEndian.Uint16(data)), true
+	case "InnerClasses":
+		if len(data) < 2 {
+			return 0, false
+		}
+		return 2 + 8*int(binary.BigEndian.Uint16(data)), true
+	case "Code":
+		if len(data) < 8 {
+			return 0, false
+		}
+		n := 8 + int(binary.BigEndian.Uint32(data[4:8]))
+		if n < 8 || len(data) < n+2 {
+			return 0, false
+		}
+		n = n + 2 + 8*int(binary.BigEndian.Uint16(data[n:]))
+		if len(data) < n+2 {
+			return 0, false
+		}
+		count := binary.BigEndian.Uint16(data[n:])
+		n = n + 2
+		for i := uint16(0); i < count; i++ {
+			if len(data) < n+6 {
+				return 0, false
+			}
+			n = n + 6 + int(binary.BigEndian.Uint32(data[n+2:]))
+			if n > len(data) {
+				return 0, false
+			}
+		}
+		return n, true
+	}
+	return len(data), true
+}
+
 func Load(r io.Reader) (Class, error) {
 	loader := &loader{r: r}
 	c := Class{}
@@ -176,5 +309,38 @@ func Load(r io.Reader) (Class, error) {
 	c.Fields = loader.fields(cp)    // fields
 	c.Methods = loader.fields(cp)   // methods
 	c.Attributes = loader.attrs(cp) // methods
+	if loader.err == nil {
+		c.InnerClasses = innerClasses(c.Attributes, cp)
+		c.Signature = signature(c.Attributes, cp)
+	}
 	return c, loader.err
 }
+
+// signature returns the string of a Signature attribute, if any.
+func signature(attrs []Attribute, cp ConstPool) string {
+	for _, a := range attrs {
+		if a.Name == "Signature" && len(a.Data) == 2 {
+			return cp.Resolve(binary.BigEndian.Uint16(a.Data))
+		}
+	}
+	return ""
+}
+
+// innerClasses decodes the InnerClasses attribute, whose length has been
+// checked by attrLength.
+func innerClasses(attrs []Attribute, cp ConstPool) (classes []InnerClass) {
+	for _, a := range attrs {
+		if a.Name != "InnerClasses" {
+			continue
+		}
+		for e := a.Data[2:]; len(e) >= 8; e = e[8:] {
+			classes = append(classes, InnerClass{
+				Inner: cp.Resolve(binary.BigEndian.Uint16(e)),
+				Outer: cp.Resolve(binary.BigEndian.Uint16(e[2:])),
+				Name:  cp.Resolve(binary.BigEndian.Uint16(e[4:])),
+				Flags: binary.BigEndian.Uint16(e[6:]),
+			})
+		}
+	}
+	return classes
+}
@@ -0,0 +1,247 @@
+package tojvm
+
+import (
+	"fmt"
+	"reflect"
+	"unicode/utf16"
+)
+
+// Marshal creates an instance of the class and sets its fields from the
+// exported fields of the Go struct in, which may also be a pointer to one.
+// Java field names default to Go field names and can be set with a
+// `jvm:"name"` tag, a "-" tag skips the field. Primitives, strings, nested
+// structs and slices or arrays are converted based on the Java field
+// descriptor. Go fields without a matching Java field are ignored unless
+// StrictFields is set.
+func (vm *VM) Marshal(class string, in interface{}) (*Object, error) {
+	v := reflect.ValueOf(in)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot marshal %T into %s", in, class)
+	}
+	return vm.marshal(class, v)
+}
+
+func (vm *VM) marshal(class string, v reflect.Value) (*Object, error) {
+	c, err := vm.Class(class)
+	if err != nil {
+		return nil, err
+	}
+	obj := c.New()
+	err = vm.structFields(c, v, func(name string, f Field, fv reflect.Value) error {
+		value, err := vm.marshalValue(fv, f.Descriptor)
+		if err != nil {
+			return fmt.Errorf("field %s of %s: %v", name, class, err)
+		}
+		obj.SetField(name, value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (vm *VM) marshalValue(v reflect.Value, desc string) (Value, error) {
+	if v.Type() == objectType && desc[0] == 'L' {
+		if v.IsNil() {
+			return nil, nil
+		}
+		return v.Interface(), nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return vm.marshalValue(v.Elem(), desc)
+	case reflect.Struct:
+		if desc[0] == 'L' {
+			return vm.marshal(desc[1:len(desc)-1], v)
+		}
+	case reflect.Slice, reflect.Array:
+		if desc[0] == '[' {
+			if v.Kind() == reflect.Slice && v.IsNil() {
+				return nil, nil
+			}
+			if len(desc) == 2 {
+				return vm.marshalPrimitives(v, desc)
+			}
+			a := make([]Value, v.Len(), arrayCap(v.Len()))
+			for i := range a {
+				e, err := vm.marshalValue(v.Index(i), desc[1:])
+				if err != nil {
+					return nil, err
+				}
+				a[i] = e
+			}
+			return a, nil
+		}
+	}
+	if !v.CanInterface() {
+		return nil, fmt.Errorf("cannot use %s as %s", v.Type(), desc)
+	}
+	return vm.convertArg(v.Interface(), desc)
+}
+
+// marshalPrimitives converts a Go slice or array into a typed primitive array.
+func (vm *VM) marshalPrimitives(v reflect.Value, desc string) (Value, error) {
+	a := newArray(desc, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		e, err := vm.marshalValue(v.Index(i), desc[1:])
+		if err != nil {
+			return nil, err
+		}
+		setElement(a, i, e)
+	}
+	return a, nil
+}
+
+// Unmarshal copies the fields of obj into the Go struct pointed to by out, see
+// Marshal for how fields are matched. Unset Java fields leave zero values.
+func (vm *VM) Unmarshal(obj *Object, out interface{}) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot unmarshal into %T", out)
+	}
+	return vm.unmarshal(obj, v.Elem())
+}
+
+func (vm *VM) unmarshal(obj *Object, v reflect.Value) error {
+	c := obj
+	if obj.ClassInstance != nil {
+		c = obj.ClassInstance
+	}
+	return vm.structFields(c, v, func(name string, f Field, fv reflect.Value) error {
+		if err := vm.unmarshalValue(obj.Field(name), fv); err != nil {
+			return fmt.Errorf("field %s of %s: %v", name, c.Name, err)
+		}
+		return nil
+	})
+}
+
+func (vm *VM) unmarshalValue(value Value, v reflect.Value) error {
+	if value == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if obj, ok := value.(*Object); ok && v.Type() == objectType {
+		v.Set(reflect.ValueOf(obj))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if n, ok := value.(int32); ok {
+			v.SetBool(n != 0)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := vm.GoInt(value); ok && !v.OverflowInt(n) {
+			v.SetInt(n)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, ok := vm.GoInt(value); ok && n >= 0 && !v.OverflowUint(uint64(n)) {
+			v.SetUint(uint64(n))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch f := value.(type) {
+		case float32:
+			v.SetFloat(float64(f))
+			return nil
+		case float64:
+			v.SetFloat(f)
+			return nil
+		}
+	case reflect.String:
+		if s, ok := vm.GoString(value); ok {
+			v.SetString(s)
+			return nil
+		}
+		if c, ok := value.([]uint16); ok {
+			v.SetString(string(utf16.Decode(c)))
+			return nil
+		}
+	case reflect.Struct:
+		if obj, ok := value.(*Object); ok {
+			return vm.unmarshal(obj, v)
+		}
+	case reflect.Ptr:
+		if obj, ok := value.(*Object); ok && v.Type().Elem().Kind() == reflect.Struct {
+			p := reflect.New(v.Type().Elem())
+			if err := vm.unmarshal(obj, p.Elem()); err != nil {
+				return err
+			}
+			v.Set(p)
+			return nil
+		}
+	case reflect.Slice, reflect.Array:
+		if a, ok := arrayElements(value); ok {
+			if v.Kind() == reflect.Slice {
+				v.Set(reflect.MakeSlice(v.Type(), len(a), len(a)))
+			} else if v.Len() != len(a) {
+				return fmt.Errorf("cannot use array of length %d as %s", len(a), v.Type())
+			}
+			for i, e := range a {
+				if err := vm.unmarshalValue(e, v.Index(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.Interface:
+		if g := reflect.ValueOf(vm.ToGo(value)); g.Type().AssignableTo(v.Type()) {
+			v.Set(g)
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot use %T as %s", value, v.Type())
+}
+
+// structFields calls fn for each exported field of the Go struct v with the
+// matching instance field declared by class c or its superclasses.
+func (vm *VM) structFields(c *Object, v reflect.Value, fn func(name string, f Field, v reflect.Value) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		name := sf.Name
+		if tag, ok := sf.Tag.Lookup("jvm"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		f, ok := instanceField(c, name)
+		if !ok {
+			if vm.StrictFields {
+				return fmt.Errorf("%s has no field %s", c.Name, name)
+			}
+			continue
+		}
+		if err := fn(name, f, v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instanceField finds the declaration of a non-static field in class c or its
+// superclasses.
+func instanceField(c *Object, name string) (Field, bool) {
+	for ; c != nil; c = c.SuperInstance {
+		for _, f := range c.Class.Fields {
+			if f.Name == name && f.Flags&0x0008 == 0 { // ACC_STATIC
+				return f, true
+			}
+		}
+	}
+	return Field{}, false
+}
@@ -0,0 +1,108 @@
+package tojvm
+
+import "errors"
+
+// SetNative stores a Go value in the object for the natives of its class,
+// where bytecode can't see it, unlike Fields. Clones of the object only get a
+// copy of it from the function registered with RegisterCloner.
+func (o *Object) SetNative(v interface{}) {
+	o.payload = v
+}
+
+// GetNative returns the Go value stored with SetNative, or nil.
+func (o *Object) GetNative() interface{} {
+	return o.payload
+}
+
+// RegisterCloner sets the function copying the Go value stored with SetNative
+// when Object.clone is called on instances of the class or its subclasses,
+// and when Snapshot or Restore copy them.
+func (vm *VM) RegisterCloner(class string, f func(v interface{}) interface{}) {
+	vm.nativeMu.Lock()
+	vm.cloners[class] = f
+	vm.nativeMu.Unlock()
+}
+
+// NativeContext is passed to natives registered with RegisterNativeFunc. Java
+// code they call through it runs nested in the calling thread, so it can enter
+// monitors held by the caller, like in a JNI callback.
+type NativeContext struct {
+	VM       *VM
+	Class    *Object // class declaring the native method
+	Receiver *Object // receiver of an instance method, or nil for arrays
+	t        *thread
+}
+
+// RegisterNativeFunc is like RegisterNative, but the function gets the call
+// context and may fail. Returning an *Exception, e.g. from Throw, throws it in
+// the caller. If desc is empty, the function implements all overloads of the
+// method that have no function registered for their own descriptor.
+func (vm *VM) RegisterNativeFunc(class, method, desc string, f func(ctx *NativeContext, args ...Value) (Value, error)) {
+	vm.nativeMu.Lock()
+	vm.contextNatives[class+"."+method+desc] = f
+	vm.nativeMu.Unlock()
+}
+
+// CallMethod calls a method of the object's class like VM.CallMethod.
+func (ctx *NativeContext) CallMethod(obj *Object, method, desc string, args ...Value) (Value, error) {
+	c := obj
+	if obj.ClassInstance != nil {
+		c = obj.ClassInstance
+	}
+	c, m, ok := virtual(c, method, desc)
+	if !ok {
+		return nil, errors.New("method not found")
+	}
+	args, err := ctx.VM.convertArgs(m, args)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.VM.callFrom(ctx.t, c, m, args...)
+}
+
+// NewInstance creates an object of the class, initializing the class if
+// needed, and runs the constructor with the given descriptor.
+func (ctx *NativeContext) NewInstance(class, desc string, args ...Value) (*Object, error) {
+	c, err := ctx.VM.resolve(class)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.VM.initialize(ctx.t, c); err != nil {
+		return nil, err
+	}
+	init, err := c.Method("<init>", desc)
+	if err != nil {
+		return nil, err
+	}
+	obj := c.New()
+	args, err = ctx.VM.convertArgs(init, append([]Value{obj}, args...))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ctx.VM.callFrom(ctx.t, c, init, args...); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Throw is like VM.Throw.
+func (ctx *NativeContext) Throw(class, msg string) error {
+	return ctx.VM.Throw(class, msg)
+}
+
+// Suspend lets the native complete later, without blocking the thread, when
+// it's called by a call started with Start. It returns the Execution to pass
+// its result to with ResumeWith, and the error the native must return.
+// Outside of an Execution, the error fails the call.
+//
+//	ex, err := ctx.Suspend()
+//	if ex != nil {
+//		go func() { ex.ResumeWith(fetch()) }()
+//	}
+//	return nil, err
+func (ctx *NativeContext) Suspend() (*Execution, error) {
+	if ctx.t == nil || ctx.t.ex == nil {
+		return nil, errors.New("can't suspend a native outside of an Execution")
+	}
+	return ctx.t.ex, errNativeSuspended
+}
@@ -0,0 +1,91 @@
+package tojvm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Policy restricts the classes and natives that the code run by a VM can
+// reach, to run untrusted code. Class names in its lists are either exact
+// names, like "java/lang/Thread", or package prefixes ending with a slash,
+// like "java/io/". The policy is checked whenever a class is resolved,
+// including the superclasses and interfaces of loaded classes, and before
+// natives are called. java/lang/Object is always allowed.
+type Policy struct {
+	// Allow lists the classes that can be used. If empty, all the classes
+	// that aren't denied can.
+	Allow []string
+	// Deny lists the classes that can't be used, even if allowed.
+	Deny []string
+	// CheckNative, if set, is called before calling a native method of an
+	// allowed class, which fails with the error returned, if any.
+	CheckNative func(class, method, desc string) error
+}
+
+// SecurityError is returned when the Policy denies the use of a class or the
+// call of a native. Method and Desc are empty for classes.
+type SecurityError struct {
+	Class  string
+	Method string
+	Desc   string
+	Err    error // returned by CheckNative
+}
+
+func (e *SecurityError) Error() string {
+	if e.Method == "" {
+		return "access to class " + e.Class + " denied"
+	} else if e.Err != nil {
+		return fmt.Sprintf("call of native %s.%s%s denied: %v", e.Class, e.Method, e.Desc, e.Err)
+	}
+	return fmt.Sprintf("call of native %s.%s%s denied", e.Class, e.Method, e.Desc)
+}
+
+func (e *SecurityError) Unwrap() error { return e.Err }
+
+// allows reports whether the policy allows the class. Arrays are allowed if
+// their element type is.
+func (p *Policy) allows(name string) bool {
+	name = strings.TrimLeft(name, "[")
+	if strings.HasPrefix(name, "L") && strings.HasSuffix(name, ";") {
+		name = name[1 : len(name)-1]
+	} else if len(name) == 1 {
+		return true // primitive
+	}
+	if name == "java/lang/Object" {
+		return true
+	}
+	match := func(list []string) bool {
+		for _, s := range list {
+			if s == name || (strings.HasSuffix(s, "/") && strings.HasPrefix(name, s)) {
+				return true
+			}
+		}
+		return false
+	}
+	return !match(p.Deny) && (len(p.Allow) == 0 || match(p.Allow))
+}
+
+// checkClass fails if the Policy denies the class.
+func (vm *VM) checkClass(name string) error {
+	if vm.Policy != nil && !vm.Policy.allows(name) {
+		return &SecurityError{Class: name}
+	}
+	return nil
+}
+
+// checkNative fails if the Policy denies calling the native m of class c.
+func (vm *VM) checkNative(c *Object, m Field) error {
+	p := vm.Policy
+	if p == nil {
+		return nil
+	}
+	if !p.allows(c.Name) {
+		return &SecurityError{Class: c.Name, Method: m.Name, Desc: m.Descriptor}
+	}
+	if p.CheckNative != nil {
+		if err := p.CheckNative(c.Name, m.Name, m.Descriptor); err != nil {
+			return &SecurityError{Class: c.Name, Method: m.Name, Desc: m.Descriptor, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package tojvm
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// properties is a string map, the Go state of java/util/Properties objects.
+// The system properties of a VM are read and written by Go and Java code.
+type properties struct {
+	mu sync.RWMutex
+	m  map[string]string
+}
+
+func (p *properties) get(key string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	v, ok := p.m[key]
+	return v, ok
+}
+
+func (p *properties) set(key, value string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, ok := p.m[key]
+	p.m[key] = value
+	return old, ok
+}
+
+func (p *properties) remove(key string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, ok := p.m[key]
+	delete(p.m, key)
+	return old, ok
+}
+
+// defaultProperties returns the system properties a VM starts with.
+func defaultProperties(classPath []string) map[string]string {
+	osNames := map[string]string{"linux": "Linux", "darwin": "Mac OS X", "windows": "Windows", "freebsd": "FreeBSD"}
+	osName, ok := osNames[runtime.GOOS]
+	if !ok {
+		osName = runtime.GOOS
+	}
+	m := map[string]string{
+		"java.version":               "1.8",
+		"java.specification.version": "1.8",
+		"java.vendor":                "tojvm",
+		"java.class.path":            strings.Join(classPath, string(os.PathListSeparator)),
+		"java.io.tmpdir":             os.TempDir(),
+		"os.name":                    osName,
+		"os.arch":                    runtime.GOARCH,
+		"file.separator":             string(filepath.Separator),
+		"path.separator":             string(os.PathListSeparator),
+		"line.separator":             "\n",
+		"file.encoding":              "UTF-8",
+	}
+	if runtime.GOOS == "windows" {
+		m["line.separator"] = "\r\n"
+	}
+	if dir, err := os.Getwd(); err == nil {
+		m["user.dir"] = dir
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		m["user.home"] = home
+	}
+	return m
+}
+
+// Property returns the value of a system property, as System.getProperty.
+func (vm *VM) Property(key string) (string, bool) {
+	return vm.properties.get(key)
+}
+
+// SetProperty sets a system property, as System.setProperty. Properties
+// such as java.version, os.name, user.dir and line.separator are set by New.
+func (vm *VM) SetProperty(key, value string) {
+	vm.properties.set(key, value)
+}
+
+// ClearProperty removes a system property, as System.clearProperty.
+func (vm *VM) ClearProperty(key string) {
+	vm.properties.remove(key)
+}
+
+// defineProperties defines java/util/Properties and the property methods of
+// java/lang/System. System.getProperties returns a view of the system
+// properties, while new Properties objects are empty. Absent properties read
+// as null.
+func (vm *VM) defineProperties() {
+	vm.properties = &properties{m: defaultProperties(vm.ClassPath)}
+	p := &Assembler{}
+	p.Method(0x0001, "<init>", "()V", 0, 0)
+	p.Method(0x0101, "getProperty", "(Ljava/lang/String;)Ljava/lang/String;", 0, 0)
+	p.Method(0x0101, "getProperty", "(Ljava/lang/String;Ljava/lang/String;)Ljava/lang/String;", 0, 0)
+	p.Method(0x0101, "setProperty", "(Ljava/lang/String;Ljava/lang/String;)Ljava/lang/Object;", 0, 0)
+	class := newClass(p.Class(0x0021, "java/util/Properties", "java/lang/Object"), vm.objectClass)
+	vm.Classes = append(vm.Classes, class)
+
+	vm.cloners["java/util/Properties"] = func(v interface{}) interface{} {
+		if v == vm.properties {
+			return v
+		}
+		p := v.(*properties)
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		m := make(map[string]string, len(p.m))
+		for k, v := range p.m {
+			m[k] = v
+		}
+		return &properties{m: m}
+	}
+	// str returns a Java string or null.
+	str := func(s string, ok bool) Value {
+		if !ok {
+			return nil
+		}
+		return vm.InternString(s)
+	}
+	// key checks a property name, which System also requires to be non-empty.
+	key := func(v Value, system bool) (string, error) {
+		s, ok := vm.GoString(v)
+		if !ok {
+			return "", &Exception{Object: vm.newThrowable("java/lang/NullPointerException", "key can't be null")}
+		} else if s == "" && system {
+			return "", &Exception{Object: vm.newThrowable("java/lang/IllegalArgumentException", "key can't be empty")}
+		}
+		return s, nil
+	}
+	// get reads a property, or returns the default value in args[1], if any.
+	get := func(p *properties, args []Value, system bool) (Value, error) {
+		k, err := key(args[0], system)
+		if err != nil {
+			return nil, err
+		} else if v, ok := p.get(k); ok {
+			return vm.InternString(v), nil
+		} else if len(args) > 1 {
+			return args[1], nil
+		}
+		return nil, nil
+	}
+	// set writes a property and returns its previous value.
+	set := func(p *properties, args []Value, system bool) (Value, error) {
+		k, err := key(args[0], system)
+		if err != nil {
+			return nil, err
+		}
+		v, ok := vm.GoString(args[1])
+		if !ok {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/NullPointerException", "")}
+		}
+		return str(p.set(k, v)), nil
+	}
+	vm.registerNative("java/util/Properties", "<init>", func(t *thread, args ...Value) (Value, error) {
+		args[0].(*Object).payload = &properties{m: map[string]string{}}
+		return nil, nil
+	})
+	vm.registerNative("java/util/Properties", "getProperty", func(t *thread, args ...Value) (Value, error) {
+		return get(args[0].(*Object).payload.(*properties), args[1:], false)
+	})
+	vm.registerNative("java/util/Properties", "setProperty", func(t *thread, args ...Value) (Value, error) {
+		return set(args[0].(*Object).payload.(*properties), args[1:], false)
+	})
+	vm.registerNative("java/lang/System", "getProperty", func(t *thread, args ...Value) (Value, error) {
+		return get(vm.properties, args, true)
+	})
+	vm.registerNative("java/lang/System", "setProperty", func(t *thread, args ...Value) (Value, error) {
+		return set(vm.properties, args, true)
+	})
+	vm.registerNative("java/lang/System", "clearProperty", func(t *thread, args ...Value) (Value, error) {
+		k, err := key(args[0], true)
+		if err != nil {
+			return nil, err
+		}
+		return str(vm.properties.remove(k)), nil
+	})
+	vm.registerNative("java/lang/System", "getProperties", func(t *thread, args ...Value) (Value, error) {
+		obj := class.New()
+		obj.payload = vm.properties
+		return obj, nil
+	})
+}
@@ -0,0 +1,54 @@
+package tojvm
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Proxy returns an object implementing the interface with a Go function. Any
+// method invoked on the object, except for equals, hashCode, toString and
+// getClass, which behave as in Object, calls fn with the method arguments, not
+// including the receiver. The result is converted to the method return type as
+// in Call.
+func (vm *VM) Proxy(iface string, fn func(args ...Value) (Value, error)) (*Object, error) {
+	i, err := vm.Class(iface)
+	if err != nil {
+		return nil, err
+	}
+	if i.Flags&0x0200 == 0 { // ACC_INTERFACE
+		return nil, fmt.Errorf("%s is not an interface", iface)
+	}
+	c := newClass(Class{
+		Name:       iface + "$Proxy",
+		Super:      "java/lang/Object",
+		Flags:      0x0011, // ACC_PUBLIC, ACC_FINAL
+		Interfaces: []string{iface},
+	}, vm.objectClass)
+	c.interfaces = []*Object{i}
+	obj := c.New()
+	obj.proxy = fn
+	return obj, nil
+}
+
+func (vm *VM) callProxy(t *thread, obj *Object, name, desc string, args []Value) (Value, error) {
+	switch name + desc {
+	case "equals(Ljava/lang/Object;)Z", "hashCode()I", "toString()Ljava/lang/String;", "getClass()Ljava/lang/Class;":
+		return vm.callNative(t, vm.objectClass, Field{Name: name, Descriptor: desc}, args)
+	}
+	res, err := obj.proxy(append([]Value{}, args[1:]...)...)
+	if err != nil {
+		return nil, err
+	}
+	_, ret, err := parseDescriptor(desc)
+	if err != nil || ret == "V" {
+		return nil, err
+	}
+	return vm.convertArg(res, ret)
+}
+
+// identityHash returns a hash code of the object or array based on its
+// address, like the default Object.hashCode.
+func identityHash(obj Value) int32 {
+	p := uint64(reflect.ValueOf(obj).Pointer())
+	return int32(p ^ p>>32)
+}
@@ -0,0 +1,211 @@
+package tojvm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// recordedBuiltins are the built-in natives that are recorded like the
+// registered ones, because their results depend on the outside world.
+var recordedBuiltins = map[string]bool{
+	"java/lang/System.currentTimeMillis": true,
+	"java/lang/System.nanoTime":          true,
+}
+
+// Record starts logging the calls of natives registered with RegisterNative
+// or RegisterNativeFunc, and of the natives reading the clock, to w: one line
+// per call with the method, the arguments and the result or the exception
+// thrown. Sources of randomness are natives too, so their values are logged
+// as well. Record(nil) stops recording. Runs are only reproducible if they
+// call natives in the same order, so threads should not call them
+// concurrently.
+func (vm *VM) Record(w io.Writer) {
+	var r *recording
+	if w != nil {
+		r = &recording{w: bufio.NewWriter(w)}
+	}
+	vm.nativeMu.Lock()
+	vm.recording = r
+	vm.nativeMu.Unlock()
+}
+
+// Replay answers the natives logged by Record from the log read from r,
+// instead of calling them. A call to another native or with other arguments
+// than the ones logged fails with a VMError at the instruction calling it.
+// Replay(nil) stops replaying.
+func (vm *VM) Replay(r io.Reader) {
+	var rec *recording
+	if r != nil {
+		rec = &recording{r: bufio.NewScanner(r)}
+		rec.r.Buffer(nil, 1<<24)
+	}
+	vm.nativeMu.Lock()
+	vm.recording = rec
+	vm.nativeMu.Unlock()
+}
+
+// recording is the log of native calls being written or replayed. Natives
+// called while recording a native aren't logged, since replaying it doesn't
+// call them.
+type recording struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	r     *bufio.Scanner
+	depth int
+}
+
+// recorded reports whether calls of the native are logged.
+func (vm *VM) recorded(obj *Object, m Field) bool {
+	if _, ok := vm.natives[obj.Name+"."+m.Name+m.Descriptor]; ok {
+		return recordedBuiltins[obj.Name+"."+m.Name]
+	} else if _, ok := vm.natives[obj.Name+"."+m.Name]; ok {
+		return recordedBuiltins[obj.Name+"."+m.Name]
+	}
+	return true
+}
+
+// call logs the call of the native by f, or answers it from the log.
+func (r *recording) call(vm *VM, obj *Object, m Field, args []Value, f func() (Value, error)) (Value, error) {
+	fields := []string{obj.Name + "." + m.Name + m.Descriptor}
+	for _, v := range args {
+		fields = append(fields, vm.encodeValue(v))
+	}
+	call := strings.Join(fields, "\t")
+	r.mu.Lock()
+	if r.w == nil {
+		defer r.mu.Unlock()
+		return r.replay(vm, call, m.Descriptor)
+	} else if r.depth > 0 {
+		r.mu.Unlock()
+		return f()
+	}
+	r.depth++
+	r.mu.Unlock()
+	res, err := f()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.depth--
+	result := vm.encodeValue(res)
+	if exc, ok := err.(*Exception); ok {
+		msg, _ := vm.GoString(exc.Object.Field("message"))
+		result = "!" + exc.Object.Name + strconv.Quote(msg)
+	} else if err != nil {
+		result = "!" + strconv.Quote(err.Error())
+	}
+	if _, werr := fmt.Fprintf(r.w, "%s\t=\t%s\n", call, result); werr != nil {
+		return nil, werr
+	} else if werr := r.w.Flush(); werr != nil {
+		return nil, werr
+	}
+	return res, err
+}
+
+func (r *recording) replay(vm *VM, call, desc string) (Value, error) {
+	if !r.r.Scan() {
+		if err := r.r.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("replay diverged: %s called after the end of the recording", call)
+	}
+	line := r.r.Text()
+	i := strings.LastIndex(line, "\t=\t")
+	if i < 0 {
+		return nil, fmt.Errorf("bad recording line %q", line)
+	}
+	if line[:i] != call {
+		return nil, fmt.Errorf("replay diverged: %s called, %s recorded", call, line[:i])
+	}
+	result := line[i+3:]
+	if strings.HasPrefix(result, "!") {
+		j := strings.Index(result, `"`)
+		if j < 0 {
+			return nil, fmt.Errorf("bad recording line %q", line)
+		}
+		msg, err := strconv.Unquote(result[j:])
+		if err != nil {
+			return nil, fmt.Errorf("bad recording line %q", line)
+		}
+		if j == 1 {
+			return nil, errors.New(msg)
+		}
+		c, err := vm.Class(result[1:j])
+		if err != nil {
+			return nil, err
+		}
+		exc := c.New()
+		if msg != "" {
+			exc.SetField("message", vm.newString(msg))
+		}
+		return nil, &Exception{Object: exc}
+	}
+	if desc[len(desc)-1] == 'V' {
+		return nil, nil
+	}
+	v, ok := vm.decodeValue(result)
+	if !ok {
+		return nil, fmt.Errorf("can't replay the result %s of %s", result, call)
+	}
+	return v, nil
+}
+
+// encodeValue formats a value for the log. Strings and primitives are
+// logged with their values, other objects and arrays with their types.
+func (vm *VM) encodeValue(v Value) string {
+	switch v := v.(type) {
+	case nil:
+		return "N"
+	case int32:
+		return "I" + strconv.FormatInt(int64(v), 10)
+	case int64:
+		return "J" + strconv.FormatInt(v, 10)
+	case float32:
+		return "F" + strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return "D" + strconv.FormatFloat(v, 'g', -1, 64)
+	case *Object:
+		if v == nil {
+			return "N"
+		} else if s, ok := vm.GoString(v); ok {
+			return "S" + strconv.Quote(s)
+		}
+		return "L" + v.Name
+	}
+	return "A" + arrayDesc(v)
+}
+
+// decodeValue parses a string or primitive value formatted by encodeValue.
+func (vm *VM) decodeValue(s string) (Value, bool) {
+	if s == "N" {
+		return nil, true
+	} else if s == "" {
+		return nil, false
+	}
+	var v Value
+	var err error
+	switch s[0] {
+	case 'I':
+		var n int64
+		n, err = strconv.ParseInt(s[1:], 10, 32)
+		v = int32(n)
+	case 'J':
+		v, err = strconv.ParseInt(s[1:], 10, 64)
+	case 'F':
+		var f float64
+		f, err = strconv.ParseFloat(s[1:], 32)
+		v = float32(f)
+	case 'D':
+		v, err = strconv.ParseFloat(s[1:], 64)
+	case 'S':
+		var str string
+		str, err = strconv.Unquote(s[1:])
+		v = vm.newString(str)
+	default:
+		return nil, false
+	}
+	return v, err == nil
+}
@@ -0,0 +1,170 @@
+package tojvm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errReloadRunning is returned by ReloadClass while methods are running.
+var errReloadRunning = errors.New("can't reload a class while methods are running")
+
+// ReloadClass reads the class file of a loaded class from the class path
+// again and swaps its constant pool, methods, fields and attributes in place,
+// so that other classes, subclasses and existing instances run the new code.
+// Static fields that are still declared with the same type keep their
+// values, new ones are set to their ConstantValue or zero value. If
+// ReinitializeOnReload is set, all of them are, and <clinit> runs again.
+// Changes that existing instances or subclasses can't follow are rejected:
+// another superclass, other interfaces, a class becoming an interface or the
+// other way around, and added, removed or retyped instance fields.
+// ReloadClass fails while methods are running.
+func (vm *VM) ReloadClass(name string) error {
+	vm.classesMu.Lock()
+	c, err := vm.reloadClass(name)
+	vm.classesMu.Unlock()
+	if err != nil || !vm.ReinitializeOnReload {
+		return err
+	}
+	return vm.initialize(nil, c)
+}
+
+func (vm *VM) reloadClass(name string) (*Object, error) {
+	if atomic.LoadInt32(&vm.running) > 0 {
+		return nil, errReloadRunning
+	}
+	c := vm.findClass(name)
+	if c == nil {
+		return nil, fmt.Errorf("class %s is not loaded", name)
+	} else if c.init == nil {
+		return nil, fmt.Errorf("can't reload built-in class %s", name)
+	}
+	nc, err := vm.readClass(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := compatible(c.Class, nc); err != nil {
+		return nil, fmt.Errorf("can't reload class %s: %v", name, err)
+	}
+	o := newClass(nc, c.SuperInstance)
+	statics := map[string]Value{}
+	for _, f := range nc.Fields {
+		if f.Flags&0x0008 == 0 { // ACC_STATIC
+			continue
+		}
+		if old, ok := staticField(c.Class, f.Name); ok && old.Descriptor == f.Descriptor && !vm.ReinitializeOnReload {
+			if v, ok := c.Fields[f.Name]; ok {
+				statics[f.Name] = v
+			}
+		} else {
+			vm.initStatic(o, f)
+			if v, ok := o.Fields[f.Name]; ok {
+				statics[f.Name] = v
+			}
+		}
+	}
+	c.Class, c.methods, c.code, c.Fields = nc, o.methods, o.code, statics
+	if vm.ReinitializeOnReload {
+		c.init = &classInit{}
+		c.init.cond.L = &c.init.mu
+	}
+	return c, nil
+}
+
+// compatible reports why the class can't be replaced by its new version nc.
+func compatible(c, nc Class) error {
+	if nc.Super != c.Super {
+		return fmt.Errorf("superclass changed from %s to %s", c.Super, nc.Super)
+	} else if fmt.Sprint(nc.Interfaces) != fmt.Sprint(c.Interfaces) {
+		return fmt.Errorf("interfaces changed from %v to %v", c.Interfaces, nc.Interfaces)
+	} else if nc.Flags&0x0200 != c.Flags&0x0200 { // ACC_INTERFACE
+		return errors.New("changed between class and interface")
+	}
+	var fields, nfields []string
+	for _, f := range c.Fields {
+		if f.Flags&0x0008 == 0 { // ACC_STATIC
+			fields = append(fields, f.Name+":"+f.Descriptor)
+		}
+	}
+	for _, f := range nc.Fields {
+		if f.Flags&0x0008 == 0 {
+			nfields = append(nfields, f.Name+":"+f.Descriptor)
+		}
+	}
+	if fmt.Sprint(nfields) != fmt.Sprint(fields) {
+		return fmt.Errorf("instance fields changed from %v to %v", fields, nfields)
+	}
+	return nil
+}
+
+func staticField(c Class, name string) (Field, bool) {
+	for _, f := range c.Fields {
+		if f.Name == name && f.Flags&0x0008 != 0 { // ACC_STATIC
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// WatchClassPath checks the class files of the loaded classes every interval
+// and reloads the ones modified since they were loaded, or since the last
+// check, calling onReload, if not nil, with the name of each class and the
+// error returned by ReloadClass. Classes are reloaded again at the next check
+// if methods were running. OnDuplicateClass is called at every check.
+// Calling the returned function stops watching.
+func (vm *VM) WatchClassPath(interval time.Duration, onReload func(class string, err error)) (stop func()) {
+	done := make(chan struct{})
+	modified := map[string]time.Time{}
+	check := func(reload bool) {
+		vm.classesMu.RLock()
+		var names []string
+		for _, c := range vm.Classes[vm.builtins:] {
+			names = append(names, c.Name)
+		}
+		vm.classesMu.RUnlock()
+		for _, name := range names {
+			vm.classesMu.Lock()
+			file, _, err := vm.findClassFile(name)
+			vm.classesMu.Unlock()
+			if err != nil || file == "" {
+				continue
+			}
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			t, ok := modified[name]
+			if ok && !info.ModTime().After(t) {
+				continue
+			}
+			if ok && reload {
+				err := vm.ReloadClass(name)
+				if onReload != nil {
+					onReload(name, err)
+				}
+				if err == errReloadRunning {
+					continue
+				}
+			}
+			modified[name] = info.ModTime()
+		}
+	}
+	check(false)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				check(true)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
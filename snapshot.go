@@ -0,0 +1,188 @@
+package tojvm
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Snapshot is the state of the classes loaded into a VM, taken by
+// VM.Snapshot, which VM.Restore can bring back any number of times.
+type Snapshot struct {
+	classes []*Object
+	statics map[*Object]map[string]Value
+	inits   map[*Object]error // initialized classes and their <clinit> errors
+	strings map[string]*Object
+}
+
+// Snapshot records the loaded classes, whether they are initialized, the
+// values of their static fields and all the objects and arrays reachable
+// from them, and the interned strings. Strings, Class objects and proxies are
+// immutable and recorded as is. The Go values stored with SetNative are
+// copied by the functions registered with RegisterCloner: it's an error if
+// an object has one but its class has no cloner. Snapshot fails while
+// methods are running.
+func (vm *VM) Snapshot() (*Snapshot, error) {
+	vm.classesMu.Lock()
+	defer vm.classesMu.Unlock()
+	if atomic.LoadInt32(&vm.running) > 0 {
+		return nil, errors.New("can't take a snapshot while methods are running")
+	}
+	s := &Snapshot{
+		classes: append([]*Object{}, vm.Classes...),
+		statics: map[*Object]map[string]Value{},
+		inits:   map[*Object]error{},
+		strings: map[string]*Object{},
+	}
+	cp := vm.copier()
+	for _, c := range s.classes[vm.builtins:] {
+		fields, err := cp.fields(c.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot of %s: %v", c.Name, err)
+		}
+		s.statics[c] = fields
+		if ci := c.init; ci != nil && atomic.LoadInt32(&ci.done) == 1 {
+			s.inits[c] = ci.err
+		}
+	}
+	vm.stringsMu.Lock()
+	for k, v := range vm.strings {
+		s.strings[k] = v
+	}
+	vm.stringsMu.Unlock()
+	return s, nil
+}
+
+// Restore brings the VM back to the state recorded by Snapshot. Classes
+// loaded since are forgotten, and static fields refer to fresh copies of the
+// recorded objects, so that changes made to them after Restore don't affect
+// the snapshot. Objects kept by Go code still refer to the objects they
+// referred to before. Restore fails while methods are running.
+func (vm *VM) Restore(s *Snapshot) error {
+	vm.classesMu.Lock()
+	defer vm.classesMu.Unlock()
+	if atomic.LoadInt32(&vm.running) > 0 {
+		return errors.New("can't restore a snapshot while methods are running")
+	}
+	cp := vm.copier()
+	statics := map[*Object]map[string]Value{}
+	for c, fields := range s.statics {
+		copied, err := cp.fields(fields)
+		if err != nil {
+			return fmt.Errorf("restore of %s: %v", c.Name, err)
+		}
+		statics[c] = copied
+	}
+	vm.Classes = append(vm.Classes[:0:0], s.classes...)
+	for c, fields := range statics {
+		c.Fields = fields
+		c.init = &classInit{}
+		c.init.cond.L = &c.init.mu
+		if err, ok := s.inits[c]; ok {
+			c.init.done, c.init.err = 1, err
+		}
+	}
+	strings := map[string]*Object{}
+	for k, v := range s.strings {
+		strings[k] = v
+	}
+	vm.stringsMu.Lock()
+	vm.strings = strings
+	vm.stringsMu.Unlock()
+	return nil
+}
+
+// copier makes deep copies of values, copying each object or array once so
+// that references to the same one still do after copying.
+type copier struct {
+	vm   *VM
+	seen map[interface{}]Value
+}
+
+func (vm *VM) copier() *copier {
+	return &copier{vm: vm, seen: map[interface{}]Value{}}
+}
+
+func (cp *copier) fields(fields map[string]Value) (map[string]Value, error) {
+	copied := make(map[string]Value, len(fields))
+	for k, v := range fields {
+		c, err := cp.copy(v)
+		if err != nil {
+			return nil, err
+		}
+		copied[k] = c
+	}
+	return copied, nil
+}
+
+func (cp *copier) copy(v Value) (Value, error) {
+	switch v := v.(type) {
+	case *Object:
+		if v == nil || v.ClassInstance == nil || v.proxy != nil ||
+			v.ClassInstance == cp.vm.stringClass || v.ClassInstance == cp.vm.classClass {
+			return v, nil
+		}
+		if c, ok := cp.seen[v]; ok {
+			return c, nil
+		}
+		obj := v.ClassInstance.New()
+		cp.seen[v] = obj
+		if v.payload != nil {
+			cloner := cp.vm.cloner(v.ClassInstance)
+			if cloner == nil {
+				return nil, fmt.Errorf("no cloner for the native value of %s", v.Name)
+			}
+			obj.payload = cloner(v.payload)
+		}
+		fields, err := cp.fields(v.Fields)
+		obj.Fields = fields
+		return obj, err
+	case *Array:
+		if v == nil {
+			return v, nil
+		} else if c, ok := cp.seen[v]; ok {
+			return c, nil
+		}
+		a := &Array{Desc: v.Desc, Values: make([]Value, len(v.Values))}
+		cp.seen[v] = a
+		return a, cp.elements(a.Values, v.Values)
+	}
+	if key, ok := keyOf(v); ok {
+		if c, ok := cp.seen[key]; ok {
+			return c, nil
+		}
+		a := cloneArray(v)
+		if key.c > 0 {
+			cp.seen[key] = a
+		}
+		if a, ok := a.([]Value); ok {
+			return a, cp.elements(a, a)
+		}
+		return a, nil
+	}
+	return v, nil
+}
+
+func (cp *copier) elements(dst, src []Value) error {
+	for i, e := range src {
+		c, err := cp.copy(e)
+		if err != nil {
+			return err
+		}
+		dst[i] = c
+	}
+	return nil
+}
+
+// cloner returns the function registered with RegisterCloner for the class
+// or its nearest superclass, or nil.
+func (vm *VM) cloner(c *Object) func(v interface{}) interface{} {
+	vm.nativeMu.RLock()
+	defer vm.nativeMu.RUnlock()
+	for k := c; k != nil; k = k.SuperInstance {
+		if f, ok := vm.cloners[k.Name]; ok {
+			return f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package tojvm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// printDescs are the descriptors of the PrintStream print and println methods.
+var printDescs = []string{
+	"(Ljava/lang/String;)V", "(Ljava/lang/Object;)V", "(Z)V", "(C)V", "(I)V", "(J)V", "(F)V", "(D)V",
+}
+
+// defineSystem defines java/lang/System with its out and err streams. The
+// streams write to VM.Stdout and VM.Stderr, which are looked up on every
+// call, so they can be changed at any time.
+func (vm *VM) defineSystem() {
+	ps := &Assembler{}
+	for _, desc := range printDescs {
+		ps.Method(0x0101, "print", desc, 0, 0)
+		ps.Method(0x0101, "println", desc, 0, 0)
+	}
+	ps.Method(0x0101, "println", "()V", 0, 0)
+	ps.Method(0x0101, "flush", "()V", 0, 0)
+	vm.Classes = append(vm.Classes, newClass(ps.Class(0x0021, "java/io/PrintStream", "java/lang/Object"), vm.Classes[0]))
+
+	sys := &Assembler{}
+	sys.Field(0x0019, "out", "Ljava/io/PrintStream;").Field(0x0019, "err", "Ljava/io/PrintStream;")
+	sys.Method(0x0109, "arraycopy", "(Ljava/lang/Object;ILjava/lang/Object;II)V", 0, 0)
+	sys.Method(0x0109, "currentTimeMillis", "()J", 0, 0)
+	sys.Method(0x0109, "nanoTime", "()J", 0, 0)
+	sys.Method(0x0109, "exit", "(I)V", 0, 0)
+	sys.Method(0x0109, "getProperty", "(Ljava/lang/String;)Ljava/lang/String;", 0, 0)
+	sys.Method(0x0109, "getProperty", "(Ljava/lang/String;Ljava/lang/String;)Ljava/lang/String;", 0, 0)
+	sys.Method(0x0109, "setProperty", "(Ljava/lang/String;Ljava/lang/String;)Ljava/lang/String;", 0, 0)
+	sys.Method(0x0109, "clearProperty", "(Ljava/lang/String;)Ljava/lang/String;", 0, 0)
+	sys.Method(0x0109, "getProperties", "()Ljava/util/Properties;", 0, 0)
+	sys.Method(0x0109, "getenv", "(Ljava/lang/String;)Ljava/lang/String;", 0, 0)
+	sys.Method(0x0109, "getenv", "()Ljava/util/Map;", 0, 0)
+	c := newClass(sys.Class(0x0031, "java/lang/System", "java/lang/Object"), vm.Classes[0])
+	vm.Classes = append(vm.Classes, c)
+	for name, w := range map[string]func() io.Writer{
+		"out": func() io.Writer { return vm.Stdout },
+		"err": func() io.Writer { return vm.Stderr },
+	} {
+		stream, _ := vm.Class("java/io/PrintStream")
+		obj := stream.New()
+		obj.payload = w
+		c.SetField(name, obj)
+	}
+
+	for _, desc := range printDescs {
+		desc := desc
+		for _, name := range []string{"print", "println"} {
+			newline := name == "println"
+			vm.registerNative("java/io/PrintStream", name+desc, func(t *thread, args ...Value) (Value, error) {
+				s, err := vm.printString(t, args[1], desc[1:len(desc)-2])
+				if err != nil {
+					return nil, err
+				}
+				if newline {
+					s = s + "\n"
+				}
+				_, err = io.WriteString(args[0].(*Object).payload.(func() io.Writer)(), s)
+				return nil, err
+			})
+		}
+	}
+	vm.registerNative("java/lang/System", "arraycopy", func(t *thread, args ...Value) (Value, error) {
+		return nil, vm.arraycopy(args[0], int(args[1].(int32)), args[2], int(args[3].(int32)), int(args[4].(int32)))
+	})
+	vm.registerNative("java/lang/System", "currentTimeMillis", func(t *thread, args ...Value) (Value, error) {
+		return vm.Clock.Now().UnixNano() / int64(time.Millisecond), nil
+	})
+	vm.registerNative("java/lang/System", "nanoTime", func(t *thread, args ...Value) (Value, error) {
+		return int64(vm.Clock.Now().Sub(vm.started)), nil
+	})
+	vm.registerNative("java/lang/System", "exit", func(t *thread, args ...Value) (Value, error) {
+		return nil, &ExitError{Code: int(args[0].(int32))}
+	})
+	vm.registerNative("java/io/PrintStream", "println()V", func(t *thread, args ...Value) (Value, error) {
+		_, err := io.WriteString(args[0].(*Object).payload.(func() io.Writer)(), "\n")
+		return nil, err
+	})
+	vm.registerNative("java/io/PrintStream", "flush", func(t *thread, args ...Value) (Value, error) {
+		if f, ok := args[0].(*Object).payload.(func() io.Writer)().(interface{ Flush() error }); ok {
+			return nil, f.Flush()
+		}
+		return nil, nil
+	})
+	vm.registerNative("java/lang/System", "getenv(Ljava/lang/String;)Ljava/lang/String;", func(t *thread, args ...Value) (Value, error) {
+		name, ok := vm.GoString(args[0])
+		if !ok {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/NullPointerException", "")}
+		} else if v, ok := vm.Env[name]; ok {
+			return vm.InternString(v), nil
+		}
+		return nil, nil
+	})
+	vm.registerNative("java/lang/System", "getenv()Ljava/util/Map;", func(t *thread, args ...Value) (Value, error) {
+		return nil, &Exception{Object: vm.newThrowable("java/lang/UnsupportedOperationException", "System.getenv()")}
+	})
+	vm.defineProperties()
+}
+
+// HostEnv returns the variables of the environment of the process that are
+// named in allow, to be set as VM.Env.
+func HostEnv(allow ...string) map[string]string {
+	env := map[string]string{}
+	for _, name := range allow {
+		if v, ok := os.LookupEnv(name); ok {
+			env[name] = v
+		}
+	}
+	return env
+}
+
+// ExitError is the Err of the VMError returned by a call that ran
+// System.exit, at the instruction calling it. No more bytecode runs: the
+// frames of the thread are unwound without running finally blocks or exception
+// handlers, but the monitors they hold are released. A Go program running a
+// Java program would typically exit with Code.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// Clock tells the current time. Times returned by the default clock have a
+// monotonic reading, which makes System.nanoTime monotonic; other clocks are
+// measured by their wall time.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// printString formats a value of the given type like String.valueOf. Objects
+// are converted with their toString method, run nested in the thread t.
+func (vm *VM) printString(t *thread, v Value, desc string) (string, error) {
+	switch desc {
+	case "Z":
+		b, _ := AsBool(v)
+		return strconv.FormatBool(b), nil
+	case "C":
+		return string(rune(v.(int32))), nil
+	case "I", "J":
+		return fmt.Sprint(v), nil
+	case "F":
+		return javaFloat(float64(v.(float32)), 32), nil
+	case "D":
+		return javaFloat(v.(float64), 64), nil
+	}
+	obj, ok := v.(*Object)
+	if v == nil || (ok && obj == nil) {
+		return "null", nil
+	} else if !ok {
+		return fmt.Sprint(v), nil
+	}
+	if s, ok := vm.GoString(obj); ok {
+		return s, nil
+	}
+	c, m, ok := virtual(obj.ClassInstance, "toString", "()Ljava/lang/String;")
+	if !ok {
+		return obj.String(), nil
+	}
+	res, err := vm.callFrom(t, c, m, obj)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := vm.GoString(res); ok {
+		return s, nil
+	}
+	return "null", nil
+}
+
+// javaFloat formats a float like Double.toString and Float.toString.
+func javaFloat(f float64, bits int) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	if a := math.Abs(f); a == 0 || (a >= 1e-3 && a < 1e7) {
+		s := strconv.FormatFloat(f, 'f', -1, bits)
+		if !strings.Contains(s, ".") {
+			s = s + ".0"
+		}
+		return s
+	}
+	s := strconv.FormatFloat(f, 'E', -1, bits)
+	i := strings.Index(s, "E")
+	mant, exp := s[:i], s[i+1:]
+	if !strings.Contains(mant, ".") {
+		mant = mant + ".0"
+	}
+	exp = strings.TrimPrefix(exp, "+")
+	if strings.HasPrefix(exp, "-") {
+		return mant + "E-" + strings.TrimLeft(exp[1:], "0")
+	}
+	return mant + "E" + strings.TrimLeft(exp, "0")
+}
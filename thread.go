@@ -0,0 +1,514 @@
+package tojvm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// monitor is the lock of an object or array used by MONITORENTER,
+// MONITOREXIT and synchronized methods. It is owned by a thread and can be
+// entered again by its owner, or by threads running nested in it, which keep
+// the owner as is. Threads blocked in Object.wait are kept in waiters.
+type monitor struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	owner   *thread
+	count   int
+	waiters []chan struct{}
+	array   Value // the array of a monitor kept in arrayMonitors
+	uses    int   // of an array monitor, guarded by monitorsMu
+}
+
+var monitorsMu sync.Mutex
+
+// arrayMonitors holds the monitors of arrays other than *Array, which have
+// nowhere to keep them, while they are used, owned or waited on.
+var arrayMonitors = map[arrayKey]*monitor{}
+
+func newMonitor() *monitor {
+	m := &monitor{}
+	m.cond.L = &m.mu
+	return m
+}
+
+// monitor returns the monitor of the object, creating it on first use.
+func (o *Object) monitor() *monitor {
+	monitorsMu.Lock()
+	defer monitorsMu.Unlock()
+	if o.mon == nil {
+		o.mon = newMonitor()
+	}
+	return o.mon
+}
+
+// monitorOf returns the monitor of an object or array, or nil for null. The
+// monitors of primitive and []Value arrays are looked up in arrayMonitors, so
+// every call must be followed by drop once the monitor is entered, exited or
+// waited on.
+func monitorOf(v Value) *monitor {
+	switch r := v.(type) {
+	case *Object:
+		if r == nil {
+			return nil
+		}
+		return r.monitor()
+	case *Array:
+		if r == nil {
+			return nil
+		}
+		monitorsMu.Lock()
+		defer monitorsMu.Unlock()
+		if r.mon == nil {
+			r.mon = newMonitor()
+		}
+		return r.mon
+	}
+	k, ok := keyOf(v)
+	if !ok {
+		return nil
+	}
+	monitorsMu.Lock()
+	defer monitorsMu.Unlock()
+	m := arrayMonitors[k]
+	if m == nil {
+		m = newMonitor()
+		m.array = v
+		arrayMonitors[k] = m
+	}
+	m.uses++
+	return m
+}
+
+// drop ends a number of uses of a monitor returned by monitorOf, and removes
+// an array monitor from arrayMonitors once it's not used, owned nor waited on.
+func (m *monitor) drop(uses int) {
+	if m.array == nil {
+		return
+	}
+	monitorsMu.Lock()
+	defer monitorsMu.Unlock()
+	m.uses -= uses
+	m.mu.Lock()
+	unused := m.uses == 0 && m.owner == nil && len(m.waiters) == 0
+	m.mu.Unlock()
+	if k, _ := keyOf(m.array); unused && arrayMonitors[k] == m {
+		delete(arrayMonitors, k)
+	}
+}
+
+func (m *monitor) enter(t *thread) {
+	m.mu.Lock()
+	for m.owner != nil && !t.within(m.owner) {
+		m.cond.Wait()
+	}
+	if m.owner == nil {
+		m.owner = t
+	}
+	m.count++
+	m.mu.Unlock()
+}
+
+func (m *monitor) exit(t *thread) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.owner == nil || !t.within(m.owner) {
+		return false
+	}
+	if m.count--; m.count == 0 {
+		m.owner = nil
+		m.cond.Signal()
+	}
+	return true
+}
+
+// wait releases the monitor until it's notified, the timeout expires, if it's
+// positive, or intr is signalled, and then enters it again. It fails if t is
+// not the owner.
+func (m *monitor) wait(t *thread, timeout time.Duration, intr <-chan struct{}) (ok, interrupted bool) {
+	m.mu.Lock()
+	if t == nil || m.owner == nil || !t.within(m.owner) {
+		m.mu.Unlock()
+		return false, false
+	}
+	owner, count := m.owner, m.count
+	ch := make(chan struct{})
+	m.waiters = append(m.waiters, ch)
+	m.owner, m.count = nil, 0
+	m.cond.Signal()
+	m.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-ch:
+	case <-expired:
+	case <-intr:
+		interrupted = true
+	}
+
+	m.mu.Lock()
+	for i, w := range m.waiters {
+		if w == ch {
+			m.waiters = append(m.waiters[:i], m.waiters[i+1:]...)
+			break
+		}
+	}
+	for m.owner != nil {
+		m.cond.Wait()
+	}
+	m.owner, m.count = owner, count
+	m.mu.Unlock()
+	return true, interrupted
+}
+
+// notify wakes up one thread waiting on the monitor, or all of them. It fails
+// if t is not the owner.
+func (m *monitor) notify(t *thread, all bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t == nil || m.owner == nil || !t.within(m.owner) {
+		return false
+	}
+	n := len(m.waiters)
+	if !all && n > 1 {
+		n = 1
+	}
+	for _, w := range m.waiters[:n] {
+		close(w)
+	}
+	m.waiters = append(m.waiters[:0], m.waiters[n:]...)
+	return true
+}
+
+// defineWait registers the Object.wait, notify and notifyAll natives.
+func (vm *VM) defineWait() {
+	notOwner := func() error {
+		return &Exception{Object: vm.newThrowable("java/lang/IllegalMonitorStateException", "current thread is not owner")}
+	}
+	vm.registerNative("java/lang/Object", "wait", func(t *thread, args ...Value) (Value, error) {
+		var timeout time.Duration
+		if len(args) > 1 {
+			ms := args[1].(int64)
+			if ms < 0 {
+				return nil, &Exception{Object: vm.newThrowable("java/lang/IllegalArgumentException", "timeout value is negative")}
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+			if len(args) > 2 {
+				timeout += time.Duration(args[2].(int32))
+			}
+		}
+		jt := vm.currentThread(t)
+		if jt.clearInterrupt() {
+			return nil, vm.interrupted()
+		}
+		mon := monitorOf(args[0])
+		ok, interrupted := mon.wait(t, timeout, jt.wake)
+		mon.drop(1)
+		if !ok {
+			return nil, notOwner()
+		} else if interrupted {
+			jt.clearInterrupt()
+			return nil, vm.interrupted()
+		}
+		return nil, nil
+	})
+	for _, name := range []string{"notify", "notifyAll"} {
+		all := name == "notifyAll"
+		vm.registerNative("java/lang/Object", name, func(t *thread, args ...Value) (Value, error) {
+			mon := monitorOf(args[0])
+			defer mon.drop(1)
+			if !mon.notify(t, all) {
+				return nil, notOwner()
+			}
+			return nil, nil
+		})
+	}
+}
+
+// syncMonitor returns the monitor a synchronized method runs under, which is
+// the receiver's for instance methods and the one of the class's Class object
+// for static methods, or nil if the method is not synchronized.
+func (vm *VM) syncMonitor(c *Object, m Field, args []Value) *monitor {
+	if m.Flags&0x0020 == 0 { // ACC_SYNCHRONIZED
+		return nil
+	}
+	if m.Flags&0x0008 != 0 { // ACC_STATIC
+		if c.ClassInstance != nil {
+			c = c.ClassInstance
+		}
+		return vm.mirror(c).monitor()
+	}
+	if len(args) > 0 {
+		if obj, ok := args[0].(*Object); ok && obj != nil {
+			return obj.monitor()
+		}
+	}
+	return nil
+}
+
+// push enters the monitor of the frame, if any, and makes it the topmost.
+func (t *thread) push(f *Frame) {
+	if f.lock != nil {
+		f.lock.enter(t)
+	}
+	t.frames = append(t.frames, f)
+}
+
+// release exits the monitors of a frame that is being popped: the one of a
+// synchronized method and the ones of synchronized blocks that were left
+// without MONITOREXIT, because the call failed.
+func (t *thread) release(f *Frame) {
+	for i := len(f.blocks) - 1; i >= 0; i-- {
+		f.blocks[i].exit(t)
+		f.blocks[i].drop(0)
+		f.blocks[i] = nil
+	}
+	f.blocks = f.blocks[:0]
+	if f.lock != nil {
+		f.lock.exit(t)
+		f.lock = nil
+	}
+}
+
+// javaThread is the Go side of a java/lang/Thread object. Interrupting a
+// thread sets its flag and wakes it up through wake if it's blocked in sleep,
+// wait or join.
+type javaThread struct {
+	mu          sync.Mutex
+	started     bool
+	interrupted bool
+	done        chan struct{}
+	wake        chan struct{}
+}
+
+func newJavaThread() *javaThread {
+	return &javaThread{done: make(chan struct{}), wake: make(chan struct{}, 1)}
+}
+
+func (jt *javaThread) interrupt() {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	jt.interrupted = true
+	select {
+	case jt.wake <- struct{}{}:
+	default:
+	}
+}
+
+// clearInterrupt clears the interrupt flag and returns its old value.
+func (jt *javaThread) clearInterrupt() bool {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	select {
+	case <-jt.wake:
+	default:
+	}
+	interrupted := jt.interrupted
+	jt.interrupted = false
+	return interrupted
+}
+
+// currentThread returns the Go side of the Thread object that t runs on.
+func (vm *VM) currentThread(t *thread) *javaThread {
+	if t != nil && t.java != nil {
+		return t.java.payload.(*javaThread)
+	}
+	return vm.mainThread().payload.(*javaThread)
+}
+
+// interrupted returns the InterruptedException thrown by blocking natives.
+func (vm *VM) interrupted() error {
+	return &Exception{Object: vm.newThrowable("java/lang/InterruptedException", "")}
+}
+
+// defineThread defines java/lang/Runnable and java/lang/Thread. Thread.start
+// runs the thread on a new goroutine and join waits for it to finish. Every
+// field access takes the lock of the object's fields, so racing threads can't
+// corrupt them, but as in Java, read-modify-write sequences like n++ must be
+// guarded by synchronized methods or blocks, which lock the object's monitor,
+// to not lose updates.
+func (vm *VM) defineThread() {
+	r := &Assembler{}
+	r.Method(0x0401, "run", "()V", 0, 0)
+	vm.Classes = append(vm.Classes, newClass(r.Class(0x0601, "java/lang/Runnable", "java/lang/Object"), vm.Classes[0]))
+
+	a := &Assembler{}
+	a.Field(0x0002, "name", "Ljava/lang/String;").Field(0x0002, "target", "Ljava/lang/Runnable;")
+	for _, desc := range []string{"()V", "(Ljava/lang/Runnable;)V", "(Ljava/lang/String;)V", "(Ljava/lang/Runnable;Ljava/lang/String;)V"} {
+		a.Method(0x0101, "<init>", desc, 0, 0)
+	}
+	// public void run() { if (target != null) target.run(); }
+	l := a.Label()
+	a.Aload(0).Getfield("java/lang/Thread", "target", "Ljava/lang/Runnable;").Dup().Branch(0xC6, l).
+		Invoke(0xB9, "java/lang/Runnable", "run", "()V").Return().
+		Mark(l).Pop().Return().
+		Method(0x0001, "run", "()V", 2, 1)
+	a.Method(0x0101, "start", "()V", 0, 0)
+	a.Method(0x0101, "join", "()V", 0, 0)
+	a.Method(0x0101, "isAlive", "()Z", 0, 0)
+	a.Method(0x0101, "getName", "()Ljava/lang/String;", 0, 0)
+	a.Method(0x0101, "setName", "(Ljava/lang/String;)V", 0, 0)
+	a.Method(0x0101, "interrupt", "()V", 0, 0)
+	a.Method(0x0101, "isInterrupted", "()Z", 0, 0)
+	a.Method(0x0109, "currentThread", "()Ljava/lang/Thread;", 0, 0)
+	a.Method(0x0109, "interrupted", "()Z", 0, 0)
+	a.Method(0x0109, "sleep", "(J)V", 0, 0)
+	vm.Classes = append(vm.Classes, newClass(a.Class(0x0021, "java/lang/Thread", "java/lang/Object", "java/lang/Runnable"), vm.Classes[0]))
+
+	vm.registerNative("java/lang/Thread", "<init>", func(t *thread, args ...Value) (Value, error) {
+		obj := args[0].(*Object)
+		obj.payload = newJavaThread()
+		obj.SetField("name", vm.newString(fmt.Sprintf("Thread-%d", atomic.AddInt32(&vm.threadCount, 1)-1)))
+		for _, arg := range args[1:] {
+			if s, ok := vm.GoString(arg); ok {
+				obj.SetField("name", vm.newString(s))
+			} else {
+				obj.SetField("target", arg)
+			}
+		}
+		return nil, nil
+	})
+	vm.registerNative("java/lang/Thread", "start", func(t *thread, args ...Value) (Value, error) {
+		obj := args[0].(*Object)
+		jt := obj.payload.(*javaThread)
+		jt.mu.Lock()
+		defer jt.mu.Unlock()
+		if jt.started {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/IllegalThreadStateException", "")}
+		}
+		jt.started = true
+		// The thread is running as soon as start returns, see Reset.
+		atomic.AddInt32(&vm.running, 1)
+		go func() {
+			defer close(jt.done)
+			defer atomic.AddInt32(&vm.running, -1)
+			if err := vm.runThread(obj); err != nil {
+				vm.uncaught(obj, err)
+			}
+		}()
+		return nil, nil
+	})
+	vm.registerNative("java/lang/Thread", "join", func(t *thread, args ...Value) (Value, error) {
+		jt := args[0].(*Object).payload.(*javaThread)
+		jt.mu.Lock()
+		started := jt.started
+		jt.mu.Unlock()
+		if !started {
+			return nil, nil
+		}
+		cur := vm.currentThread(t)
+		if cur.clearInterrupt() {
+			return nil, vm.interrupted()
+		}
+		select {
+		case <-jt.done:
+			return nil, nil
+		case <-cur.wake:
+			cur.clearInterrupt()
+			return nil, vm.interrupted()
+		}
+	})
+	vm.registerNative("java/lang/Thread", "isAlive", func(t *thread, args ...Value) (Value, error) {
+		jt := args[0].(*Object).payload.(*javaThread)
+		jt.mu.Lock()
+		defer jt.mu.Unlock()
+		select {
+		case <-jt.done:
+			return boolValue(false), nil
+		default:
+			return boolValue(jt.started), nil
+		}
+	})
+	vm.registerNative("java/lang/Thread", "getName", func(t *thread, args ...Value) (Value, error) {
+		return args[0].(*Object).Field("name"), nil
+	})
+	vm.registerNative("java/lang/Thread", "setName", func(t *thread, args ...Value) (Value, error) {
+		args[0].(*Object).SetField("name", args[1])
+		return nil, nil
+	})
+	vm.registerNative("java/lang/Thread", "interrupt", func(t *thread, args ...Value) (Value, error) {
+		args[0].(*Object).payload.(*javaThread).interrupt()
+		return nil, nil
+	})
+	vm.registerNative("java/lang/Thread", "isInterrupted", func(t *thread, args ...Value) (Value, error) {
+		jt := args[0].(*Object).payload.(*javaThread)
+		jt.mu.Lock()
+		defer jt.mu.Unlock()
+		return boolValue(jt.interrupted), nil
+	})
+	vm.registerNative("java/lang/Thread", "interrupted", func(t *thread, args ...Value) (Value, error) {
+		return boolValue(vm.currentThread(t).clearInterrupt()), nil
+	})
+	vm.registerNative("java/lang/Thread", "sleep", func(t *thread, args ...Value) (Value, error) {
+		ms := args[0].(int64)
+		if ms < 0 {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/IllegalArgumentException", "timeout value is negative")}
+		}
+		jt := vm.currentThread(t)
+		if jt.clearInterrupt() {
+			return nil, vm.interrupted()
+		}
+		select {
+		case <-time.After(time.Duration(ms) * time.Millisecond):
+			return nil, nil
+		case <-jt.wake:
+			jt.clearInterrupt()
+			return nil, vm.interrupted()
+		}
+	})
+	vm.registerNative("java/lang/Thread", "currentThread", func(t *thread, args ...Value) (Value, error) {
+		if t != nil && t.java != nil {
+			return t.java, nil
+		}
+		return vm.mainThread(), nil
+	})
+}
+
+// mainThread returns the Thread object for code called from Go.
+func (vm *VM) mainThread() *Object {
+	vm.mainOnce.Do(func() {
+		c, _ := vm.Class("java/lang/Thread")
+		vm.main = c.New()
+		vm.main.payload = newJavaThread()
+		vm.main.SetField("name", vm.newString("main"))
+	})
+	return vm.main
+}
+
+// runThread calls the run method of a Thread object on a new VM thread.
+func (vm *VM) runThread(obj *Object) error {
+	c, m, ok := virtual(obj.ClassInstance, "run", "()V")
+	if !ok {
+		return errors.New("method not found")
+	}
+	code, ok := c.codeOf(m)
+	if !ok {
+		_, err := vm.callNative(nil, c, m, []Value{obj})
+		return err
+	}
+	frame, err := vm.methodFrame(c, m, code, []Value{obj})
+	if err != nil {
+		return err
+	}
+	vm.enter(c.Name, m)
+	_, err = vm.runOn(nil, obj, frame)
+	vm.exit(c.Name, m, nil, err)
+	return err
+}
+
+// uncaught reports an error that ended a thread to OnUncaught, or prints it.
+func (vm *VM) uncaught(obj *Object, err error) {
+	if vm.OnUncaught != nil {
+		vm.OnUncaught(obj, err)
+		return
+	}
+	name, _ := vm.GoString(obj.Field("name"))
+	fmt.Fprintf(vm.Stderr, "Exception in thread %q %v\n", name, err)
+}
@@ -3,58 +3,467 @@ package tojvm
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Value is a Java value. Ints, shorts, bytes, booleans and chars, which hold a
+// UTF-16 code unit, are int32, as on the operand stack. Booleans are always 0
+// or 1, see AsBool. Longs are int64, floats are float32 and doubles are
+// float64. References are *Object, arrays or nil.
 type Value interface{}
 
+// Frame is the activation of a method. Stack is allocated once with the
+// method's max_stack size and SP is the number of values on it.
+//
+// Every value takes a single element of Stack, including long and double
+// values which the JVM counts as two slots. The category of a value is
+// tracked by its type instead: int64 and float64 are category 2, everything
+// else is category 1. Stack manipulation opcodes like DUP2 and POP2 are
+// defined in terms of slots and use the categories to find out how many values
+// they affect. Since values never take more room than slots, max_stack is
+// always enough for the Stack, though overflows are detected in values, not
+// slots. Locals, on the contrary, are indexed by slot as in the class file, so
+// a long or double local leaves the next slot unused.
+//
+// IP is the index of the current instruction in Instructions, or the bytecode
+// offset of its opcode in Code when the method is interpreted from raw
+// bytecode. It stays there while the instruction runs, and moves to the next
+// instruction or to the branch target once it's done; invocations move it
+// before the callee runs. Branch targets are computed from the address of the
+// opcode by branchTarget when decoding.
 type Frame struct {
-	Class  *Object
+	Class        *Object
+	Method       Field
+	IP           uint32
+	Code         []byte
+	Instructions []Instruction
+	Locals       []Value
+	Stack        []Value
+	SP           int
+	insn         Instruction
+	at           uint32     // bytecode offset of the current instruction
+	lock         *monitor   // monitor of a synchronized method
+	blocks       []*monitor // monitors entered by MONITORENTER and not exited
+}
+
+// VMError is an error detected by the interpreter while executing a method.
+// Trace lists the active methods and their bytecode offsets, innermost first.
+type VMError struct {
+	Class  string
+	Method string
 	IP     uint32
-	Code   []byte
-	Locals []Value
-	Stack  []Value
+	Msg    string
+	Err    error
+	Trace  []string
+}
+
+func (e *VMError) Error() string {
+	return fmt.Sprintf("%s at %s.%s+%d", e.Msg, e.Class, e.Method, e.IP)
+}
+
+func (e *VMError) Unwrap() error { return e.Err }
+
+// stackError is raised by push and pop, and turned into a VMError by exec.
+type stackError string
+
+var framePool = sync.Pool{New: func() interface{} { return &Frame{} }}
+
+// newFrame returns a pooled frame with room for the given number of locals and
+// operand stack values. Pooling only saves allocating the frame, its locals
+// and its stack on every call: values are still boxed into Value, which
+// allocates for ints, longs and floats that Go can't box statically, such as
+// ints outside 0..255.
+func newFrame(class *Object, m Field, code []byte, maxLocals, maxStack int) *Frame {
+	f := framePool.Get().(*Frame)
+	f.Class, f.Method, f.Code = class, m, code
+	if cap(f.Locals) < maxLocals {
+		f.Locals = make([]Value, maxLocals, maxLocals)
+	} else {
+		f.Locals = f.Locals[:maxLocals]
+	}
+	if cap(f.Stack) < maxStack {
+		f.Stack = make([]Value, maxStack, maxStack)
+	} else {
+		f.Stack = f.Stack[:maxStack]
+	}
+	return f
+}
+
+// freeFrame clears all references held by the frame and returns it to the
+// pool, so that pooled frames don't keep garbage alive.
+func freeFrame(f *Frame) {
+	locals, stack := f.Locals[:cap(f.Locals)], f.Stack[:cap(f.Stack)]
+	for i := range locals {
+		locals[i] = nil
+	}
+	for i := range stack {
+		stack[i] = nil
+	}
+	*f = Frame{Locals: locals[:0], Stack: stack[:0]}
+	framePool.Put(f)
+}
+
+// fetch returns the instruction at IP and the IP of the instruction following
+// it. Without decoded instructions the raw bytecode is decoded on the fly.
+func (f *Frame) fetch() (*Instruction, uint32, error) {
+	if f.Instructions != nil {
+		if int(f.IP) >= len(f.Instructions) {
+			return nil, 0, errEndOfCode
+		}
+		return &f.Instructions[f.IP], f.IP + 1, nil
+	}
+	n, err := decode(&f.insn, f.Class, f.Code, f.IP)
+	return &f.insn, f.IP + n, err
 }
 
 func (f *Frame) push(v Value) {
-	f.Stack = append(f.Stack, v)
+	if f.SP >= len(f.Stack) {
+		panic(stackError("operand stack overflow"))
+	}
+	f.Stack[f.SP] = v
+	f.SP++
 }
 
 func (f *Frame) pop() Value {
-	v := f.Stack[len(f.Stack)-1]
-	f.Stack = f.Stack[:len(f.Stack)-1]
+	if f.SP <= 0 {
+		panic(stackError("operand stack underflow"))
+	}
+	f.SP--
+	v := f.Stack[f.SP]
+	f.Stack[f.SP] = nil
 	return v
 }
 
+// sameRef reports whether two references point to the same object or array.
+// Arrays are the same if they share their backing, so slices with no
+// capacity, which the VM never creates, are never the same as any array.
+func sameRef(a, b Value) bool {
+	if x, ok := keyOf(a); ok {
+		y, ok := keyOf(b)
+		return ok && x == y && x.c > 0
+	} else if _, ok := keyOf(b); ok {
+		return false
+	}
+	return a == b
+}
+
+// f2i and f2l convert a float or double to an int or long like Java does,
+// which turns NaN into 0 and saturates values out of range.
+func f2i(f float64) int32 {
+	switch {
+	case f != f:
+		return 0
+	case f >= math.MaxInt32:
+		return math.MaxInt32
+	case f <= math.MinInt32:
+		return math.MinInt32
+	}
+	return int32(f)
+}
+
+func f2l(f float64) int64 {
+	switch {
+	case f != f:
+		return 0
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(f)
+}
+
+// fcmp compares floats or doubles for FCMPx and DCMPx, which differ in the
+// result if any of them is NaN.
+func fcmp(a, b float64, nan int32) int32 {
+	switch {
+	case a > b:
+		return 1
+	case a < b:
+		return -1
+	case a == b:
+		return 0
+	}
+	return nan
+}
+
+func category(v Value) int {
+	switch v.(type) {
+	case int64, float64:
+		return 2
+	}
+	return 1
+}
+
+// depth returns the size of the operand stack in slots.
+func (f *Frame) depth() (n int) {
+	for _, v := range f.Stack[:f.SP] {
+		n = n + category(v)
+	}
+	return n
+}
+
+// values returns the number of values below sp occupying exactly n slots.
+func (f *Frame) values(n, sp int) (count int) {
+	for slots := 0; slots < n; count++ {
+		if sp-count <= 0 {
+			panic(stackError("operand stack underflow"))
+		}
+		slots = slots + category(f.Stack[sp-count-1])
+		if slots > n {
+			panic(stackError("bad operand stack value category"))
+		}
+	}
+	return count
+}
+
+// popSlots pops values occupying n slots, as POP and POP2 do.
+func (f *Frame) popSlots(n int) {
+	for i := f.values(n, f.SP); i > 0; i-- {
+		f.pop()
+	}
+}
+
+// dupX duplicates the values in the top m slots and inserts them below the k
+// slots under them. All DUP opcodes are of this form.
+func (f *Frame) dupX(m, k int) {
+	top := f.values(m, f.SP)
+	below := f.values(k, f.SP-top)
+	if f.SP+top > len(f.Stack) {
+		panic(stackError("operand stack overflow"))
+	}
+	base := f.SP - top - below
+	copy(f.Stack[base+top:], f.Stack[base:f.SP])
+	copy(f.Stack[base:], f.Stack[f.SP:f.SP+top])
+	f.SP = f.SP + top
+}
+
+// popN removes n values from the stack and returns them in push order. The
+// returned slice is only valid until the next push.
+func (f *Frame) popN(n int) []Value {
+	if f.SP < n {
+		panic(stackError("operand stack underflow"))
+	}
+	f.SP -= n
+	return f.Stack[f.SP : f.SP+n]
+}
+
 type Object struct {
 	Class
 	ClassInstance *Object
 	SuperInstance *Object
 	Fields        map[string]Value
+	fieldsMu      sync.RWMutex        // guards Fields, which threads share
+	methods       map[[2]string]Field // by name and descriptor, and by name only
+	code          map[[2]string]*methodCode
+	proxy         func(args ...Value) (Value, error)
+	mon           *monitor
+	mirror        *Object     // java/lang/Class object of a class, see VM.mirror
+	payload       interface{} // Go state of built-in classes
+	finalizers    []func()    // see OnFinalize
+	init          *classInit  // nil for built-in classes, which need no <clinit>
+	slots         map[string]string
+	interfaces    []*Object
 }
 
+// newClass returns a class object, indexing its methods for Method.
+func newClass(c Class, super *Object) *Object {
+	o := &Object{
+		Class:         c,
+		SuperInstance: super,
+		Fields:        map[string]Value{},
+		methods:       map[[2]string]Field{},
+		slots:         map[string]string{},
+	}
+	if super != nil {
+		for name, key := range super.slots {
+			o.slots[name] = key
+		}
+	}
+	for _, f := range c.Fields {
+		if f.Flags&0x0008 == 0 { // ACC_STATIC
+			if _, ok := o.slots[f.Name]; ok {
+				o.slots[f.Name] = c.Name + "." + f.Name // hides a superclass field
+			} else {
+				o.slots[f.Name] = f.Name
+			}
+		}
+	}
+	for _, m := range c.Methods {
+		o.methods[[2]string{m.Name, m.Descriptor}] = m
+		if _, ok := o.methods[[2]string{m.Name, ""}]; !ok {
+			o.methods[[2]string{m.Name, ""}] = m
+		}
+		if data, ok := codeAttribute(m); ok {
+			if o.code == nil {
+				o.code = map[[2]string]*methodCode{}
+			}
+			o.code[[2]string{m.Name, m.Descriptor}] = parseCode(data)
+		}
+	}
+	return o
+}
+
+// New returns a new instance of the class, with its instance fields and the
+// ones inherited from superclasses set to their zero values. A field hiding
+// one of a superclass is kept in Fields as "Class.name", after its declaring
+// class, while Field and SetField use the declaration seen from the class of
+// the instance. Static fields are only kept in the Fields of the class object.
 func (o *Object) New() *Object {
-	return &Object{
+	obj := &Object{
 		Class:         o.Class,
 		ClassInstance: o,
 		Fields:        map[string]Value{},
+		methods:       o.methods,
+		code:          o.code,
+	}
+	for c := o; c != nil; c = c.SuperInstance {
+		for _, f := range c.Class.Fields {
+			if f.Flags&0x0008 == 0 { // ACC_STATIC
+				if z := zeroValue(f.Descriptor); z != nil {
+					obj.Fields[c.slot(f.Name)] = z
+				}
+			}
+		}
 	}
+	return obj
+}
+
+// fieldValue normalizes a value stored in a field, so that booleans read back
+// as 0 or 1 and bytes, shorts and chars are truncated to their size.
+func fieldValue(v Value, desc string) Value {
+	n, ok := v.(int32)
+	if !ok || len(desc) != 1 {
+		return v
+	}
+	switch desc[0] {
+	case 'Z':
+		return boolValue(n != 0)
+	case 'B':
+		return int32(int8(n))
+	case 'S':
+		return int32(int16(n))
+	case 'C':
+		return int32(uint16(n))
+	}
+	return v
+}
+
+// zeroValue returns the default value of a field of the given type.
+func zeroValue(desc string) Value {
+	switch desc[0] {
+	case 'B', 'C', 'I', 'S', 'Z':
+		return int32(0)
+	case 'J':
+		return int64(0)
+	case 'F':
+		return float32(0)
+	case 'D':
+		return float64(0)
+	}
+	return nil
 }
 
 func (o *Object) Const(index uint16) Value {
+	switch c := o.ConstPool[index-1]; c.Tag {
+	case TagInteger:
+		return c.Integer
+	case TagFloat:
+		return c.Float
+	case TagLong:
+		return c.Long
+	case TagDouble:
+		return c.Double
+	}
 	return o.ConstPool.Resolve(index)
 }
 
+// Field returns the value of a field of an object, or a static field of a
+// class object. Field and SetField may be called while threads run, unlike
+// accessing Fields directly.
 func (o *Object) Field(name string) Value {
-	return o.Fields[name]
+	if o.ClassInstance != nil {
+		name = o.ClassInstance.slot(name)
+	}
+	return o.getField(name)
 }
 
 func (o *Object) SetField(name string, value Value) {
-	o.Fields[name] = value
+	if o.ClassInstance != nil {
+		name = o.ClassInstance.slot(name)
+	}
+	o.putField(name, value)
+}
+
+// getField and putField read and write Fields by key, under the field lock.
+func (o *Object) getField(key string) Value {
+	o.fieldsMu.RLock()
+	v := o.Fields[key]
+	o.fieldsMu.RUnlock()
+	return v
+}
+
+func (o *Object) putField(key string, value Value) {
+	o.fieldsMu.Lock()
+	o.Fields[key] = value
+	o.fieldsMu.Unlock()
+}
+
+// copyFields returns a copy of Fields, read under the field lock.
+func (o *Object) copyFields() map[string]Value {
+	o.fieldsMu.RLock()
+	defer o.fieldsMu.RUnlock()
+	m := make(map[string]Value, len(o.Fields))
+	for k, v := range o.Fields {
+		m[k] = v
+	}
+	return m
+}
+
+// SetField sets a field of an object, or a static field of a class object,
+// like the Object method. If CheckFinal is set, final fields can only be set
+// with force.
+func (vm *VM) SetField(obj *Object, name string, value Value, force bool) error {
+	c := obj
+	if obj.ClassInstance != nil {
+		c = obj.ClassInstance
+	}
+	if owner, f, ok := declaredField(c, name); ok {
+		if vm.CheckFinal && !force {
+			if err := checkFinal(nil, "", owner, f); err != nil {
+				return err
+			}
+		}
+		value = fieldValue(value, f.Descriptor)
+	}
+	obj.SetField(name, value)
+	return nil
+}
+
+// slot returns the key in Fields of the instance field name as seen from the
+// class c, which may be declared by a superclass.
+func (c *Object) slot(name string) string {
+	if key, ok := c.slots[name]; ok {
+		return key
+	}
+	return name
 }
 
 func (o *Object) Method(name, desc string) (Field, error) {
+	if o.methods != nil {
+		if m, ok := o.methods[[2]string{name, desc}]; ok {
+			return m, nil
+		}
+		return Field{}, errors.New("method not found")
+	}
 	for _, m := range o.Methods {
 		if m.Name == name && (desc == "" || desc == m.Descriptor) {
 			return m, nil
@@ -63,86 +472,813 @@ func (o *Object) Method(name, desc string) (Field, error) {
 	return Field{}, errors.New("method not found")
 }
 
+// ErrIllegalAccess is returned when CheckAccess is set and bytecode resolves
+// a field or method it has no access to, or when CheckFinal is set and a final
+// field is assigned outside of an initializer, like IllegalAccessError in Java.
+var ErrIllegalAccess = errors.New("illegal access")
+
+// declaredField finds the declaration of a field in class c, its interfaces or
+// its superclasses, in the order of JVM field resolution, and returns the
+// declaring class.
+func declaredField(c *Object, name string) (*Object, Field, bool) {
+	for ; c != nil; c = c.SuperInstance {
+		for _, f := range c.Class.Fields {
+			if f.Name == name {
+				return c, f, true
+			}
+		}
+		for _, i := range c.interfaces {
+			if owner, f, ok := declaredField(i, name); ok {
+				return owner, f, true
+			}
+		}
+	}
+	return nil, Field{}, false
+}
+
+// checkFinal reports whether code in method of class caller may assign field
+// f declared by class c. Final instance fields may only be assigned by the
+// constructors of c, final static fields by its static initializer.
+func checkFinal(caller *Object, method string, c *Object, f Field) error {
+	if f.Flags&0x0010 == 0 { // ACC_FINAL
+		return nil
+	}
+	if caller != nil && caller.ClassInstance != nil {
+		caller = caller.ClassInstance
+	}
+	init := "<init>"
+	if f.Flags&0x0008 != 0 { // ACC_STATIC
+		init = "<clinit>"
+	}
+	if caller == c && method == init {
+		return nil
+	}
+	from := "Go"
+	if caller != nil {
+		from = caller.Name + "." + method
+	}
+	return fmt.Errorf("%w to final field %s.%s from %s", ErrIllegalAccess, c.Name, f.Name, from)
+}
+
+// checkAccess reports whether code in class caller may access member m
+// declared by class c.
+func checkAccess(caller, c *Object, m Field) error {
+	if caller.ClassInstance != nil {
+		caller = caller.ClassInstance
+	}
+	switch {
+	case caller == c || m.Flags&0x0001 != 0: // ACC_PUBLIC
+		return nil
+	case m.Flags&0x0002 != 0: // ACC_PRIVATE
+	case packageName(caller.Name) == packageName(c.Name):
+		return nil
+	case m.Flags&0x0004 != 0: // ACC_PROTECTED
+		for s := caller.SuperInstance; s != nil; s = s.SuperInstance {
+			if s == c {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w to %s.%s from %s", ErrIllegalAccess, c.Name, m.Name, caller.Name)
+}
+
+func packageName(class string) string {
+	if i := strings.LastIndexByte(class, '/'); i >= 0 {
+		return class[:i]
+	}
+	return ""
+}
+
+// virtual finds the implementation of a method for an object of class c,
+// searching its superclasses and then the default methods of its interfaces.
+// Abstract methods are skipped.
+func virtual(c *Object, name, desc string) (*Object, Field, bool) {
+	for k := c; k != nil; k = k.SuperInstance {
+		if m, err := k.Method(name, desc); err == nil && m.Flags&0x0400 == 0 { // ACC_ABSTRACT
+			return k, m, true
+		}
+	}
+	if i, m, ok := interfaceMethod(c, name, desc); ok && m.Flags&0x0400 == 0 {
+		return i, m, true
+	}
+	return nil, Field{}, false
+}
+
+// special returns the class where INVOKESPECIAL starts looking up a method
+// named in class c. When the caller has ACC_SUPER set and c is one of its
+// superclasses, the lookup starts at the caller's direct superclass instead,
+// so that super.m() finds the closest override of m. The receiver's class is
+// never used, unlike in virtual.
+func special(caller, c *Object) *Object {
+	if caller == nil || caller.Class.Flags&0x0020 == 0 || caller.SuperInstance == nil { // ACC_SUPER
+		return c
+	}
+	for k := caller.SuperInstance; k != nil; k = k.SuperInstance {
+		if k == c {
+			return caller.SuperInstance
+		}
+	}
+	return c
+}
+
+// interfaceMethod finds the most specific declaration of a method in the
+// interfaces implemented by class c, preferring default methods to abstract
+// ones. Static and private interface methods are not inherited.
+func interfaceMethod(c *Object, name, desc string) (*Object, Field, bool) {
+	var found *Object
+	var fm Field
+	var visit func(ifaces []*Object)
+	visit = func(ifaces []*Object) {
+		for _, i := range ifaces {
+			m, err := i.Method(name, desc)
+			if err == nil && m.Flags&0x000A == 0 { // ACC_PRIVATE, ACC_STATIC
+				abstract, foundAbstract := m.Flags&0x0400 != 0, fm.Flags&0x0400 != 0
+				if found == nil || (foundAbstract && !abstract) || (foundAbstract == abstract && extends(i, found)) {
+					found, fm = i, m
+				}
+			}
+			visit(i.interfaces)
+		}
+	}
+	for k := c; k != nil; k = k.SuperInstance {
+		visit(k.interfaces)
+	}
+	return found, fm, found != nil
+}
+
+// extends reports whether interface i is a subinterface of interface j.
+func extends(i, j *Object) bool {
+	for _, k := range i.interfaces {
+		if k == j || extends(k, j) {
+			return true
+		}
+	}
+	return false
+}
+
 type VM struct {
-	ClassPath []string
-	Classes   []*Object
-	Native    map[string]func(...Value) Value
+	ClassPath     []string
+	Classes       []*Object
+	Native        map[string]func(...Value) Value
+	RawBytecode   bool // interpret bytecode directly instead of decoding methods once
+	CheckAccess   bool // enforce private, protected and package access to members
+	CheckFinal    bool // allow final fields to be assigned only by initializers
+	StrictOpcodes bool // fail on unimplemented opcodes instead of skipping them
+	StrictFields  bool // fail to Marshal or Unmarshal Go fields missing in Java
+	CountOpcodes  bool // count executed opcodes, see OpcodeCoverage
+	// DefaultCallTimeout, if positive, bounds the time of every call from
+	// Go, like CallTimeout.
+	DefaultCallTimeout time.Duration
+	// MaxCallAllocations and MaxCallAllocatedBytes, if positive, limit the
+	// number of objects and arrays, and the estimated bytes of arrays,
+	// allocated by bytecode during a call from Go, including the methods
+	// it calls. Allocations beyond them throw OutOfMemoryError.
+	MaxCallAllocations    int64
+	MaxCallAllocatedBytes int64
+	// StrictClassPath makes loading a class fail if its class file is found
+	// in more than one of the searched class path entries.
+	StrictClassPath bool
+	// OnDuplicateClass, if set, is called with the class path entries having
+	// a class file for the class, in search order, when there are several of
+	// them. The first one is loaded, unless StrictClassPath is set. It's
+	// called with the class list locked, so it must not use the VM.
+	OnDuplicateClass func(class string, paths []string)
+	// ClassPathOrder, if set, returns the class path entries to search for
+	// a class, in order. By default ClassPath is searched in order.
+	ClassPathOrder func(class string, paths []string) []string
+	// ReinitializeOnReload makes ReloadClass reset the static fields of the
+	// class and run its static initializer again.
+	ReinitializeOnReload bool
+	// Stdout and Stderr are written to by System.out and System.err.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Env holds the environment variables that System.getenv reads, none by
+	// default. HostEnv copies variables of the process.
+	Env map[string]string
+	// Clock is the time source of System.currentTimeMillis and nanoTime.
+	Clock Clock
+	// Heap allocates the objects and arrays created by bytecode.
+	Heap Heap
+	// Policy, if set, restricts the classes and natives that can be used.
+	Policy *Policy
+	// OnEnter and OnExit, if set, are called when a method, interpreted or
+	// native, is entered and when it returns or fails.
+	OnEnter func(class, method, desc string)
+	OnExit  func(class, method, desc string, result Value, err error)
+	// OnUncaught, if set, is called with the Thread object and the error
+	// when a thread started by Thread.start fails. By default the error is
+	// printed to Stderr.
+	OnUncaught func(thread *Object, err error)
+
+	classesMu      sync.RWMutex // guards Classes and loading
+	loading        map[string]bool
+	nativeMu       sync.RWMutex // guards Native, contextNatives, cloners and recording
+	strings        map[string]*Object
+	stringsMu      sync.Mutex
+	properties     *properties
+	builtins       int // number of built-in classes at the start of Classes
+	objectClass    *Object
+	stringClass    *Object
+	classClass     *Object
+	mirrorsMu      sync.Mutex
+	arrayMirrors   map[string]*Object
+	natives        map[string]func(t *thread, args ...Value) (Value, error)
+	contextNatives map[string]func(ctx *NativeContext, args ...Value) (Value, error)
+	cloners        map[string]func(v interface{}) interface{}
+	recording      *recording
+	main           *Object
+	mainOnce       sync.Once
+	threadCount    int32
+	running        int32     // calls and threads in progress, see Reset
+	started        time.Time // origin of System.nanoTime
+	opcodes        [256]int64
 }
 
 func New(classPath ...string) *VM {
 	vm := &VM{
 		ClassPath: classPath,
+		Stdout:    os.Stdout,
+		Stderr:    os.Stderr,
+		Clock:     realClock{},
+		Heap:      goHeap{},
+		started:   time.Now(),
 		Classes: []*Object{
-			&Object{
-				Class: Class{
-					Name:    "java/lang/Object",
-					Methods: []Field{{Name: "<init>", Descriptor: "()V"}},
+			newClass(Class{
+				Name: "java/lang/Object",
+				Methods: []Field{
+					{Name: "<init>", Descriptor: "()V"},
+					{Name: "equals", Descriptor: "(Ljava/lang/Object;)Z"},
+					{Name: "hashCode", Descriptor: "()I"},
+					{Name: "toString", Descriptor: "()Ljava/lang/String;"},
+					{Flags: 0x0104, Name: "clone", Descriptor: "()Ljava/lang/Object;"},
+					{Flags: 0x0111, Name: "getClass", Descriptor: "()Ljava/lang/Class;"},
+					{Flags: 0x0111, Name: "wait", Descriptor: "()V"},
+					{Flags: 0x0111, Name: "wait", Descriptor: "(J)V"},
+					{Flags: 0x0111, Name: "wait", Descriptor: "(JI)V"},
+					{Flags: 0x0111, Name: "notify", Descriptor: "()V"},
+					{Flags: 0x0111, Name: "notifyAll", Descriptor: "()V"},
 				},
-			},
+			}, nil),
 		},
-		Native: map[string]func(...Value) Value{},
+		Native:         map[string]func(...Value) Value{},
+		natives:        map[string]func(t *thread, args ...Value) (Value, error){},
+		contextNatives: map[string]func(ctx *NativeContext, args ...Value) (Value, error){},
+		cloners:        map[string]func(v interface{}) interface{}{},
+		strings:        map[string]*Object{},
+		loading:        map[string]bool{},
 	}
+	vm.objectClass = vm.Classes[0]
 	vm.RegisterNative("java/lang/Object", "<init>", "()V", func(...Value) Value {
 		return nil
 	})
+	vm.RegisterNative("java/lang/Object", "equals", "(Ljava/lang/Object;)Z", func(args ...Value) Value {
+		return boolValue(sameRef(args[0], args[1]))
+	})
+	vm.RegisterNative("java/lang/Object", "hashCode", "()I", func(args ...Value) Value {
+		return identityHash(args[0])
+	})
+	vm.RegisterNative("java/lang/Object", "toString", "()Ljava/lang/String;", func(args ...Value) Value {
+		if obj, ok := args[0].(*Object); ok {
+			return vm.newString(obj.String())
+		}
+		return vm.newString(fmt.Sprintf("%s@%p", arrayDesc(args[0]), args[0]))
+	})
+	vm.defineLang()
+	vm.builtins = len(vm.Classes)
 	return vm
 }
 
-func (vm *VM) RegisterNative(class, method, desc string, f func(...Value) Value) {
-	vm.Native[class+"."+method] = f
+// Reset forgets all classes loaded from the class path or added with
+// DefineClass, keeping only the built-in ones. Classes are loaded and
+// initialized again on next use, so their static fields start over from the
+// values set by their static initializers. Interned strings, the main thread
+// and opcode counts are dropped too. The class path, registered natives and
+// options are kept. Objects created before the reset still refer to their old
+// classes. Reset fails if methods are running, including started threads and
+// unfinished Executions.
+func (vm *VM) Reset() error {
+	vm.classesMu.Lock()
+	defer vm.classesMu.Unlock()
+	if atomic.LoadInt32(&vm.running) > 0 {
+		return errors.New("can't reset while methods are running")
+	}
+	for i := vm.builtins; i < len(vm.Classes); i++ {
+		vm.Classes[i] = nil
+	}
+	vm.Classes = vm.Classes[:vm.builtins]
+	vm.stringsMu.Lock()
+	vm.strings = map[string]*Object{}
+	vm.stringsMu.Unlock()
+	vm.mirrorsMu.Lock()
+	vm.arrayMirrors = map[string]*Object{}
+	vm.mirrorsMu.Unlock()
+	vm.main, vm.mainOnce = nil, sync.Once{}
+	atomic.StoreInt32(&vm.threadCount, 0)
+	for op := range vm.opcodes {
+		atomic.StoreInt64(&vm.opcodes[op], 0)
+	}
+	return nil
+}
+
+// Unload forgets a class loaded from the class path or added with
+// DefineClass, so that it's loaded again on next use and its memory can be
+// collected. Instances of the class keep working, as they refer to the class
+// object they were created with. A class can't be unloaded while other loaded
+// classes extend or implement it.
+func (vm *VM) Unload(name string) error {
+	n, err := vm.unload(func(s string) bool { return s == name })
+	if err == nil && n == 0 {
+		return fmt.Errorf("class %s is not loaded", name)
+	}
+	return err
+}
+
+// UnloadMatching is like Unload for all the classes whose names start with
+// the prefix, such as a package of generated classes, which may depend on each
+// other. If any of them can't be unloaded, none is. It returns the number of
+// classes unloaded.
+func (vm *VM) UnloadMatching(prefix string) (int, error) {
+	return vm.unload(func(s string) bool { return strings.HasPrefix(s, prefix) })
+}
+
+func (vm *VM) unload(match func(name string) bool) (int, error) {
+	vm.classesMu.Lock()
+	defer vm.classesMu.Unlock()
+	unloaded := map[*Object]bool{}
+	for i, c := range vm.Classes {
+		if !match(c.Name) {
+			continue
+		} else if i < vm.builtins {
+			return 0, fmt.Errorf("can't unload built-in class %s", c.Name)
+		}
+		unloaded[c] = true
+	}
+	for _, c := range vm.Classes[vm.builtins:] {
+		if unloaded[c] {
+			continue
+		} else if unloaded[c.SuperInstance] {
+			return 0, fmt.Errorf("can't unload %s: %s extends it", c.SuperInstance.Name, c.Name)
+		}
+		for _, i := range c.interfaces {
+			if unloaded[i] {
+				return 0, fmt.Errorf("can't unload %s: %s implements it", i.Name, c.Name)
+			}
+		}
+	}
+	kept := vm.Classes[:vm.builtins]
+	for _, c := range vm.Classes[vm.builtins:] {
+		if !unloaded[c] {
+			kept = append(kept, c)
+		}
+	}
+	for i := len(kept); i < len(vm.Classes); i++ {
+		vm.Classes[i] = nil
+	}
+	vm.Classes = kept
+	return len(unloaded), nil
+}
+
+// OpcodeCoverage returns how many times each opcode was executed while
+// CountOpcodes was set, including unimplemented opcodes that were skipped.
+func (vm *VM) OpcodeCoverage() map[byte]int {
+	counts := map[byte]int{}
+	for op := range vm.opcodes {
+		if n := atomic.LoadInt64(&vm.opcodes[op]); n > 0 {
+			counts[byte(op)] = int(n)
+		}
+	}
+	return counts
+}
+
+// LoadedClasses returns the classes loaded so far, including the built-in
+// ones, in the order they were loaded.
+func (vm *VM) LoadedClasses() []*Object {
+	vm.classesMu.RLock()
+	defer vm.classesMu.RUnlock()
+	return append([]*Object{}, vm.Classes...)
+}
+
+// PreloadAll loads every class file found in the class path directories,
+// with its superclasses and interfaces, without initializing it, and returns
+// the errors of the classes that fail to load, in class path order. A class
+// found in several entries is loaded once, from the entry Class would use.
+func (vm *VM) PreloadAll() []error {
+	var errs []error
+	for _, dir := range vm.ClassPath {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				errs = append(errs, err)
+				return nil
+			} else if info.IsDir() || filepath.Ext(path) != ".class" || info.Name() == "module-info.class" {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				errs = append(errs, err)
+				return nil
+			}
+			if _, err := vm.resolve(strings.TrimSuffix(filepath.ToSlash(rel), ".class")); err != nil {
+				errs = append(errs, err)
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// RegisterNative sets the Go function implementing a native method. It's safe
+// to call while other goroutines run code, unlike writing to Native directly.
+// Natives of instance methods get the receiver as args[0], which is never
+// null: calling them on null throws NullPointerException.
+func (vm *VM) RegisterNative(class, method, desc string, f func(...Value) Value) {
+	vm.nativeMu.Lock()
+	vm.Native[class+"."+method] = f
+	vm.nativeMu.Unlock()
+}
+
+// registerNative registers a built-in native, which gets the calling thread
+// and may fail. Returning an *Exception throws it. The method name may be
+// followed by a descriptor to register overloads separately.
+func (vm *VM) registerNative(class, method string, f func(t *thread, args ...Value) (Value, error)) {
+	vm.natives[class+"."+method] = f
+}
+
+// Class returns the class with the given name, loading it from the class path
+// and initializing it if needed.
+func (vm *VM) Class(name string) (*Object, error) {
+	c, err := vm.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.initialize(nil, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// resolve returns the class with the given name, loading it from the class
+// path if needed, but doesn't initialize it. Goroutines resolving the same
+// class at once load it only once. It fails if the Policy denies the class.
+func (vm *VM) resolve(name string) (*Object, error) {
+	if err := vm.checkClass(name); err != nil {
+		return nil, err
+	}
+	return vm.resolveClass(name)
+}
+
+// resolveClass is like resolve, regardless of the Policy.
+func (vm *VM) resolveClass(name string) (*Object, error) {
+	vm.classesMu.RLock()
+	c := vm.findClass(name)
+	vm.classesMu.RUnlock()
+	if c != nil {
+		return c, nil
+	}
+	vm.classesMu.Lock()
+	defer vm.classesMu.Unlock()
+	return vm.load(name)
+}
+
+// validClassName reports whether name is a binary class name that can be
+// looked up in the class path: slash-separated, with no empty, "." or ".."
+// segments, nor backslashes or colons, so that it can't refer to a file
+// outside of a class path entry on any OS.
+func validClassName(name string) bool {
+	if strings.ContainsAny(name, "\\:\x00") {
+		return false
+	}
+	for _, s := range strings.Split(name, "/") {
+		if s == "" || s == "." || s == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// classFilePath returns the OS path of the class file of a valid class name
+// in the class path directory dir.
+func classFilePath(dir, name string) string {
+	return filepath.Join(append([]string{dir}, strings.Split(name+".class", "/")...)...)
+}
+
+func (vm *VM) findClass(name string) *Object {
+	for _, c := range vm.Classes {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// load is like resolve, with classesMu held.
+func (vm *VM) load(name string) (*Object, error) {
+	if c := vm.findClass(name); c != nil {
+		return c, nil
+	}
+	if !validClassName(name) {
+		return nil, fmt.Errorf("invalid class name %q", name)
+	}
+	c, err := vm.readClass(name)
+	if err != nil {
+		return nil, err
+	}
+	return vm.defineClass(c)
+}
+
+// readClass parses the class file of the named class, found on the class
+// path by findClassFile.
+func (vm *VM) readClass(name string) (Class, error) {
+	file, paths, err := vm.findClassFile(name)
+	if err != nil {
+		return Class{}, err
+	} else if file == "" {
+		return Class{}, &ClassNotFoundError{Name: name, Searched: paths}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return Class{}, &ClassNotFoundError{Name: name, Searched: paths, File: file, Err: err}
+	}
+	defer f.Close()
+	c, err := Load(f)
+	if err == nil && c.Name != name {
+		err = fmt.Errorf("it declares class %s", c.Name)
+	}
+	if err != nil {
+		return Class{}, &ClassNotFoundError{Name: name, Searched: paths, File: file, Err: err}
+	}
+	return c, nil
+}
+
+// findClassFile returns the class file of the named class in the first class
+// path entry that has one, or "" if none has, and the entries searched in
+// order.
+func (vm *VM) findClassFile(name string) (string, []string, error) {
+	paths := vm.ClassPath
+	if vm.ClassPathOrder != nil {
+		paths = vm.ClassPathOrder(name, append([]string{}, paths...))
+	}
+	var found []string
+	for _, path := range paths {
+		if _, err := os.Stat(classFilePath(path, name)); err == nil {
+			found = append(found, path)
+			if !vm.StrictClassPath && vm.OnDuplicateClass == nil {
+				break
+			}
+		}
+	}
+	if len(found) > 1 {
+		if vm.OnDuplicateClass != nil {
+			vm.OnDuplicateClass(name, found)
+		}
+		if vm.StrictClassPath {
+			return "", paths, fmt.Errorf("duplicate class %s in %s", name, strings.Join(found, ", "))
+		}
+	}
+	if len(found) == 0 {
+		return "", paths, nil
+	}
+	return classFilePath(found[0], name), paths, nil
+}
+
+// neededBy adds to a ClassNotFoundError why the class was loaded.
+func neededBy(err error, via string) error {
+	if e, ok := err.(*ClassNotFoundError); ok {
+		e.Via = append(e.Via, via)
+	}
+	return err
+}
+
+// ClassNotFoundError is returned when a class can't be loaded from the class
+// path, because no entry has its class file or because the first one found
+// fails to load. Via tells why a class that wasn't directly requested was
+// loaded, such as "superclass of app/Sub", innermost first.
+type ClassNotFoundError struct {
+	Name     string
+	Searched []string // class path entries
+	File     string   // class file that failed to load
+	Err      error
+	Via      []string
+}
+
+func (e *ClassNotFoundError) Error() string {
+	var msg string
+	if e.Err != nil {
+		msg = fmt.Sprintf("can't load class %s from %s: %v", e.Name, e.File, e.Err)
+	} else if len(e.Searched) == 0 {
+		msg = "class " + e.Name + " not found, the class path is empty"
+	} else {
+		msg = "class " + e.Name + " not found in " + strings.Join(e.Searched, ", ")
+	}
+	if len(e.Via) > 0 {
+		msg += ", needed as " + strings.Join(e.Via, ", ")
+	}
+	return msg
+}
+
+func (e *ClassNotFoundError) Unwrap() error { return e.Err }
+
+// DefineClass adds a class that was loaded or assembled elsewhere, resolving
+// its superclass and running its static initializer.
+func (vm *VM) DefineClass(c Class) (*Object, error) {
+	vm.classesMu.Lock()
+	classObj, err := vm.defineClass(c)
+	vm.classesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.initialize(nil, classObj); err != nil {
+		return nil, err
+	}
+	return classObj, nil
+}
+
+// EnsureInitialized runs the static initializers of the class and its
+// superclasses, unless they already ran. Classes loaded by the interpreter
+// are initialized on first use, by NEW, GETSTATIC, PUTSTATIC and
+// INVOKESTATIC, and by the Call, Class and DefineClass methods.
+func (vm *VM) EnsureInitialized(c *Object) error {
+	return vm.initialize(nil, c)
 }
 
-func (vm *VM) Class(name string) (*Object, error) {
-	for _, c := range vm.Classes {
-		if c.Name == name {
-			return c, nil
-		}
+// defineClass adds a class without initializing it, with classesMu held. Its
+// superclass and interfaces are loaded first, unless one of them is the class
+// itself or depends on it.
+func (vm *VM) defineClass(c Class) (*Object, error) {
+	if vm.loading[c.Name] {
+		return nil, fmt.Errorf("class circularity: %s is its own superclass or superinterface", c.Name)
 	}
-	for _, path := range vm.ClassPath {
-		f, err := os.Open(filepath.Join(path, name+".class"))
+	vm.loading[c.Name] = true
+	defer delete(vm.loading, c.Name)
+	var super *Object
+	if c.Super != "" {
+		var err error
+		if err = vm.checkClass(c.Super); err == nil {
+			super, err = vm.load(c.Super)
+		}
 		if err != nil {
-			continue
+			return nil, neededBy(err, "superclass of "+c.Name)
 		}
-		c, err := Load(f)
-		f.Close()
+	}
+	var interfaces []*Object
+	for _, name := range c.Interfaces {
+		if err := vm.checkClass(name); err != nil {
+			return nil, err
+		}
+		i, err := vm.load(name)
 		if err != nil {
-			continue
+			return nil, neededBy(err, "interface of "+c.Name)
 		}
-		var super *Object
-		if c.Super != "" {
-			super, err = vm.Class(c.Super)
-			if err != nil {
-				return nil, err
+		interfaces = append(interfaces, i)
+	}
+	classObj := newClass(c, super)
+	classObj.interfaces = interfaces
+	classObj.init = &classInit{}
+	classObj.init.cond.L = &classObj.init.mu
+	for _, f := range c.Fields {
+		if f.Flags&0x0008 != 0 { // ACC_STATIC
+			vm.initStatic(classObj, f)
+		}
+	}
+	vm.Classes = append(vm.Classes, classObj)
+	return classObj, nil
+}
+
+// initStatic sets the static field f of the class to its ConstantValue, or
+// to its zero value.
+func (vm *VM) initStatic(c *Object, f Field) {
+	if z := zeroValue(f.Descriptor); z != nil {
+		c.Fields[f.Name] = z
+	}
+	for _, a := range f.Attributes {
+		if a.Name == "ConstantValue" && len(a.Data) == 2 {
+			v := c.Const(binary.BigEndian.Uint16(a.Data))
+			if s, ok := v.(string); ok {
+				v = vm.InternString(s)
 			}
+			c.Fields[f.Name] = v
 		}
-		classObj := &Object{
-			Class:         c,
-			SuperInstance: super,
-			Fields:        map[string]Value{},
+	}
+}
+
+// classInit is the initialization state of a class. While <clinit> runs,
+// owner is the thread that runs it. A failed initialization is not retried.
+type classInit struct {
+	mu    sync.Mutex
+	cond  sync.Cond
+	done  int32 // set atomically once <clinit> has returned
+	owner *thread
+	err   error
+}
+
+// initialize runs the static initializer of the class, after the ones of its
+// superclasses, unless it's already done or in progress, on behalf of the
+// thread t, which is nil when called from Go. A class being initialized by t,
+// or by a thread t runs nested in, is used as is, while other threads wait
+// for the initialization to finish.
+func (vm *VM) initialize(t *thread, c *Object) error {
+	ci := c.init
+	if ci == nil {
+		return nil
+	} else if atomic.LoadInt32(&ci.done) == 1 {
+		return ci.err
+	}
+	if c.SuperInstance != nil {
+		if err := vm.initialize(t, c.SuperInstance); err != nil {
+			return err
 		}
-		vm.Classes = append(vm.Classes, classObj)
-		if m, err := classObj.Method("<clinit>", "()V"); err == nil {
-			if _, err := vm.callMethod(classObj, m); err != nil {
-				return nil, err
-			}
+	}
+	ci.mu.Lock()
+	for ci.owner != nil {
+		if t.within(ci.owner) {
+			ci.mu.Unlock()
+			return nil
 		}
-		return classObj, nil
+		ci.cond.Wait()
+	}
+	if ci.done == 1 {
+		ci.mu.Unlock()
+		return ci.err
+	}
+	if t == nil {
+		t = &thread{}
+	}
+	ci.owner = t
+	ci.mu.Unlock()
+
+	var err error
+	if m, e := c.Method("<clinit>", "()V"); e == nil {
+		_, err = vm.callFrom(t, c, m)
 	}
-	return nil, errors.New("class not found")
+
+	ci.mu.Lock()
+	ci.owner, ci.err = nil, err
+	atomic.StoreInt32(&ci.done, 1)
+	ci.cond.Broadcast()
+	ci.mu.Unlock()
+	return err
 }
 
 func (vm *VM) Call(class, method string, args ...Value) (Value, error) {
+	return vm.CallDesc(class, method, "", args...)
+}
+
+// CallDesc is like Call, but resolves the method by its exact descriptor, such
+// as "(I)I", to pick one of several overloads. An empty descriptor matches the
+// first method with the given name.
+func (vm *VM) CallDesc(class, method, desc string, args ...Value) (Value, error) {
 	c, err := vm.Class(class)
 	if err != nil {
 		return nil, err
 	}
-	m, err := c.Method(method, "")
+	m, err := c.Method(method, desc)
 	if err != nil {
 		return nil, err
 	}
+	if args, err = vm.convertArgs(m, args); err != nil {
+		return nil, err
+	}
 	return vm.callMethod(c, m, args...)
 }
 
+// Invoker calls a method resolved once by Resolve, which saves looking up the
+// class and the method on every call.
+type Invoker struct {
+	vm     *VM
+	class  *Object
+	method Field
+	params []string
+}
+
+// Resolve finds a method like CallDesc and returns an Invoker to call it
+// repeatedly.
+func (vm *VM) Resolve(class, method, desc string) (Invoker, error) {
+	c, err := vm.Class(class)
+	if err != nil {
+		return Invoker{}, err
+	}
+	m, err := c.Method(method, desc)
+	if err != nil {
+		return Invoker{}, err
+	}
+	params, _, err := parseDescriptor(m.Descriptor)
+	if err != nil {
+		return Invoker{}, err
+	}
+	return Invoker{vm: vm, class: c, method: m, params: params}, nil
+}
+
+// Invoke calls the method, converting the arguments like Call.
+func (i Invoker) Invoke(args ...Value) (Value, error) {
+	args, err := i.vm.convertParams(i.method, i.params, args)
+	if err != nil {
+		return nil, err
+	}
+	return i.vm.callMethod(i.class, i.method, args...)
+}
+
 func argc(desc string) (n int) {
 	inClass := false
 	for i := 1; i < len(desc); i++ {
@@ -154,6 +1290,8 @@ func argc(desc string) (n int) {
 		}
 		if desc[i] == ')' {
 			return n
+		} else if desc[i] == '[' {
+			continue // counted with the component type
 		} else if desc[i] == 'L' {
 			inClass = true
 		}
@@ -162,40 +1300,404 @@ func argc(desc string) (n int) {
 	return 0
 }
 
+// argSlots returns the number of local slots taken by the arguments in a
+// method descriptor, where longs and doubles take two.
+func argSlots(desc string) (n int) {
+	params, _, _ := parseDescriptor(desc)
+	for _, p := range params {
+		if p == "J" || p == "D" {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// CallMethod calls a method of the object's class, or one inherited from its
+// superclasses. Instance methods take the receiver as the first argument.
 func (vm *VM) CallMethod(obj *Object, method, desc string, args ...Value) (Value, error) {
-	m, err := obj.Method(method, desc)
+	c := obj
+	if obj.ClassInstance != nil {
+		c = obj.ClassInstance
+	}
+	c, m, ok := virtual(c, method, desc)
+	if !ok {
+		return nil, errors.New("method not found")
+	}
+	args, err := vm.convertArgs(m, args)
 	if err != nil {
 		return nil, err
 	}
-	return vm.callMethod(obj, m, args...)
+	return vm.callMethod(c, m, args...)
 }
 
 func (vm *VM) callMethod(obj *Object, m Field, args ...Value) (Value, error) {
+	return vm.callLimited(vm.DefaultCallTimeout, obj, m, args...)
+}
+
+// callFrom is like callMethod, but runs the method nested in the parent thread.
+// The arguments must match the descriptor, with the receiver first for
+// instance methods.
+func (vm *VM) callFrom(parent *thread, obj *Object, m Field, args ...Value) (res Value, err error) {
+	atomic.AddInt32(&vm.running, 1)
+	defer atomic.AddInt32(&vm.running, -1)
+	if err := checkArgc(m, args); err != nil {
+		return nil, err
+	}
+	vm.enter(obj.Name, m)
+	if code, ok := obj.codeOf(m); ok {
+		var frame *Frame
+		if frame, err = vm.methodFrame(obj, m, code, args); err == nil {
+			res, err = vm.runOn(parent, nil, frame)
+		}
+	} else if mon := vm.syncMonitor(obj, m, args); mon != nil {
+		t := &thread{}
+		mon.enter(t)
+		res, err = vm.callNative(nil, obj, m, args)
+		mon.exit(t)
+	} else {
+		res, err = vm.callNative(nil, obj, m, args)
+	}
+	vm.exit(obj.Name, m, res, err)
+	return res, err
+}
+
+// checkArgc checks the number of arguments of a call of m, including the
+// receiver of instance methods, which is reported when it's missing.
+func checkArgc(m Field, args []Value) error {
+	receiver := 1
+	if m.Flags&0x0008 != 0 { // ACC_STATIC
+		receiver = 0
+	}
+	if n := argc(m.Descriptor); len(args) != receiver+n {
+		if receiver == 1 && len(args) == n {
+			return fmt.Errorf("%s%s takes %d arguments, got %d without a receiver", m.Name, m.Descriptor, n, n)
+		}
+		got := len(args) - receiver
+		if got < 0 {
+			got = 0
+		}
+		return fmt.Errorf("%s%s takes %d arguments, got %d", m.Name, m.Descriptor, n, got)
+	}
+	return nil
+}
+
+// enter and exit call the OnEnter and OnExit hooks, if set.
+func (vm *VM) enter(class string, m Field) {
+	if vm.OnEnter != nil {
+		vm.OnEnter(class, m.Name, m.Descriptor)
+	}
+}
+
+func (vm *VM) exit(class string, m Field, res Value, err error) {
+	if vm.OnExit != nil {
+		vm.OnExit(class, m.Name, m.Descriptor, res, err)
+	}
+}
+
+// callNative calls a native method. Built-in natives registered with
+// registerNative get the calling thread, which is nil when called from Go.
+// Go bools returned by other natives become int32 booleans. Natives
+// registered with RegisterNativeFunc take precedence over Native. Calls are
+// logged or replayed by Record and Replay, once the Policy allowed them.
+func (vm *VM) callNative(t *thread, obj *Object, m Field, args []Value) (Value, error) {
+	var receiver *Object
+	if m.Flags&0x0008 == 0 { // ACC_STATIC
+		if len(args) == 0 || sameRef(args[0], nil) {
+			return nil, &Exception{Object: vm.newThrowable("java/lang/NullPointerException",
+				"null receiver of native "+obj.Name+"."+m.Name)}
+		}
+		receiver, _ = args[0].(*Object)
+	}
+	if err := vm.checkNative(obj, m); err != nil {
+		return nil, err
+	}
+	vm.nativeMu.RLock()
+	r := vm.recording
+	vm.nativeMu.RUnlock()
+	if r != nil && vm.recorded(obj, m) {
+		return r.call(vm, obj, m, args, func() (Value, error) {
+			return vm.dispatchNative(t, obj, m, receiver, args)
+		})
+	}
+	return vm.dispatchNative(t, obj, m, receiver, args)
+}
+
+func (vm *VM) dispatchNative(t *thread, obj *Object, m Field, receiver *Object, args []Value) (Value, error) {
+	if f, ok := vm.natives[obj.Name+"."+m.Name+m.Descriptor]; ok {
+		return f(t, args...)
+	}
+	if f, ok := vm.natives[obj.Name+"."+m.Name]; ok {
+		return f(t, args...)
+	}
+	vm.nativeMu.RLock()
+	cf, ok := vm.contextNatives[obj.Name+"."+m.Name+m.Descriptor]
+	if !ok {
+		cf, ok = vm.contextNatives[obj.Name+"."+m.Name]
+	}
+	f, found := vm.Native[obj.Name+"."+m.Name]
+	vm.nativeMu.RUnlock()
+	if ok {
+		res, err := cf(&NativeContext{VM: vm, Class: obj, Receiver: receiver, t: t}, args...)
+		if b, ok := res.(bool); ok {
+			res = boolValue(b)
+		}
+		return ownArray(res), err
+	} else if !found {
+		return nil, noCode(obj, m)
+	}
+	res := f(args...)
+	if b, ok := res.(bool); ok {
+		return boolValue(b), nil
+	}
+	return ownArray(res), nil
+}
+
+// noCode returns the error for calling a method of class c that has no code
+// nor native function, telling why from the method flags.
+func noCode(c *Object, m Field) error {
+	name := c.Name + "." + m.Name + m.Descriptor
+	switch {
+	case m.Flags&0x0400 != 0: // ACC_ABSTRACT
+		return fmt.Errorf("abstract method %s has no code", name)
+	case m.Flags&0x0100 != 0: // ACC_NATIVE
+		return fmt.Errorf("native method %s is not registered", name)
+	}
+	return fmt.Errorf("method %s has no code", name)
+}
+
+func codeAttribute(m Field) ([]byte, bool) {
 	for _, a := range m.Attributes {
 		if a.Name == "Code" && len(a.Data) > 8 {
-			maxLocals := binary.BigEndian.Uint16(a.Data[2:4])
-			frame := Frame{
-				Class:  obj,
-				Code:   a.Data[8:],
-				Locals: make([]Value, maxLocals, maxLocals),
-			}
-			for i := 0; i < len(args); i++ {
-				frame.Locals[i] = args[i]
-			}
-			return vm.exec(frame)
+			return a.Data, true
 		}
 	}
-	f, ok := vm.Native[obj.Name+"."+m.Name]
-	if ok {
-		return f(args...), nil
+	return nil, false
+}
+
+// methodCode is the parsed Code attribute of a method. Methods are parsed
+// once by newClass, and decoded the first time they are called. If the code
+// can't be decoded, instructions is nil and err tells why: the method is
+// interpreted from raw bytecode, which reports the error when it's reached,
+// unless StrictOpcodes is set.
+type methodCode struct {
+	maxStack, maxLocals int
+	bytecode            []byte // nil if the attribute is truncated
+	once                sync.Once
+	instructions        []Instruction
+	err                 error
+}
+
+// decode decodes the code of a method of the class, once.
+func (code *methodCode) decode(class *Object) ([]Instruction, error) {
+	code.once.Do(func() { code.instructions, code.err = decodeMethod(class, code.bytecode) })
+	return code.instructions, code.err
+}
+
+func parseCode(data []byte) *methodCode {
+	code := &methodCode{
+		maxStack:  int(binary.BigEndian.Uint16(data[0:2])),
+		maxLocals: int(binary.BigEndian.Uint16(data[2:4])),
+	}
+	if n := binary.BigEndian.Uint32(data[4:8]); uint64(len(data)) >= 8+uint64(n) {
+		code.bytecode = data[8 : 8+n]
+	}
+	return code
+}
+
+// codeOf returns the Code attribute of a method of the class, or false if
+// it has none, such as native and abstract methods.
+func (o *Object) codeOf(m Field) (*methodCode, bool) {
+	if code, ok := o.code[[2]string{m.Name, m.Descriptor}]; ok {
+		return code, true
+	}
+	if data, ok := codeAttribute(m); ok {
+		return parseCode(data), true
+	}
+	return nil, false
+}
+
+// methodFrame returns a new frame for the method with the arguments stored in
+// its locals. The receiver of an instance method, which callFrom counts in
+// the arguments, is in slot 0 and the parameters follow. Long and double
+// arguments take two local slots, of which the second one is left empty, so
+// that locals are numbered like in the bytecode.
+func (vm *VM) methodFrame(obj *Object, m Field, code *methodCode, args []Value) (*Frame, error) {
+	if code.bytecode == nil {
+		return nil, errors.New("bad code attribute")
+	}
+	var insns []Instruction
+	if !vm.RawBytecode {
+		var err error
+		if insns, err = code.decode(obj); err != nil && vm.StrictOpcodes {
+			return nil, fmt.Errorf("can't decode %s.%s%s: %v", obj.Name, m.Name, m.Descriptor, err)
+		}
+	}
+	frame := newFrame(obj, m, code.bytecode, code.maxLocals, code.maxStack)
+	frame.Instructions = insns
+	for i, slot := 0, 0; i < len(args); i, slot = i+1, slot+category(args[i]) {
+		if slot >= len(frame.Locals) {
+			freeFrame(frame)
+			return nil, errors.New("arguments exceed max_locals")
+		}
+		frame.Locals[slot] = args[i]
+	}
+	frame.lock = vm.syncMonitor(obj, m, args)
+	return frame, nil
+}
+
+// EvalMethod runs raw bytecode as the body of a method of an empty class,
+// with maxLocals local slots and room for maxStack values on the operand
+// stack, and returns its result. The args are stored in the locals one per
+// slot, without conversion, and there can't be more of them than maxLocals.
+// The code has no constant pool, so it can't refer to classes, methods or
+// constants. It's decoded first unless RawBytecode is set, and interpreted
+// from raw bytecode if decoding fails.
+func (vm *VM) EvalMethod(code []byte, maxLocals, maxStack int, args ...Value) (Value, error) {
+	if len(args) > maxLocals {
+		return nil, errors.New("too many arguments")
+	}
+	frame := newFrame(newClass(Class{Name: "<eval>"}, nil), Field{Name: "<eval>"}, code, maxLocals, maxStack)
+	if !vm.RawBytecode {
+		if insns, err := decodeMethod(frame.Class, code); err == nil {
+			frame.Instructions = insns
+		}
+	}
+	copy(frame.Locals, args)
+	return vm.run(frame)
+}
+
+// thread executes methods on an explicit stack of frames, so that calls
+// between interpreted methods don't recurse in Go.
+//
+// A thread is also the owner of the monitors it enters. Java threads keep
+// their java/lang/Thread object in java, it's nil when called from Go. A
+// thread started by another one to run a static initializer keeps it in
+// parent.
+type thread struct {
+	frames  []*Frame
+	java    *Object
+	parent  *thread
+	watched bool        // limited or with a deadline, see tick
+	limited bool        // exec stops when budget is exhausted, see Execution
+	budget  int64       // instructions left to execute
+	ex      *Execution  // running on the thread, natives can suspend it
+	limits  *callLimits // of the call from Go, shared with nested threads
+	ticks   int
+}
+
+// within reports whether t is the thread other or runs nested in it.
+func (t *thread) within(other *thread) bool {
+	for ; t != nil; t = t.parent {
+		if t == other {
+			return true
+		}
+	}
+	return false
+}
+
+var threadPool = sync.Pool{New: func() interface{} { return &thread{} }}
+
+// run executes the frame, and all the frames it calls, to completion.
+func (vm *VM) run(frame *Frame) (Value, error) {
+	return vm.runOn(nil, nil, frame)
+}
+
+// runOn is like run, but nested in the parent thread, if any, and on behalf
+// of the given java/lang/Thread object, which defaults to the parent's.
+func (vm *VM) runOn(parent *thread, java *Object, frame *Frame) (Value, error) {
+	atomic.AddInt32(&vm.running, 1)
+	defer atomic.AddInt32(&vm.running, -1)
+	t := threadPool.Get().(*thread)
+	if java == nil && parent != nil {
+		java = parent.java
+	}
+	t.java, t.parent = java, parent
+	if parent != nil && parent.limits != nil {
+		t.limits, t.watched = parent.limits, !parent.limits.deadline.IsZero()
+	}
+	t.push(frame)
+	res, err := vm.exec(t)
+	vm.unwind(t, err)
+	t.java, t.parent = nil, nil
+	t.watched, t.limits, t.ticks = false, nil, 0
+	threadPool.Put(t)
+	return res, err
+}
+
+// unwind pops all the frames of a thread after exec returned, calling the
+// OnExit hook for the ones still running if it failed.
+func (vm *VM) unwind(t *thread, err error) {
+	for i := len(t.frames) - 1; i > 0 && err != nil; i-- {
+		vm.exit(t.frames[i].Class.Name, t.frames[i].Method, nil, err)
+	}
+	for i, f := range t.frames {
+		t.release(f)
+		freeFrame(f)
+		t.frames[i] = nil
+	}
+	t.frames = t.frames[:0]
+}
+
+// fail turns err into a VMError at the current instruction of the topmost
+// frame, with a trace of all the frames of the thread.
+func (t *thread) fail(msg string, err error) error {
+	if e, ok := err.(*VMError); ok {
+		return e
+	}
+	if err != nil {
+		msg = err.Error()
 	}
-	return nil, errors.New("method code not found")
+	frame := t.frames[len(t.frames)-1]
+	e := &VMError{Class: frame.Class.Name, Method: frame.Method.Name, IP: frame.at, Msg: msg, Err: err}
+	for i := len(t.frames) - 1; i >= 0; i-- {
+		f := t.frames[i]
+		e.Trace = append(e.Trace, fmt.Sprintf("%s.%s+%d", f.Class.Name, f.Method.Name, f.at))
+	}
+	return e
 }
 
-func (vm *VM) exec(frame Frame) (Value, error) {
+// exec runs the topmost frame of the thread. Invocations of interpreted
+// methods push a new frame, returns pop it and pass the result to the caller.
+// The bottom frame is left on the thread when it returns.
+func (vm *VM) exec(t *thread) (result Value, err error) {
+	frame := t.frames[len(t.frames)-1]
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(stackError)
+			if !ok {
+				panic(r)
+			}
+			result, err = nil, t.fail(string(e), nil)
+		}
+	}()
 	for {
-		op := frame.Code[frame.IP]
+		ins, next, err := frame.fetch()
+		if err != nil {
+			return nil, t.fail("", err)
+		}
+		frame.at = ins.IP
+		if t.watched {
+			if err := t.tick(); err == errSuspended {
+				return nil, err
+			} else if err != nil {
+				return nil, t.fail("", err)
+			}
+		}
+		op := ins.Op
+		if vm.CountOpcodes {
+			atomic.AddInt64(&vm.opcodes[op], 1)
+		}
 		//log.Printf("%02x %v", op, frame.Stack)
+		if (op >= 0x2E && op <= 0x35) || (op >= 0x4F && op <= 0x56) { // xALOAD, xASTORE
+			if class, msg := checkIndex(frame, op >= 0x4F); class != "" {
+				if frame, err = vm.throw(t, vm.newThrowable(class, msg)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
 		switch op {
 		//
 		// Constants
@@ -232,24 +1734,34 @@ func (vm *VM) exec(frame Frame) (Value, error) {
 		case 0x0F: // DCONST_1
 			frame.push(1.0)
 		case 0x10: // BIPUSH
-			frame.push(int8(frame.Code[frame.IP+1]))
-			frame.IP = frame.IP + 1
+			frame.push(ins.Arg)
 		case 0x11: // SIPUSH
-			frame.push(int16(binary.BigEndian.Uint16(frame.Code[frame.IP+1:])))
-			frame.IP = frame.IP + 2
-		case 0x12: // LDC
-			frame.push(frame.Class.Const(uint16(frame.Code[frame.IP+1])))
-			frame.IP = frame.IP + 1
-		case 0x13, 0x14: // LDC_W, LDC2_W
-			frame.push(frame.Class.Const(uint16(frame.Code[frame.IP+1])))
-			frame.IP = frame.IP + 1
+			frame.push(ins.Arg)
+		case 0x12, 0x13, 0x14: // LDC, LDC_W, LDC2_W
+			if ins.Ref != nil {
+				desc, err := vm.classType(ins.Ref.Class)
+				if err != nil {
+					return nil, t.fail("", err)
+				}
+				if desc[0] == '[' {
+					frame.push(vm.arrayMirror(desc))
+				} else {
+					c, _ := vm.resolve(ins.Ref.Class)
+					frame.push(vm.mirror(c))
+				}
+			} else if s, ok := ins.Const.(string); ok {
+				frame.push(vm.InternString(s))
+			} else {
+				frame.push(ins.Const)
+			}
 
 		//
 		// Loads
 		//
+		// A long or double is kept whole in the first of its two slots, so the
+		// loads and stores of all types are the same.
 		case 0x15, 0x16, 0x17, 0x18, 0x19: // ILOAD, LLOAD, FLOAD, DLOAD, ALOAD
-			frame.push(frame.Locals[frame.Code[frame.IP+1]])
-			frame.IP = frame.IP + 1
+			frame.push(frame.Locals[ins.Arg])
 		case 0x1A, 0x1E, 0x22, 0x26, 0x2A: // ILOAD_0, LLOAD_0, FLOAD_0, DLOAD_0, ALOAD_0
 			frame.push(frame.Locals[0])
 		case 0x1B, 0x1F, 0x23, 0x27, 0x2B: // ILOAD_1, LLOAD_1, FLOAD_1, DLOAD_1, ALOAD_1
@@ -258,46 +1770,124 @@ func (vm *VM) exec(frame Frame) (Value, error) {
 			frame.push(frame.Locals[2])
 		case 0x1D, 0x21, 0x25, 0x29, 0x2D: // ILOAD_3, LLOAD_3, FLOAD_3, DLOAD_3, ALOAD_3
 			frame.push(frame.Locals[3])
-		case 0x2E, 0x2F, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35: // IALOAD, LALOAD, FALOAD, DALOAD, AALOAD, BALOAD, CALOAD, SALOAD
-			a := frame.pop().([]Value)
-			i := frame.pop().(int32) // XXX other index types?
+		case 0x2E: // IALOAD
+			i := frame.pop().(int32)
+			frame.push(frame.pop().([]int32)[i])
+		case 0x2F: // LALOAD
+			i := frame.pop().(int32)
+			frame.push(frame.pop().([]int64)[i])
+		case 0x30: // FALOAD
+			i := frame.pop().(int32)
+			frame.push(frame.pop().([]float32)[i])
+		case 0x31: // DALOAD
+			i := frame.pop().(int32)
+			frame.push(frame.pop().([]float64)[i])
+		case 0x32: // AALOAD
+			i := frame.pop().(int32)
+			a, _ := arrayValues(frame.pop())
 			frame.push(a[i])
+		case 0x33: // BALOAD
+			i := frame.pop().(int32)
+			switch a := frame.pop().(type) {
+			case []byte:
+				frame.push(int32(int8(a[i])))
+			case boolArray:
+				frame.push(int32(a[i]))
+			default:
+				return nil, t.fail(fmt.Sprintf("baload from %T", a), nil)
+			}
+		case 0x34: // CALOAD
+			i := frame.pop().(int32)
+			a := frame.pop().([]uint16)
+			frame.push(int32(a[i]))
+		case 0x35: // SALOAD
+			i := frame.pop().(int32)
+			frame.push(int32(frame.pop().([]int16)[i]))
 
 		//
 		// Stores
 		//
-		case 0x36: // ISTORE
-		case 0x37: // LSTORE
-		case 0x38: // FSTORE
-		case 0x39: // DSTORE
-		case 0x3A: // ASTORE
-		case 0x3B: // ISTORE_0
-		case 0x3C: // ISTORE_1
-		case 0x3D: // ISTORE_2
-		case 0x3E: // ISTORE_3
-		case 0x3F: // LSTORE_0
-		case 0x40: // LSTORE_1
-		case 0x41: // LSTORE_2
-		case 0x42: // LSTORE_3
-		case 0x43: // LSTORE_3
-		//...
-		case 0x4A: // DSTORE_3
-		case 0x4B: // ASTORE_0
-		case 0x4C: // ASTORE_1
-		case 0x4D: // ASTORE_2
-		case 0x4E: // ASTORE_3
+		case 0x36, 0x37, 0x38, 0x39, 0x3A: // ISTORE, LSTORE, FSTORE, DSTORE, ASTORE
+			frame.Locals[ins.Arg] = frame.pop()
+		case 0x3B, 0x3F, 0x43, 0x47, 0x4B: // ISTORE_0, LSTORE_0, FSTORE_0, DSTORE_0, ASTORE_0
+			frame.Locals[0] = frame.pop()
+		case 0x3C, 0x40, 0x44, 0x48, 0x4C: // ISTORE_1, LSTORE_1, FSTORE_1, DSTORE_1, ASTORE_1
+			frame.Locals[1] = frame.pop()
+		case 0x3D, 0x41, 0x45, 0x49, 0x4D: // ISTORE_2, LSTORE_2, FSTORE_2, DSTORE_2, ASTORE_2
+			frame.Locals[2] = frame.pop()
+		case 0x3E, 0x42, 0x46, 0x4A, 0x4E: // ISTORE_3, LSTORE_3, FSTORE_3, DSTORE_3, ASTORE_3
+			frame.Locals[3] = frame.pop()
 		case 0x4F: // IASTORE
-		//...
+			v := frame.pop().(int32)
+			i := frame.pop().(int32)
+			frame.pop().([]int32)[i] = v
+		case 0x50: // LASTORE
+			v := frame.pop().(int64)
+			i := frame.pop().(int32)
+			frame.pop().([]int64)[i] = v
+		case 0x51: // FASTORE
+			v := frame.pop().(float32)
+			i := frame.pop().(int32)
+			frame.pop().([]float32)[i] = v
+		case 0x52: // DASTORE
+			v := frame.pop().(float64)
+			i := frame.pop().(int32)
+			frame.pop().([]float64)[i] = v
 		case 0x53: // AASTORE
+			v := frame.pop()
+			i := frame.pop().(int32)
+			ref := frame.pop()
+			if a, ok := ref.(*Array); ok && !vm.canStore(v, a.Desc[1:]) {
+				if frame, err = vm.throw(t, vm.newThrowable("java/lang/ArrayStoreException", typeName(v))); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			a, _ := arrayValues(ref)
+			a[i] = v
+		case 0x54: // BASTORE
+			v := frame.pop().(int32)
+			i := frame.pop().(int32)
+			switch a := frame.pop().(type) {
+			case []byte:
+				a[i] = byte(v)
+			case boolArray:
+				a[i] = 0
+				if v != 0 {
+					a[i] = 1
+				}
+			default:
+				return nil, t.fail(fmt.Sprintf("bastore to %T", a), nil)
+			}
+		case 0x55: // CASTORE
+			v := frame.pop().(int32)
+			i := frame.pop().(int32)
+			a := frame.pop().([]uint16)
+			a[i] = uint16(v)
+		case 0x56: // SASTORE
+			v := frame.pop().(int32)
+			i := frame.pop().(int32)
+			frame.pop().([]int16)[i] = int16(v)
 
 		//
 		// Stack
 		//
 		case 0x57: // POP
+			frame.popSlots(1)
+		case 0x58: // POP2
+			frame.popSlots(2)
 		case 0x59: // DUP
-			value := frame.pop()
-			frame.push(value)
-			frame.push(value)
+			frame.dupX(1, 0)
+		case 0x5A: // DUP_X1
+			frame.dupX(1, 1)
+		case 0x5B: // DUP_X2
+			frame.dupX(1, 2)
+		case 0x5C: // DUP2
+			frame.dupX(2, 0)
+		case 0x5D: // DUP2_X1
+			frame.dupX(2, 1)
+		case 0x5E: // DUP2_X2
+			frame.dupX(2, 2)
 		case 0x5F: // SWAP
 			a := frame.pop()
 			b := frame.pop()
@@ -335,111 +1925,414 @@ func (vm *VM) exec(frame Frame) (Value, error) {
 			frame.push(frame.pop().(float32) * frame.pop().(float32))
 		case 0x6B: // DMUL
 			frame.push(frame.pop().(float64) * frame.pop().(float64))
-		case 0x6F: // DDIV
-		case 0x70: // IREM
 		case 0x84: // IINC
+			frame.Locals[ins.Arg] = frame.Locals[ins.Arg].(int32) + ins.Arg2
 
 		//
 		// Conversions
 		//
+		case 0x85: // I2L
+			frame.push(int64(frame.pop().(int32)))
+		case 0x86: // I2F
+			frame.push(float32(frame.pop().(int32)))
 		case 0x87: // I2D
+			frame.push(float64(frame.pop().(int32)))
+		case 0x88: // L2I
+			frame.push(int32(frame.pop().(int64)))
+		case 0x89: // L2F
+			frame.push(float32(frame.pop().(int64)))
+		case 0x8A: // L2D
+			frame.push(float64(frame.pop().(int64)))
+		case 0x8B: // F2I
+			frame.push(f2i(float64(frame.pop().(float32))))
+		case 0x8C: // F2L
+			frame.push(f2l(float64(frame.pop().(float32))))
+		case 0x8D: // F2D
+			frame.push(float64(frame.pop().(float32)))
+		case 0x8E: // D2I
+			frame.push(f2i(frame.pop().(float64)))
+		case 0x8F: // D2L
+			frame.push(f2l(frame.pop().(float64)))
+		case 0x90: // D2F
+			frame.push(float32(frame.pop().(float64)))
+		case 0x91: // I2B
+			frame.push(int32(int8(frame.pop().(int32))))
 		case 0x92: // I2C
+			frame.push(int32(uint16(frame.pop().(int32))))
+		case 0x93: // I2S
+			frame.push(int32(int16(frame.pop().(int32))))
 
 		//
 		// Comparisons
 		//
-		case 0x98: // DCMPG
-		case 0x9A: // IFNE
-		case 0x9B: // IFLT
-		case 0x9C: // IFGE
-		case 0x9E: // IFLE
-		case 0xA1: // IF_ICMPLT
-		case 0xA2: // IF_ICMPGE
-		case 0xA3: // IF_ICMPGT
-		case 0xA4: // IF_ICMPLE
+		case 0x94: // LCMP
+			a, b := frame.pop().(int64), frame.pop().(int64)
+			switch {
+			case b > a:
+				frame.push(int32(1))
+			case b < a:
+				frame.push(int32(-1))
+			default:
+				frame.push(int32(0))
+			}
+		case 0x95, 0x96: // FCMPL, FCMPG
+			a, b := frame.pop().(float32), frame.pop().(float32)
+			frame.push(fcmp(float64(b), float64(a), int32(op-0x95)*2-1))
+		case 0x97, 0x98: // DCMPL, DCMPG
+			a, b := frame.pop().(float64), frame.pop().(float64)
+			frame.push(fcmp(b, a, int32(op-0x97)*2-1))
+		case 0x99, 0x9A, 0x9B, 0x9C, 0x9D, 0x9E: // IFEQ, IFNE, IFLT, IFGE, IFGT, IFLE
+			v := frame.pop().(int32)
+			if (op == 0x99 && v == 0) || (op == 0x9A && v != 0) ||
+				(op == 0x9B && v < 0) || (op == 0x9C && v >= 0) ||
+				(op == 0x9D && v > 0) || (op == 0x9E && v <= 0) {
+				next = ins.Target
+			}
+		case 0x9F, 0xA0, 0xA1, 0xA2, 0xA3, 0xA4: // IF_ICMPEQ, IF_ICMPNE, IF_ICMPLT, IF_ICMPGE, IF_ICMPGT, IF_ICMPLE
+			b, a := frame.pop().(int32), frame.pop().(int32)
+			if (op == 0x9F && a == b) || (op == 0xA0 && a != b) ||
+				(op == 0xA1 && a < b) || (op == 0xA2 && a >= b) ||
+				(op == 0xA3 && a > b) || (op == 0xA4 && a <= b) {
+				next = ins.Target
+			}
+		case 0xA5, 0xA6: // IF_ACMPEQ, IF_ACMPNE
+			b, a := frame.pop(), frame.pop()
+			if sameRef(a, b) == (op == 0xA5) {
+				next = ins.Target
+			}
+		case 0xC6, 0xC7: // IFNULL, IFNONNULL
+			if sameRef(frame.pop(), nil) == (op == 0xC6) {
+				next = ins.Target
+			}
 
 		//
 		// Controls
 		//
 		case 0xA7: // GOTO
-			branch := uint32(binary.BigEndian.Uint16(frame.Code[frame.IP+1:]))
-			frame.IP = frame.IP - 3 + branch
-		case 0xA8: // JSR
-		case 0xA9: // RET
-		case 0xAC, 0xAD, 0xAE, 0xAF, 0xB0: // IRETURN, LRETURN, FRETURN, DRETURN, ARETURN
-			return frame.pop(), nil
-		case 0xB1: // RETURN
-			return nil, nil
+			next = ins.Target
+		case 0xAC, 0xAD, 0xAE, 0xAF, 0xB0, 0xB1: // IRETURN, LRETURN, FRETURN, DRETURN, ARETURN, RETURN
+			var res Value
+			if op != 0xB1 {
+				res = frame.pop()
+			}
+			if len(t.frames) == 1 {
+				return res, nil
+			}
+			vm.exit(frame.Class.Name, frame.Method, res, nil)
+			t.frames[len(t.frames)-1] = nil
+			t.frames = t.frames[:len(t.frames)-1]
+			t.release(frame)
+			freeFrame(frame)
+			frame = t.frames[len(t.frames)-1]
+			if op != 0xB1 {
+				frame.push(res)
+			}
+			continue
 
 		//
 		// References
 		//
-		case 0xB2, 0xB3, 0xB4, 0xB5, 0xB6, 0xB7, 0xB8:
-			cp := frame.Class.ConstPool
-			index := uint16(binary.BigEndian.Uint16(frame.Code[frame.IP+1:]))
-			frame.IP = frame.IP + 2
-			ref := cp[index-1]
-			className := cp.Resolve(ref.ClassIndex)
-			name := cp.Resolve(cp[ref.NameAndTypeIndex-1].NameIndex)
-			desc := cp.Resolve(cp[ref.NameAndTypeIndex-1].DescIndex)
-			c, err := vm.Class(className)
+		case 0xB2, 0xB3, 0xB4, 0xB5, 0xB6, 0xB7, 0xB8, 0xB9:
+			className, name, desc := ins.Ref.Class, ins.Ref.Name, ins.Ref.Desc
+			if className[0] == '[' && op == 0xB6 {
+				// Methods of arrays, such as clone()
+				args := frame.popN(argc(desc) + 1)
+				res, err := vm.arrayMethod(t, name, desc, args)
+				if exc, ok := err.(*Exception); ok {
+					if frame, err = vm.throw(t, exc.Object); err != nil {
+						return nil, err
+					}
+					continue
+				} else if err != nil {
+					return nil, t.fail("", err)
+				}
+				if desc[len(desc)-1] != 'V' {
+					frame.push(res)
+				}
+				break
+			}
+			c, err := vm.resolve(className)
+			if err == nil && (op == 0xB2 || op == 0xB3) {
+				// Static fields live in, and initialize, the declaring class.
+				if owner, _, ok := declaredField(c, name); ok {
+					c = owner
+				}
+			}
+			if err == nil && (op == 0xB2 || op == 0xB3 || op == 0xB8) {
+				err = vm.initialize(t, c)
+			}
 			if err != nil {
-				return nil, err
+				return nil, t.fail("", err)
+			}
+			if (vm.CheckAccess || vm.CheckFinal) && op < 0xB6 {
+				if owner, f, ok := declaredField(c, name); ok {
+					if vm.CheckAccess {
+						err = checkAccess(frame.Class, owner, f)
+					}
+					if err == nil && vm.CheckFinal && (op == 0xB3 || op == 0xB5) {
+						err = checkFinal(frame.Class, frame.Method.Name, owner, f)
+					}
+					if err != nil {
+						return nil, t.fail("", err)
+					}
+				}
 			}
 			switch op {
 			case 0xB2: // GETSTATIC
 				frame.push(c.Field(name))
 			case 0xB3: // PUTSTATIC
-				c.SetField(name, frame.pop())
+				c.SetField(name, fieldValue(frame.pop(), desc))
 			case 0xB4: // GETFIELD
-				obj := frame.pop().(*Object)
-				frame.push(obj.Field(name))
+				obj, _ := frame.pop().(*Object)
+				if obj == nil {
+					if frame, err = vm.throw(t, vm.newThrowable("java/lang/NullPointerException", "getfield "+name)); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				frame.push(obj.getField(c.slot(name)))
 			case 0xB5: // PUTFIELD
-				value := frame.pop()
-				obj := frame.pop().(*Object)
-				obj.SetField(name, value)
-			case 0xB6: // INVOKEVIRTUAL
-				n := argc(desc)
-				res, err := vm.CallMethod(c, name, desc, frame.Stack[len(frame.Stack)-n-1:]...)
+				value := fieldValue(frame.pop(), desc)
+				obj, _ := frame.pop().(*Object)
+				if obj == nil {
+					if frame, err = vm.throw(t, vm.newThrowable("java/lang/NullPointerException", "putfield "+name)); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				obj.putField(c.slot(name), value)
+			case 0xB6, 0xB7, 0xB8, 0xB9: // INVOKEVIRTUAL, INVOKESPECIAL, INVOKESTATIC, INVOKEINTERFACE
+				if op == 0xB7 && name != "<init>" {
+					c = special(frame.Class, c)
+				}
+				m, err := c.Method(name, desc)
+				for k := c.SuperInstance; err != nil && k != nil; k = k.SuperInstance {
+					if m, err = k.Method(name, desc); err == nil {
+						c = k
+					}
+				}
 				if err != nil {
-					return nil, err
+					if i, im, ok := interfaceMethod(c, name, desc); ok {
+						c, m, err = i, im, nil
+					}
 				}
-				frame.Stack = frame.Stack[:len(frame.Stack)-n]
-				_ = res
-			case 0xB7: // INVOKESPECIAL
-				n := argc(desc)
-				res, err := vm.CallMethod(c, name, desc, frame.Stack[len(frame.Stack)-n-1:]...)
 				if err != nil {
-					return nil, err
+					return nil, t.fail("", err)
+				}
+				if vm.CheckAccess {
+					if err := checkAccess(frame.Class, c, m); err != nil {
+						return nil, t.fail("", err)
+					}
 				}
-				frame.Stack = frame.Stack[:len(frame.Stack)-n]
-				_ = res
-			case 0xB8: // INVOKESTATIC
 				n := argc(desc)
-				res, err := vm.CallMethod(c, name, desc, frame.Stack[len(frame.Stack)-n:]...)
-				if err != nil {
-					return nil, err
+				if op != 0xB8 {
+					n++ // receiver
+				}
+				args := frame.popN(n)
+				if op != 0xB8 && args[0] == nil {
+					if frame, err = vm.throw(t, vm.newThrowable("java/lang/NullPointerException", "invoke "+name)); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				var recv *Object
+				if op == 0xB6 || op == 0xB9 {
+					recv, _ = args[0].(*Object)
+				}
+				if recv != nil && recv.proxy != nil {
+					vm.enter(recv.Name, m)
+					res, err := vm.callProxy(t, recv, name, desc, args)
+					vm.exit(recv.Name, m, res, err)
+					if err != nil {
+						return nil, t.fail("", err)
+					}
+					if desc[len(desc)-1] != 'V' {
+						frame.push(res)
+					}
+					break
+				}
+				if recv != nil && recv.ClassInstance != nil {
+					if k, km, ok := virtual(recv.ClassInstance, name, desc); ok {
+						c, m = k, km
+					}
+				}
+				if code, ok := c.codeOf(m); ok {
+					callee, err := vm.methodFrame(c, m, code, args)
+					if err != nil {
+						return nil, t.fail("", err)
+					}
+					vm.enter(c.Name, m)
+					frame.IP = next
+					t.push(callee)
+					frame = callee
+					continue
+				}
+				vm.enter(c.Name, m)
+				mon := vm.syncMonitor(c, m, args)
+				if mon != nil {
+					mon.enter(t)
+				}
+				res, err := vm.callNative(t, c, m, args)
+				if mon != nil {
+					mon.exit(t)
+				}
+				if err == errNativeSuspended && t.ex != nil {
+					frame.IP = next
+					t.ex.waiting = &waitingNative{class: c, method: m}
+					return nil, errSuspended
+				}
+				vm.exit(c.Name, m, res, err)
+				if exc, ok := err.(*Exception); ok {
+					if frame, err = vm.throw(t, exc.Object); err != nil {
+						return nil, err
+					}
+					continue
+				} else if err != nil {
+					return nil, t.fail("", err)
+				}
+				if desc[len(desc)-1] != 'V' {
+					frame.push(res)
 				}
-				frame.Stack = frame.Stack[:len(frame.Stack)-n]
-				_ = res
 			}
-		case 0xB9: // INVOKEINTERFACE
-		case 0xBA: // INVOKEDYNAMIC
 		case 0xBB: // NEW
-			cp := frame.Class.ConstPool
-			index := uint16(binary.BigEndian.Uint16(frame.Code[frame.IP+1:]))
-			frame.IP = frame.IP + 2
-			className := cp.Resolve(cp[index-1].NameIndex)
-			c, err := vm.Class(className)
+			c, err := vm.resolve(ins.Ref.Class)
+			if err == nil && c.Flags&0x0600 != 0 { // ACC_INTERFACE, ACC_ABSTRACT
+				exc := vm.newThrowable("java/lang/InstantiationError", strings.Replace(c.Name, "/", ".", -1))
+				if frame, err = vm.throw(t, exc); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err == nil {
+				err = vm.initialize(t, c)
+			}
 			if err != nil {
-				return nil, err
+				return nil, t.fail("", err)
+			}
+			obj, err := vm.alloc(t, c)
+			if exc, ok := err.(*Exception); ok {
+				if frame, err = vm.throw(t, exc.Object); err != nil {
+					return nil, err
+				}
+				continue
+			} else if err != nil {
+				return nil, t.fail("", err)
 			}
-			obj := c.New()
 			frame.push(obj)
 		case 0xBC: // NEWARRAY
+			n := frame.pop().(int32)
+			if n < 0 {
+				if frame, err = vm.throw(t, vm.newThrowable("java/lang/NegativeArraySizeException", fmt.Sprint(n))); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if int(ins.Arg) >= len(arrayTypes) || arrayTypes[ins.Arg] == "" {
+				return nil, t.fail(fmt.Sprintf("bad array type %d", ins.Arg), nil)
+			}
+			a, err := vm.allocArray(t, arrayTypes[ins.Arg], int(n))
+			if exc, ok := err.(*Exception); ok {
+				if frame, err = vm.throw(t, exc.Object); err != nil {
+					return nil, err
+				}
+				continue
+			} else if err != nil {
+				return nil, t.fail("", err)
+			}
+			frame.push(a)
 		case 0xBD: // ANEWARRAY
+			n := frame.pop().(int32)
+			if n < 0 {
+				if frame, err = vm.throw(t, vm.newThrowable("java/lang/NegativeArraySizeException", fmt.Sprint(n))); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			desc, err := vm.classType(ins.Ref.Class)
+			if err != nil {
+				return nil, t.fail("", err)
+			}
+			a, err := vm.allocArray(t, "["+desc, int(n))
+			if exc, ok := err.(*Exception); ok {
+				if frame, err = vm.throw(t, exc.Object); err != nil {
+					return nil, err
+				}
+				continue
+			} else if err != nil {
+				return nil, t.fail("", err)
+			}
+			frame.push(a)
 		case 0xBE: // ARRAYLENGTH
+			ref := frame.pop()
+			n, ok := arrayLength(ref)
+			if !ok {
+				if ref == nil {
+					if frame, err = vm.throw(t, vm.newThrowable("java/lang/NullPointerException", "arraylength")); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				return nil, t.fail(fmt.Sprintf("arraylength of %T", ref), nil)
+			}
+			frame.push(int32(n))
+		case 0xBF: // ATHROW
+			exc, _ := frame.pop().(*Object)
+			if exc == nil {
+				exc = vm.newThrowable("java/lang/NullPointerException", "athrow")
+			}
+			if frame, err = vm.throw(t, exc); err != nil {
+				return nil, err
+			}
+			continue
+		case 0xC0, 0xC1: // CHECKCAST, INSTANCEOF
+			desc, err := vm.classType(ins.Ref.Class)
+			if err != nil {
+				return nil, t.fail("", err)
+			}
+			v := frame.pop()
+			ok := vm.canStore(v, desc)
+			if op == 0xC1 {
+				frame.push(boolValue(ok && !sameRef(v, nil)))
+			} else if !ok {
+				if frame, err = vm.throw(t, vm.newThrowable("java/lang/ClassCastException", typeName(v)+" cannot be cast to "+ins.Ref.Class)); err != nil {
+					return nil, err
+				}
+				continue
+			} else {
+				frame.push(v)
+			}
+		case 0xC2, 0xC3: // MONITORENTER, MONITOREXIT
+			mon := monitorOf(frame.pop())
+			var exc *Object
+			if mon == nil {
+				exc = vm.newThrowable("java/lang/NullPointerException", "monitor")
+			} else if op == 0xC2 {
+				mon.enter(t)
+				frame.blocks = append(frame.blocks, mon)
+			} else if !mon.exit(t) {
+				exc = vm.newThrowable("java/lang/IllegalMonitorStateException", "")
+			} else {
+				for i := len(frame.blocks) - 1; i >= 0; i-- {
+					if frame.blocks[i] == mon {
+						frame.blocks = append(frame.blocks[:i], frame.blocks[i+1:]...)
+						break
+					}
+				}
+			}
+			if mon != nil {
+				mon.drop(1)
+			}
+			if exc != nil {
+				if frame, err = vm.throw(t, exc); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		default:
+			if vm.StrictOpcodes {
+				return nil, t.fail(fmt.Sprintf("unimplemented opcode 0x%02x at IP %d", op, ins.IP), nil)
+			}
 		}
-		frame.IP++
+		frame.IP = next
 	}
 }
@@ -1,9 +1,24 @@
 package tojvm
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func runtimeLog(args ...Value) Value {
@@ -66,7 +81,8 @@ func TestSub(t *testing.T) {
 func TestHello(t *testing.T) {
 	vm := New("testdata")
 	vm.RegisterNative("Runtime", "log", "(Ljava/lang/String;)V", runtimeLog)
-	if res, err := vm.Call("FieldsAndMethods", "hello"); err != nil {
+	obj, _ := vm.Call("FieldsAndMethods", "create")
+	if res, err := vm.Call("FieldsAndMethods", "hello", obj); err != nil {
 		t.Error(err)
 	} else if res != nil {
 		t.Error(res)
@@ -75,8 +91,9 @@ func TestHello(t *testing.T) {
 
 func TestStaticFields(t *testing.T) {
 	vm := New("testdata")
+	obj, _ := vm.Call("FieldsAndMethods", "create")
 	for i := 0; i < 3; i++ {
-		if res, err := vm.Call("FieldsAndMethods", "incrementB"); err != nil {
+		if res, err := vm.Call("FieldsAndMethods", "incrementB", obj); err != nil {
 			t.Error(err)
 		} else if res != nil {
 			t.Error(res)
@@ -106,3 +123,4946 @@ func TestInstanceFields(t *testing.T) {
 		t.Error(obj.Fields)
 	}
 }
+
+func TestEvalMethod(t *testing.T) {
+	vm := New()
+	// iload_0, iload_1, iadd, ireturn
+	if res, err := vm.EvalMethod([]byte{0x1A, 0x1B, 0x60, 0xAC}, 2, 2, int32(2), int32(3)); err != nil {
+		t.Error(err)
+	} else if n, ok := res.(int32); !ok || n != int32(5) {
+		t.Error(res)
+	}
+	// iconst_2, iconst_3, iadd, iconst_4, iadd, ireturn
+	if res, err := vm.EvalMethod([]byte{0x05, 0x06, 0x60, 0x07, 0x60, 0xAC}, 0, 2); err != nil {
+		t.Error(err)
+	} else if n, ok := res.(int32); !ok || n != int32(9) {
+		t.Error(res)
+	}
+	// iconst_1 without a return
+	if _, err := vm.EvalMethod([]byte{0x04}, 0, 1); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := vm.EvalMethod([]byte{0xB1}, 1, 0, int32(1), int32(2)); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// fibClass assembles a class with a recursive static method equivalent to:
+//
+//	static int fib(int n) {
+//		if (n - 2 < 0) return n;
+//		return fib(n - 1) + fib(n - 2);
+//	}
+//	static void nop() {}
+func fibClass() Class {
+	a := &Assembler{}
+	recurse := a.Label()
+	// IFGE
+	a.Iload(0).Iconst(2).Isub().Branch(0x9C, recurse).
+		Iload(0).Ireturn()
+	a.Mark(recurse).
+		Iload(0).Iconst(1).Isub().Invoke(0xB8, "Fib", "fib", "(I)I").
+		Iload(0).Iconst(2).Isub().Invoke(0xB8, "Fib", "fib", "(I)I").
+		Iadd().Ireturn().
+		Method(0x0009, "fib", "(I)I", 3, 1)
+	a.Return().Method(0x0009, "nop", "()V", 0, 0)
+	return a.Class(0x0021, "Fib", "java/lang/Object")
+}
+
+func TestFib(t *testing.T) {
+	vm := New()
+	if _, err := vm.DefineClass(fibClass()); err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range []int32{0, 1, 1, 2, 3, 5, 8, 13, 21, 34, 55} {
+		if res, err := vm.Call("Fib", "fib", int32(n)); err != nil || res != want {
+			t.Error(n, res, err)
+		}
+	}
+}
+
+func TestFreeFrame(t *testing.T) {
+	obj := &Object{}
+	f := newFrame(obj, Field{Name: "test"}, []byte{0xB1}, 2, 4)
+	f.Locals[1] = obj
+	f.push(obj)
+	f.push(obj)
+	f.pop()
+	freeFrame(f)
+	if f.Class != nil || f.Method.Name != "" || f.Code != nil || len(f.Locals) != 0 || len(f.Stack) != 0 || f.SP != 0 {
+		t.Error(f)
+	}
+	for _, v := range append(f.Locals[:cap(f.Locals)], f.Stack[:cap(f.Stack)]...) {
+		if v != nil {
+			t.Error(v)
+		}
+	}
+}
+
+// BenchmarkFib allocates about once for each int above 255 computed by fib,
+// which is boxed into a Value. Frames are pooled.
+func BenchmarkFib(b *testing.B) {
+	vm := New()
+	if _, err := vm.DefineClass(fibClass()); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := vm.Call("Fib", "fib", int32(15)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCallOverhead(b *testing.B) {
+	vm := New()
+	if _, err := vm.DefineClass(fibClass()); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := vm.Call("Fib", "nop"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkInvokeLoop measures calls from bytecode, by a method equivalent to:
+//
+//	static int loop(int n) {
+//		int sum = 0;
+//		for (; n != 0; n--) {
+//			sum = add(sum, n);
+//		}
+//		return sum;
+//	}
+func BenchmarkInvokeLoop(b *testing.B) {
+	a := &Assembler{}
+	a.Iload(0).Iload(1).Iadd().Ireturn().Method(0x0009, "add", "(II)I", 2, 2)
+	start, end := a.Label(), a.Label()
+	a.Iconst(0).Istore(1).
+		Mark(start).Iload(0).Branch(0x99, end). // IFEQ
+		Iload(1).Iload(0).Invoke(0xB8, "Loop", "add", "(II)I").Istore(1).
+		Iinc(0, -1).Goto(start).
+		Mark(end).Iload(1).Ireturn().
+		Method(0x0009, "loop", "(I)I", 2, 2)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Loop", "java/lang/Object")); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := vm.Call("Loop", "loop", int32(1000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInvoker(b *testing.B) {
+	vm := New()
+	if _, err := vm.DefineClass(fibClass()); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("Call", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := vm.CallDesc("Fib", "fib", "(I)I", int32(1)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Invoker", func(b *testing.B) {
+		fib, err := vm.Resolve("Fib", "fib", "(I)I")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := fib.Invoke(int32(1)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkArraySum(b *testing.B) {
+	a := &Assembler{}
+	// static int sum(int n) {
+	//   int[] a = new int[n]; for (int i = 0; i < n; i++) a[i] = i;
+	//   int s = 0; for (int i = 0; i < n; i++) s += a[i]; return s;
+	// }
+	fill, sum, loop, end := a.Label(), a.Label(), a.Label(), a.Label()
+	a.Iload(0).Newarray(10).Astore(1).Iconst(0).Istore(2).
+		Mark(fill).Iload(2).Iload(0).Branch(0xA2, sum).
+		Aload(1).Iload(2).Iload(2).Op(0x4F).Iinc(2, 1).Goto(fill).
+		Mark(sum).Iconst(0).Istore(3).Iconst(0).Istore(2).
+		Mark(loop).Iload(2).Iload(0).Branch(0xA2, end).
+		Iload(3).Aload(1).Iload(2).Op(0x2E).Iadd().Istore(3).Iinc(2, 1).Goto(loop).
+		Mark(end).Iload(3).Ireturn().
+		Method(0x0009, "sum", "(I)I", 4, 4)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Sum", "java/lang/Object")); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if res, err := vm.Call("Sum", "sum", 1000000); err != nil || res != int32(1783293664) {
+			b.Fatal(res, err)
+		}
+	}
+}
+
+func TestCharArray(t *testing.T) {
+	a := &Assembler{}
+	// static int roundTrip(int v) { char[] c = new char[1]; c[0] = (char) v; return c[0]; }
+	a.Iconst(1).Newarray(5).Astore(1).
+		Aload(1).Iconst(0).Iload(0).Op(0x92).Op(0x55). // I2C, CASTORE
+		Aload(1).Iconst(0).Op(0x34).Ireturn().         // CALOAD
+		Method(0x0009, "roundTrip", "(I)I", 3, 2)
+	// static int store(int v) { char[] c = new char[1]; c[0] = v; return c[0] + c.length; }
+	a.Iconst(1).Newarray(5).Astore(1).
+		Aload(1).Iconst(0).Iload(0).Op(0x55). // CASTORE
+		Aload(1).Iconst(0).Op(0x34).          // CALOAD
+		Aload(1).Op(0xBE).Iadd().Ireturn().   // ARRAYLENGTH
+		Method(0x0009, "store", "(I)I", 3, 2)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Chars", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ In, Out int32 }{{65535, 65535}, {65, 65}, {-1, 65535}, {65536 + 65, 65}} {
+		if res, err := vm.Call("Chars", "roundTrip", test.In); err != nil || res != test.Out {
+			t.Error(test, res, err)
+		}
+		if res, err := vm.Call("Chars", "store", test.In); err != nil || res != test.Out+1 {
+			t.Error(test, res, err)
+		}
+	}
+}
+
+func TestNewArrayZero(t *testing.T) {
+	a := &Assembler{}
+	// static double sum() { double[] d = new double[3]; return d[0] + d[1] + d[2]; }
+	a.Iconst(3).Newarray(7).Astore(0).
+		Aload(0).Iconst(0).Op(0x31).
+		Aload(0).Iconst(1).Op(0x31).Op(0x63).
+		Aload(0).Iconst(2).Op(0x31).Op(0x63).Dreturn().
+		Method(0x0009, "sum", "()D", 4, 1)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Zero", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Zero", "sum"); err != nil || res != float64(0) {
+		t.Error(res, err)
+	}
+	for atype, zero := range map[byte]Value{
+		4: false, 5: int32(0), 6: float32(0), 7: float64(0),
+		8: int32(0), 9: int32(0), 10: int32(0), 11: int64(0),
+	} {
+		code := (&Assembler{}).Iconst(2).Newarray(atype).Areturn().Code()
+		res, err := vm.EvalMethod(code, 0, 1)
+		if arr, ok := vm.GoSlice(res); err != nil || !ok || len(arr) != 2 || arr[0] != zero || arr[1] != zero {
+			t.Error(atype, res, err)
+		}
+	}
+}
+
+func TestInternLiterals(t *testing.T) {
+	a := &Assembler{}
+	a.Ldc("a").Areturn().Method(0x0009, "a", "()Ljava/lang/String;", 1, 0)
+	a.Ldc("a").Invoke(0xB6, "java/lang/String", "intern", "()Ljava/lang/String;").Areturn().
+		Method(0x0009, "internA", "()Ljava/lang/String;", 1, 0)
+	a.Ldc("b").Areturn().Method(0x0009, "b", "()Ljava/lang/String;", 1, 0)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Literals", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	a1, err1 := vm.Call("Literals", "a")
+	a2, err2 := vm.Call("Literals", "a")
+	b, err3 := vm.Call("Literals", "b")
+	if err1 != nil || err2 != nil || err3 != nil {
+		t.Fatal(err1, err2, err3)
+	}
+	if a1 != a2 || a1 == b || a1.(*Object).String() != "a" || b.(*Object).String() != "b" {
+		t.Error(a1, a2, b)
+	}
+	if res, err := vm.Call("Literals", "internA"); err != nil || res != a1 {
+		t.Error(res, err)
+	}
+	s := vm.newString("a")
+	c, _ := vm.Class("java/lang/String")
+	if s == a1 {
+		t.Error(s)
+	} else if res, err := vm.CallMethod(c, "intern", "", s); err != nil || res != a1 {
+		t.Error(res, err)
+	}
+}
+
+func TestOperandStackErrors(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		a := &Assembler{}
+		a.Op(0x00).Op(0x00).Op(0x00).Iadd().Ireturn().Method(0x0009, "bar", "()I", 2, 0) // NOP, NOP, NOP
+		a.Iconst(1).Iconst(2).Iconst(3).Iadd().Ireturn().Method(0x0009, "baz", "()I", 2, 0)
+		vm := New()
+		vm.RawBytecode = raw
+		if _, err := vm.DefineClass(a.Class(0x0021, "Foo", "java/lang/Object")); err != nil {
+			t.Fatal(err)
+		}
+		_, err := vm.Call("Foo", "bar")
+		if e, ok := err.(*VMError); !ok || e.Error() != "operand stack underflow at Foo.bar+3" {
+			t.Error(raw, err)
+		}
+		_, err = vm.Call("Foo", "baz")
+		if e, ok := err.(*VMError); !ok || e.Error() != "operand stack overflow at Foo.baz+2" {
+			t.Error(raw, err)
+		}
+	}
+}
+
+func TestIntCompare(t *testing.T) {
+	ops := []struct {
+		Op   byte
+		Name string
+		F    func(a, b int32) bool
+	}{
+		{0x9F, "eq", func(a, b int32) bool { return a == b }},
+		{0xA0, "ne", func(a, b int32) bool { return a != b }},
+		{0xA1, "lt", func(a, b int32) bool { return a < b }},
+		{0xA2, "ge", func(a, b int32) bool { return a >= b }},
+		{0xA3, "gt", func(a, b int32) bool { return a > b }},
+		{0xA4, "le", func(a, b int32) bool { return a <= b }},
+	}
+	a := &Assembler{}
+	for _, op := range ops {
+		// static int op(int a, int b) { return a OP b ? 1 : 0; }
+		yes := a.Label()
+		a.Iload(0).Iload(1).Branch(op.Op, yes).Iconst(0).Ireturn().Mark(yes).Iconst(1).Ireturn().
+			Method(0x0009, op.Name, "(II)I", 2, 2)
+	}
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Compare", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		for _, args := range [][2]int32{{3, 7}, {7, 3}, {3, 3}, {-7, 3}} {
+			want := int32(0)
+			if op.F(args[0], args[1]) {
+				want = 1
+			}
+			if res, err := vm.Call("Compare", op.Name, args[0], args[1]); err != nil || res != want {
+				t.Error(op.Name, args, res, err)
+			}
+		}
+	}
+}
+
+func TestWideReturn(t *testing.T) {
+	a := &Assembler{}
+	a.Ldc(int64(1)<<40).Lreturn().Method(0x0009, "big", "()J", 2, 0)
+	// static long sum() { return big() + 5L; }, 0x61 is LADD
+	a.Invoke(0xB8, "Wide", "big", "()J").Ldc(int64(5)).Op(0x61).Lreturn().
+		Method(0x0009, "sum", "()J", 4, 0)
+	a.Ldc(0.5).Dreturn().Method(0x0009, "half", "()D", 2, 0)
+	// static double twice() { return half() + half(); }, 0x63 is DADD
+	a.Invoke(0xB8, "Wide", "half", "()D").Invoke(0xB8, "Wide", "half", "()D").Op(0x63).Dreturn().
+		Method(0x0009, "twice", "()D", 4, 0)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Wide", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Wide", "sum"); err != nil || res != int64(1)<<40+5 {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Wide", "twice"); err != nil || res != 1.0 {
+		t.Error(res, err)
+	}
+}
+
+func TestMethodLookup(t *testing.T) {
+	c := newClass(Class{Methods: []Field{
+		{Name: "foo", Descriptor: "()V"},
+		{Name: "foo", Descriptor: "(I)V"},
+		{Name: "bar", Descriptor: "()I"},
+	}}, nil)
+	for _, obj := range []*Object{c, c.New(), {Class: c.Class}} {
+		if m, err := obj.Method("foo", ""); err != nil || m.Descriptor != "()V" {
+			t.Error(m, err)
+		}
+		if m, err := obj.Method("foo", "(I)V"); err != nil || m.Descriptor != "(I)V" {
+			t.Error(m, err)
+		}
+		if _, err := obj.Method("foo", "(J)V"); err == nil {
+			t.Error("expected error")
+		}
+		if _, err := obj.Method("baz", ""); err == nil {
+			t.Error("expected error")
+		}
+	}
+}
+
+func BenchmarkMethodLookup(b *testing.B) {
+	c := Class{}
+	for i := 0; i < 50; i++ {
+		c.Methods = append(c.Methods, Field{Name: fmt.Sprintf("method%d", i), Descriptor: "()V"})
+	}
+	for _, obj := range []*Object{{Class: c}, newClass(c, nil)} {
+		name := "Scan"
+		if obj.methods != nil {
+			name = "Map"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := obj.Method("method49", "()V"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStackCategories(t *testing.T) {
+	for _, test := range []struct {
+		Name  string
+		Op    byte
+		Stack []Value
+		Want  []Value
+	}{
+		{"POP", 0x57, []Value{int32(1), int32(2)}, []Value{int32(1)}},
+		{"POP2, form 1", 0x58, []Value{int32(1), int32(2), int32(3)}, []Value{int32(1)}},
+		{"POP2, form 2", 0x58, []Value{int32(1), int64(2)}, []Value{int32(1)}},
+		{"DUP", 0x59, []Value{int32(1)}, []Value{int32(1), int32(1)}},
+		{"DUP_X1", 0x5A, []Value{int32(1), int32(2)}, []Value{int32(2), int32(1), int32(2)}},
+		{"DUP_X2, form 1", 0x5B, []Value{int32(1), int32(2), int32(3)}, []Value{int32(3), int32(1), int32(2), int32(3)}},
+		{"DUP_X2, form 2", 0x5B, []Value{int64(1), int32(2)}, []Value{int32(2), int64(1), int32(2)}},
+		{"DUP2, form 1", 0x5C, []Value{int32(1), int32(2)}, []Value{int32(1), int32(2), int32(1), int32(2)}},
+		{"DUP2, form 2", 0x5C, []Value{int64(1)}, []Value{int64(1), int64(1)}},
+		{"DUP2_X1, form 1", 0x5D, []Value{int32(1), int32(2), int32(3)}, []Value{int32(2), int32(3), int32(1), int32(2), int32(3)}},
+		{"DUP2_X1, form 2", 0x5D, []Value{int32(1), 2.0}, []Value{2.0, int32(1), 2.0}},
+		{"DUP2_X2, form 1", 0x5E, []Value{int32(1), int32(2), int32(3), int32(4)}, []Value{int32(3), int32(4), int32(1), int32(2), int32(3), int32(4)}},
+		{"DUP2_X2, form 2", 0x5E, []Value{int32(1), int32(2), 3.0}, []Value{3.0, int32(1), int32(2), 3.0}},
+		{"DUP2_X2, form 3", 0x5E, []Value{1.0, int32(2), int32(3)}, []Value{int32(2), int32(3), 1.0, int32(2), int32(3)}},
+		{"DUP2_X2, form 4", 0x5E, []Value{int64(1), int64(2)}, []Value{int64(2), int64(1), int64(2)}},
+	} {
+		f := newFrame(&Object{}, Field{Name: "test"}, []byte{test.Op, 0xB1}, 0, 6)
+		for _, v := range test.Stack {
+			f.push(v)
+		}
+		if _, err := New().exec(&thread{frames: []*Frame{f}}); err != nil {
+			t.Error(test.Name, err)
+		} else if !reflect.DeepEqual(f.Stack[:f.SP], test.Want) {
+			t.Error(test.Name, f.Stack[:f.SP], test.Want)
+		}
+		freeFrame(f)
+	}
+
+	f := newFrame(&Object{}, Field{Name: "test"}, []byte{0x0A, 0x5C, 0xB1}, 0, 4) // LCONST_1, DUP2, RETURN
+	if _, err := New().exec(&thread{frames: []*Frame{f}}); err != nil {
+		t.Error(err)
+	} else if f.SP != 2 || f.depth() != 4 {
+		t.Error(f.Stack[:f.SP], f.SP, f.depth())
+	}
+	// LCONST_1, DUP2, LADD, LRETURN
+	if res, err := New().EvalMethod([]byte{0x0A, 0x5C, 0x61, 0xAD}, 0, 4); err != nil || res != int64(2) {
+		t.Error(res, err)
+	}
+	// LCONST_1, DUP, LRETURN
+	if _, err := New().EvalMethod([]byte{0x0A, 0x59, 0xAD}, 0, 4); err == nil || err.Error() != "bad operand stack value category at <eval>.<eval>+1" {
+		t.Error(err)
+	}
+}
+
+func TestDeepRecursion(t *testing.T) {
+	a := &Assembler{}
+	// static int depth(int n) { if (n == 0) return 0; return depth(n - 1) + 1; }, 0x9A is IFNE
+	l := a.Label()
+	a.Iload(0).Branch(0x9A, l).Iconst(0).Ireturn().
+		Mark(l).Iload(0).Iconst(1).Isub().Invoke(0xB8, "Deep", "depth", "(I)I").Iconst(1).Iadd().Ireturn().
+		Method(0x0009, "depth", "(I)I", 2, 1)
+	// static int fail(int n) { if (n == 0) <underflow>; return fail(n - 1); }
+	l = a.Label()
+	a.Iload(0).Branch(0x9A, l).Iadd().Ireturn().
+		Mark(l).Iload(0).Iconst(1).Isub().Invoke(0xB8, "Deep", "fail", "(I)I").Ireturn().
+		Method(0x0009, "fail", "(I)I", 2, 1)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Deep", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Deep", "depth", int32(10000)); err != nil || res != int32(10000) {
+		t.Error(res, err)
+	}
+	_, err := vm.Call("Deep", "fail", int32(2))
+	if e, ok := err.(*VMError); !ok {
+		t.Error(err)
+	} else if e.Error() != "operand stack underflow at Deep.fail+4" ||
+		!reflect.DeepEqual(e.Trace, []string{"Deep.fail+4", "Deep.fail+9", "Deep.fail+9"}) {
+		t.Error(e, e.Trace)
+	}
+	// the VM is still usable after an error
+	if res, err := vm.Call("Deep", "depth", int32(3)); err != nil || res != int32(3) {
+		t.Error(res, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	vm := New("testdata")
+	vm.RegisterNative("Runtime", "log", "(Ljava/lang/String;)V", runtimeLog)
+	obj, _ := vm.Call("FieldsAndMethods", "create")
+	if _, err := vm.Call("FieldsAndMethods", "incrementB", obj); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := vm.Class("FieldsAndMethods"); err != nil || c.Fields["b"] != int32(3) {
+		t.Fatal(c, err)
+	}
+	hello := vm.InternString("hello")
+	vm.CountOpcodes = true
+	if _, err := vm.Call("FieldsAndMethods", "add", int32(1), int32(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if counts := vm.OpcodeCoverage(); len(counts) != 0 || !vm.CountOpcodes {
+		t.Error(counts)
+	}
+	if len(vm.Classes) != len(New().Classes) {
+		t.Error(vm.Classes)
+	}
+	if c, err := vm.Class("FieldsAndMethods"); err != nil || c.Fields["b"] != int32(2) {
+		t.Error(c, err)
+	}
+	if vm.InternString("hello") == hello {
+		t.Error("interned strings were kept")
+	}
+	if _, ok := vm.Native["Runtime.log"]; !ok {
+		t.Error(vm.Native)
+	}
+
+	// A running call blocks the reset.
+	started, release := make(chan struct{}), make(chan struct{})
+	vm.RegisterNative("Runtime", "log", "(Ljava/lang/String;)V", func(args ...Value) Value {
+		close(started)
+		<-release
+		return nil
+	})
+	done := make(chan error)
+	go func() {
+		_, err := vm.Call("FieldsAndMethods", "hello", obj)
+		done <- err
+	}()
+	<-started
+	if err := vm.Reset(); err == nil {
+		t.Error("reset while running")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if err := vm.Reset(); err != nil {
+		t.Error(err)
+	}
+	if _, ok := vm.Native["Runtime.log"]; !ok {
+		t.Error(vm.Native)
+	}
+	if res, err := vm.Call("FieldsAndMethods", "add", int32(2), int32(3)); err != nil || res != int32(5) {
+		t.Error(res, err)
+	}
+}
+
+func TestInternString(t *testing.T) {
+	a := &Assembler{}
+	a.ConstField(0x0019, "GREETING", "Ljava/lang/String;", "hello")
+	// static int identity() {
+	//     int r = 0;
+	//     String a = "hello", b = "hello", c = new String(a);
+	//     if (a == b) r++;
+	//     if (a == GREETING) r++;
+	//     if (a != c) r++;
+	//     if (a == c.intern()) r++;
+	//     return r;
+	// }
+	// 0xA6 is IF_ACMPNE, 0xA5 is IF_ACMPEQ
+	l1, l2, l3, l4 := a.Label(), a.Label(), a.Label(), a.Label()
+	a.Iconst(0).Istore(0).
+		Ldc("hello").Astore(1).Ldc("hello").Astore(2).
+		New("java/lang/String").Dup().Aload(1).
+		Invoke(0xB7, "java/lang/String", "<init>", "(Ljava/lang/String;)V").Astore(3).
+		Aload(1).Aload(2).Branch(0xA6, l1).Iinc(0, 1).Mark(l1).
+		Aload(1).Getstatic("Strings", "GREETING", "Ljava/lang/String;").Branch(0xA6, l2).Iinc(0, 1).Mark(l2).
+		Aload(1).Aload(3).Branch(0xA5, l3).Iinc(0, 1).Mark(l3).
+		Aload(1).Aload(3).Invoke(0xB6, "java/lang/String", "intern", "()Ljava/lang/String;").Branch(0xA6, l4).Iinc(0, 1).Mark(l4).
+		Iload(0).Ireturn().
+		Method(0x0009, "identity", "()I", 3, 4)
+	a.Ldc("hello").Areturn().Method(0x0009, "hello", "()Ljava/lang/String;", 1, 0)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Strings", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Strings", "identity"); err != nil || res != int32(4) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Strings", "hello"); err != nil || res != vm.InternString("hello") {
+		t.Error(res, err)
+	}
+	if vm.InternString("other") != vm.InternString("other") || vm.InternString("other") == vm.newString("other") {
+		t.Error("not interned")
+	}
+	var wg sync.WaitGroup
+	results := make([]*Object, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = vm.InternString("concurrent")
+		}(i)
+	}
+	wg.Wait()
+	for _, obj := range results {
+		if obj != results[0] {
+			t.Error(results)
+		}
+	}
+}
+
+func TestCallConvertArgs(t *testing.T) {
+	a := &Assembler{}
+	a.Iload(0).Iload(1).Iadd().Ireturn().Method(0x0009, "add", "(II)I", 2, 2)
+	a.Aload(0).Areturn().Method(0x0009, "id", "(Ljava/lang/String;)Ljava/lang/String;", 1, 1)
+	a.Iload(0).Ireturn().Method(0x0009, "flag", "(Z)Z", 1, 1)
+	a.Lload(0).Lreturn().Method(0x0009, "long", "(J)J", 2, 1)
+	a.Fload(0).Freturn().Method(0x0009, "float", "(F)F", 1, 1)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Convert", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		Method string
+		Args   []Value
+		Result Value
+	}{
+		{"add", []Value{2, 3}, int32(5)},
+		{"add", []Value{int8(-2), uint16(3)}, int32(1)},
+		{"id", []Value{"hello"}, vm.InternString("hello")},
+		{"id", []Value{nil}, nil},
+		{"flag", []Value{true}, int32(1)},
+		{"long", []Value{1 << 40}, int64(1 << 40)},
+		{"float", []Value{1.5}, float32(1.5)},
+	} {
+		if res, err := vm.Call("Convert", test.Method, test.Args...); err != nil || res != test.Result {
+			t.Error(test.Method, test.Args, res, err)
+		}
+	}
+	for _, test := range []struct {
+		Method string
+		Args   []Value
+		Error  string
+	}{
+		{"add", []Value{1, "2"}, "argument 2 of add(II)I: cannot use string as I"},
+		{"add", []Value{1 << 40, 2}, "argument 1 of add(II)I: 1099511627776 overflows I"},
+		{"id", []Value{42}, "argument 1 of id(Ljava/lang/String;)Ljava/lang/String;: cannot use int as Ljava/lang/String;"},
+		{"flag", []Value{int32(2)}, "argument 1 of flag(Z)Z: cannot use int32 as Z"},
+	} {
+		if _, err := vm.Call("Convert", test.Method, test.Args...); err == nil || err.Error() != test.Error {
+			t.Error(test.Method, test.Args, err)
+		}
+	}
+	args := []Value{1, 2}
+	if _, err := vm.Call("Convert", "add", args...); err != nil || args[0] != 1 {
+		t.Error(args, err)
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0x000A, "hidden", "I")
+	a.Iconst(5).Ireturn().Method(0x000A, "secret", "()I", 1, 0)
+	a.Invoke(0xB8, "pkg/A", "secret", "()I").Ireturn().Method(0x0009, "open", "()I", 1, 0)
+	a.Iconst(7).Ireturn().Method(0x0008, "shared", "()I", 1, 0)
+	b := &Assembler{}
+	b.Invoke(0xB8, "pkg/A", "secret", "()I").Ireturn().Method(0x0009, "secret", "()I", 1, 0)
+	b.Getstatic("pkg/A", "hidden", "I").Ireturn().Method(0x0009, "hidden", "()I", 1, 0)
+	b.Invoke(0xB8, "pkg/A", "open", "()I").Ireturn().Method(0x0009, "open", "()I", 1, 0)
+	b.Invoke(0xB8, "pkg/A", "shared", "()I").Ireturn().Method(0x0009, "shared", "()I", 1, 0)
+	vm := New()
+	for _, c := range []Class{
+		a.Class(0x0021, "pkg/A", "java/lang/Object"),
+		b.Class(0x0021, "other/B", "java/lang/Object"),
+	} {
+		if _, err := vm.DefineClass(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, err := vm.Call("other/B", "secret"); err != nil || res != int32(5) {
+		t.Error(res, err)
+	}
+	vm.CheckAccess = true
+	for _, method := range []string{"secret", "hidden", "shared"} {
+		if _, err := vm.Call("other/B", method); !errors.Is(err, ErrIllegalAccess) {
+			t.Error(method, err)
+		}
+	}
+	if res, err := vm.Call("other/B", "open"); err != nil || res != int32(5) {
+		t.Error(res, err)
+	}
+}
+
+func TestCallDesc(t *testing.T) {
+	a := &Assembler{}
+	a.Iload(0).Ireturn().Method(0x0009, "foo", "(I)I", 1, 1)
+	a.Lload(0).Lreturn().Method(0x0009, "foo", "(J)J", 2, 1)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Overloads", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.CallDesc("Overloads", "foo", "(I)I", 3); err != nil || res != int32(3) {
+		t.Error(res, err)
+	}
+	if res, err := vm.CallDesc("Overloads", "foo", "(J)J", 3); err != nil || res != int64(3) {
+		t.Error(res, err)
+	}
+	if _, err := vm.CallDesc("Overloads", "foo", "(F)F", 3); err == nil {
+		t.Error("expected method not found")
+	}
+}
+
+func TestToGo(t *testing.T) {
+	a := &Assembler{}
+	a.Aload(0).Areturn().Method(0x0009, "id", "(Ljava/lang/Object;)Ljava/lang/Object;", 1, 1)
+	a.Iconst(3).Newarray(10).Dup().Iconst(1).Iconst(5).Op(0x4F).Areturn().
+		Method(0x0009, "ints", "()[I", 4, 0)
+	a.New("Pair").Dup().Iconst(1).Putfield("Pair", "x", "I").
+		Dup().Ldc("one").Putfield("Pair", "name", "Ljava/lang/String;").Areturn().
+		Method(0x0009, "pair", "()LPair;", 3, 0)
+	a.Field(0, "x", "I").Field(0, "name", "Ljava/lang/String;")
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Pair", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Pair", "id", "hello"); err != nil || vm.ToGo(res) != "hello" {
+		t.Error(res, err)
+	}
+	res, err := vm.Call("Pair", "ints")
+	if s, ok := vm.GoSlice(res); err != nil || !ok || !reflect.DeepEqual(s, []interface{}{int32(0), int32(5), int32(0)}) {
+		t.Error(s, err)
+	}
+	if s, ok := vm.ToGo(res).([]interface{}); !ok || len(s) != 3 {
+		t.Error(s)
+	}
+	res, err = vm.Call("Pair", "pair")
+	if m, ok := vm.GoMap(res); err != nil || !ok || !reflect.DeepEqual(m, map[string]interface{}{"x": int32(1), "name": "one"}) {
+		t.Error(m, err)
+	}
+	if n, ok := vm.GoInt(res.(*Object).Field("x")); !ok || n != 1 {
+		t.Error(n, ok)
+	}
+	if _, ok := vm.GoString(res); ok {
+		t.Error("not a string")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	type Point struct {
+		X     int    `jvm:"x"`
+		Y     int    `jvm:"y"`
+		Name  string `jvm:"name"`
+		Tags  []int16
+		Extra bool
+		skip  int
+	}
+	a := &Assembler{}
+	a.Field(0, "x", "I").Field(0, "y", "I").Field(0, "name", "Ljava/lang/String;").Field(0, "Tags", "[S")
+	// void translate(int d) { x += d; y += d; }
+	a.Aload(0).Aload(0).Getfield("Point", "x", "I").Iload(1).Iadd().Putfield("Point", "x", "I").
+		Aload(0).Aload(0).Getfield("Point", "y", "I").Iload(1).Iadd().Putfield("Point", "y", "I").
+		Return().Method(0x0001, "translate", "(I)V", 3, 2)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Point", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := vm.Marshal("Point", &Point{X: 1, Y: 2, Name: "p", Tags: []int16{3, 4}, Extra: true, skip: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.Call("Point", "translate", obj, 2); err != nil {
+		t.Fatal(err)
+	}
+	p := Point{}
+	if err := vm.Unmarshal(obj, &p); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, Point{X: 3, Y: 4, Name: "p", Tags: []int16{3, 4}}) {
+		t.Error(p)
+	}
+	vm.StrictFields = true
+	if _, err := vm.Marshal("Point", Point{}); err == nil || err.Error() != "Point has no field Extra" {
+		t.Error(err)
+	}
+	if err := vm.Unmarshal(obj, &p); err == nil {
+		t.Error("expected missing field error")
+	}
+}
+
+func TestNullPointerException(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0, "x", "I")
+	a.Op(0x01).Getfield("Nulls", "x", "I").Ireturn().Method(0x0009, "getfield", "()I", 1, 0)
+	a.Op(0x01).Iconst(1).Putfield("Nulls", "x", "I").Return().Method(0x0009, "putfield", "()V", 2, 0)
+	a.Op(0x01).Invoke(0xB6, "Nulls", "get", "()I").Ireturn().Method(0x0009, "invokevirtual", "()I", 1, 0)
+	a.Op(0x01).Athrow().Method(0x0009, "athrow", "()V", 1, 0)
+	a.Aload(0).Getfield("Nulls", "x", "I").Ireturn().Method(0x0001, "get", "()I", 1, 1)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Nulls", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"getfield", "putfield", "invokevirtual", "athrow"} {
+		_, err := vm.Call("Nulls", method)
+		var exc *Exception
+		if !errors.As(err, &exc) || exc.Object.Name != "java/lang/NullPointerException" {
+			t.Error(method, err)
+		}
+	}
+}
+
+func TestCatch(t *testing.T) {
+	a := &Assembler{}
+	// static int local() { try { return ((Catch) null).x; } catch (NullPointerException e) { return 2; } }
+	start, end, handler := a.Label(), a.Label(), a.Label()
+	a.Mark(start).Op(0x01).Getfield("Catch", "x", "I").Ireturn().Mark(end).
+		Mark(handler).Pop().Iconst(2).Ireturn().
+		Catch(start, end, handler, "java/lang/NullPointerException").
+		Method(0x0009, "local", "()I", 1, 0)
+	// static void fail(String s) { throw new RuntimeException(s); }
+	a.New("java/lang/RuntimeException").Dup().Aload(0).
+		Invoke(0xB7, "java/lang/RuntimeException", "<init>", "(Ljava/lang/String;)V").Athrow().
+		Method(0x0009, "fail", "(Ljava/lang/String;)V", 3, 1)
+	// static String caller() { try { fail("boom"); } catch (Exception e) { return e.getMessage(); } return null; }
+	start, end, handler = a.Label(), a.Label(), a.Label()
+	a.Mark(start).Ldc("boom").Invoke(0xB8, "Catch", "fail", "(Ljava/lang/String;)V").Mark(end).Op(0x01).Areturn().
+		Mark(handler).Invoke(0xB6, "java/lang/Exception", "getMessage", "()Ljava/lang/String;").Areturn().
+		Catch(start, end, handler, "java/lang/Exception").
+		Method(0x0009, "caller", "()Ljava/lang/String;", 1, 0)
+	// static int mismatch() { try { fail("oops"); } catch (NullPointerException e) { return 1; } return 0; }
+	start, end, handler = a.Label(), a.Label(), a.Label()
+	a.Mark(start).Ldc("oops").Invoke(0xB8, "Catch", "fail", "(Ljava/lang/String;)V").Mark(end).Iconst(0).Ireturn().
+		Mark(handler).Iconst(1).Ireturn().
+		Catch(start, end, handler, "java/lang/NullPointerException").
+		Method(0x0009, "mismatch", "()I", 1, 0)
+	a.Field(0, "x", "I")
+	for _, raw := range []bool{false, true} {
+		vm := New()
+		vm.RawBytecode = raw
+		if _, err := vm.DefineClass(a.Class(0x0021, "Catch", "java/lang/Object")); err != nil {
+			t.Fatal(err)
+		}
+		if res, err := vm.Call("Catch", "local"); err != nil || res != int32(2) {
+			t.Error(raw, res, err)
+		}
+		if res, err := vm.Call("Catch", "caller"); err != nil || vm.ToGo(res) != "boom" {
+			t.Error(raw, res, err)
+		}
+		_, err := vm.Call("Catch", "mismatch")
+		var exc *Exception
+		if !errors.As(err, &exc) || exc.Error() != "java/lang/RuntimeException: oops" {
+			t.Error(raw, err)
+		} else if trace := err.(*VMError).Trace; len(trace) != 2 || trace[0] != "Catch.fail+8" {
+			t.Error(raw, trace)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	i := &Assembler{}
+	i.Method(0x0401, "compare", "(Ljava/lang/Object;Ljava/lang/Object;)I", 0, 0)
+	a := &Assembler{}
+	// static void sort(Object[] a, Comparator c) {
+	//   for (int i = 1; i < a.length; i++)
+	//     for (int j = i; j > 0 && c.compare(a[j-1], a[j]) > 0; j--) { Object t = a[j]; a[j] = a[j-1]; a[j-1] = t; }
+	// }
+	outer, inner, next, done := a.Label(), a.Label(), a.Label(), a.Label()
+	a.Iconst(1).Istore(2).
+		Mark(outer).Iload(2).Aload(0).Op(0xBE).Branch(0xA2, done).
+		Iload(2).Istore(3).
+		Mark(inner).Iload(3).Branch(0x9E, next).
+		Aload(1).Aload(0).Iload(3).Iconst(1).Isub().Op(0x32).Aload(0).Iload(3).Op(0x32).
+		Invoke(0xB9, "java/util/Comparator", "compare", "(Ljava/lang/Object;Ljava/lang/Object;)I").Branch(0x9E, next).
+		Aload(0).Iload(3).Op(0x32).Astore(4).
+		Aload(0).Iload(3).Aload(0).Iload(3).Iconst(1).Isub().Op(0x32).Op(0x53).
+		Aload(0).Iload(3).Iconst(1).Isub().Aload(4).Op(0x53).
+		Iinc(3, -1).Goto(inner).
+		Mark(next).Iinc(2, 1).Goto(outer).
+		Mark(done).Return().
+		Method(0x0009, "sort", "([Ljava/lang/Object;Ljava/util/Comparator;)V", 6, 5)
+	// static boolean same(Object a, Object b) { return a.equals(b); }
+	a.Aload(0).Aload(1).Invoke(0xB6, "java/lang/Object", "equals", "(Ljava/lang/Object;)Z").Ireturn().
+		Method(0x0009, "same", "(Ljava/lang/Object;Ljava/lang/Object;)Z", 2, 2)
+	vm := New()
+	for _, c := range []Class{
+		i.Class(0x0601, "java/util/Comparator", "java/lang/Object"),
+		a.Class(0x0021, "Sort", "java/lang/Object"),
+	} {
+		if _, err := vm.DefineClass(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := 0
+	cmp, err := vm.Proxy("java/util/Comparator", func(args ...Value) (Value, error) {
+		calls++
+		x, _ := vm.GoString(args[0])
+		y, _ := vm.GoString(args[1])
+		return len(x) - len(y), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := []Value{vm.InternString("three"), vm.InternString("a"), vm.InternString("pair")}
+	if _, err := vm.Call("Sort", "sort", words, cmp); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := vm.GoSlice(words); !reflect.DeepEqual(s, []interface{}{"a", "pair", "three"}) || calls == 0 {
+		t.Error(s, calls)
+	}
+	if res, err := vm.Call("Sort", "same", cmp, cmp); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Sort", "same", cmp, words[0]); err != nil || res != int32(0) {
+		t.Error(res, err)
+	}
+	if _, err := vm.Proxy("Sort", nil); err == nil {
+		t.Error("expected an error for a class")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	vm := New()
+	if _, err := vm.DefineClass(fibClass()); err != nil {
+		t.Fatal(err)
+	}
+	enters, exits, depth, maxDepth := map[string]int{}, map[string]int{}, 0, 0
+	vm.OnEnter = func(class, method, desc string) {
+		enters[class+"."+method+desc]++
+		if depth++; depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	vm.OnExit = func(class, method, desc string, result Value, err error) {
+		exits[class+"."+method+desc]++
+		depth--
+	}
+	if res, err := vm.Call("Fib", "fib", int32(10)); err != nil || res != int32(55) {
+		t.Fatal(res, err)
+	}
+	if n := enters["Fib.fib(I)I"]; n != 177 || exits["Fib.fib(I)I"] != n || depth != 0 || maxDepth != 10 {
+		t.Error(enters, exits, depth, maxDepth)
+	}
+}
+
+func TestBind(t *testing.T) {
+	vm := New("testdata")
+	var add func(int32, int32) (int32, error)
+	if err := vm.Bind("FieldsAndMethods", "add", "(II)I", &add); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := add(2, 3); err != nil || res != 5 {
+		t.Error(res, err)
+	}
+	var addInts func(a, b int) int
+	if err := vm.Bind("FieldsAndMethods", "add", "", &addInts); err != nil {
+		t.Fatal(err)
+	}
+	if res := addInts(-2, 3); res != 1 {
+		t.Error(res)
+	}
+	var create func() (*Object, error)
+	var incrementA func(*Object) error
+	if err := vm.Bind("FieldsAndMethods", "create", "()LFieldsAndMethods;", &create); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Bind("FieldsAndMethods", "incrementA", "()V", &incrementA); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := incrementA(obj); err != nil || obj.Field("a") != int32(2) {
+		t.Error(obj.Fields, err)
+	}
+	var missing func() error
+	if err := vm.Bind("FieldsAndMethods", "missing", "()V", &missing); err == nil || missing != nil {
+		t.Error(err)
+	}
+	for _, f := range []interface{}{
+		&add,
+		new(func(int32) (int32, error)),
+		new(func(string, int32) int32),
+		new(func(*Object, int32, int32) int32),
+		new(func(int32, int32)),
+	} {
+		if err := vm.Bind("FieldsAndMethods", "sub", "(II)J", f); err == nil {
+			t.Error(reflect.TypeOf(f), "bound to a wrong descriptor")
+		}
+		if reflect.TypeOf(f) != reflect.TypeOf(&add) {
+			if err := vm.Bind("FieldsAndMethods", "sub", "(II)I", f); err == nil {
+				t.Error(reflect.TypeOf(f), "bound to a wrong signature")
+			}
+		}
+	}
+}
+
+func TestStaticAndInstanceField(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0x0008, "x", "I").Field(0, "x", "I")
+	// static int both(Both b) { x = 3; b.x++; return x * 10 + b.x; }
+	a.Iconst(3).Putstatic("Both", "x", "I").
+		Aload(0).Aload(0).Getfield("Both", "x", "I").Iconst(1).Iadd().Putfield("Both", "x", "I").
+		Getstatic("Both", "x", "I").Iconst(5).Iconst(2).Imul().Imul().Aload(0).Getfield("Both", "x", "I").Iadd().Ireturn().
+		Method(0x0009, "both", "(LBoth;)I", 3, 1)
+	vm := New()
+	c, err := vm.DefineClass(a.Class(0x0021, "Both", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := c.New()
+	if c.Field("x") != int32(0) || obj.Field("x") != int32(0) {
+		t.Error(c.Fields, obj.Fields)
+	}
+	if res, err := vm.Call("Both", "both", obj); err != nil || res != int32(31) {
+		t.Error(res, err)
+	}
+	if c.Field("x") != int32(3) || obj.Field("x") != int32(1) {
+		t.Error(c.Fields, obj.Fields)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	counter := &Assembler{}
+	counter.Field(0, "n", "I")
+	counter.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	inc := &Assembler{}
+	inc.Field(0, "c", "LCounter;")
+	inc.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").
+		Aload(0).Aload(1).Putfield("Inc", "c", "LCounter;").Return().
+		Method(0x0001, "<init>", "(LCounter;)V", 2, 2)
+	// public void run() { for (int i = 0; i < 1000; i++) synchronized (c) { c.n++; } }
+	loop, done := inc.Label(), inc.Label()
+	inc.Iconst(0).Istore(1).
+		Mark(loop).Iload(1).Iconst(1000).Branch(0xA2, done).
+		Aload(0).Getfield("Inc", "c", "LCounter;").Dup().Astore(2).Op(0xC2).
+		Aload(0).Getfield("Inc", "c", "LCounter;").Dup().Getfield("Counter", "n", "I").Iconst(1).Iadd().Putfield("Counter", "n", "I").
+		Aload(2).Op(0xC3).
+		Iinc(1, 1).Goto(loop).
+		Mark(done).Return().
+		Method(0x0001, "run", "()V", 3, 3)
+	// static int count() {
+	//   Counter c = new Counter(); Thread a = new Thread(new Inc(c)), b = new Thread(new Inc(c));
+	//   a.start(); b.start(); a.join(); b.join(); return c.n;
+	// }
+	inc.New("Counter").Dup().Invoke(0xB7, "Counter", "<init>", "()V").Astore(0)
+	for i := 1; i <= 2; i++ {
+		inc.New("java/lang/Thread").Dup().New("Inc").Dup().Aload(0).Invoke(0xB7, "Inc", "<init>", "(LCounter;)V").
+			Invoke(0xB7, "java/lang/Thread", "<init>", "(Ljava/lang/Runnable;)V").Astore(i)
+	}
+	inc.Aload(1).Invoke(0xB6, "java/lang/Thread", "start", "()V").
+		Aload(2).Invoke(0xB6, "java/lang/Thread", "start", "()V").
+		Aload(1).Invoke(0xB6, "java/lang/Thread", "join", "()V").
+		Aload(2).Invoke(0xB6, "java/lang/Thread", "join", "()V").
+		Aload(0).Getfield("Counter", "n", "I").Ireturn().
+		Method(0x0009, "count", "()I", 5, 3)
+	// static String fail() { Thread t = new Thread("worker"); t.start(); t.start(); }
+	inc.New("java/lang/Thread").Dup().Ldc("worker").Invoke(0xB7, "java/lang/Thread", "<init>", "(Ljava/lang/String;)V").
+		Dup().Invoke(0xB6, "java/lang/Thread", "start", "()V").
+		Dup().Invoke(0xB6, "java/lang/Thread", "join", "()V").
+		Invoke(0xB6, "java/lang/Thread", "start", "()V").Return().
+		Method(0x0009, "restart", "()V", 3, 0)
+	// static String name() { return Thread.currentThread().getName(); }
+	inc.Invoke(0xB8, "java/lang/Thread", "currentThread", "()Ljava/lang/Thread;").
+		Invoke(0xB6, "java/lang/Thread", "getName", "()Ljava/lang/String;").Areturn().
+		Method(0x0009, "name", "()Ljava/lang/String;", 1, 0)
+	vm := New()
+	for _, c := range []Class{
+		counter.Class(0x0021, "Counter", "java/lang/Object"),
+		inc.Class(0x0021, "Inc", "java/lang/Object", "java/lang/Runnable"),
+	} {
+		if _, err := vm.DefineClass(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, err := vm.Call("Inc", "count"); err != nil || res != int32(2000) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Inc", "name"); err != nil || vm.ToGo(res) != "main" {
+		t.Error(res, err)
+	}
+	_, err := vm.Call("Inc", "restart")
+	var exc *Exception
+	if !errors.As(err, &exc) || exc.Object.Name != "java/lang/IllegalThreadStateException" {
+		t.Error(err)
+	}
+}
+
+func TestUncaught(t *testing.T) {
+	a := &Assembler{}
+	a.Aload(0).Invoke(0xB7, "java/lang/Thread", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	a.New("java/lang/RuntimeException").Dup().Ldc("boom").
+		Invoke(0xB7, "java/lang/RuntimeException", "<init>", "(Ljava/lang/String;)V").Athrow().
+		Method(0x0001, "run", "()V", 3, 1)
+	// static void main() { Worker w = new Worker(); w.start(); w.join(); }
+	a.New("Worker").Dup().Invoke(0xB7, "Worker", "<init>", "()V").
+		Dup().Invoke(0xB6, "Worker", "start", "()V").
+		Invoke(0xB6, "Worker", "join", "()V").Return().
+		Method(0x0009, "main", "()V", 2, 0)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Worker", "java/lang/Thread")); err != nil {
+		t.Fatal(err)
+	}
+	var uncaught error
+	vm.OnUncaught = func(thread *Object, err error) {
+		if name, _ := vm.GoString(thread.Field("name")); name != "Thread-0" {
+			t.Error(name)
+		}
+		uncaught = err
+	}
+	if _, err := vm.Call("Worker", "main"); err != nil {
+		t.Fatal(err)
+	}
+	var exc *Exception
+	if !errors.As(uncaught, &exc) || exc.Error() != "java/lang/RuntimeException: boom" {
+		t.Error(uncaught)
+	}
+}
+
+func TestLoadedClasses(t *testing.T) {
+	vm := New("testdata")
+	if _, err := vm.Class("FieldsAndMethods"); err != nil {
+		t.Fatal(err)
+	}
+	classes := vm.LoadedClasses()
+	if c := classes[len(classes)-1]; c.Name != "FieldsAndMethods" {
+		t.Error(c.Name)
+	} else if names := c.MethodNames(); !reflect.DeepEqual(names, []string{
+		"<init>", "add", "mul", "sub", "hello", "incrementA", "create", "incrementB", "incrementBoth", "<clinit>",
+	}) {
+		t.Error(names)
+	}
+	if classes[0].Name != "java/lang/Object" {
+		t.Error(classes[0].Name)
+	}
+}
+
+func TestSynchronized(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0x0008, "n", "I").Field(0, "m", "I")
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	// native static int yield(int n) lets other goroutines run mid-update.
+	a.Method(0x0109, "yield", "(I)I", 0, 0)
+	// static synchronized void inc() { n = yield(n) + 1; }
+	a.Getstatic("Sync", "n", "I").Invoke(0xB8, "Sync", "yield", "(I)I").Iconst(1).Iadd().Putstatic("Sync", "n", "I").Return().
+		Method(0x0028, "inc", "()V", 2, 0)
+	// synchronized void add() { m = yield(m) + 1; }
+	a.Aload(0).Dup().Getfield("Sync", "m", "I").Invoke(0xB8, "Sync", "yield", "(I)I").Iconst(1).Iadd().Putfield("Sync", "m", "I").Return().
+		Method(0x0021, "add", "()V", 3, 1)
+	// synchronized void addTwice() { add(); add(); }
+	a.Aload(0).Invoke(0xB6, "Sync", "add", "()V").Aload(0).Invoke(0xB6, "Sync", "add", "()V").Return().
+		Method(0x0021, "addTwice", "()V", 1, 1)
+	// static void incBlock() { synchronized (Sync.class) { n = yield(n) + 1; } }
+	a.ClassOp(0x13, "Sync").Dup().Astore(0).Op(0xC2).
+		Getstatic("Sync", "n", "I").Invoke(0xB8, "Sync", "yield", "(I)I").Iconst(1).Iadd().Putstatic("Sync", "n", "I").
+		Aload(0).Op(0xC3).Return().Method(0x0008, "incBlock", "()V", 2, 1)
+	// static synchronized void fail() { throw null; }
+	a.Op(0x01).Athrow().Method(0x0028, "fail", "()V", 1, 0)
+	vm := New()
+	vm.Native["Sync.yield"] = func(args ...Value) Value {
+		runtime.Gosched()
+		return args[0]
+	}
+	c, err := vm.DefineClass(a.Class(0x0021, "Sync", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.Call("Sync", "fail"); err == nil {
+		t.Error("expected an exception")
+	}
+	obj := c.New()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 250; j++ {
+				if _, err := vm.Call("Sync", "inc"); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := vm.Call("Sync", "incBlock"); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := vm.CallMethod(obj, "addTwice", "()V", obj); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := c.Field("n"); n != int32(2000) {
+		t.Error(n)
+	}
+	if m := obj.Field("m"); m != int32(2000) {
+		t.Error(m)
+	}
+}
+
+func TestLoadBadAttributeLength(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/FieldsAndMethods.class")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, ok := codeAttribute(c.Methods[0])
+	if !ok {
+		t.Fatal("no code")
+	}
+	// Make the first Code attribute claim two more bytes than it has.
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(code)))
+	i := bytes.Index(b, append(header[:], code...))
+	if i < 0 {
+		t.Fatal("code attribute not found")
+	}
+	binary.BigEndian.PutUint32(b[i:], uint32(len(code)+2))
+	if _, err := Load(bytes.NewReader(b)); err == nil || !strings.Contains(err.Error(), "bad Code attribute") {
+		t.Error(err)
+	}
+	// A length past the end of the file is an error too, without allocating it.
+	binary.BigEndian.PutUint32(b[i:], 0xFFFFFFFF)
+	if _, err := Load(bytes.NewReader(b)); err != io.ErrUnexpectedEOF {
+		t.Error(err)
+	}
+}
+
+func TestWaitNotify(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0, "ready", "Z")
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	// synchronized void await() { while (!ready) wait(); }
+	loop, done := a.Label(), a.Label()
+	a.Mark(loop).Aload(0).Getfield("Handoff", "ready", "Z").Branch(0x9A, done).
+		Aload(0).Invoke(0xB6, "java/lang/Object", "wait", "()V").Goto(loop).
+		Mark(done).Return().
+		Method(0x0021, "await", "()V", 1, 1)
+	// synchronized void signal() { ready = true; notifyAll(); }
+	a.Aload(0).Iconst(1).Putfield("Handoff", "ready", "Z").
+		Aload(0).Invoke(0xB6, "java/lang/Object", "notifyAll", "()V").Return().
+		Method(0x0021, "signal", "()V", 2, 1)
+	// synchronized void sleep(long ms) { wait(ms); }
+	a.Aload(0).Lload(1).Invoke(0xB6, "java/lang/Object", "wait", "(J)V").Return().
+		Method(0x0021, "sleep", "(J)V", 3, 3)
+	// void notifyUnlocked() { notify(); }
+	a.Aload(0).Invoke(0xB6, "java/lang/Object", "notify", "()V").Return().
+		Method(0x0001, "notifyUnlocked", "()V", 1, 1)
+	vm := New()
+	c, err := vm.DefineClass(a.Class(0x0021, "Handoff", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.New()
+	done1 := make(chan error, 1)
+	go func() {
+		_, err := vm.CallMethod(h, "await", "()V", h)
+		done1 <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := vm.CallMethod(h, "signal", "()V", h); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done1:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("await did not return")
+	}
+
+	start := time.Now()
+	if _, err := vm.CallMethod(h, "sleep", "(J)V", h, int64(20)); err != nil {
+		t.Error(err)
+	} else if d := time.Since(start); d < 20*time.Millisecond {
+		t.Error(d)
+	}
+
+	_, err = vm.CallMethod(h, "notifyUnlocked", "()V", h)
+	var exc *Exception
+	if !errors.As(err, &exc) || exc.Object.Name != "java/lang/IllegalMonitorStateException" {
+		t.Error(err)
+	}
+}
+
+func TestBoolean(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0, "flag", "Z")
+	a.Method(0x0109, "isEven", "(I)Z", 0, 0)
+	// static void set(Flags f, int n) { f.flag = isEven(n); }
+	a.Aload(0).Iload(1).Invoke(0xB8, "Flags", "isEven", "(I)Z").Putfield("Flags", "flag", "Z").Return().
+		Method(0x0009, "set", "(LFlags;I)V", 2, 2)
+	vm := New()
+	vm.Native["Flags.isEven"] = func(args ...Value) Value {
+		return args[0].(int32)%2 == 0
+	}
+	c, err := vm.DefineClass(a.Class(0x0021, "Flags", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := c.New()
+	if b, ok := AsBool(obj.Field("flag")); !ok || b {
+		t.Error(obj.Field("flag"))
+	}
+	for _, n := range []int32{4, 3} {
+		if _, err := vm.Call("Flags", "set", obj, n); err != nil {
+			t.Fatal(err)
+		}
+		if v := obj.Field("flag"); v != boolValue(n%2 == 0) {
+			t.Errorf("%d: %#v", n, v)
+		} else if b, ok := AsBool(v); !ok || b != (n%2 == 0) {
+			t.Error(n, b, ok)
+		}
+	}
+	if res, err := vm.Call("Flags", "isEven", int32(2)); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if _, ok := AsBool(int32(2)); ok {
+		t.Error("2 is not a boolean")
+	}
+}
+
+func TestBooleanConversion(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0, "flag", "Z")
+	a.Method(0x0109, "yes", "()Z", 0, 0)
+	// static boolean not(boolean b) { return !b; }
+	set := a.Label()
+	a.Iload(0).Branch(0x9A, set).Iconst(1).Ireturn().Mark(set).Iconst(0).Ireturn().
+		Method(0x0009, "not", "(Z)Z", 1, 1)
+	// static void set(Bools o, int n) { o.flag = n; }, which javac would reject
+	a.Aload(0).Iload(1).Putfield("Bools", "flag", "Z").Return().Method(0x0009, "set", "(LBools;I)V", 2, 2)
+	// static boolean[] flags(int n) { boolean[] a = new boolean[2]; a[1] = n; return a; }, likewise
+	a.Iconst(2).Newarray(4).Dup().Iconst(1).Iload(0).Op(0x54).Areturn().
+		Method(0x0009, "flags", "(I)[Z", 4, 1)
+	// static int get(boolean[] a, int i) { return a[i]; }
+	a.Aload(0).Iload(1).Op(0x33).Ireturn().Method(0x0009, "get", "([ZI)I", 2, 2)
+	// static byte signed() { byte[] b = new byte[1]; b[0] = (byte) 200; return b[0]; }
+	a.Iconst(1).Newarray(8).Dup().Iconst(0).Iconst(200).Op(0x54).Iconst(0).Op(0x33).Ireturn().
+		Method(0x0009, "signed", "()B", 4, 0)
+	vm := New()
+	vm.Native["Bools.yes"] = func(args ...Value) Value { return true }
+	c, err := vm.DefineClass(a.Class(0x0021, "Bools", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Bools", "not", true); err != nil || res != int32(0) || vm.ToGoType(res, "Z") != false {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Bools", "yes"); err != nil || res != int32(1) || vm.ToGoType(res, "Z") != true {
+		t.Error(res, err)
+	}
+	obj := c.New()
+	if _, err := vm.Call("Bools", "set", obj, 42); err != nil || obj.Field("flag") != int32(1) {
+		t.Error(obj.Field("flag"), err)
+	}
+	res, err := vm.Call("Bools", "flags", 7)
+	if s, ok := vm.GoSlice(res); err != nil || !ok || len(s) != 2 || s[0] != false || s[1] != true {
+		t.Error(res, err)
+	}
+	for i, want := range []int32{0, 1} {
+		if res, err := vm.Call("Bools", "get", []bool{false, true}, i); err != nil || res != want {
+			t.Error(i, res, err)
+		}
+	}
+	if res, err := vm.Call("Bools", "signed"); err != nil || res != int32(-56) {
+		t.Error(res, err)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	s := &Assembler{}
+	s.Field(0, "caught", "Z")
+	s.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	// public void run() { try { Thread.sleep(10000); } catch (InterruptedException e) { caught = true; } }
+	start, end, handler := s.Label(), s.Label(), s.Label()
+	s.Mark(start).Ldc(int64(10000)).Invoke(0xB8, "java/lang/Thread", "sleep", "(J)V").Mark(end).Return().
+		Mark(handler).Pop().Aload(0).Iconst(1).Putfield("Sleeper", "caught", "Z").Return().
+		Catch(start, end, handler, "java/lang/InterruptedException").
+		Method(0x0001, "run", "()V", 2, 1)
+	// static boolean test() { Sleeper s = new Sleeper(); Thread t = new Thread(s); t.start(); t.interrupt(); t.join(); return s.caught; }
+	s.New("Sleeper").Dup().Invoke(0xB7, "Sleeper", "<init>", "()V").Astore(0).
+		New("java/lang/Thread").Dup().Aload(0).Invoke(0xB7, "java/lang/Thread", "<init>", "(Ljava/lang/Runnable;)V").Astore(1).
+		Aload(1).Invoke(0xB6, "java/lang/Thread", "start", "()V").
+		Aload(1).Invoke(0xB6, "java/lang/Thread", "interrupt", "()V").
+		Aload(1).Invoke(0xB6, "java/lang/Thread", "join", "()V").
+		Aload(0).Getfield("Sleeper", "caught", "Z").Ireturn().
+		Method(0x0009, "test", "()Z", 3, 2)
+	// static int flags() {
+	//   Thread.currentThread().interrupt();
+	//   return Thread.currentThread().isInterrupted() + Thread.interrupted() + Thread.interrupted();
+	// }
+	s.Invoke(0xB8, "java/lang/Thread", "currentThread", "()Ljava/lang/Thread;").Invoke(0xB6, "java/lang/Thread", "interrupt", "()V").
+		Invoke(0xB8, "java/lang/Thread", "currentThread", "()Ljava/lang/Thread;").Invoke(0xB6, "java/lang/Thread", "isInterrupted", "()Z").
+		Invoke(0xB8, "java/lang/Thread", "interrupted", "()Z").Iadd().
+		Invoke(0xB8, "java/lang/Thread", "interrupted", "()Z").Iadd().Ireturn().
+		Method(0x0009, "flags", "()I", 2, 0)
+	vm := New()
+	if _, err := vm.DefineClass(s.Class(0x0021, "Sleeper", "java/lang/Object", "java/lang/Runnable")); err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	if res, err := vm.Call("Sleeper", "test"); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if d := time.Since(begin); d > 5*time.Second {
+		t.Error(d)
+	}
+	if res, err := vm.Call("Sleeper", "flags"); err != nil || res != int32(2) {
+		t.Error(res, err)
+	}
+}
+
+func TestSystemOut(t *testing.T) {
+	a := &Assembler{}
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	a.Ldc("point").Areturn().Method(0x0001, "toString", "()Ljava/lang/String;", 1, 1)
+	out := func(a *Assembler) *Assembler {
+		return a.Getstatic("java/lang/System", "out", "Ljava/io/PrintStream;")
+	}
+	out(a).Ldc("hello").Invoke(0xB6, "java/io/PrintStream", "println", "(Ljava/lang/String;)V")
+	out(a).Iconst(5).Invoke(0xB6, "java/io/PrintStream", "print", "(I)V")
+	out(a).Iconst('!').Invoke(0xB6, "java/io/PrintStream", "print", "(C)V")
+	out(a).Iconst(1).Invoke(0xB6, "java/io/PrintStream", "println", "(Z)V")
+	out(a).Ldc(float64(1.5)).Invoke(0xB6, "java/io/PrintStream", "println", "(D)V")
+	out(a).Ldc(float32(1e10)).Invoke(0xB6, "java/io/PrintStream", "println", "(F)V")
+	out(a).New("Point").Dup().Invoke(0xB7, "Point", "<init>", "()V").Invoke(0xB6, "java/io/PrintStream", "println", "(Ljava/lang/Object;)V")
+	out(a).Iconst(0).Newarray(10).Invoke(0xB6, "java/io/PrintStream", "println", "(Ljava/lang/Object;)V")
+	out(a).Op(0x01).Invoke(0xB6, "java/io/PrintStream", "println", "(Ljava/lang/Object;)V")
+	out(a).Invoke(0xB6, "java/io/PrintStream", "flush", "()V")
+	a.Getstatic("java/lang/System", "err", "Ljava/io/PrintStream;").Ldc("oops").Invoke(0xB6, "java/io/PrintStream", "println", "(Ljava/lang/String;)V").
+		Return().Method(0x0009, "main", "()V", 3, 0)
+	vm := New()
+	var stdout, stderr bytes.Buffer
+	vm.Stdout, vm.Stderr = &stdout, &stderr
+	if _, err := vm.DefineClass(a.Class(0x0021, "Point", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.Call("Point", "main"); err != nil {
+		t.Fatal(err)
+	}
+	if s := stdout.String(); s != "hello\n5!true\n1.5\n1.0E10\npoint\n[]\nnull\n" {
+		t.Errorf("%q", s)
+	}
+	if s := stderr.String(); s != "oops\n" {
+		t.Errorf("%q", s)
+	}
+}
+
+// classFile encodes an assembled class in the class file format, so that it
+// can be loaded from the class path.
+func classFile(c Class) []byte {
+	var buf bytes.Buffer
+	u1 := func(n uint8) { buf.WriteByte(n) }
+	u2 := func(n uint16) { binary.Write(&buf, binary.BigEndian, n) }
+	u4 := func(n uint32) { binary.Write(&buf, binary.BigEndian, n) }
+	utf8 := func(s string) uint16 {
+		for i, k := range c.ConstPool {
+			if k.Tag == TagUTF8 && k.String == s {
+				return uint16(i + 1)
+			}
+		}
+		panic("missing constant " + s)
+	}
+	class := func(s string) uint16 {
+		for i, k := range c.ConstPool {
+			if k.Tag == TagClass && c.ConstPool.Resolve(k.NameIndex) == s {
+				return uint16(i + 1)
+			}
+		}
+		panic("missing class " + s)
+	}
+	attrs := func(attrs []Attribute) {
+		u2(uint16(len(attrs)))
+		for _, a := range attrs {
+			u2(utf8(a.Name))
+			u4(uint32(len(a.Data)))
+			buf.Write(a.Data)
+		}
+	}
+	u4(0xCAFEBABE)
+	u2(0)
+	u2(52)
+	u2(uint16(len(c.ConstPool) + 1))
+	for i := 0; i < len(c.ConstPool); i++ {
+		k := c.ConstPool[i]
+		u1(uint8(k.Tag))
+		switch k.Tag {
+		case TagClass:
+			u2(k.NameIndex)
+		case TagFieldRef, TagMethodRef, TagInterfaceMethodRef:
+			u2(k.ClassIndex)
+			u2(k.NameAndTypeIndex)
+		case TagString:
+			u2(k.StringIndex)
+		case TagInteger:
+			u4(uint32(k.Integer))
+		case TagFloat:
+			u4(math.Float32bits(k.Float))
+		case TagLong:
+			binary.Write(&buf, binary.BigEndian, k.Long)
+			i++
+		case TagDouble:
+			binary.Write(&buf, binary.BigEndian, k.Double)
+			i++
+		case TagNameAndType:
+			u2(k.NameIndex)
+			u2(k.DescIndex)
+		case TagUTF8:
+			u2(uint16(len(k.String)))
+			buf.WriteString(k.String)
+		}
+	}
+	u2(c.Flags)
+	u2(class(c.Name))
+	u2(class(c.Super))
+	u2(uint16(len(c.Interfaces)))
+	for _, i := range c.Interfaces {
+		u2(class(i))
+	}
+	for _, fields := range [][]Field{c.Fields, c.Methods} {
+		u2(uint16(len(fields)))
+		for _, f := range fields {
+			u2(f.Flags)
+			u2(utf8(f.Name))
+			u2(utf8(f.Descriptor))
+			attrs(f.Attributes)
+		}
+	}
+	attrs(c.Attributes)
+	return buf.Bytes()
+}
+
+func TestClassInit(t *testing.T) {
+	dir := t.TempDir()
+	// class A { static int a = B.b + 1; static int get() { return a; } }
+	a := &Assembler{}
+	a.Field(0x0008, "a", "I")
+	a.Getstatic("B", "b", "I").Iconst(1).Iadd().Putstatic("A", "a", "I").Return().Method(0x0008, "<clinit>", "()V", 2, 0)
+	a.Getstatic("A", "a", "I").Ireturn().Method(0x0008, "get", "()I", 1, 0)
+	// class B { static int b = A.a + 1; }
+	b := &Assembler{}
+	b.Field(0x0008, "b", "I")
+	b.Getstatic("A", "a", "I").Iconst(1).Iadd().Putstatic("B", "b", "I").Return().Method(0x0008, "<clinit>", "()V", 2, 0)
+	// class Slow { static int n = Slow.block(42); }
+	slow := &Assembler{}
+	slow.Field(0x0008, "n", "I")
+	slow.Method(0x0109, "block", "(I)I", 0, 0)
+	slow.Iconst(42).Invoke(0xB8, "Slow", "block", "(I)I").Putstatic("Slow", "n", "I").Return().Method(0x0008, "<clinit>", "()V", 1, 0)
+	slow.Getstatic("Slow", "n", "I").Ireturn().Method(0x0008, "get", "()I", 1, 0)
+	for _, c := range []Class{
+		a.Class(0x0021, "A", "java/lang/Object"),
+		b.Class(0x0021, "B", "java/lang/Object"),
+		slow.Class(0x0021, "Slow", "java/lang/Object"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vm := New(dir)
+	if res, err := vm.Call("A", "get"); err != nil || res != int32(2) {
+		t.Error(res, err)
+	}
+	if c, err := vm.Class("B"); err != nil || c.Field("b") != int32(1) {
+		t.Error(c, err)
+	}
+
+	// A second goroutine waits for the initializer running in the first one.
+	started, release := make(chan struct{}), make(chan struct{})
+	vm.Native["Slow.block"] = func(args ...Value) Value {
+		close(started)
+		<-release
+		return args[0]
+	}
+	first := make(chan error, 1)
+	go func() {
+		_, err := vm.Class("Slow")
+		first <- err
+	}()
+	<-started
+	second := make(chan Value, 1)
+	go func() {
+		res, _ := vm.Call("Slow", "get")
+		second <- res
+	}()
+	select {
+	case res := <-second:
+		t.Fatal("read a half-initialized class:", res)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Error(err)
+	}
+	select {
+	case res := <-second:
+		if res != int32(42) {
+			t.Error(res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("initialization did not finish")
+	}
+}
+
+func TestLazyClassInit(t *testing.T) {
+	dir := t.TempDir()
+	// class Log { static int log; }
+	logClass := &Assembler{}
+	logClass.Field(0x0008, "log", "I")
+	// Each initializer appends its digit to Log.log.
+	initializer := func(a *Assembler, digit int32) {
+		a.Getstatic("Log", "log", "I").Iconst(10).Imul().Iconst(digit).Iadd().Putstatic("Log", "log", "I").Return().
+			Method(0x0008, "<clinit>", "()V", 2, 0)
+	}
+	parent, child, other := &Assembler{}, &Assembler{}, &Assembler{}
+	initializer(parent, 1)
+	initializer(child, 2)
+	child.Return().Method(0x0008, "touch", "()V", 0, 0)
+	initializer(other, 3)
+	other.Aload(0).Invoke(0xB7, "java/lang/Exception", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	// static int run() {
+	//   try { throw null; } catch (Other e) {} catch (NullPointerException e) {}
+	//   Child.touch();
+	//   new Other();
+	//   return Log.log;
+	// }
+	main := &Assembler{}
+	start, end, handler := main.Label(), main.Label(), main.Label()
+	main.Mark(start).Op(0x01).Athrow().Mark(end).
+		Mark(handler).Pop().
+		Invoke(0xB8, "Child", "touch", "()V").
+		New("Other").Dup().Invoke(0xB7, "Other", "<init>", "()V").Pop().
+		Getstatic("Log", "log", "I").Ireturn().
+		Catch(start, end, handler, "Other").
+		Catch(start, end, handler, "java/lang/NullPointerException").
+		Method(0x0009, "run", "()I", 2, 0)
+	for _, c := range []Class{
+		logClass.Class(0x0021, "Log", "java/lang/Object"),
+		parent.Class(0x0021, "Parent", "java/lang/Object"),
+		child.Class(0x0021, "Child", "Parent"),
+		other.Class(0x0021, "Other", "java/lang/Exception"),
+		main.Class(0x0021, "Main", "java/lang/Object"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	if res, err := vm.Call("Main", "run"); err != nil || res != int32(123) {
+		t.Error(res, err)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		code func(a *Assembler) *Assembler
+		want Value
+	}{
+		// Integer.MAX_VALUE + 1
+		{"iadd", func(a *Assembler) *Assembler { return a.Ldc(int32(math.MaxInt32)).Iconst(1).Iadd().Ireturn() }, int32(math.MinInt32)},
+		// Integer.MIN_VALUE - 1
+		{"isub", func(a *Assembler) *Assembler { return a.Ldc(int32(math.MinInt32)).Iconst(1).Isub().Ireturn() }, int32(math.MaxInt32)},
+		// 65536 * 65536
+		{"imul", func(a *Assembler) *Assembler { return a.Ldc(int32(65536)).Dup().Imul().Ireturn() }, int32(0)},
+		// Integer.MAX_VALUE * 2
+		{"imul2", func(a *Assembler) *Assembler { return a.Ldc(int32(math.MaxInt32)).Iconst(2).Imul().Ireturn() }, int32(-2)},
+		// int i = Integer.MAX_VALUE; i++;
+		{"iinc", func(a *Assembler) *Assembler {
+			return a.Ldc(int32(math.MaxInt32)).Istore(0).Iinc(0, 1).Iload(0).Ireturn()
+		}, int32(math.MinInt32)},
+		// 10 + 1, with BIPUSH
+		{"bipush", func(a *Assembler) *Assembler { return a.Iconst(10).Iconst(1).Iadd().Ireturn() }, int32(11)},
+		// 1000 + -100, with SIPUSH and BIPUSH
+		{"sipush", func(a *Assembler) *Assembler { return a.Iconst(1000).Iconst(-100).Iadd().Ireturn() }, int32(900)},
+		// -32768 - 1
+		{"sipush2", func(a *Assembler) *Assembler { return a.Iconst(-32768).Iconst(1).Isub().Ireturn() }, int32(-32769)},
+		// -128 + 127, with BIPUSH sign-extended to int
+		{"bipush2", func(a *Assembler) *Assembler { return a.Op(0x10, 0x80).Op(0x10, 0x7F).Iadd().Ireturn() }, int32(-1)},
+		// 32767 + 1, with SIPUSH
+		{"sipush3", func(a *Assembler) *Assembler { return a.Op(0x11, 0x7F, 0xFF).Iconst(1).Iadd().Ireturn() }, int32(32768)},
+		// (char) -1
+		{"i2c", func(a *Assembler) *Assembler { return a.Iconst(-1).Op(0x92).Ireturn() }, int32(65535)},
+		// Long.MAX_VALUE + 1
+		{"ladd", func(a *Assembler) *Assembler {
+			return a.Ldc(int64(math.MaxInt64)).Ldc(int64(1)).Op(0x61).Lreturn()
+		}, int64(math.MinInt64)},
+		// Long.MIN_VALUE - 1
+		{"lsub", func(a *Assembler) *Assembler {
+			return a.Ldc(int64(math.MinInt64)).Ldc(int64(1)).Op(0x65).Lreturn()
+		}, int64(math.MaxInt64)},
+		// 4294967296L * 4294967296L
+		{"lmul", func(a *Assembler) *Assembler {
+			return a.Ldc(int64(1 << 32)).Op(0x5C).Op(0x69).Lreturn() // DUP2, LMUL
+		}, int64(0)},
+	} {
+		desc := "()I"
+		if _, ok := test.want.(int64); ok {
+			desc = "()J"
+		}
+		a := &Assembler{}
+		test.code(a).Method(0x0009, "run", desc, 4, 1)
+		for _, raw := range []bool{false, true} {
+			vm := New()
+			vm.RawBytecode = raw
+			if _, err := vm.DefineClass(a.Class(0x0021, "Overflow", "java/lang/Object")); err != nil {
+				t.Fatal(err)
+			}
+			if res, err := vm.Call("Overflow", "run"); err != nil || res != test.want {
+				t.Errorf("%s (raw %v): %#v %v", test.name, raw, res, err)
+			}
+		}
+	}
+}
+
+func TestClassJSON(t *testing.T) {
+	f, err := os.Open("testdata/FieldsAndMethods.class")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c, err := Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump struct {
+		Name      string
+		Super     string
+		Constants []struct {
+			Tag, Class, Name, Descriptor string
+		}
+		Fields []struct {
+			Name       string
+			Attributes []struct {
+				Name  string
+				Value interface{}
+			}
+		}
+		Methods []struct {
+			Name, Descriptor string
+			Attributes       []struct {
+				Name      string
+				Data      []byte
+				MaxStack  int
+				MaxLocals int
+			}
+		}
+	}
+	if err := json.Unmarshal(b, &dump); err != nil {
+		t.Fatal(err)
+	}
+	if dump.Name != "FieldsAndMethods" || dump.Super != "java/lang/Object" || len(dump.Fields) != 2 || len(dump.Methods) != 10 {
+		t.Fatal(string(b))
+	}
+	found := false
+	for _, k := range dump.Constants {
+		if k.Tag == "Methodref" && k.Class == "Runtime" && k.Name == "log" && k.Descriptor == "(Ljava/lang/String;)V" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Runtime.log not found", dump.Constants)
+	}
+	for i, m := range dump.Methods {
+		if m.Name == "add" {
+			code, _ := codeAttribute(c.Methods[i])
+			if m.Descriptor != "(II)I" || len(m.Attributes) == 0 || m.Attributes[0].Name != "Code" ||
+				!bytes.Equal(m.Attributes[0].Data, code) || m.Attributes[0].MaxStack != 2 || m.Attributes[0].MaxLocals != 2 {
+				t.Error(m)
+			}
+		}
+	}
+}
+
+func TestInheritedFields(t *testing.T) {
+	dir := t.TempDir()
+	// class Animal {
+	//   String name; int legs;
+	//   Animal(String name) { this.name = name; }
+	//   String getName() { return name; }
+	// }
+	animal := &Assembler{}
+	animal.Field(0, "name", "Ljava/lang/String;").Field(0, "legs", "I")
+	animal.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").
+		Aload(0).Aload(1).Putfield("Animal", "name", "Ljava/lang/String;").Return().
+		Method(0x0001, "<init>", "(Ljava/lang/String;)V", 2, 2)
+	animal.Aload(0).Getfield("Animal", "name", "Ljava/lang/String;").Areturn().
+		Method(0x0001, "getName", "()Ljava/lang/String;", 1, 1)
+	// class Dog extends Animal {
+	//   Dog(String name) { super(name); legs = legs + 4; }
+	//   static Dog create() { return new Dog("Rex"); }
+	// }
+	dog := &Assembler{}
+	dog.Aload(0).Aload(1).Invoke(0xB7, "Animal", "<init>", "(Ljava/lang/String;)V").
+		Aload(0).Aload(0).Getfield("Dog", "legs", "I").Iconst(4).Iadd().Putfield("Dog", "legs", "I").Return().
+		Method(0x0001, "<init>", "(Ljava/lang/String;)V", 3, 2)
+	dog.New("Dog").Dup().Ldc("Rex").Invoke(0xB7, "Dog", "<init>", "(Ljava/lang/String;)V").Areturn().
+		Method(0x0009, "create", "()LDog;", 3, 0)
+	for _, c := range []Class{
+		animal.Class(0x0021, "Animal", "java/lang/Object"),
+		dog.Class(0x0021, "Dog", "Animal"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	res, err := vm.Call("Dog", "create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := res.(*Object)
+	if name, err := vm.CallMethod(obj, "getName", "()Ljava/lang/String;", obj); err != nil || vm.ToGo(name) != "Rex" {
+		t.Error(name, err)
+	}
+	if legs := obj.Field("legs"); legs != int32(4) {
+		t.Error(legs)
+	}
+	if c, _ := vm.Class("Dog"); c.New().Field("legs") != int32(0) {
+		t.Error("inherited field is not zeroed")
+	}
+}
+
+func TestFieldShadowing(t *testing.T) {
+	dir := t.TempDir()
+	// class Parent { int x; Parent() { x = 1; } int parentX() { return x; } }
+	parent := &Assembler{}
+	parent.Field(0, "x", "I")
+	parent.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").
+		Aload(0).Iconst(1).Putfield("Parent", "x", "I").Return().
+		Method(0x0001, "<init>", "()V", 2, 1)
+	parent.Aload(0).Getfield("Parent", "x", "I").Ireturn().Method(0x0001, "parentX", "()I", 1, 1)
+	// class Child extends Parent { int x; Child() { super(); x = 2; } int childX() { return x; } }
+	child := &Assembler{}
+	child.Field(0, "x", "I")
+	child.Aload(0).Invoke(0xB7, "Parent", "<init>", "()V").
+		Aload(0).Iconst(2).Putfield("Child", "x", "I").Return().
+		Method(0x0001, "<init>", "()V", 2, 1)
+	child.Aload(0).Getfield("Child", "x", "I").Ireturn().Method(0x0001, "childX", "()I", 1, 1)
+	for _, c := range []Class{
+		parent.Class(0x0021, "Parent", "java/lang/Object"),
+		child.Class(0x0021, "Child", "Parent"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	c, err := vm.Class("Child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := c.New()
+	if _, err := vm.CallMethod(obj, "<init>", "()V", obj); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.CallMethod(obj, "parentX", "()I", obj); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if res, err := vm.CallMethod(obj, "childX", "()I", obj); err != nil || res != int32(2) {
+		t.Error(res, err)
+	}
+	if x := obj.Field("x"); x != int32(2) {
+		t.Error(x)
+	}
+	if x := obj.Fields["Child.x"]; x != int32(2) {
+		t.Error(obj.Fields)
+	}
+}
+
+func TestConstructorStack(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0, "n", "I")
+	// Foo(int n) { this.n = n; }
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").
+		Aload(0).Iload(1).Putfield("Foo", "n", "I").Return().
+		Method(0x0001, "<init>", "(I)V", 2, 2)
+	newFoo := func(a *Assembler) *Assembler {
+		return a.New("Foo").Dup().Iconst(5).Invoke(0xB7, "Foo", "<init>", "(I)V")
+	}
+	// static Foo make() { return new Foo(5); }
+	newFoo(a).Areturn().Method(0x0009, "make", "()LFoo;", 3, 0)
+	// new Foo(5) leaves only the object, so popping it twice underflows.
+	newFoo(a).Pop().Pop().Return().Method(0x0009, "leftover", "()V", 3, 0)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Foo", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := vm.Call("Foo", "make")
+	if obj, ok := res.(*Object); err != nil || !ok || obj.Name != "Foo" || obj.Field("n") != int32(5) {
+		t.Error(res, err)
+	}
+	var e *VMError
+	if _, err := vm.Call("Foo", "leftover"); !errors.As(err, &e) || e.Method != "leftover" || e.Msg != "operand stack underflow" {
+		t.Error(err)
+	}
+}
+
+func TestArrayStore(t *testing.T) {
+	vm := New()
+	for _, c := range [][2]string{{"Animal", "java/lang/Object"}, {"Dog", "Animal"}, {"Cat", "Animal"}} {
+		a := &Assembler{}
+		a.Aload(0).Invoke(0xB7, c[1], "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+		if _, err := vm.DefineClass(a.Class(0x0021, c[0], c[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &Assembler{}
+	store := func(a *Assembler, class string) *Assembler {
+		return a.Aload(0).Iconst(0).New(class).Dup().Invoke(0xB7, class, "<init>", "()V").Op(0x53)
+	}
+	// static Animal[] dogs() { Animal[] a = new Dog[1]; a[0] = new Dog(); return a; }
+	store(a.Iconst(1).Anewarray("Dog").Astore(0), "Dog").Aload(0).Areturn().
+		Method(0x0009, "dogs", "()[LAnimal;", 4, 1)
+	// static int cat() {
+	//   Animal[] a = new Dog[1]; a[0] = null;
+	//   try { a[0] = new Cat(); } catch (ArrayStoreException e) { return a[0] == null ? 1 : 2; }
+	//   return 0;
+	// }
+	start, end, handler := a.Label(), a.Label(), a.Label()
+	a.Iconst(1).Anewarray("Dog").Astore(0).Aload(0).Iconst(0).Op(0x01).Op(0x53).Mark(start)
+	store(a, "Cat").Mark(end).Iconst(0).Ireturn().
+		Mark(handler).Pop().Aload(0).Iconst(0).Op(0x32).Branch(0xC7, end).Iconst(1).Ireturn().
+		Catch(start, end, handler, "java/lang/ArrayStoreException").
+		Method(0x0009, "cat", "()I", 4, 1)
+	// static void uncaught() { Animal[] a = new Dog[1]; a[0] = new Cat(); }
+	store(a.Iconst(1).Anewarray("Dog").Astore(0), "Cat").Return().
+		Method(0x0009, "uncaught", "()V", 4, 1)
+	if _, err := vm.DefineClass(a.Class(0x0021, "Store", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := vm.Call("Store", "dogs")
+	if a, ok := res.(*Array); err != nil || !ok || a.Desc != "[LDog;" || len(a.Values) != 1 || a.Values[0].(*Object).Name != "Dog" {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Store", "cat"); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	var exc *Exception
+	if _, err := vm.Call("Store", "uncaught"); !errors.As(err, &exc) || exc.Error() != "java/lang/ArrayStoreException: Cat" {
+		t.Error(err)
+	}
+}
+
+func TestDefaultMethods(t *testing.T) {
+	// interface Shape { int sides(); default int doubled() { return sides() * 2; } default int id() { return 1; } }
+	shape := &Assembler{}
+	shape.Method(0x0401, "sides", "()I", 0, 0)
+	shape.Aload(0).Invoke(0xB9, "Shape", "sides", "()I").Iconst(2).Imul().Ireturn().
+		Method(0x0001, "doubled", "()I", 2, 1)
+	shape.Iconst(1).Ireturn().Method(0x0001, "id", "()I", 1, 1)
+	// interface Square extends Shape { default int id() { return 2; } }
+	square := &Assembler{}
+	square.Iconst(2).Ireturn().Method(0x0001, "id", "()I", 1, 1)
+	// class Box implements Shape, Square { public int sides() { return 4; } }
+	box := &Assembler{}
+	box.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	box.Iconst(4).Ireturn().Method(0x0001, "sides", "()I", 1, 1)
+	newBox := func(a *Assembler) *Assembler {
+		return a.New("Box").Dup().Invoke(0xB7, "Box", "<init>", "()V")
+	}
+	test := &Assembler{}
+	// static int shape() { Shape s = new Box(); return s.doubled(); }
+	newBox(test).Invoke(0xB9, "Shape", "doubled", "()I").Ireturn().Method(0x0009, "shape", "()I", 2, 0)
+	// static int box() { return new Box().id(); }
+	newBox(test).Invoke(0xB6, "Box", "id", "()I").Ireturn().Method(0x0009, "box", "()I", 2, 0)
+	vm := New()
+	for _, c := range []Class{
+		shape.Class(0x0601, "Shape", "java/lang/Object"),
+		square.Class(0x0601, "Square", "java/lang/Object", "Shape"),
+		box.Class(0x0021, "Box", "java/lang/Object", "Shape", "Square"),
+		test.Class(0x0021, "Test", "java/lang/Object"),
+	} {
+		if _, err := vm.DefineClass(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, err := vm.Call("Test", "shape"); err != nil || res != int32(8) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Test", "box"); err != nil || res != int32(2) {
+		t.Error(res, err)
+	}
+	c, _ := vm.Class("Box")
+	obj := c.New()
+	if res, err := vm.CallMethod(obj, "doubled", "()I", obj); err != nil || res != int32(8) {
+		t.Error(res, err)
+	}
+}
+
+func TestChars(t *testing.T) {
+	a := &Assembler{}
+	// static void upper(char[] a) { for (int i = 0; i < a.length; i++) a[i] = Character.toUpperCase(a[i]); }
+	loop, end := a.Label(), a.Label()
+	a.Iconst(0).Istore(1).
+		Mark(loop).Iload(1).Aload(0).Op(0xBE).Branch(0xA2, end).             // ARRAYLENGTH, IF_ICMPGE
+		Aload(0).Iload(1).Aload(0).Iload(1).Op(0x34).                        // CALOAD
+		Invoke(0xB8, "java/lang/Character", "toUpperCase", "(C)C").Op(0x55). // CASTORE
+		Iinc(1, 1).Goto(loop).
+		Mark(end).Return().
+		Method(0x0009, "upper", "([C)V", 4, 2)
+	// static String shout(String s) { char[] a = s.toCharArray(); upper(a); return new String(a); }
+	a.Aload(0).Invoke(0xB6, "java/lang/String", "toCharArray", "()[C").Astore(1).
+		Aload(1).Invoke(0xB8, "Chars", "upper", "([C)V").
+		New("java/lang/String").Dup().Aload(1).Invoke(0xB7, "java/lang/String", "<init>", "([C)V").Areturn().
+		Method(0x0009, "shout", "(Ljava/lang/String;)Ljava/lang/String;", 3, 2)
+	// static boolean digitAt(String s, int i) { return Character.isDigit(s.charAt(i)); }
+	a.Aload(0).Iload(1).Invoke(0xB6, "java/lang/String", "charAt", "(I)C").
+		Invoke(0xB8, "java/lang/Character", "isDigit", "(C)Z").Ireturn().
+		Method(0x0009, "digitAt", "(Ljava/lang/String;I)Z", 2, 2)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Chars", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Chars", "shout", "h\u00e9llo, w\u00f6rld \U0001F600"); err != nil || vm.ToGo(res) != "H\u00c9LLO, W\u00d6RLD \U0001F600" {
+		t.Error(vm.ToGo(res), err)
+	}
+	chars := []uint16{'a', 0x00FF, '1'}
+	if _, err := vm.Call("Chars", "upper", chars); err != nil || chars[0] != 'A' || chars[1] != 0x0178 || chars[2] != '1' {
+		t.Error(chars, err)
+	}
+	if res, err := vm.Call("Chars", "digitAt", "a1", 1); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	var exc *Exception
+	if _, err := vm.Call("Chars", "digitAt", "a1", 2); !errors.As(err, &exc) || exc.Object.Name != "java/lang/StringIndexOutOfBoundsException" {
+		t.Error(err)
+	}
+}
+
+func TestFloatSpecialValues(t *testing.T) {
+	nan, inf, negZero := math.NaN(), math.Inf(1), math.Copysign(0, -1)
+	for _, test := range []struct {
+		op      string
+		a, b    float64
+		want    float64
+		float32 bool
+	}{
+		{op: "add", a: nan, b: 1, want: nan},
+		{op: "add", a: 1, b: nan, want: nan},
+		{op: "add", a: inf, b: -inf, want: nan},
+		{op: "add", a: inf, b: 1, want: inf},
+		{op: "add", a: negZero, b: 0, want: 0},
+		{op: "add", a: negZero, b: negZero, want: negZero},
+		{op: "sub", a: nan, b: 1, want: nan},
+		{op: "sub", a: inf, b: inf, want: nan},
+		{op: "sub", a: 1, b: inf, want: -inf},
+		{op: "sub", a: 0, b: 0, want: 0},
+		{op: "sub", a: negZero, b: 0, want: negZero},
+		{op: "mul", a: nan, b: 0, want: nan},
+		{op: "mul", a: inf, b: 0, want: nan},
+		{op: "mul", a: inf, b: -2, want: -inf},
+		{op: "mul", a: negZero, b: 1, want: negZero},
+		{op: "mul", a: negZero, b: negZero, want: 0},
+		{op: "mul", a: 1e200, b: 1e200, want: inf},
+		{op: "mul", a: 1e30, b: 1e30, want: inf, float32: true},
+		{op: "mul", a: 1e-30, b: -1e-30, want: negZero, float32: true},
+	} {
+		for _, single := range []bool{true, false} {
+			if test.float32 && !single {
+				continue
+			}
+			a := &Assembler{}
+			var desc string
+			if single {
+				a.Ldc(float32(test.a)).Ldc(float32(test.b))
+				a.Op(map[string]byte{"add": 0x62, "sub": 0x66, "mul": 0x6A}[test.op]).Freturn()
+				desc = "()F"
+			} else {
+				a.Ldc(test.a).Ldc(test.b)
+				a.Op(map[string]byte{"add": 0x63, "sub": 0x67, "mul": 0x6B}[test.op]).Dreturn()
+				desc = "()D"
+			}
+			a.Method(0x0009, "run", desc, 4, 0)
+			vm := New()
+			if _, err := vm.DefineClass(a.Class(0x0021, "Floats", "java/lang/Object")); err != nil {
+				t.Fatal(err)
+			}
+			res, err := vm.Call("Floats", "run")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got float64
+			if single {
+				got = float64(res.(float32))
+			} else {
+				got = res.(float64)
+			}
+			if math.IsNaN(test.want) && !math.IsNaN(got) ||
+				!math.IsNaN(test.want) && math.Float64bits(got) != math.Float64bits(test.want) {
+				t.Errorf("%v %s %v (single %v) = %v, want %v", test.a, test.op, test.b, single, got, test.want)
+			}
+		}
+	}
+}
+
+func TestReferenceLocals(t *testing.T) {
+	a := &Assembler{}
+	// static Object keep(Object o) { Object n = null, m, k, x = o; m = n; k = x; return m == null ? k : "lost null"; }
+	lost := a.Label()
+	a.Op(0x01).Astore(1).Aload(0).Astore(4).Aload(1).Astore(2).Aload(4).Astore(3).
+		Aload(2).Branch(0xC7, lost).Aload(3).Areturn().
+		Mark(lost).Ldc("lost null").Areturn().
+		Method(0x0009, "keep", "(Ljava/lang/Object;)Ljava/lang/Object;", 1, 5)
+	vm := New()
+	c, err := vm.DefineClass(a.Class(0x0021, "Refs", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, arr := c.New(), []Value{int32(1)}
+	for _, raw := range []bool{false, true} {
+		vm.RawBytecode = raw
+		for _, v := range []Value{obj, vm.InternString("s")} {
+			if res, err := vm.Call("Refs", "keep", v); err != nil || res != v {
+				t.Error(raw, res, err)
+			}
+		}
+		if res, err := vm.Call("Refs", "keep", arr); err != nil || !sameRef(res, arr) {
+			t.Error(raw, res, err)
+		}
+		if res, err := vm.Call("Refs", "keep", nil); err != nil || res != nil {
+			t.Errorf("%v: %#v %v", raw, res, err)
+		}
+	}
+}
+
+func TestStrictOpcodes(t *testing.T) {
+	a := &Assembler{}
+	// static int ret() { RET 0; return 1; }
+	a.Op(0xA9, 0).Iconst(1).Ireturn().Method(0x0009, "ret", "()I", 1, 1)
+	for _, raw := range []bool{false, true} {
+		vm := New()
+		vm.RawBytecode = raw
+		if _, err := vm.DefineClass(a.Class(0x0021, "Strict", "java/lang/Object")); err != nil {
+			t.Fatal(err)
+		}
+		if res, err := vm.Call("Strict", "ret"); err != nil || res != int32(1) {
+			t.Error(raw, res, err)
+		}
+		vm.StrictOpcodes = true
+		var e *VMError
+		if _, err := vm.Call("Strict", "ret"); !errors.As(err, &e) || e.Msg != "unimplemented opcode 0xa9 at IP 0" {
+			t.Error(raw, err)
+		}
+	}
+}
+
+func TestByteShort(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0x0008, "b", "B").Field(0x0008, "s", "S")
+	// static byte count(int n) { byte b = 0; for (int i = 0; i < n; i++) b++; return b; }
+	loop, end := a.Label(), a.Label()
+	a.Iconst(0).Istore(1).Iconst(0).Istore(2).
+		Mark(loop).Iload(2).Iload(0).Branch(0xA2, end).
+		Iload(1).Iconst(1).Iadd().Op(0x91).Istore(1). // I2B
+		Iinc(2, 1).Goto(loop).
+		Mark(end).Iload(1).Ireturn().
+		Method(0x0009, "count", "(I)B", 2, 3)
+	// static void put(int n) { b = n; s = n; }, without the casts javac would insist on
+	a.Iload(0).Putstatic("Bytes", "b", "B").Iload(0).Putstatic("Bytes", "s", "S").Return().
+		Method(0x0009, "put", "(I)V", 1, 1)
+	// static short last(int n) { short[] a = new short[1]; a[0] = n; return a[0]; }, likewise
+	a.Iconst(1).Newarray(9).Dup().Iconst(0).Iload(0).Op(0x56).Iconst(0).Op(0x35).Ireturn().
+		Method(0x0009, "last", "(I)S", 4, 1)
+	// static int widen(byte b, short s) { return b + s; }
+	a.Iload(0).Iload(1).Iadd().Ireturn().Method(0x0009, "widen", "(BS)I", 2, 2)
+	vm := New()
+	c, err := vm.DefineClass(a.Class(0x0021, "Bytes", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range map[int32]int32{300: 44, 200: -56, 127: 127} {
+		if res, err := vm.Call("Bytes", "count", n); err != nil || res != want {
+			t.Error(n, res, err)
+		}
+	}
+	if _, err := vm.Call("Bytes", "put", 300); err != nil || c.Field("b") != int32(44) || c.Field("s") != int32(300) {
+		t.Error(c.Field("b"), c.Field("s"), err)
+	}
+	if _, err := vm.Call("Bytes", "put", 70000); err != nil || c.Field("b") != int32(112) || c.Field("s") != int32(4464) {
+		t.Error(c.Field("b"), c.Field("s"), err)
+	}
+	if res, err := vm.Call("Bytes", "last", 40000); err != nil || res != int32(-25536) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Bytes", "widen", int8(-3), int16(-300)); err != nil || res != int32(-303) {
+		t.Error(res, err)
+	}
+	if _, err := vm.Call("Bytes", "widen", 128, 0); err == nil {
+		t.Error("128 is not a byte")
+	}
+}
+
+func TestInnerClasses(t *testing.T) {
+	dir := t.TempDir()
+	nested := func(a *Assembler) Attribute {
+		// Outer$Inner is a public static member class of Outer named Inner
+		data := []byte{0, 1}
+		for _, n := range []uint16{a.ConstClass("Outer$Inner"), a.ConstClass("Outer"), a.ConstUTF8("Inner"), 0x0009} {
+			data = append(data, byte(n>>8), byte(n))
+		}
+		a.ConstUTF8("InnerClasses")
+		return Attribute{Name: "InnerClasses", Data: data}
+	}
+	// class Outer { static int get() { return Inner.value(); } static class Inner { static int value() { return 5; } } }
+	outer := &Assembler{}
+	outer.Invoke(0xB8, "Outer$Inner", "value", "()I").Ireturn().Method(0x0009, "get", "()I", 1, 0)
+	inner := &Assembler{}
+	inner.Iconst(5).Ireturn().Method(0x0009, "value", "()I", 1, 0)
+	outerAttr, innerAttr := nested(outer), nested(inner)
+	for _, c := range []Class{
+		outer.Class(0x0021, "Outer", "java/lang/Object"),
+		inner.Class(0x0021, "Outer$Inner", "java/lang/Object"),
+	} {
+		if c.Name == "Outer" {
+			c.Attributes = append(c.Attributes, outerAttr)
+		} else {
+			c.Attributes = append(c.Attributes, innerAttr)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	if res, err := vm.Call("Outer", "get"); err != nil || res != int32(5) {
+		t.Fatal(res, err)
+	}
+	want := []InnerClass{{Inner: "Outer$Inner", Outer: "Outer", Name: "Inner", Flags: 0x0009}}
+	for _, name := range []string{"Outer", "Outer$Inner"} {
+		c, err := vm.Class(name)
+		if err != nil || !reflect.DeepEqual(c.InnerClasses, want) {
+			t.Error(name, c.InnerClasses, err)
+		}
+	}
+}
+
+func TestPrimitiveArrays(t *testing.T) {
+	a := &Assembler{}
+	// static void copy(Object src, int srcPos, Object dst, int dstPos, int n) { System.arraycopy(src, srcPos, dst, dstPos, n); }
+	a.Aload(0).Iload(1).Aload(2).Iload(3).Iload(4).
+		Invoke(0xB8, "java/lang/System", "arraycopy", "(Ljava/lang/Object;ILjava/lang/Object;II)V").Return().
+		Method(0x0009, "copy", "(Ljava/lang/Object;ILjava/lang/Object;II)V", 5, 5)
+	// static void shift(int[] i, long[] l, float[] f, double[] d, short[] s) { i[0] = i[1]; l[0] = l[1]; f[0] = f[1]; d[0] = d[1]; s[0] = s[1]; }
+	for k, op := range [][2]byte{{0x2E, 0x4F}, {0x2F, 0x50}, {0x30, 0x51}, {0x31, 0x52}, {0x35, 0x56}} {
+		a.Aload(k).Iconst(0).Aload(k).Iconst(1).Op(op[0]).Op(op[1])
+	}
+	a.Return().Method(0x0009, "shift", "([I[J[F[D[S)V", 4, 5)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Arrays", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	i, l, f, d, s := []int32{0, 1}, []int64{0, 1 << 40}, []float32{0, 1.5}, []float64{0, 2.5}, []int16{0, -1}
+	if _, err := vm.Call("Arrays", "shift", i, l, f, d, s); err != nil {
+		t.Fatal(err)
+	}
+	if i[0] != 1 || l[0] != 1<<40 || f[0] != 1.5 || d[0] != 2.5 || s[0] != -1 {
+		t.Error(i, l, f, d, s)
+	}
+	ints := []int{0, 1}
+	if _, err := vm.Call("Arrays", "shift", ints, l, f, d, s); err != nil || ints[0] != 0 {
+		t.Error(ints, err)
+	}
+	n := []int32{1, 2, 3, 4, 5}
+	if _, err := vm.Call("Arrays", "copy", n, 0, n, 1, 3); err != nil || !reflect.DeepEqual(n, []int32{1, 1, 2, 3, 5}) {
+		t.Error(n, err)
+	}
+	words := []Value{vm.InternString("a"), vm.InternString("b")}
+	dst := make([]Value, 3)
+	if _, err := vm.Call("Arrays", "copy", words, 0, dst, 1, 2); err != nil || dst[0] != nil || dst[1] != words[0] || dst[2] != words[1] {
+		t.Error(dst, err)
+	}
+	for _, test := range []struct {
+		Args []Value
+		Exc  string
+	}{
+		{[]Value{n, 0, l, 0, 1}, "java/lang/ArrayStoreException"},
+		{[]Value{n, 0, words, 0, 1}, "java/lang/ArrayStoreException"},
+		{[]Value{n, 3, n, 0, 3}, "java/lang/ArrayIndexOutOfBoundsException"},
+		{[]Value{n, 0, n, 0, -1}, "java/lang/ArrayIndexOutOfBoundsException"},
+		{[]Value{nil, 0, n, 0, 0}, "java/lang/NullPointerException"},
+	} {
+		var exc *Exception
+		if _, err := vm.Call("Arrays", "copy", test.Args...); !errors.As(err, &exc) || exc.Object.Name != test.Exc {
+			t.Error(test.Args, err)
+		}
+	}
+}
+
+func TestFinalFields(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0x0011, "x", "I").Field(0x0019, "ORIGIN", "I")
+	// static { ORIGIN = 2; }
+	a.Iconst(2).Putstatic("Point", "ORIGIN", "I").Return().Method(0x0008, "<clinit>", "()V", 1, 0)
+	// Point(int x) { this.x = x; }
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").
+		Aload(0).Iload(1).Putfield("Point", "x", "I").Return().
+		Method(0x0001, "<init>", "(I)V", 2, 2)
+	// void setX(int x) { this.x = x; } and static void reset() { ORIGIN = 0; }, which javac would reject
+	a.Aload(0).Iload(1).Putfield("Point", "x", "I").Return().Method(0x0001, "setX", "(I)V", 2, 2)
+	a.Iconst(0).Putstatic("Point", "ORIGIN", "I").Return().Method(0x0009, "reset", "()V", 1, 0)
+	for _, strict := range []bool{false, true} {
+		vm := New()
+		vm.CheckFinal = strict
+		c, err := vm.DefineClass(a.Class(0x0021, "Point", "java/lang/Object"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := c.New()
+		if _, err := vm.CallMethod(obj, "<init>", "(I)V", obj, 3); err != nil || obj.Field("x") != int32(3) || c.Field("ORIGIN") != int32(2) {
+			t.Fatal(strict, obj.Field("x"), c.Field("ORIGIN"), err)
+		}
+		_, err = vm.CallMethod(obj, "setX", "(I)V", obj, 4)
+		if strict && (!errors.Is(err, ErrIllegalAccess) || !strings.Contains(err.Error(), "final field Point.x from Point.setX")) {
+			t.Error(err)
+		} else if !strict && (err != nil || obj.Field("x") != int32(4)) {
+			t.Error(obj.Field("x"), err)
+		}
+		if _, err := vm.Call("Point", "reset"); strict != errors.Is(err, ErrIllegalAccess) {
+			t.Error(strict, err)
+		}
+		if err := vm.SetField(obj, "x", 5, false); strict != errors.Is(err, ErrIllegalAccess) {
+			t.Error(strict, err)
+		}
+		if err := vm.SetField(obj, "x", int32(6), true); err != nil || obj.Field("x") != int32(6) {
+			t.Error(obj.Field("x"), err)
+		}
+	}
+}
+
+func TestCheckCast(t *testing.T) {
+	a := &Assembler{}
+	// static int store(Object o) {
+	//   Object[] a = new String[1];
+	//   try { a[0] = o; } catch (ArrayStoreException e) { return 0; }
+	//   return 1;
+	// }
+	start, end, handler := a.Label(), a.Label(), a.Label()
+	a.Iconst(1).Anewarray("java/lang/String").Astore(1).Mark(start).
+		Aload(1).Iconst(0).Aload(0).Op(0x53).Mark(end).Iconst(1).Ireturn().
+		Mark(handler).Pop().Iconst(0).Ireturn().
+		Catch(start, end, handler, "java/lang/ArrayStoreException").
+		Method(0x0009, "store", "(Ljava/lang/Object;)I", 3, 2)
+	// static boolean is(Object o) { return o instanceof String; }
+	a.Aload(0).ClassOp(0xC1, "java/lang/String").Ireturn().Method(0x0009, "is", "(Ljava/lang/Object;)Z", 1, 1)
+	// static String cast(Object o) { return (String) o; }
+	a.Aload(0).ClassOp(0xC0, "java/lang/String").Areturn().
+		Method(0x0009, "cast", "(Ljava/lang/Object;)Ljava/lang/String;", 1, 1)
+	// static Object[] array(Object o) { return (Object[]) o; }
+	a.Aload(0).ClassOp(0xC0, "[Ljava/lang/Object;").Areturn().
+		Method(0x0009, "array", "(Ljava/lang/Object;)[Ljava/lang/Object;", 1, 1)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Cast", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := vm.Class("java/lang/Object")
+	obj := c.New()
+	for _, test := range []struct {
+		arg         Value
+		store, isOK int32
+	}{{"s", 1, 1}, {obj, 0, 0}, {nil, 1, 0}} {
+		if res, err := vm.Call("Cast", "store", test.arg); err != nil || res != test.store {
+			t.Error(test.arg, res, err)
+		}
+		if res, err := vm.Call("Cast", "is", test.arg); err != nil || res != test.isOK {
+			t.Error(test.arg, res, err)
+		}
+	}
+	if res, err := vm.Call("Cast", "cast", "s"); err != nil || vm.ToGo(res) != "s" {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Cast", "cast", nil); err != nil || res != nil {
+		t.Error(res, err)
+	}
+	var exc *Exception
+	if _, err := vm.Call("Cast", "cast", obj); !errors.As(err, &exc) || exc.Error() != "java/lang/ClassCastException: java/lang/Object cannot be cast to java/lang/String" {
+		t.Error(err)
+	}
+	strs := &Array{Desc: "[Ljava/lang/String;", Values: []Value{nil}}
+	if res, err := vm.Call("Cast", "array", strs); err != nil || res != strs {
+		t.Error(res, err)
+	}
+	if _, err := vm.Call("Cast", "array", []int32{1}); !errors.As(err, &exc) || exc.Object.Name != "java/lang/ClassCastException" {
+		t.Error(err)
+	}
+}
+
+func TestInvoker(t *testing.T) {
+	vm := New()
+	if _, err := vm.DefineClass(fibClass()); err != nil {
+		t.Fatal(err)
+	}
+	fib, err := vm.Resolve("Fib", "fib", "(I)I")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range []int32{0, 1, 1, 2, 3, 5, 8} {
+		if res, err := fib.Invoke(n); err != nil || res != want {
+			t.Error(n, res, err)
+		}
+	}
+	if _, err := fib.Invoke("x"); err == nil {
+		t.Error("want argument error")
+	}
+	if _, err := vm.Resolve("Fib", "fib", "(J)J"); err == nil {
+		t.Error("want method not found")
+	}
+	if _, err := vm.Resolve("NoSuchClass", "fib", ""); err == nil {
+		t.Error("want class not found")
+	}
+}
+
+func TestInvokeSpecial(t *testing.T) {
+	vm := New()
+	describe := func(a *Assembler, s string) *Assembler {
+		return a.Ldc(s).Areturn().Method(0x0001, "describe", "()Ljava/lang/String;", 1, 1)
+	}
+	// class Base { String describe() { return "base"; } }
+	// class Sub extends Base {
+	//   String describe() { return "sub"; }
+	//   String parent() { return super.describe(); }
+	//   String self() { return describe(); }
+	// }
+	// class Leaf extends Sub {
+	//   String describe() { return "leaf"; }
+	//   // super.describe() compiled when Sub didn't override it, naming Base
+	//   String base() { return super.describe(); }
+	// }
+	base, sub, leaf := &Assembler{}, &Assembler{}, &Assembler{}
+	describe(base, "base")
+	describe(sub, "sub")
+	sub.Aload(0).Invoke(0xB7, "Base", "describe", "()Ljava/lang/String;").Areturn().
+		Method(0x0001, "parent", "()Ljava/lang/String;", 1, 1)
+	sub.Aload(0).Invoke(0xB6, "Sub", "describe", "()Ljava/lang/String;").Areturn().
+		Method(0x0001, "self", "()Ljava/lang/String;", 1, 1)
+	describe(leaf, "leaf")
+	leaf.Aload(0).Invoke(0xB7, "Base", "describe", "()Ljava/lang/String;").Areturn().
+		Method(0x0001, "base", "()Ljava/lang/String;", 1, 1)
+	for _, c := range []struct {
+		a           *Assembler
+		name, super string
+	}{{base, "Base", "java/lang/Object"}, {sub, "Sub", "Base"}, {leaf, "Leaf", "Sub"}} {
+		c.a.Aload(0).Invoke(0xB7, c.super, "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+		if _, err := vm.DefineClass(c.a.Class(0x0021, c.name, c.super)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		class, method, want string
+	}{
+		{"Sub", "parent", "base"},
+		{"Sub", "self", "sub"},
+		{"Leaf", "parent", "base"},
+		{"Leaf", "self", "leaf"},
+		{"Leaf", "base", "sub"}, // ACC_SUPER starts at Sub
+	} {
+		c, _ := vm.Class(test.class)
+		obj := c.New()
+		if res, err := vm.CallMethod(obj, test.method, "()Ljava/lang/String;", obj); err != nil || vm.ToGo(res) != test.want {
+			t.Error(test, vm.ToGo(res), err)
+		}
+	}
+}
+
+func TestConcurrentLoading(t *testing.T) {
+	dir := t.TempDir()
+	// class Base {}
+	base := &Assembler{}
+	// class Lazy extends Base { static int inits; static { inits++; } static int get() { return inits; } }
+	lazy := &Assembler{}
+	lazy.Field(0x0008, "inits", "I")
+	lazy.Getstatic("Lazy", "inits", "I").Iconst(1).Iadd().Putstatic("Lazy", "inits", "I").Return().
+		Method(0x0008, "<clinit>", "()V", 2, 0)
+	lazy.Getstatic("Lazy", "inits", "I").Ireturn().Method(0x0009, "get", "()I", 1, 0)
+	for _, c := range []Class{
+		base.Class(0x0021, "Base", "java/lang/Object"),
+		lazy.Class(0x0021, "Lazy", "Base"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if res, err := vm.Call("Lazy", "get"); err != nil || res != int32(1) {
+				t.Error(res, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	loaded := map[string]int{}
+	for _, c := range vm.LoadedClasses() {
+		loaded[c.Name]++
+	}
+	if loaded["Lazy"] != 1 || loaded["Base"] != 1 {
+		t.Error(loaded)
+	}
+}
+
+func TestWideLocals(t *testing.T) {
+	a := &Assembler{}
+	// static long add(long a, long b) { return a + b; }
+	a.Lload(0).Lload(2).Op(0x61).Lreturn().Method(0x0009, "add", "(JJ)J", 4, 4)
+	// static long twice(long x) { return add(x, x); }
+	a.Lload(0).Lload(0).Invoke(0xB8, "Wide", "add", "(JJ)J").Lreturn().Method(0x0009, "twice", "(J)J", 4, 2)
+	// static double mix(int i, double d, Object o, double e) { return o == null ? d + e : d; }
+	nonNull := a.Label()
+	a.Aload(3).Branch(0xC7, nonNull).Dload(1).Dload(4).Op(0x63).Dreturn().
+		Mark(nonNull).Dload(1).Dreturn().
+		Method(0x0009, "mix", "(IDLjava/lang/Object;D)D", 4, 6)
+	// static long id(int i, long x) { long y = x; return y; }, with LLOAD instead of LLOAD_3
+	a.Lload(1).Lstore(3).Op(0x16, 3).Lreturn().Method(0x0009, "id", "(IJ)J", 2, 5)
+	for _, raw := range []bool{false, true} {
+		vm := New()
+		vm.RawBytecode = raw
+		if _, err := vm.DefineClass(a.Class(0x0021, "Wide", "java/lang/Object")); err != nil {
+			t.Fatal(err)
+		}
+		if res, err := vm.Call("Wide", "add", int64(1)<<40, int64(2)); err != nil || res != int64(1)<<40+2 {
+			t.Error(raw, res, err)
+		}
+		if res, err := vm.Call("Wide", "twice", int64(21)); err != nil || res != int64(42) {
+			t.Error(raw, res, err)
+		}
+		if res, err := vm.Call("Wide", "mix", 1, 1.5, nil, 2.0); err != nil || res != 3.5 {
+			t.Error(raw, res, err)
+		}
+		if res, err := vm.Call("Wide", "id", 1, int64(math.MinInt64)); err != nil || res != int64(math.MinInt64) {
+			t.Error(raw, res, err)
+		}
+	}
+}
+
+func TestArrayExceptions(t *testing.T) {
+	a := &Assembler{}
+	accesses := []struct {
+		name, desc string
+		code       func(a *Assembler) *Assembler
+		array      Value
+	}{
+		// a[i];
+		{"iaload", "[I", func(a *Assembler) *Assembler { return a.Op(0x2E).Pop() }, []int32{1, 2, 3}},
+		{"baload", "[Z", func(a *Assembler) *Assembler { return a.Op(0x33).Pop() }, []bool{true, false, true}},
+		{"aaload", "[Ljava/lang/Object;", func(a *Assembler) *Assembler { return a.Op(0x32).Pop() }, []Value{nil, nil, nil}},
+		// a[i] = 0;
+		{"lastore", "[J", func(a *Assembler) *Assembler { return a.Op(0x09).Op(0x50) }, []int64{1, 2, 3}},
+		{"dastore", "[D", func(a *Assembler) *Assembler { return a.Op(0x0E).Op(0x52) }, []float64{1, 2, 3}},
+		{"castore", "[C", func(a *Assembler) *Assembler { return a.Iconst(0).Op(0x55) }, "abc"},
+	}
+	for _, access := range accesses {
+		access.code(a.Aload(0).Iload(1)).Return().Method(0x0009, access.name, "("+access.desc+"I)V", 4, 2)
+	}
+	// static int safe(int[] a, int i) { try { return a[i]; } catch (ArrayIndexOutOfBoundsException e) { return -1; } }
+	start, end, handler := a.Label(), a.Label(), a.Label()
+	a.Mark(start).Aload(0).Iload(1).Op(0x2E).Mark(end).Ireturn().
+		Mark(handler).Pop().Iconst(-1).Ireturn().
+		Catch(start, end, handler, "java/lang/ArrayIndexOutOfBoundsException").
+		Method(0x0009, "safe", "([II)I", 2, 2)
+	// static int[] make(int n) { return new int[n]; } and static Object[] makeObjects(int n) { return new Object[n]; }
+	a.Iload(0).Newarray(10).Areturn().Method(0x0009, "make", "(I)[I", 1, 1)
+	a.Iload(0).Anewarray("java/lang/Object").Areturn().Method(0x0009, "makeObjects", "(I)[Ljava/lang/Object;", 1, 1)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Arrays", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	for _, access := range accesses {
+		for _, test := range []struct {
+			array Value
+			index int32
+			want  string
+		}{
+			{access.array, 0, ""},
+			{access.array, 3, "java/lang/ArrayIndexOutOfBoundsException: Index 3 out of bounds for length 3"},
+			{access.array, -1, "java/lang/ArrayIndexOutOfBoundsException: Index -1 out of bounds for length 3"},
+			{nil, 0, "java/lang/NullPointerException: array is null"},
+		} {
+			_, err := vm.Call("Arrays", access.name, test.array, test.index)
+			var exc *Exception
+			if test.want == "" && err != nil {
+				t.Error(access.name, err)
+			} else if test.want != "" && (!errors.As(err, &exc) || exc.Error() != test.want) {
+				t.Error(access.name, test.index, err)
+			}
+		}
+	}
+	if res, err := vm.Call("Arrays", "safe", []int32{7}, 1); err != nil || res != int32(-1) {
+		t.Error(res, err)
+	}
+	for _, method := range []string{"make", "makeObjects"} {
+		var exc *Exception
+		if _, err := vm.Call("Arrays", method, -1); !errors.As(err, &exc) || exc.Error() != "java/lang/NegativeArraySizeException: -1" {
+			t.Error(method, err)
+		}
+	}
+}
+
+func TestInheritedStatics(t *testing.T) {
+	dir := t.TempDir()
+	// class A { static int x = 1; }
+	a := &Assembler{}
+	a.Field(0x0008, "x", "I")
+	a.Iconst(1).Putstatic("A", "x", "I").Return().Method(0x0008, "<clinit>", "()V", 1, 0)
+	// class B extends A { static int y = 1; }
+	b := &Assembler{}
+	b.Field(0x0008, "y", "I")
+	b.Iconst(1).Putstatic("B", "y", "I").Return().Method(0x0008, "<clinit>", "()V", 1, 0)
+	// class Main { static int get() { return B.x; } static void set(int v) { B.x = v; } }
+	main := &Assembler{}
+	main.Getstatic("B", "x", "I").Ireturn().Method(0x0009, "get", "()I", 1, 0)
+	main.Iload(0).Putstatic("B", "x", "I").Return().Method(0x0009, "set", "(I)V", 1, 1)
+	for _, c := range []Class{
+		a.Class(0x0021, "A", "java/lang/Object"),
+		b.Class(0x0021, "B", "A"),
+		main.Class(0x0021, "Main", "java/lang/Object"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	if res, err := vm.Call("Main", "get"); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if _, err := vm.Call("Main", "set", 5); err != nil {
+		t.Fatal(err)
+	}
+	classes := map[string]*Object{}
+	for _, c := range vm.LoadedClasses() {
+		classes[c.Name] = c
+	}
+	if x := classes["A"].Field("x"); x != int32(5) {
+		t.Error("A.x", x)
+	}
+	if _, ok := classes["B"].Fields["x"]; ok {
+		t.Error("B has its own x")
+	}
+	if y := classes["B"].Field("y"); y != int32(0) {
+		t.Error("B was initialized", y)
+	}
+}
+
+func TestArgumentCount(t *testing.T) {
+	a := &Assembler{}
+	// static int iadd(int a, int b) { return a + b; }
+	a.Iload(0).Iload(1).Iadd().Ireturn().Method(0x0009, "iadd", "(II)I", 2, 2)
+	// int inc(int a) { return a + 1; }
+	a.Iload(1).Iconst(1).Iadd().Ireturn().Method(0x0001, "inc", "(I)I", 2, 2)
+	vm := New()
+	c, err := vm.DefineClass(a.Class(0x0021, "L", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := c.New()
+	for _, test := range []struct {
+		method string
+		args   []Value
+		err    string
+	}{
+		{"iadd", []Value{1, 2}, ""},
+		{"iadd", []Value{1, 2, 3}, "iadd(II)I takes 2 arguments, got 3"},
+		{"iadd", []Value{1}, "iadd(II)I takes 2 arguments, got 1"},
+		{"inc", []Value{obj, 1}, ""},
+		{"inc", []Value{1}, "inc(I)I takes 1 arguments, got 1 without a receiver"},
+		{"inc", []Value{obj, 1, 2}, "inc(I)I takes 1 arguments, got 2"},
+		{"inc", []Value{}, "inc(I)I takes 1 arguments, got 0"},
+	} {
+		_, err := vm.Call("L", test.method, test.args...)
+		if (test.err == "" && err != nil) || (test.err != "" && (err == nil || err.Error() != test.err)) {
+			t.Error(test.method, test.args, err)
+		}
+	}
+	// Arguments are checked without conversion too, with the receiver required.
+	inc, _ := c.Method("inc", "(I)I")
+	for _, args := range [][]Value{{int32(1)}, {obj, int32(1), int32(2)}, {}} {
+		if _, err := vm.callMethod(c, inc, args...); err == nil || !strings.HasPrefix(err.Error(), "inc(I)I takes 1 arguments") {
+			t.Error(args, err)
+		}
+	}
+}
+
+func TestPrintLocked(t *testing.T) {
+	a := &Assembler{}
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	// public synchronized String toString() { return "locked"; }
+	a.Ldc("locked").Areturn().Method(0x0021, "toString", "()Ljava/lang/String;", 1, 1)
+	// static void show() { Locked l = new Locked(); synchronized (l) { System.out.println(l); } }
+	a.New("Locked").Dup().Invoke(0xB7, "Locked", "<init>", "()V").Astore(0).
+		Aload(0).Op(0xC2). // MONITORENTER
+		Getstatic("java/lang/System", "out", "Ljava/io/PrintStream;").Aload(0).
+		Invoke(0xB6, "java/io/PrintStream", "println", "(Ljava/lang/Object;)V").
+		Aload(0).Op(0xC3). // MONITOREXIT
+		Return().Method(0x0009, "show", "()V", 2, 1)
+	vm := New()
+	var stdout bytes.Buffer
+	vm.Stdout = &stdout
+	if _, err := vm.DefineClass(a.Class(0x0021, "Locked", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := vm.Call("Locked", "show")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil || stdout.String() != "locked\n" {
+			t.Error(stdout.String(), err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock")
+	}
+}
+
+func TestClassJSONNonFinite(t *testing.T) {
+	a := &Assembler{}
+	// static final float NAN = 0f / 0f; static final double INF = 1d / 0, NEG = -1d / 0, ONE = 1;
+	a.ConstField(0x0018, "NAN", "F", float32(math.NaN())).
+		ConstField(0x0018, "INF", "D", math.Inf(1)).
+		ConstField(0x0018, "NEG", "D", math.Inf(-1)).
+		ConstField(0x0018, "ONE", "D", 1.0)
+	b, err := json.Marshal(a.Class(0x0021, "Limits", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump struct {
+		Constants []struct {
+			Tag   string
+			Value interface{}
+		}
+		Fields []struct {
+			Name       string
+			Attributes []struct{ Value interface{} }
+		}
+	}
+	if err := json.Unmarshal(b, &dump); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"NAN": "NaN", "INF": "Infinity", "NEG": "-Infinity", "ONE": 1.0}
+	for _, f := range dump.Fields {
+		if len(f.Attributes) != 1 || f.Attributes[0].Value != want[f.Name] {
+			t.Error(f.Name, f.Attributes)
+		}
+	}
+	for _, k := range dump.Constants {
+		if k.Tag == "Double" && k.Value != "Infinity" && k.Value != "-Infinity" && k.Value != 1.0 {
+			t.Error(k)
+		}
+	}
+}
+
+func TestArrayClone(t *testing.T) {
+	a := &Assembler{}
+	// static int[] ints(int[] a) { int[] b = a.clone(); b[0] = 9; return b; }
+	a.Aload(0).Invoke(0xB6, "[I", "clone", "()Ljava/lang/Object;").ClassOp(0xC0, "[I").Astore(1).
+		Aload(1).Iconst(0).Iconst(9).Op(0x4F).Aload(1).Areturn().
+		Method(0x0009, "ints", "([I)[I", 3, 2)
+	// static String[] strings(String[] a) { String[] b = a.clone(); b[0] = "x"; return b; }
+	a.Aload(0).Invoke(0xB6, "[Ljava/lang/String;", "clone", "()Ljava/lang/Object;").ClassOp(0xC0, "[Ljava/lang/String;").Astore(1).
+		Aload(1).Iconst(0).Ldc("x").Op(0x53).Aload(1).Areturn().
+		Method(0x0009, "strings", "([Ljava/lang/String;)[Ljava/lang/String;", 3, 2)
+	// static boolean isInts(Object o) { return o instanceof int[]; }
+	a.Aload(0).ClassOp(0xC1, "[I").Ireturn().Method(0x0009, "isInts", "(Ljava/lang/Object;)Z", 1, 1)
+	// static boolean isObjects(Object o) { return o instanceof Object[]; }
+	a.Aload(0).ClassOp(0xC1, "[Ljava/lang/Object;").Ireturn().Method(0x0009, "isObjects", "(Ljava/lang/Object;)Z", 1, 1)
+	// static int hash(int[] a) { return a.hashCode(); }
+	a.Aload(0).Invoke(0xB6, "[I", "hashCode", "()I").Ireturn().Method(0x0009, "hash", "([I)I", 1, 1)
+	// static String str(int[] a) { return a.toString(); }
+	a.Aload(0).Invoke(0xB6, "[I", "toString", "()Ljava/lang/String;").Areturn().
+		Method(0x0009, "str", "([I)Ljava/lang/String;", 1, 1)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Clone", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	ints := []int32{1, 2, 3}
+	if res, err := vm.Call("Clone", "ints", ints); err != nil || !reflect.DeepEqual(res, []int32{9, 2, 3}) || ints[0] != 1 {
+		t.Error(res, ints, err)
+	}
+	strs := &Array{Desc: "[Ljava/lang/String;", Values: []Value{vm.InternString("a"), vm.InternString("b")}}
+	res, err := vm.Call("Clone", "strings", strs)
+	if c, ok := res.(*Array); err != nil || !ok || c == strs || c.Desc != strs.Desc || vm.ToGo(c.Values[0]) != "x" || c.Values[1] != strs.Values[1] {
+		t.Error(res, err)
+	}
+	if vm.ToGo(strs.Values[0]) != "a" {
+		t.Error(strs.Values[0])
+	}
+	for _, test := range []struct {
+		method string
+		arg    Value
+		want   int32
+	}{
+		{"isInts", ints, 1}, {"isInts", strs, 0}, {"isInts", nil, 0},
+		{"isObjects", strs, 1}, {"isObjects", ints, 0},
+	} {
+		if res, err := vm.Call("Clone", test.method, test.arg); err != nil || res != test.want {
+			t.Error(test, res, err)
+		}
+	}
+	if res, err := vm.Call("Clone", "hash", ints); err != nil || res != identityHash(ints) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Clone", "str", ints); err != nil || !strings.HasPrefix(vm.ToGo(res).(string), "[I@") {
+		t.Error(vm.ToGo(res), err)
+	}
+	var exc *Exception
+	if _, err := vm.Call("Clone", "ints", nil); !errors.As(err, &exc) || exc.Object.Name != "java/lang/NullPointerException" {
+		t.Error(err)
+	}
+}
+
+func TestThreadsSynchronizedMethod(t *testing.T) {
+	// class Tally implements Runnable {
+	//   int n;
+	//   synchronized void inc() { n++; }
+	//   public void run() { for (int i = 0; i < 500; i++) inc(); }
+	//   static int count() { Tally c = new Tally(); Thread a = new Thread(c), b = new Thread(c); ... return c.n; }
+	// }
+	a := &Assembler{}
+	a.Field(0, "n", "I")
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	a.Aload(0).Dup().Getfield("Tally", "n", "I").Iconst(1).Iadd().Putfield("Tally", "n", "I").Return().
+		Method(0x0020, "inc", "()V", 3, 1)
+	loop, done := a.Label(), a.Label()
+	a.Iconst(0).Istore(1).
+		Mark(loop).Iload(1).Iconst(500).Branch(0xA2, done).
+		Aload(0).Invoke(0xB6, "Tally", "inc", "()V").Iinc(1, 1).Goto(loop).
+		Mark(done).Return().
+		Method(0x0001, "run", "()V", 2, 2)
+	a.New("Tally").Dup().Invoke(0xB7, "Tally", "<init>", "()V").Astore(0)
+	for i := 1; i <= 2; i++ {
+		a.New("java/lang/Thread").Dup().Aload(0).Invoke(0xB7, "java/lang/Thread", "<init>", "(Ljava/lang/Runnable;)V").
+			Dup().Invoke(0xB6, "java/lang/Thread", "start", "()V").Astore(i)
+	}
+	a.Aload(1).Invoke(0xB6, "java/lang/Thread", "join", "()V").
+		Aload(2).Invoke(0xB6, "java/lang/Thread", "join", "()V").
+		Aload(0).Getfield("Tally", "n", "I").Ireturn().
+		Method(0x0009, "count", "()I", 4, 3)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Tally", "java/lang/Object", "java/lang/Runnable")); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Tally", "count"); err != nil || res != int32(1000) {
+		t.Error(res, err)
+	}
+}
+
+func TestGetClass(t *testing.T) {
+	a := &Assembler{}
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	// static Class<?> literal() { return Point.class; }
+	a.op2(0x13, a.ConstClass("pkg/Point"))
+	a.Areturn().Method(0x0009, "literal", "()Ljava/lang/Class;", 1, 0)
+	// static Class<?> arrayLiteral() { return String[].class; }
+	a.op2(0x13, a.ConstClass("[Ljava/lang/String;"))
+	a.Areturn().Method(0x0009, "arrayLiteral", "()Ljava/lang/Class;", 1, 0)
+	// static Class<?> of(Object o) { return o.getClass(); }
+	a.Aload(0).Invoke(0xB6, "java/lang/Object", "getClass", "()Ljava/lang/Class;").Areturn().
+		Method(0x0009, "of", "(Ljava/lang/Object;)Ljava/lang/Class;", 1, 1)
+	// static boolean same(Object a, Object b) { return a.getClass() == b.getClass(); }
+	differ := a.Label()
+	a.Aload(0).Invoke(0xB6, "java/lang/Object", "getClass", "()Ljava/lang/Class;").
+		Aload(1).Invoke(0xB6, "java/lang/Object", "getClass", "()Ljava/lang/Class;").
+		Branch(0xA6, differ).Iconst(1).Ireturn().Mark(differ).Iconst(0).Ireturn().
+		Method(0x0009, "same", "(Ljava/lang/Object;Ljava/lang/Object;)Z", 2, 2)
+	inner := &Assembler{}
+	innerClass := inner.Class(0x0021, "pkg/Outer$Inner", "java/lang/Object")
+	innerClass.InnerClasses = []InnerClass{{Inner: "pkg/Outer$Inner", Outer: "pkg/Outer", Name: "Inner", Flags: 0x0009}}
+	vm := New()
+	point, err := vm.DefineClass(a.Class(0x0021, "pkg/Point", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	innerObj, err := vm.DefineClass(innerClass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, q := point.New(), point.New()
+	if res, err := vm.Call("pkg/Point", "same", p, q); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("pkg/Point", "same", p, "s"); err != nil || res != int32(0) {
+		t.Error(res, err)
+	}
+	mirror, err := vm.Call("pkg/Point", "of", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("pkg/Point", "literal"); err != nil || res != mirror {
+		t.Error(res, err)
+	}
+	str := func(m Value, method string) interface{} {
+		res, err := vm.CallMethod(m.(*Object), method, "", m)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		if method == "isInterface" || method == "isArray" {
+			b, _ := AsBool(res)
+			return b
+		}
+		return vm.ToGo(res)
+	}
+	runnable, _ := vm.Class("java/lang/Runnable")
+	strs, _ := vm.Call("pkg/Point", "arrayLiteral")
+	ints, _ := vm.Call("pkg/Point", "of", []int32{1})
+	for _, test := range []struct {
+		mirror                Value
+		name, simple, display string
+		iface, array          bool
+	}{
+		{mirror, "pkg.Point", "Point", "class pkg.Point", false, false},
+		{vm.mirror(innerObj), "pkg.Outer$Inner", "Inner", "class pkg.Outer$Inner", false, false},
+		{vm.mirror(runnable), "java.lang.Runnable", "Runnable", "interface java.lang.Runnable", true, false},
+		{strs, "[Ljava.lang.String;", "String[]", "class [Ljava.lang.String;", false, true},
+		{ints, "[I", "int[]", "class [I", false, true},
+	} {
+		if name, simple, display := str(test.mirror, "getName"), str(test.mirror, "getSimpleName"), str(test.mirror, "toString"); name != test.name || simple != test.simple || display != test.display {
+			t.Error(name, simple, display)
+		}
+		if iface, array := str(test.mirror, "isInterface"), str(test.mirror, "isArray"); iface != test.iface || array != test.array {
+			t.Error(test.name, iface, array)
+		}
+	}
+	super, _ := vm.CallMethod(mirror.(*Object), "getSuperclass", "", mirror)
+	if name := str(super, "getName"); name != "java.lang.Object" {
+		t.Error(name)
+	}
+	for _, m := range []Value{super, vm.mirror(runnable)} {
+		if res, err := vm.CallMethod(m.(*Object), "getSuperclass", "", m); err != nil || res != nil {
+			t.Error(res, err)
+		}
+	}
+	if res, err := vm.CallMethod(ints.(*Object), "getSuperclass", "", ints); err != nil || res != super {
+		t.Error(res, err)
+	}
+}
+
+func TestForName(t *testing.T) {
+	dir := t.TempDir()
+	// class plugin.Hello { static String greeting = "hello"; String name = "world";
+	//   String greet() { return greeting; } }
+	hello := &Assembler{}
+	hello.Field(0x0008, "greeting", "Ljava/lang/String;").Field(0, "name", "Ljava/lang/String;")
+	hello.Ldc("hello").Putstatic("plugin/Hello", "greeting", "Ljava/lang/String;").Return().
+		Method(0x0008, "<clinit>", "()V", 1, 0)
+	hello.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").
+		Aload(0).Ldc("world").Putfield("plugin/Hello", "name", "Ljava/lang/String;").Return().
+		Method(0x0001, "<init>", "()V", 2, 1)
+	hello.Getstatic("plugin/Hello", "greeting", "Ljava/lang/String;").Areturn().
+		Method(0x0001, "greet", "()Ljava/lang/String;", 1, 1)
+	main := &Assembler{}
+	// static String load(String name) throws Exception {
+	//   return ((Hello) Class.forName(name).newInstance()).greet(); }
+	main.Aload(0).Invoke(0xB8, "java/lang/Class", "forName", "(Ljava/lang/String;)Ljava/lang/Class;").
+		Invoke(0xB6, "java/lang/Class", "newInstance", "()Ljava/lang/Object;").
+		ClassOp(0xC0, "plugin/Hello").Invoke(0xB6, "plugin/Hello", "greet", "()Ljava/lang/String;").Areturn().
+		Method(0x0009, "load", "(Ljava/lang/String;)Ljava/lang/String;", 1, 1)
+	// static Object construct(String name) throws Exception {
+	//   return Class.forName(name).getDeclaredConstructor().newInstance(); }
+	main.Aload(0).Invoke(0xB8, "java/lang/Class", "forName", "(Ljava/lang/String;)Ljava/lang/Class;").
+		Iconst(0).Anewarray("java/lang/Class").
+		Invoke(0xB6, "java/lang/Class", "getDeclaredConstructor", "([Ljava/lang/Class;)Ljava/lang/reflect/Constructor;").
+		Iconst(0).Anewarray("java/lang/Object").
+		Invoke(0xB6, "java/lang/reflect/Constructor", "newInstance", "([Ljava/lang/Object;)Ljava/lang/Object;").Areturn().
+		Method(0x0009, "construct", "(Ljava/lang/String;)Ljava/lang/Object;", 2, 1)
+	// static String missing(String name) {
+	//   try { Class.forName(name); return null; } catch (ClassNotFoundException e) { return e.getMessage(); } }
+	start, end, handler := main.Label(), main.Label(), main.Label()
+	main.Mark(start).Aload(0).Invoke(0xB8, "java/lang/Class", "forName", "(Ljava/lang/String;)Ljava/lang/Class;").
+		Pop().Mark(end).Op(0x01).Areturn().
+		Mark(handler).Invoke(0xB6, "java/lang/Throwable", "getMessage", "()Ljava/lang/String;").Areturn().
+		Catch(start, end, handler, "java/lang/ClassNotFoundException").
+		Method(0x0009, "missing", "(Ljava/lang/String;)Ljava/lang/String;", 1, 1)
+	for _, c := range []Class{
+		hello.Class(0x0021, "plugin/Hello", "java/lang/Object"),
+		main.Class(0x0021, "Main", "java/lang/Object"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, c.Name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	if res, err := vm.Call("Main", "load", "plugin.Hello"); err != nil || vm.ToGo(res) != "hello" {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Main", "construct", "plugin.Hello"); err != nil {
+		t.Error(err)
+	} else if name := vm.ToGo(res.(*Object).Field("name")); name != "world" {
+		t.Error(name)
+	}
+	for _, name := range []string{"plugin.Missing", "[Lplugin.Missing;", "[Q"} {
+		if res, err := vm.Call("Main", "missing", name); err != nil || vm.ToGo(res) != name {
+			t.Error(res, err)
+		}
+	}
+	if res, err := vm.Call("Main", "missing", "[Lplugin.Hello;"); err != nil || res != nil {
+		t.Error(res, err)
+	}
+	// Interfaces have no instances.
+	if _, err := vm.Call("Main", "load", "java.lang.Runnable"); err == nil || !strings.Contains(err.Error(), "InstantiationException") {
+		t.Error(err)
+	}
+}
+
+func TestFinalize(t *testing.T) {
+	vm := New()
+	c, _ := vm.Class("java/lang/Object")
+	var collected, released, kept int
+	func() {
+		c.New().OnFinalize(func() { collected++ })
+	}()
+	obj := c.New()
+	obj.OnFinalize(func() { released++ })
+	live := c.New()
+	live.OnFinalize(func() { kept++ })
+	obj.Release()
+	if released != 1 {
+		t.Error(released)
+	}
+	vm.Collect()
+	if collected != 1 || released != 1 || kept != 0 {
+		t.Error(collected, released, kept)
+	}
+	runtime.KeepAlive(live)
+}
+
+func TestStringConcat(t *testing.T) {
+	a := &Assembler{}
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	// public String toString() { return "concat"; }
+	a.Ldc("concat").Areturn().Method(0x0001, "toString", "()Ljava/lang/String;", 1, 1)
+	sb := func(desc string) *Assembler {
+		return a.Invoke(0xB6, "java/lang/StringBuilder", "append", "("+desc+")Ljava/lang/StringBuilder;")
+	}
+	// static String format(int n, String s, double d) { return "n=" + n + ", s=" + s + ", d=" + d; }
+	a.New("java/lang/StringBuilder").Dup().Invoke(0xB7, "java/lang/StringBuilder", "<init>", "()V")
+	a.Ldc("n=")
+	sb("Ljava/lang/String;").Iload(0)
+	sb("I").Ldc(", s=")
+	sb("Ljava/lang/String;").Aload(1)
+	sb("Ljava/lang/String;").Ldc(", d=")
+	sb("Ljava/lang/String;").Dload(2)
+	sb("D").Invoke(0xB6, "java/lang/StringBuilder", "toString", "()Ljava/lang/String;").Areturn().
+		Method(0x0009, "format", "(ILjava/lang/String;D)Ljava/lang/String;", 3, 4)
+	// static String mixed(char c, long l, boolean b, float f, Object o) { return c + ":" + l + b + f + o; }
+	a.New("java/lang/StringBuilder").Dup().Invoke(0xB7, "java/lang/StringBuilder", "<init>", "()V").Iload(0)
+	sb("C").Ldc(":")
+	sb("Ljava/lang/String;").Lload(1)
+	sb("J").Iload(3)
+	sb("Z").Fload(4)
+	sb("F").Aload(5)
+	sb("Ljava/lang/Object;").Invoke(0xB6, "java/lang/StringBuilder", "toString", "()Ljava/lang/String;").Areturn().
+		Method(0x0009, "mixed", "(CJZFLjava/lang/Object;)Ljava/lang/String;", 3, 6)
+	vm := New()
+	c, err := vm.DefineClass(a.Class(0x0021, "Concat", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenth := 0.1
+	for _, test := range []struct {
+		n    int32
+		s    Value
+		d    float64
+		want string
+	}{
+		{42, "x", 1.5, "n=42, s=x, d=1.5"},
+		{-1, nil, 1e10, "n=-1, s=null, d=1.0E10"},
+		{0, "", tenth + 0.2, "n=0, s=, d=0.30000000000000004"},
+		{7, "y", 100, "n=7, s=y, d=100.0"},
+	} {
+		if res, err := vm.Call("Concat", "format", test.n, test.s, test.d); err != nil || vm.ToGo(res) != test.want {
+			t.Error(res, err)
+		}
+	}
+	if res, err := vm.Call("Concat", "mixed", int32('c'), int64(1)<<40, true, float32(0.1), c.New()); err != nil || vm.ToGo(res) != "c:1099511627776true0.1concat" {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Concat", "mixed", int32('c'), int64(0), false, float32(1e-5), nil); err != nil || vm.ToGo(res) != "c:0false1.0E-5null" {
+		t.Error(res, err)
+	}
+}
+
+func TestConstantValue(t *testing.T) {
+	dir := t.TempDir()
+	// class Consts { static final double PI = 3.141592653589793; static final long BIG = 1L << 40;
+	//   static final char C = 'x'; }
+	consts := &Assembler{}
+	consts.ConstField(0x0018, "PI", "D", math.Pi).
+		ConstField(0x0018, "BIG", "J", int64(1)<<40).
+		ConstField(0x0018, "C", "C", int32('x'))
+	// class Area { static double area(double r) { return Consts.PI * r * r; } }
+	area := &Assembler{}
+	area.Getstatic("Consts", "PI", "D").Dload(0).Op(0x6B).Dload(0).Op(0x6B).Dreturn().
+		Method(0x0009, "area", "(D)D", 4, 2)
+	area.Getstatic("Consts", "BIG", "J").Lreturn().Method(0x0009, "big", "()J", 2, 0)
+	area.Getstatic("Consts", "C", "C").Ireturn().Method(0x0009, "c", "()C", 1, 0)
+	for _, c := range []Class{
+		consts.Class(0x0021, "Consts", "java/lang/Object"),
+		area.Class(0x0021, "Area", "java/lang/Object"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	if res, err := vm.Call("Area", "area", 2.0); err != nil || res != math.Pi*4 {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Area", "big"); err != nil || res != int64(1)<<40 {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Area", "c"); err != nil || res != int32('x') {
+		t.Error(res, err)
+	}
+}
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestClock(t *testing.T) {
+	a := &Assembler{}
+	// native static void work();
+	a.Method(0x0109, "work", "()V", 0, 0)
+	// static long elapsed() { long start = System.nanoTime(); work(); return System.nanoTime() - start; }
+	a.Invoke(0xB8, "java/lang/System", "nanoTime", "()J").Lstore(0).Invoke(0xB8, "Timer", "work", "()V").
+		Invoke(0xB8, "java/lang/System", "nanoTime", "()J").Lload(0).Op(0x65).Lreturn().
+		Method(0x0009, "elapsed", "()J", 4, 2)
+	a.Invoke(0xB8, "java/lang/System", "currentTimeMillis", "()J").Lreturn().
+		Method(0x0009, "millis", "()J", 2, 0)
+	vm := New()
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	vm.Clock = clock
+	vm.Native["Timer.work"] = func(args ...Value) Value {
+		clock.now = clock.now.Add(1234567 * time.Nanosecond)
+		return nil
+	}
+	if _, err := vm.DefineClass(a.Class(0x0021, "Timer", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Timer", "elapsed"); err != nil || res != int64(1234567) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Timer", "millis"); err != nil || res != int64(1600000000001) {
+		t.Error(res, err)
+	}
+	// The real clock never goes back.
+	vm.Clock = realClock{}
+	if res, err := vm.Call("Timer", "elapsed"); err != nil || res.(int64) < 0 {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Timer", "millis"); err != nil || res.(int64) < time.Now().Add(-time.Minute).UnixNano()/1e6 {
+		t.Error(res, err)
+	}
+}
+
+func TestOpcodeCoverage(t *testing.T) {
+	vm := New("testdata")
+	if _, err := vm.Call("FieldsAndMethods", "add", int32(2), int32(3)); err != nil {
+		t.Fatal(err)
+	}
+	if counts := vm.OpcodeCoverage(); len(counts) != 0 {
+		t.Error(counts)
+	}
+	vm.CountOpcodes = true
+	for i := 0; i < 3; i++ {
+		if _, err := vm.Call("FieldsAndMethods", "add", int32(2), int32(3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if counts := vm.OpcodeCoverage(); counts[0x60] != 3 || counts[0xAC] != 3 { // IADD, IRETURN
+		t.Error(counts)
+	}
+}
+
+func TestRegisterNativeFunc(t *testing.T) {
+	item := &Assembler{}
+	item.Field(0, "n", "I")
+	// Item(int n) { this.n = n; }
+	item.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Aload(0).Iload(1).Putfield("Item", "n", "I").Return().
+		Method(0x0001, "<init>", "(I)V", 2, 2)
+	// synchronized int twice() { return n * 2; }
+	item.Aload(0).Getfield("Item", "n", "I").Iconst(2).Imul().Ireturn().Method(0x0021, "twice", "()I", 2, 1)
+	host := &Assembler{}
+	// static native int make(int n);
+	host.Method(0x0109, "make", "(I)I", 0, 0)
+	// static int call(int n) { return make(n) + 1; }
+	host.Iload(0).Invoke(0xB8, "Host", "make", "(I)I").Iconst(1).Iadd().Ireturn().Method(0x0009, "call", "(I)I", 2, 1)
+	vm := New()
+	for _, c := range []Class{item.Class(0x0021, "Item", "java/lang/Object"), host.Class(0x0021, "Host", "java/lang/Object")} {
+		if _, err := vm.DefineClass(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Native is overridden by RegisterNativeFunc.
+	vm.Native["Host.make"] = func(args ...Value) Value { return int32(-1) }
+	vm.RegisterNativeFunc("Host", "make", "", func(ctx *NativeContext, args ...Value) (Value, error) {
+		if ctx.Class.Name != "Host" {
+			t.Error(ctx.Class.Name)
+		}
+		if args[0].(int32) < 0 {
+			return nil, ctx.Throw("java/lang/IllegalArgumentException", "negative")
+		}
+		obj, err := ctx.NewInstance("Item", "(I)V", args[0])
+		if err != nil {
+			return nil, err
+		}
+		return ctx.CallMethod(obj, "twice", "()I", obj)
+	})
+	if res, err := vm.Call("Host", "call", int32(20)); err != nil || res != int32(41) {
+		t.Error(res, err)
+	}
+	if _, err := vm.Call("Host", "call", int32(-1)); err == nil || !strings.HasPrefix(err.Error(), "java/lang/IllegalArgumentException: negative") {
+		t.Error(err)
+	}
+}
+
+func TestNativeReceiver(t *testing.T) {
+	a := &Assembler{}
+	a.Field(0, "n", "I")
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	// native void inc(); native void add(int k);
+	a.Method(0x0101, "inc", "()V", 0, 0).Method(0x0101, "add", "(I)V", 0, 0)
+	// static int run() { Counter c = new Counter(); c.inc(); c.add(10); c.inc(); return c.n; }
+	a.New("Counter").Dup().Invoke(0xB7, "Counter", "<init>", "()V").Astore(0).
+		Aload(0).Invoke(0xB6, "Counter", "inc", "()V").
+		Aload(0).Iconst(10).Invoke(0xB6, "Counter", "add", "(I)V").
+		Aload(0).Invoke(0xB6, "Counter", "inc", "()V").
+		Aload(0).Getfield("Counter", "n", "I").Ireturn().Method(0x0009, "run", "()I", 2, 1)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Counter", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	vm.RegisterNative("Counter", "inc", "()V", func(args ...Value) Value {
+		obj := args[0].(*Object)
+		obj.SetField("n", obj.Field("n").(int32)+1)
+		return nil
+	})
+	vm.RegisterNativeFunc("Counter", "add", "(I)V", func(ctx *NativeContext, args ...Value) (Value, error) {
+		ctx.Receiver.SetField("n", ctx.Receiver.Field("n").(int32)+args[1].(int32))
+		return nil, nil
+	})
+	if res, err := vm.Call("Counter", "run"); err != nil || res != int32(12) {
+		t.Error(res, err)
+	}
+	if _, err := vm.Call("Counter", "add", nil, int32(1)); err == nil || !strings.Contains(err.Error(), "NullPointerException") {
+		t.Error(err)
+	}
+}
+
+func TestNativePayload(t *testing.T) {
+	a := &Assembler{}
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	// native void inc(); native int get();
+	a.Method(0x0101, "inc", "()V", 0, 0).Method(0x0101, "get", "()I", 0, 0)
+	// Tally copy() throws CloneNotSupportedException { return (Tally) super.clone(); }
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "clone", "()Ljava/lang/Object;").ClassOp(0xC0, "Tally").Areturn().
+		Method(0x0001, "copy", "()LTally;", 1, 1)
+	// static int run() { Tally a = new Tally(); a.inc(); a.inc(); Tally b = a.copy(); b.inc(); return a.get() * 10 + b.get(); }
+	a.New("Tally").Dup().Invoke(0xB7, "Tally", "<init>", "()V").Astore(0).
+		Aload(0).Invoke(0xB6, "Tally", "inc", "()V").Aload(0).Invoke(0xB6, "Tally", "inc", "()V").
+		Aload(0).Invoke(0xB6, "Tally", "copy", "()LTally;").Astore(1).Aload(1).Invoke(0xB6, "Tally", "inc", "()V").
+		Aload(0).Invoke(0xB6, "Tally", "get", "()I").Iconst(10).Imul().
+		Aload(1).Invoke(0xB6, "Tally", "get", "()I").Iadd().Ireturn().Method(0x0009, "run", "()I", 3, 2)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Tally", "java/lang/Object", "java/lang/Cloneable")); err != nil {
+		t.Fatal(err)
+	}
+	count := func(obj *Object) *int {
+		if obj.GetNative() == nil {
+			obj.SetNative(new(int))
+		}
+		return obj.GetNative().(*int)
+	}
+	vm.RegisterNativeFunc("Tally", "inc", "()V", func(ctx *NativeContext, args ...Value) (Value, error) {
+		*count(ctx.Receiver)++
+		return nil, nil
+	})
+	vm.RegisterNativeFunc("Tally", "get", "()I", func(ctx *NativeContext, args ...Value) (Value, error) {
+		return int32(*count(ctx.Receiver)), nil
+	})
+	// Without a cloner, clones start with no Go value.
+	if res, err := vm.Call("Tally", "run"); err != nil || res != int32(21) {
+		t.Error(res, err)
+	}
+	vm.RegisterCloner("Tally", func(v interface{}) interface{} {
+		n := *v.(*int)
+		return &n
+	})
+	if res, err := vm.Call("Tally", "run"); err != nil || res != int32(23) {
+		t.Error(res, err)
+	}
+
+	// Classes must implement Cloneable to be cloned.
+	b := &Assembler{}
+	b.Aload(0).Invoke(0xB7, "java/lang/Object", "clone", "()Ljava/lang/Object;").Areturn().
+		Method(0x0001, "copy", "()Ljava/lang/Object;", 1, 1)
+	c, err := vm.DefineClass(b.Class(0x0021, "Plain", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := c.New()
+	if _, err := vm.CallMethod(obj, "copy", "", obj); err == nil || !strings.Contains(err.Error(), "CloneNotSupportedException") {
+		t.Error(err)
+	}
+}
+
+func TestConversionsAndComparisons(t *testing.T) {
+	dir := t.TempDir()
+	a := &Assembler{}
+	// static int exceeds(int n, double limit) { if (!(n <= limit)) return 1; return 0; }, with DCMPG so NaN exceeds
+	le := a.Label()
+	a.Iload(0).Op(0x87).Dload(1).Op(0x98).Branch(0x9E, le).Iconst(1).Ireturn().
+		Mark(le).Iconst(0).Ireturn().Method(0x0009, "exceeds", "(ID)I", 4, 3)
+	// static int below(float f, float g) { return f < g ? 1 : 0; }, with FCMPG so NaN isn't below
+	ge := a.Label()
+	a.Fload(0).Fload(1).Op(0x96).Branch(0x9C, ge).Iconst(1).Ireturn().
+		Mark(ge).Iconst(0).Ireturn().Method(0x0009, "below", "(FF)I", 2, 2)
+	// static int cmp(long a, long b) { return Long.compare(a, b); }
+	a.Lload(0).Lload(2).Op(0x94).Ireturn().Method(0x0009, "cmp", "(JJ)I", 4, 4)
+	// static int dcmpl(double a, double b) { return DCMPL(a, b); }
+	a.Dload(0).Dload(2).Op(0x97).Ireturn().Method(0x0009, "dcmpl", "(DD)I", 4, 4)
+	// static long round(double d) { return (long) (float) ((int) d + (long) d); }
+	a.Dload(0).Op(0x8E).Op(0x85).Dload(0).Op(0x8F).Op(0x61).Op(0x89).Op(0x8C).Lreturn().
+		Method(0x0009, "round", "(D)J", 4, 2)
+	// static double widen(float f, long l) { return (double) f + (double) l; }
+	a.Fload(0).Op(0x8D).Lload(1).Op(0x8A).Op(0x63).Dreturn().Method(0x0009, "widen", "(FJ)D", 4, 3)
+	// static int narrow(double d) { return (int) (float) d + (int) (float) (int) d; }
+	a.Dload(0).Op(0x90).Op(0x8B).Dload(0).Op(0x8E).Op(0x86).Op(0x8B).Op(0x60).Ireturn().
+		Method(0x0009, "narrow", "(D)I", 4, 2)
+	// static int truncate(long l) { return (int) l; }
+	a.Lload(0).Op(0x88).Ireturn().Method(0x0009, "truncate", "(J)I", 2, 2)
+	c := a.Class(0x0021, "Conv", "java/lang/Object")
+	if err := ioutil.WriteFile(filepath.Join(dir, "Conv.class"), classFile(c), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vm := New(dir)
+	nan, inf := math.NaN(), math.Inf(1)
+	for _, test := range []struct {
+		method string
+		args   []Value
+		want   Value
+	}{
+		{"exceeds", []Value{int32(3), 2.5}, int32(1)},
+		{"exceeds", []Value{int32(2), 2.0}, int32(0)},
+		{"exceeds", []Value{int32(-5), 2.0}, int32(0)},
+		{"exceeds", []Value{int32(0), nan}, int32(1)},
+		{"below", []Value{float32(1), float32(2)}, int32(1)},
+		{"below", []Value{float32(2), float32(1)}, int32(0)},
+		{"below", []Value{float32(nan), float32(1)}, int32(0)},
+		{"cmp", []Value{int64(1) << 40, int64(1)}, int32(1)},
+		{"cmp", []Value{int64(-1), int64(1) << 40}, int32(-1)},
+		{"cmp", []Value{int64(7), int64(7)}, int32(0)},
+		{"dcmpl", []Value{nan, 1.0}, int32(-1)},
+		{"dcmpl", []Value{inf, 1.0}, int32(1)},
+		{"round", []Value{2.9}, int64(4)},
+		{"round", []Value{-2.9}, int64(-4)},
+		{"round", []Value{nan}, int64(0)},
+		{"widen", []Value{float32(0.5), int64(3)}, 3.5},
+		{"narrow", []Value{1e10}, int32(-2)}, // MaxInt32 twice overflows
+		{"narrow", []Value{-inf}, int32(0)},  // MinInt32 twice overflows
+		{"narrow", []Value{nan}, int32(0)},
+		{"truncate", []Value{int64(1)<<32 + 5}, int32(5)},
+	} {
+		if res, err := vm.Call("Conv", test.method, test.args...); err != nil || res != test.want {
+			t.Error(test.method, test.args, res, err)
+		}
+	}
+}
+
+// limitedHeap fails allocations once a number of them were made.
+type limitedHeap struct {
+	Heap
+	vm   *VM
+	left int
+}
+
+func (h *limitedHeap) Alloc(class *Object) (*Object, error) {
+	if h.left == 0 {
+		return nil, h.vm.Throw("java/lang/OutOfMemoryError", "heap limit")
+	}
+	h.left--
+	return h.Heap.Alloc(class)
+}
+
+func (h *limitedHeap) AllocArray(desc string, n int) (Value, error) {
+	if h.left == 0 {
+		return nil, h.vm.Throw("java/lang/OutOfMemoryError", "heap limit")
+	}
+	h.left--
+	return h.Heap.AllocArray(desc, n)
+}
+
+func TestHeap(t *testing.T) {
+	a := &Assembler{}
+	// static int fill() {
+	//   int n = 0;
+	//   try { for (;;) { new Object(); n++; Object[] a = new String[1]; n++; int[] b = new int[1]; n++; } }
+	//   catch (OutOfMemoryError e) { return n; }
+	// }
+	loop, end, handler := a.Label(), a.Label(), a.Label()
+	a.Iconst(0).Istore(0).
+		Mark(loop).New("java/lang/Object").Dup().Invoke(0xB7, "java/lang/Object", "<init>", "()V").Pop().Iinc(0, 1).
+		Iconst(1).Anewarray("java/lang/String").Pop().Iinc(0, 1).
+		Iconst(1).Newarray(10).Pop().Iinc(0, 1).Goto(loop).Mark(end).
+		Mark(handler).Pop().Iload(0).Ireturn().
+		Catch(loop, end, handler, "java/lang/OutOfMemoryError").
+		Method(0x0009, "fill", "()I", 2, 1)
+	// static Object alloc() { return new Object(); }
+	a.New("java/lang/Object").Dup().Invoke(0xB7, "java/lang/Object", "<init>", "()V").Areturn().
+		Method(0x0009, "alloc", "()Ljava/lang/Object;", 2, 0)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Fill", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	heap := &limitedHeap{Heap: vm.Heap, vm: vm, left: 5}
+	vm.Heap = heap
+	if res, err := vm.Call("Fill", "fill"); err != nil || res != int32(5) {
+		t.Error(res, err)
+	}
+	if _, err := vm.Call("Fill", "alloc"); err == nil || !strings.Contains(err.Error(), "java/lang/OutOfMemoryError: heap limit") {
+		t.Error(err)
+	}
+	heap.left = 1
+	if res, err := vm.Call("Fill", "alloc"); err != nil || res.(*Object).Name != "java/lang/Object" {
+		t.Error(res, err)
+	}
+}
+
+func TestUnload(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "gen"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// class gen.Rule { int value() { return n; } static int get() { return n; } }, for n = 1 and 2
+	rule := func(n int32) Class {
+		a := &Assembler{}
+		a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+		a.Iconst(n).Ireturn().Method(0x0001, "value", "()I", 1, 1)
+		a.Iconst(n).Ireturn().Method(0x0009, "get", "()I", 1, 0)
+		return a.Class(0x0021, "gen/Rule", "java/lang/Object")
+	}
+	base := (&Assembler{}).Class(0x0021, "gen/Base", "java/lang/Object")
+	derived := (&Assembler{}).Class(0x0021, "gen/Derived", "gen/Base")
+	for _, c := range []Class{rule(1), base, derived} {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	if res, err := vm.Call("gen/Rule", "get"); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	c, _ := vm.Class("gen/Rule")
+	old := c.New()
+	if err := ioutil.WriteFile(filepath.Join(dir, "gen/Rule.class"), classFile(rule(2)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("gen/Rule", "get"); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if err := vm.Unload("gen/Rule"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("gen/Rule", "get"); err != nil || res != int32(2) {
+		t.Error(res, err)
+	}
+	if res, err := vm.CallMethod(old, "value", "()I", old); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+
+	if _, err := vm.Class("gen/Derived"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"gen/Base", "gen/Missing", "java/lang/Object"} {
+		if err := vm.Unload(name); err == nil {
+			t.Error(name)
+		}
+	}
+	if err := vm.Unload("gen/Base"); err == nil || err.Error() != "can't unload gen/Base: gen/Derived extends it" {
+		t.Error(err)
+	}
+	n := len(vm.LoadedClasses())
+	if count, err := vm.UnloadMatching("gen/"); err != nil || count != 3 {
+		t.Error(count, err)
+	}
+	if loaded := vm.LoadedClasses(); len(loaded) != n-3 {
+		t.Error(loaded)
+	}
+	if res, err := vm.Call("gen/Rule", "get"); err != nil || res != int32(2) {
+		t.Error(res, err)
+	}
+}
+
+func TestLoadInterfaces(t *testing.T) {
+	dir := t.TempDir()
+	// interface Shape extends Named { int sides(); }, interface Named {}
+	shape := &Assembler{}
+	shape.Method(0x0401, "sides", "()I", 0, 0)
+	// class Square implements Shape { public int sides() { return 4; } static boolean named(Object o) { return o instanceof Named; } }
+	square := &Assembler{}
+	square.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	square.Iconst(4).Ireturn().Method(0x0001, "sides", "()I", 1, 1)
+	square.Aload(0).ClassOp(0xC1, "Named").Ireturn().Method(0x0009, "named", "(Ljava/lang/Object;)Z", 1, 1)
+	// static int count(Shape s) { return s.sides(); }
+	square.Aload(0).Invoke(0xB9, "Shape", "sides", "()I").Ireturn().Method(0x0009, "count", "(LShape;)I", 1, 1)
+	// Two classes that extend each other, which javac wouldn't compile.
+	for _, c := range []Class{
+		(&Assembler{}).Class(0x0601, "Named", "java/lang/Object"),
+		shape.Class(0x0601, "Shape", "java/lang/Object", "Named"),
+		square.Class(0x0021, "Square", "java/lang/Object", "Shape"),
+		(&Assembler{}).Class(0x0021, "Chicken", "Egg"),
+		(&Assembler{}).Class(0x0021, "Egg", "Chicken"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	c, err := vm.Class("Square")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := map[string]bool{}
+	for _, c := range vm.LoadedClasses() {
+		loaded[c.Name] = true
+	}
+	if !loaded["Shape"] || !loaded["Named"] {
+		t.Error(loaded)
+	}
+	if res, err := vm.Call("Square", "named", c.New()); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Square", "count", c.New()); err != nil || res != int32(4) {
+		t.Error(res, err)
+	}
+	if _, err := vm.Class("Chicken"); err == nil || !strings.Contains(err.Error(), "class circularity") {
+		t.Error(err)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	a := &Assembler{}
+	sig := func(s string) Attribute {
+		i := a.ConstUTF8(s)
+		a.ConstUTF8("Signature")
+		return Attribute{Name: "Signature", Data: []byte{byte(i >> 8), byte(i)}}
+	}
+	// class Box<T> implements Comparable<Box<T>> { T value; static <U> U id(U u) { return u; } }
+	a.Field(0, "value", "Ljava/lang/Object;")
+	a.Aload(0).Areturn().Method(0x0009, "id", "(Ljava/lang/Object;)Ljava/lang/Object;", 1, 1)
+	c := a.Class(0x0021, "Box", "java/lang/Object", "java/lang/Comparable")
+	c.Attributes = append(c.Attributes, sig("<T:Ljava/lang/Object;>Ljava/lang/Object;Ljava/lang/Comparable<LBox<TT;>;>;"))
+	c.Fields[0].Attributes = append(c.Fields[0].Attributes, sig("TT;"))
+	c.Methods[0].Attributes = append(c.Methods[0].Attributes, sig("<U:Ljava/lang/Object;>(TU;)TU;"))
+	c.ConstPool = a.Class(0x0021, "Box", "java/lang/Object", "java/lang/Comparable").ConstPool // with the signatures
+	loaded, err := Load(bytes.NewReader(classFile(c)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Signature != "<T:Ljava/lang/Object;>Ljava/lang/Object;Ljava/lang/Comparable<LBox<TT;>;>;" {
+		t.Error(loaded.Signature)
+	}
+	if loaded.Fields[0].Signature != "TT;" {
+		t.Error(loaded.Fields[0].Signature)
+	}
+	if m := loaded.Methods[0]; m.Signature != "<U:Ljava/lang/Object;>(TU;)TU;" {
+		t.Error(m.Signature)
+	}
+	b, err := json.Marshal(loaded)
+	if err != nil || !strings.Contains(string(b), `{"name":"Signature","data":"AA4=","value":"TT;"}`) {
+		t.Error(string(b), err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	// class Counter {
+	//   static int n; static int[] hist; static Counter a, b; int v;
+	//   static { n = 1; hist = new int[2]; a = b = new Counter(); }
+	//   static int bump() { n++; hist[0]++; a.v++; return n; }
+	//   static int get() { return n * 100 + hist[0] * 10 + b.v; }
+	// }
+	a := &Assembler{}
+	a.Field(0x0008, "n", "I").Field(0x0008, "hist", "[I")
+	a.Field(0x0008, "a", "LCounter;").Field(0x0008, "b", "LCounter;").Field(0, "v", "I")
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0000, "<init>", "()V", 1, 1)
+	a.Iconst(1).Putstatic("Counter", "n", "I")
+	a.Iconst(2).Newarray(10).Putstatic("Counter", "hist", "[I")
+	a.New("Counter").Dup().Invoke(0xB7, "Counter", "<init>", "()V").Dup()
+	a.Putstatic("Counter", "a", "LCounter;").Putstatic("Counter", "b", "LCounter;")
+	a.Return().Method(0x0008, "<clinit>", "()V", 3, 0)
+	a.Getstatic("Counter", "n", "I").Iconst(1).Iadd().Putstatic("Counter", "n", "I")
+	a.Getstatic("Counter", "hist", "[I").Iconst(0).Getstatic("Counter", "hist", "[I").Iconst(0).Op(0x2E)
+	a.Iconst(1).Iadd().Op(0x4F)
+	a.Getstatic("Counter", "a", "LCounter;").Dup().Getfield("Counter", "v", "I").Iconst(1).Iadd()
+	a.Putfield("Counter", "v", "I")
+	a.Getstatic("Counter", "n", "I").Ireturn().Method(0x0008, "bump", "()I", 4, 0)
+	a.Getstatic("Counter", "n", "I").Iconst(100).Imul()
+	a.Getstatic("Counter", "hist", "[I").Iconst(0).Op(0x2E).Iconst(10).Imul().Iadd()
+	a.Getstatic("Counter", "b", "LCounter;").Getfield("Counter", "v", "I").Iadd()
+	a.Ireturn().Method(0x0008, "get", "()I", 3, 0)
+	vm := New("")
+	c, err := vm.DefineClass(a.Class(0x0020, "Counter", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Counter", "get"); err != nil || res != int32(100) {
+		t.Fatal(res, err)
+	}
+	hello := vm.InternString("hello")
+	s, err := vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		vm.Call("Counter", "bump")
+	}
+	vm.InternString("world")
+	if res, err := vm.Call("Counter", "get"); err != nil || res != int32(322) {
+		t.Error(res, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := vm.Restore(s); err != nil {
+			t.Fatal(err)
+		}
+		if res, err := vm.Call("Counter", "get"); err != nil || res != int32(100) {
+			t.Error(res, err)
+		}
+		if c.Fields["a"] != c.Fields["b"] {
+			t.Error("aliasing lost", c.Fields["a"], c.Fields["b"])
+		}
+		if res, err := vm.Call("Counter", "bump"); err != nil || res != int32(2) {
+			t.Error(res, err)
+		}
+		if res, err := vm.Call("Counter", "get"); err != nil || res != int32(211) {
+			t.Error(res, err)
+		}
+	}
+	if vm.InternString("hello") != hello {
+		t.Error("interned string changed")
+	}
+	vm.stringsMu.Lock()
+	_, ok := vm.strings["world"]
+	vm.stringsMu.Unlock()
+	if ok {
+		t.Error("string interned after the snapshot survived")
+	}
+
+	c.Fields["a"].(*Object).SetNative([]int{1})
+	if _, err := vm.Snapshot(); err == nil || !strings.Contains(err.Error(), "no cloner") {
+		t.Error(err)
+	}
+	vm.RegisterCloner("Counter", func(v interface{}) interface{} { return append([]int{}, v.([]int)...) })
+	s, err = vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Fields["a"].(*Object).GetNative().([]int)[0] = 2
+	if err := vm.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.Fields["b"].(*Object).GetNative().([]int); v[0] != 1 {
+		t.Error(v)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	// class Dice {
+	//   static native int roll(int sides);
+	//   static int play() { return roll(6) * 10 + roll(100) + (int) System.currentTimeMillis(); }
+	// }
+	dice := func(sides int32) Class {
+		a := &Assembler{}
+		a.Method(0x0109, "roll", "(I)I", 0, 0)
+		a.Iconst(sides).Invoke(0xB8, "Dice", "roll", "(I)I").Iconst(10).Imul()
+		a.Iconst(100).Invoke(0xB8, "Dice", "roll", "(I)I").Iadd()
+		a.Invoke(0xB8, "java/lang/System", "currentTimeMillis", "()J").Op(0x88).Iadd()
+		a.Ireturn().Method(0x0009, "play", "()I", 3, 0)
+		return a.Class(0x0021, "Dice", "java/lang/Object")
+	}
+	run := func(c Class, roll func(sides int32) int32, log io.Reader) (Value, string, error) {
+		vm := New("")
+		vm.RegisterNative("Dice", "roll", "(I)I", func(args ...Value) Value {
+			return roll(args[0].(int32))
+		})
+		if _, err := vm.DefineClass(c); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if log != nil {
+			vm.Replay(log)
+		} else {
+			vm.Record(&b)
+		}
+		res, err := vm.Call("Dice", "play")
+		return res, b.String(), err
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	want, log, err := run(dice(6), func(sides int32) int32 { return rnd.Int31n(sides) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(log), "\n"); len(lines) != 3 ||
+		!strings.HasPrefix(lines[0], "Dice.roll(I)I\tI6\t=\tI") ||
+		!strings.HasPrefix(lines[2], "java/lang/System.currentTimeMillis()J\t=\tJ") {
+		t.Error(log)
+	}
+	for i := 0; i < 2; i++ {
+		res, _, err := run(dice(6), func(int32) int32 { panic("called while replaying") }, strings.NewReader(log))
+		if err != nil || res != want {
+			t.Error(res, want, err)
+		}
+	}
+	_, _, err = run(dice(7), func(int32) int32 { return 0 }, strings.NewReader(log))
+	var e *VMError
+	if !errors.As(err, &e) || e.Class != "Dice" || e.Method != "play" || e.IP != 2 ||
+		!strings.Contains(e.Msg, "replay diverged: Dice.roll(I)I\tI7 called, Dice.roll(I)I\tI6 recorded") {
+		t.Error(err)
+	}
+}
+
+func TestDuplicateClasses(t *testing.T) {
+	// class Version { static int get() { return n; } }, for n = 1 and 2
+	dirs := []string{t.TempDir(), t.TempDir()}
+	for i, dir := range dirs {
+		a := &Assembler{}
+		a.Iconst(int32(i+1)).Ireturn().Method(0x0009, "get", "()I", 1, 0)
+		if err := ioutil.WriteFile(filepath.Join(dir, "Version.class"), classFile(a.Class(0x0021, "Version", "java/lang/Object")), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dirs...)
+	var dups []string
+	vm.OnDuplicateClass = func(class string, paths []string) {
+		dups = append(dups, class+": "+strings.Join(paths, " "))
+	}
+	if res, err := vm.Call("Version", "get"); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if want := "Version: " + dirs[0] + " " + dirs[1]; len(dups) != 1 || dups[0] != want {
+		t.Error(dups)
+	}
+
+	vm = New(dirs...)
+	vm.StrictClassPath = true
+	if _, err := vm.Class("Version"); err == nil || !strings.Contains(err.Error(), "duplicate class Version in "+dirs[0]+", "+dirs[1]) {
+		t.Error(err)
+	}
+	if _, err := vm.Class("java/lang/String"); err != nil {
+		t.Error(err)
+	}
+
+	vm = New(dirs...)
+	vm.StrictClassPath = true
+	vm.ClassPathOrder = func(class string, paths []string) []string {
+		return paths[1:]
+	}
+	if res, err := vm.Call("Version", "get"); err != nil || res != int32(2) {
+		t.Error(res, err)
+	}
+}
+
+type calc struct {
+	vm    *VM
+	calls int
+}
+
+func (c *calc) Add(a, b int32) int32 { c.calls++; return a + b }
+
+func (c *calc) Greet(name string) string { return "hello, " + name }
+
+func (c *calc) Sum(a []int32) int64 {
+	n := int64(0)
+	for _, x := range a {
+		n += int64(x)
+	}
+	return n
+}
+
+func (c *calc) Check(n int32) error {
+	if n < 0 {
+		return c.vm.Throw("java/lang/IllegalArgumentException", "negative")
+	}
+	return nil
+}
+
+func TestBindNatives(t *testing.T) {
+	// class Calc {
+	//   static native int add(int a, int b); native String greet(String name); static native long sum(int[] a);
+	//   static native void check(int n);
+	//   static int run() { return add(2, 3); }
+	//   String hi() { return greet("bob"); }
+	//   static long total() { return sum(new int[3]); }
+	//   static int safe(int n) { try { check(n); return 1; } catch (IllegalArgumentException e) { return 0; } }
+	// }
+	a := &Assembler{}
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	a.Method(0x0109, "add", "(II)I", 0, 0).Method(0x0101, "greet", "(Ljava/lang/String;)Ljava/lang/String;", 0, 0)
+	a.Method(0x0109, "sum", "([I)J", 0, 0).Method(0x0109, "check", "(I)V", 0, 0)
+	a.Iconst(2).Iconst(3).Invoke(0xB8, "Calc", "add", "(II)I").Ireturn().Method(0x0009, "run", "()I", 2, 0)
+	a.Aload(0).Ldc("bob").Invoke(0xB6, "Calc", "greet", "(Ljava/lang/String;)Ljava/lang/String;").Areturn()
+	a.Method(0x0001, "hi", "()Ljava/lang/String;", 2, 1)
+	a.Iconst(3).Newarray(10).Invoke(0xB8, "Calc", "sum", "([I)J").Lreturn().Method(0x0009, "total", "()J", 1, 0)
+	start, end, handler := a.Label(), a.Label(), a.Label()
+	a.Mark(start).Iload(0).Invoke(0xB8, "Calc", "check", "(I)V").Iconst(1).Mark(end).Ireturn()
+	a.Mark(handler).Pop().Iconst(0).Ireturn()
+	a.Catch(start, end, handler, "java/lang/IllegalArgumentException")
+	a.Method(0x0009, "safe", "(I)I", 1, 1)
+	vm := New("")
+	c, err := vm.DefineClass(a.Class(0x0021, "Calc", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl := &calc{vm: vm}
+	if err := vm.BindNatives("Calc", impl); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Calc", "run"); err != nil || res != int32(5) || impl.calls != 1 {
+		t.Error(res, err, impl.calls)
+	}
+	if res, err := vm.CallMethod(c.New(), "hi", "()Ljava/lang/String;", c.New()); err != nil || vm.ToGo(res) != "hello, bob" {
+		t.Error(res, err)
+	}
+	if res, err := vm.Call("Calc", "total"); err != nil || res != int64(0) {
+		t.Error(res, err)
+	}
+	for n, want := range map[int32]int32{1: 1, -1: 0} {
+		if res, err := vm.Call("Calc", "safe", n); err != nil || res != want {
+			t.Error(n, res, err)
+		}
+	}
+	if err := vm.BindNatives("Calc", struct{ M map[string]int }{}); err != nil {
+		t.Error(err)
+	}
+	if err := vm.BindNatives("Calc", &struct{ calc }{}); err != nil {
+		t.Error(err)
+	}
+	if err := vm.BindNatives("Calc", new(bytes.Buffer)); err == nil || !strings.Contains(err.Error(), "no Java type for io.") {
+		t.Error(err)
+	}
+}
+
+func TestExecution(t *testing.T) {
+	// class Agent {
+	//   static int twice(int x) { return x * 2; }
+	//   static int sum(int n) { int s = 0; for (int i = 0; i < n; i++) { s += i * i + twice(i); } return s; }
+	// }
+	a := &Assembler{}
+	a.Iload(0).Iconst(2).Imul().Ireturn().Method(0x0009, "twice", "(I)I", 2, 1)
+	loop, end := a.Label(), a.Label()
+	a.Iconst(0).Istore(1).Iconst(0).Istore(2)
+	a.Mark(loop).Iload(2).Iload(0).Branch(0xA2, end)
+	a.Iload(1).Iload(2).Iload(2).Imul().Iadd().Iload(2).Invoke(0xB8, "Agent", "twice", "(I)I").Iadd().Istore(1)
+	a.Iinc(2, 1).Goto(loop)
+	a.Mark(end).Iload(1).Ireturn().Method(0x0009, "sum", "(I)I", 4, 3)
+	vm := New("")
+	if _, err := vm.DefineClass(a.Class(0x0021, "Agent", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	want, err := vm.Call("Agent", "sum", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ex, err := vm.Start("Agent", "sum", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for done := false; !done; total++ {
+		if done, _, err = ex.Run(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total-- // the last instruction returned
+	var entered, exited int
+	vm.OnEnter = func(class, method, desc string) {
+		if method == "sum" {
+			entered++
+		}
+	}
+	vm.OnExit = func(class, method, desc string, res Value, err error) {
+		if method == "sum" {
+			exited++
+		}
+	}
+	if ex, err = vm.Start("Agent", "sum", 100); err != nil {
+		t.Fatal(err)
+	}
+	slice := (total + 2) / 3
+	for i := 0; i < 3; i++ {
+		done, res, err := ex.Run(slice)
+		if err != nil || done != (i == 2) {
+			t.Fatal(i, done, res, err)
+		}
+		if i < 2 && vm.Reset() == nil {
+			t.Error("reset while suspended")
+		}
+		if done && res != want {
+			t.Error(res, want)
+		}
+	}
+	if done, res, err := ex.Run(1); !done || res != want || err != nil {
+		t.Error(done, res, err)
+	}
+	if entered != 1 || exited != 1 {
+		t.Error(entered, exited)
+	}
+	if _, err := vm.Start("Agent", "sum"); err == nil {
+		t.Error("missing argument")
+	}
+	if ex, err = vm.Start("Agent", "sum", 100); err != nil {
+		t.Fatal(err)
+	}
+	ex.Run(10)
+	ex.Stop()
+	if done, _, err := ex.Run(1); !done || err == nil {
+		t.Error(done, err)
+	}
+	if err := vm.Reset(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSuspendNative(t *testing.T) {
+	// class Net {
+	//   static native int fetch(int id);
+	//   static int get() { return fetch(1) + 1; }
+	//   static int safe() { try { return fetch(2); } catch (IllegalArgumentException e) { return -1; } }
+	// }
+	a := &Assembler{}
+	a.Method(0x0109, "fetch", "(I)I", 0, 0)
+	a.Iconst(1).Invoke(0xB8, "Net", "fetch", "(I)I").Iconst(1).Iadd().Ireturn().Method(0x0009, "get", "()I", 2, 0)
+	start, end, handler := a.Label(), a.Label(), a.Label()
+	a.Mark(start).Iconst(2).Invoke(0xB8, "Net", "fetch", "(I)I").Mark(end).Ireturn()
+	a.Mark(handler).Pop().Iconst(-1).Ireturn()
+	a.Catch(start, end, handler, "java/lang/IllegalArgumentException")
+	a.Method(0x0009, "safe", "()I", 1, 0)
+	vm := New("")
+	if _, err := vm.DefineClass(a.Class(0x0021, "Net", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan *Execution, 1)
+	vm.RegisterNativeFunc("Net", "fetch", "(I)I", func(ctx *NativeContext, args ...Value) (Value, error) {
+		ex, err := ctx.Suspend()
+		if ex != nil {
+			requests <- ex
+		}
+		return nil, err
+	})
+	for _, test := range []struct {
+		method string
+		res    Value
+		err    error
+		want   Value
+	}{
+		{"get", int32(41), nil, int32(42)},
+		{"safe", nil, vm.Throw("java/lang/IllegalArgumentException", "not found"), int32(-1)},
+	} {
+		ex, err := vm.Start("Net", test.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done, _, err := ex.Run(100); done || err != nil || !ex.Suspended() {
+			t.Fatal(test.method, done, err)
+		}
+		if done, _, err := ex.Run(100); done || err != nil {
+			t.Error(test.method, done, err)
+		}
+		resumed := make(chan error)
+		go func() {
+			resumed <- (<-requests).ResumeWith(test.res, test.err)
+		}()
+		if err := <-resumed; err != nil {
+			t.Fatal(err)
+		}
+		if ex.Suspended() {
+			t.Error("still suspended")
+		}
+		if done, res, err := ex.Run(100); !done || err != nil || res != test.want {
+			t.Error(test.method, done, res, err)
+		}
+		if err := ex.ResumeWith(int32(0), nil); err == nil {
+			t.Error("resumed twice")
+		}
+	}
+
+	ex, _ := vm.Start("Net", "get")
+	ex.Run(100)
+	(<-requests).ResumeWith(nil, errors.New("connection refused"))
+	if done, _, err := ex.Run(100); !done || err == nil || err.Error() != "connection refused at Net.get+1" {
+		t.Error(done, err)
+	}
+	if _, err := vm.Call("Net", "get"); err == nil || !strings.Contains(err.Error(), "can't suspend a native outside of an Execution") {
+		t.Error(err)
+	}
+}
+
+func TestNoCode(t *testing.T) {
+	// abstract class Shape { abstract int area(); static native int sides(); static int none(); }
+	a := &Assembler{}
+	a.Method(0x0401, "area", "()I", 0, 0).Method(0x0109, "sides", "()I", 0, 0).Method(0x0009, "none", "()I", 0, 0)
+	vm := New("")
+	c, err := vm.DefineClass(a.Class(0x0421, "Shape", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for method, want := range map[string]string{
+		"area":  "abstract method Shape.area()I has no code",
+		"sides": "native method Shape.sides()I is not registered",
+		"none":  "method Shape.none()I has no code",
+	} {
+		var args []Value
+		if method == "area" {
+			args = append(args, c.New())
+		}
+		if _, err := vm.Call("Shape", method, args...); err == nil || err.Error() != want {
+			t.Error(method, err)
+		}
+	}
+	vm.RegisterNative("Shape", "sides", "()I", func(...Value) Value { return int32(3) })
+	if res, err := vm.Call("Shape", "sides"); err != nil || res != int32(3) {
+		t.Error(res, err)
+	}
+}
+
+func TestInstanceSlots(t *testing.T) {
+	// class Mixed {
+	//   Mixed self; long l; int i; double d; String s;
+	//   void set(long l, int i, double d, String s) { self = this; this.l = l; this.i = i; this.d = d; this.s = s; }
+	//   static Mixed make() { Mixed m = new Mixed(); m.set(1L << 40, 7, 2.5, "x"); return m; }
+	// }
+	a := &Assembler{}
+	a.Field(0, "self", "LMixed;").Field(0, "l", "J").Field(0, "i", "I").Field(0, "d", "D").Field(0, "s", "Ljava/lang/String;")
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	a.Aload(0).Aload(0).Putfield("Mixed", "self", "LMixed;")
+	a.Aload(0).Lload(1).Putfield("Mixed", "l", "J")
+	a.Aload(0).Iload(3).Putfield("Mixed", "i", "I")
+	a.Aload(0).Dload(4).Putfield("Mixed", "d", "D")
+	a.Aload(0).Aload(6).Putfield("Mixed", "s", "Ljava/lang/String;")
+	a.Return().Method(0x0001, "set", "(JIDLjava/lang/String;)V", 3, 7)
+	a.New("Mixed").Dup().Invoke(0xB7, "Mixed", "<init>", "()V").Astore(0)
+	a.Aload(0).Ldc(int64(1<<40)).Iconst(7).Ldc(2.5).Ldc("x").Invoke(0xB6, "Mixed", "set", "(JIDLjava/lang/String;)V")
+	a.Aload(0).Areturn().Method(0x0009, "make", "()LMixed;", 7, 1)
+	vm := New("")
+	c, err := vm.DefineClass(a.Class(0x0021, "Mixed", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(obj *Object) {
+		if obj.Field("self") != obj || obj.Field("l") != int64(1<<40) || obj.Field("i") != int32(7) ||
+			obj.Field("d") != 2.5 || vm.ToGo(obj.Field("s")) != "x" {
+			t.Error(obj.Fields)
+		}
+	}
+	res, err := vm.Call("Mixed", "make")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(res.(*Object))
+	obj := c.New()
+	if _, err := vm.CallMethod(obj, "set", "(JIDLjava/lang/String;)V", obj, 1<<40, 7, 2.5, "x"); err != nil {
+		t.Fatal(err)
+	}
+	check(obj)
+}
+
+func TestCallTimeout(t *testing.T) {
+	// class Spin {
+	//   static void spin() { for (;;); }
+	//   static synchronized void locked(Object o) { synchronized (o) { for (;;); } }
+	//   static int one() { return 1; }
+	// }
+	a := &Assembler{}
+	loop := a.Label()
+	a.Mark(loop).Goto(loop).Method(0x0009, "spin", "()V", 0, 0)
+	block := a.Label()
+	a.Aload(0).Op(0xC2).Mark(block).Goto(block).Method(0x0029, "locked", "(Ljava/lang/Object;)V", 1, 1)
+	a.Iconst(1).Ireturn().Method(0x0009, "one", "()I", 1, 0)
+	vm := New("")
+	c, err := vm.DefineClass(a.Class(0x0021, "Spin", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = vm.CallTimeout(20*time.Millisecond, "Spin", "spin")
+	var te *TimeoutError
+	var ve *VMError
+	if !errors.As(err, &te) || !errors.As(err, &ve) || ve.Method != "spin" || te.Elapsed < 20*time.Millisecond ||
+		!strings.HasPrefix(err.Error(), "call timed out after ") || !strings.HasSuffix(err.Error(), " at Spin.spin+0") {
+		t.Error(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error(elapsed)
+	}
+	if res, err := vm.Call("Spin", "one"); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+
+	obj := vm.objectClass.New()
+	vm.DefaultCallTimeout = 20 * time.Millisecond
+	if _, err := vm.Call("Spin", "locked", obj); !errors.As(err, &te) {
+		t.Error(err)
+	}
+	for _, mon := range []*monitor{obj.monitor(), vm.mirror(c).monitor()} {
+		if mon.owner != nil || mon.count != 0 {
+			t.Error(mon.owner, mon.count)
+		}
+	}
+	if res, err := vm.Call("Spin", "one"); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+}
+
+func TestAllocationLimits(t *testing.T) {
+	// class Hog {
+	//   static void bytes() { for (;;) { byte[] b = new byte[1 << 20]; } }
+	//   static void objects() { for (;;) { new Object(); } }
+	// }
+	a := &Assembler{}
+	loop := a.Label()
+	a.Mark(loop).Ldc(int32(1<<20)).Newarray(8).Astore(0).Goto(loop).Method(0x0009, "bytes", "()V", 1, 1)
+	loop = a.Label()
+	a.Mark(loop).New("java/lang/Object").Dup().Invoke(0xB7, "java/lang/Object", "<init>", "()V").Pop().Goto(loop)
+	a.Method(0x0009, "objects", "()V", 2, 0)
+	vm := New("")
+	if _, err := vm.DefineClass(a.Class(0x0021, "Hog", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	vm.MaxCallAllocations = 100
+	vm.MaxCallAllocatedBytes = 10 << 20
+	for _, test := range []struct {
+		method string
+		ip     uint32
+		msg    string
+	}{
+		{"bytes", 2, "allocation limit of 10485760 bytes exceeded"},
+		{"objects", 0, "allocation limit of 100 objects exceeded"},
+	} {
+		for i := 0; i < 2; i++ {
+			_, err := vm.Call("Hog", test.method)
+			var ve *VMError
+			var exc *Exception
+			if !errors.As(err, &ve) || !errors.As(err, &exc) || ve.Method != test.method || ve.IP != test.ip ||
+				err.Error() != "java/lang/OutOfMemoryError: "+test.msg+" at Hog."+test.method+"+"+fmt.Sprint(test.ip) {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	dir := t.TempDir()
+	for _, pkg := range []string{"app", "host"} {
+		if err := os.Mkdir(filepath.Join(dir, pkg), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// class host.Base { static int base() { return 1; } }
+	// class app.Helper extends host.Base { static int value() { return base() + 1; } }
+	// class app.Main {
+	//   static native int secret();
+	//   static int run() { return Helper.value(); }
+	//   static int leak() { return secret(); }
+	// }
+	base := &Assembler{}
+	base.Iconst(1).Ireturn().Method(0x0009, "base", "()I", 1, 0)
+	helper := &Assembler{}
+	helper.Invoke(0xB8, "app/Helper", "base", "()I").Iconst(1).Iadd().Ireturn().Method(0x0009, "value", "()I", 2, 0)
+	main := &Assembler{}
+	main.Method(0x0109, "secret", "()I", 0, 0)
+	main.Invoke(0xB8, "app/Helper", "value", "()I").Ireturn().Method(0x0009, "run", "()I", 1, 0)
+	main.Invoke(0xB8, "app/Main", "secret", "()I").Ireturn().Method(0x0009, "leak", "()I", 1, 0)
+	for _, c := range []Class{
+		base.Class(0x0021, "host/Base", "java/lang/Object"),
+		helper.Class(0x0021, "app/Helper", "host/Base"),
+		main.Class(0x0021, "app/Main", "java/lang/Object"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func(p *Policy) (Value, Value, error, error) {
+		vm := New(dir)
+		vm.Policy = p
+		vm.RegisterNative("app/Main", "secret", "()I", func(...Value) Value { return int32(42) })
+		res, err := vm.Call("app/Main", "run")
+		leaked, leakErr := vm.Call("app/Main", "leak")
+		return res, leaked, err, leakErr
+	}
+	if res, leaked, err, leakErr := run(nil); res != int32(2) || leaked != int32(42) || err != nil || leakErr != nil {
+		t.Error(res, leaked, err, leakErr)
+	}
+	if res, leaked, err, leakErr := run(&Policy{Allow: []string{"app/", "host/", "java/lang/"}}); res != int32(2) || leaked != int32(42) || err != nil || leakErr != nil {
+		t.Error(res, leaked, err, leakErr)
+	}
+
+	_, _, err, leakErr := run(&Policy{
+		Allow: []string{"app/", "java/"},
+		Deny:  []string{"host/", "java/io/"},
+		CheckNative: func(class, method, desc string) error {
+			if class == "app/Main" {
+				return errors.New("no secrets")
+			}
+			return nil
+		},
+	})
+	var se *SecurityError
+	var ve *VMError
+	if !errors.As(err, &se) || !errors.As(err, &ve) || se.Class != "host/Base" || ve.Method != "run" || ve.IP != 0 ||
+		err.Error() != "access to class host/Base denied at app/Main.run+0" {
+		t.Error(err)
+	}
+	if !errors.As(leakErr, &se) || se.Method != "secret" ||
+		leakErr.Error() != "call of native app/Main.secret()I denied: no secrets at app/Main.leak+0" {
+		t.Error(leakErr)
+	}
+
+	vm := New(dir)
+	vm.Policy = &Policy{Allow: []string{"app/"}}
+	for _, name := range []string{"java/lang/String", "[Ljava/lang/String;", "host/Base"} {
+		if _, err := vm.Class(name); err == nil || !strings.Contains(err.Error(), "denied") {
+			t.Error(name, err)
+		}
+	}
+	if _, err := vm.Class("java/lang/Object"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	// class Shape { String label; Shape next; }
+	// class Point extends Shape { int x; long y; double z; int[] tags; }
+	shape := &Assembler{}
+	shape.Field(0, "label", "Ljava/lang/String;").Field(0, "next", "LShape;")
+	point := &Assembler{}
+	point.Field(0, "x", "I").Field(0, "y", "J").Field(0, "z", "D").Field(0, "tags", "[I")
+	vm := New("")
+	if _, err := vm.DefineClass(shape.Class(0x0021, "Shape", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := vm.DefineClass(point.Class(0x0021, "Point", "Shape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.New()
+	p.SetField("x", int32(1))
+	p.SetField("y", int64(2))
+	p.SetField("z", 0.5)
+	p.SetField("tags", []int32{3, 4})
+	p.SetField("label", vm.InternString("origin"))
+	p.SetField("next", p)
+	p.Fields["extra"] = int32(5)
+	want := `Point{label="origin", next=Point{...}, x=1, y=2L, z=0.5, tags=[3, 4], extra=5}`
+	for i := 0; i < 10; i++ {
+		if got := vm.Dump(p); got != want {
+			t.Fatal(got)
+		}
+	}
+	if names := p.FieldNames(); !reflect.DeepEqual(names, []string{"label", "next", "x", "y", "z", "tags", "extra"}) {
+		t.Error(names)
+	}
+}
+
+func TestClassNames(t *testing.T) {
+	dir := t.TempDir()
+	cp := filepath.Join(dir, "classes")
+	if err := os.MkdirAll(filepath.Join(cp, "com", "example", "deep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// class com.example.deep.Foo { static int get() { return 7; } }
+	// class Evil { static int get() { return 666; } }, outside of the class path
+	// class Bad { static int get() { return ../Evil.get(); } }
+	foo := &Assembler{}
+	foo.Iconst(7).Ireturn().Method(0x0009, "get", "()I", 1, 0)
+	evil := &Assembler{}
+	evil.Iconst(666).Ireturn().Method(0x0009, "get", "()I", 1, 0)
+	bad := &Assembler{}
+	bad.Invoke(0xB8, "../Evil", "get", "()I").Ireturn().Method(0x0009, "get", "()I", 1, 0)
+	for path, c := range map[string]Class{
+		filepath.Join(cp, "com", "example", "deep", "Foo.class"): foo.Class(0x0021, "com/example/deep/Foo", "java/lang/Object"),
+		filepath.Join(dir, "Evil.class"):                         evil.Class(0x0021, "Evil", "java/lang/Object"),
+		filepath.Join(cp, "Bad.class"):                           bad.Class(0x0021, "Bad", "java/lang/Object"),
+	} {
+		if err := ioutil.WriteFile(path, classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(cp)
+	if res, err := vm.Call("com/example/deep/Foo", "get"); err != nil || res != int32(7) {
+		t.Error(res, err)
+	}
+	for _, name := range []string{"../Evil", "com/../../Evil", "/" + filepath.ToSlash(filepath.Join(dir, "Evil")), `..\Evil`, "com//example/deep/Foo", "./Bad"} {
+		if _, err := vm.Class(name); err == nil || !strings.Contains(err.Error(), "invalid class name") {
+			t.Error(name, err)
+		}
+	}
+	if _, err := vm.Call("Bad", "get"); err == nil || err.Error() != `invalid class name "../Evil" at Bad.get+0` {
+		t.Error(err)
+	}
+}
+
+func TestClassNotFound(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	// class Mid extends Missing {}
+	// class Sub extends Mid {}
+	// class Main { static void run() { new Gone(); } }
+	main := &Assembler{}
+	main.New("Gone").Pop().Return().Method(0x0009, "run", "()V", 1, 0)
+	for _, c := range []Class{
+		(&Assembler{}).Class(0x0021, "Mid", "Missing"),
+		(&Assembler{}).Class(0x0021, "Sub", "Mid"),
+		(&Assembler{}).Class(0x0021, "Other", "java/lang/Object"),
+		main.Class(0x0021, "Main", "java/lang/Object"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dirs[1], c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirs[0], "Corrupt.class"), []byte{0xCA, 0xFE}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dirs[1], "Other.class"), filepath.Join(dirs[1], "Renamed.class")); err != nil {
+		t.Fatal(err)
+	}
+	vm := New(dirs...)
+	path := strings.Join(dirs, ", ")
+	for name, want := range map[string]string{
+		"Nowhere": "class Nowhere not found in " + path,
+		"Sub":     "class Missing not found in " + path + ", needed as superclass of Mid, superclass of Sub",
+		"Corrupt": "can't load class Corrupt from " + filepath.Join(dirs[0], "Corrupt.class") + ": ",
+		"Renamed": "can't load class Renamed from " + filepath.Join(dirs[1], "Renamed.class") + ": it declares class Other",
+	} {
+		_, err := vm.Class(name)
+		var e *ClassNotFoundError
+		if !errors.As(err, &e) || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := vm.Call("Main", "run"); err == nil || err.Error() != "class Gone not found in "+path+" at Main.run+0" {
+		t.Error(err)
+	}
+	if _, err := New().Class("Nowhere"); err == nil || err.Error() != "class Nowhere not found, the class path is empty" {
+		t.Error(err)
+	}
+}
+
+func TestAccessFlags(t *testing.T) {
+	// public final class Flags {
+	//	private static final int N = 1;
+	//	protected transient int t;
+	//	public synchronized native void run();
+	// }
+	a := &Assembler{}
+	a.Field(0x001A, "N", "I").Field(0x0084, "t", "I")
+	a.Method(0x0121, "run", "()V", 0, 1)
+	c, err := Load(bytes.NewReader(classFile(a.Class(0x0031, "Flags", "java/lang/Object"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsPublic() || !c.IsFinal() || !c.IsSuper() || c.IsInterface() || c.IsAbstract() || c.IsEnum() {
+		t.Errorf("class flags %#x", c.Flags)
+	}
+	n, tr, run := c.Fields[0], c.Fields[1], c.Methods[0]
+	if !n.IsPrivate() || !n.IsStatic() || !n.IsFinal() || n.IsPublic() || n.IsVolatile() {
+		t.Errorf("N flags %#x", n.Flags)
+	}
+	if !tr.IsProtected() || !tr.IsTransient() || tr.IsStatic() || tr.IsFinal() {
+		t.Errorf("t flags %#x", tr.Flags)
+	}
+	if !run.IsPublic() || !run.IsSynchronized() || !run.IsNative() || run.IsAbstract() || run.IsStatic() {
+		t.Errorf("run flags %#x", run.Flags)
+	}
+}
+
+func TestReloadClass(t *testing.T) {
+	dir := t.TempDir()
+	write := func(c Class) {
+		if err := ioutil.WriteFile(filepath.Join(dir, c.Name+".class"), classFile(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// class Greeter {
+	//	static int calls;
+	//	int n;
+	//	static String greet() { calls++; return "hello"; }
+	//	int twice() { return n * 2; }
+	// }
+	greeter := func(super, greeting string, factor int32, fields ...string) Class {
+		a := &Assembler{}
+		a.Field(0x0008, "calls", "I").Field(0x0000, "n", "I")
+		for _, f := range fields {
+			a.Field(0x0008, f, "I")
+		}
+		a.Getstatic("Greeter", "calls", "I").Iconst(1).Iadd().Putstatic("Greeter", "calls", "I").
+			Ldc(greeting).Areturn().Method(0x0008, "greet", "()Ljava/lang/String;", 2, 0)
+		a.Op(0x2A).Getfield("Greeter", "n", "I").Iconst(factor).Imul().Ireturn().Method(0x0000, "twice", "()I", 2, 1) // ALOAD_0
+		return a.Class(0x0020, "Greeter", super)
+	}
+	// class Main { static String run() { return Greeter.greet(); } }
+	main := &Assembler{}
+	main.Invoke(0xB8, "Greeter", "greet", "()Ljava/lang/String;").Areturn().Method(0x0009, "run", "()Ljava/lang/String;", 1, 0)
+	write(main.Class(0x0021, "Main", "java/lang/Object"))
+	write(greeter("java/lang/Object", "hello", 2))
+
+	vm := New(dir)
+	greet := func() string {
+		res, err := vm.Call("Main", "run")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _ := vm.GoString(res.(*Object))
+		return s
+	}
+	if s := greet(); s != "hello" {
+		t.Fatal(s)
+	}
+	c, _ := vm.Class("Greeter")
+	obj := c.New()
+	obj.SetField("n", int32(5))
+
+	write(greeter("java/lang/Object", "hi", 3, "added"))
+	if err := vm.ReloadClass("Greeter"); err != nil {
+		t.Fatal(err)
+	}
+	if s := greet(); s != "hi" {
+		t.Error(s)
+	}
+	if c.Field("calls") != int32(2) || c.Field("added") != int32(0) {
+		t.Error(c.Fields)
+	}
+	if res, err := vm.CallMethod(obj, "twice", "()I", obj); err != nil || res != int32(15) {
+		t.Error(res, err)
+	}
+
+	vm.ReinitializeOnReload = true
+	write(greeter("java/lang/Object", "hey", 3))
+	if err := vm.ReloadClass("Greeter"); err != nil {
+		t.Fatal(err)
+	}
+	if s := greet(); s != "hey" || c.Field("calls") != int32(1) || c.Field("added") != nil {
+		t.Error(s, c.Fields)
+	}
+
+	write(greeter("Main", "hello", 2))
+	if err := vm.ReloadClass("Greeter"); err == nil || err.Error() != "can't reload class Greeter: superclass changed from java/lang/Object to Main" {
+		t.Error(err)
+	}
+	changed := greeter("java/lang/Object", "hello", 2)
+	changed.Fields[1].Name = "calls"
+	write(changed)
+	if err := vm.ReloadClass("Greeter"); err == nil || err.Error() != "can't reload class Greeter: instance fields changed from [n:I] to [calls:I]" {
+		t.Error(err)
+	}
+	if s := greet(); s != "hey" {
+		t.Error(s)
+	}
+	if err := vm.ReloadClass("Absent"); err == nil || err.Error() != "class Absent is not loaded" {
+		t.Error(err)
+	}
+
+	reloaded := make(chan error, 1)
+	stop := vm.WatchClassPath(time.Millisecond, func(class string, err error) {
+		if class == "Greeter" {
+			reloaded <- err
+		}
+	})
+	defer stop()
+	write(greeter("java/lang/Object", "yo", 3))
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "Greeter.class"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	if s := greet(); s != "yo" {
+		t.Error(s)
+	}
+}
+
+func TestNewAbstract(t *testing.T) {
+	// abstract class Shape { static int inits; static { inits++; } }
+	// interface Named {}
+	// class Main {
+	//	static int shape() { try { new Shape(); return 0; } catch (IncompatibleClassChangeError e) { return 1; } }
+	//	static void named() { new Named(); }
+	// }
+	shape := &Assembler{}
+	shape.Field(0x0008, "inits", "I")
+	shape.Getstatic("Shape", "inits", "I").Iconst(1).Iadd().Putstatic("Shape", "inits", "I").Return().
+		Method(0x0008, "<clinit>", "()V", 2, 0)
+	a := &Assembler{}
+	start, end, handler := a.Label(), a.Label(), a.Label()
+	a.Mark(start).New("Shape").Pop().Iconst(0).Mark(end).Ireturn()
+	a.Mark(handler).Pop().Iconst(1).Ireturn()
+	a.Catch(start, end, handler, "java/lang/IncompatibleClassChangeError")
+	a.Method(0x0008, "shape", "()I", 1, 0)
+	a.New("Named").Pop().Return().Method(0x0008, "named", "()V", 1, 0)
+	vm := New()
+	for _, c := range []Class{
+		shape.Class(0x0421, "Shape", "java/lang/Object"),
+		(&Assembler{}).Class(0x0601, "Named", "java/lang/Object"),
+		a.Class(0x0020, "Main", "java/lang/Object"),
+	} {
+		vm.classesMu.Lock()
+		_, err := vm.defineClass(c)
+		vm.classesMu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, err := vm.Call("Main", "shape"); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if c := vm.findClass("Shape"); c.Field("inits") != int32(0) {
+		t.Error("Shape was initialized")
+	}
+	var exc *Exception
+	if _, err := vm.Call("Main", "named"); !errors.As(err, &exc) || exc.Error() != "java/lang/InstantiationError: Named" {
+		t.Error(err)
+	}
+}
+
+func TestSystemExit(t *testing.T) {
+	// class Main {
+	//	static int after;
+	//	static synchronized void main(String[] args) {
+	//		try { System.exit(3); } finally { after = 2; }
+	//		after = 1;
+	//	}
+	//	static synchronized int poll() { return after; }
+	// }
+	a := &Assembler{}
+	a.Field(0x0008, "after", "I")
+	start, end, handler := a.Label(), a.Label(), a.Label()
+	a.Mark(start).Iconst(3).Invoke(0xB8, "java/lang/System", "exit", "(I)V").Mark(end).
+		Iconst(1).Putstatic("Main", "after", "I").Return()
+	a.Mark(handler).Iconst(2).Putstatic("Main", "after", "I").Return()
+	a.Catch(start, end, handler, "")
+	a.Method(0x0029, "main", "([Ljava/lang/String;)V", 1, 1)
+	a.Getstatic("Main", "after", "I").Ireturn().Method(0x0029, "poll", "()I", 1, 0)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Main", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := vm.Call("Main", "main", &Array{Desc: "[Ljava/lang/String;"})
+	var exit *ExitError
+	if !errors.As(err, &exit) || exit.Code != 3 || err.Error() != "exit status 3 at Main.main+1" {
+		t.Error(err)
+	}
+	done := make(chan Value)
+	go func() {
+		res, _ := vm.Call("Main", "poll")
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		if res != int32(0) {
+			t.Error(res)
+		}
+	case <-time.After(time.Second):
+		t.Error("monitor of Main not released")
+	}
+}
+
+func TestPreloadAll(t *testing.T) {
+	dir := t.TempDir()
+	// package app; class Good {}
+	good := (&Assembler{}).Class(0x0021, "app/Good", "java/lang/Object")
+	if err := os.Mkdir(filepath.Join(dir, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, data := range map[string][]byte{
+		"app/Good.class": classFile(good),
+		"Bad.class":      {0xCA, 0xFE, 0xBA, 0xBE},
+		"README":         []byte("not a class"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm := New(dir)
+	errs := vm.PreloadAll()
+	var e *ClassNotFoundError
+	if len(errs) != 1 || !errors.As(errs[0], &e) || e.Name != "Bad" {
+		t.Fatal(errs)
+	}
+	vm.classesMu.RLock()
+	c := vm.findClass("app/Good")
+	vm.classesMu.RUnlock()
+	if c == nil || c.init.done != 0 {
+		t.Error("app/Good not preloaded, or initialized", c)
+	}
+}
+
+func TestProperties(t *testing.T) {
+	// class Config {
+	//	static String get(String key) { return System.getProperty(key); }
+	//	static String orDefault(String key) { return System.getProperty(key, "none"); }
+	//	static void set(String key, String value) { System.setProperty(key, value); }
+	//	static String view(String key) { return System.getProperties().getProperty(key); }
+	// }
+	a := &Assembler{}
+	a.Aload(0).Invoke(0xB8, "java/lang/System", "getProperty", "(Ljava/lang/String;)Ljava/lang/String;").Areturn().
+		Method(0x0008, "get", "(Ljava/lang/String;)Ljava/lang/String;", 1, 1)
+	a.Aload(0).Ldc("none").Invoke(0xB8, "java/lang/System", "getProperty", "(Ljava/lang/String;Ljava/lang/String;)Ljava/lang/String;").Areturn().
+		Method(0x0008, "orDefault", "(Ljava/lang/String;)Ljava/lang/String;", 2, 1)
+	a.Aload(0).Aload(1).Invoke(0xB8, "java/lang/System", "setProperty", "(Ljava/lang/String;Ljava/lang/String;)Ljava/lang/String;").Pop().Return().
+		Method(0x0008, "set", "(Ljava/lang/String;Ljava/lang/String;)V", 2, 2)
+	a.Invoke(0xB8, "java/lang/System", "getProperties", "()Ljava/util/Properties;").Aload(0).
+		Invoke(0xB6, "java/util/Properties", "getProperty", "(Ljava/lang/String;)Ljava/lang/String;").Areturn().
+		Method(0x0008, "view", "(Ljava/lang/String;)Ljava/lang/String;", 2, 1)
+	vm := New("classes")
+	if _, err := vm.DefineClass(a.Class(0x0020, "Config", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	call := func(method string, args ...Value) Value {
+		res, err := vm.Call("Config", method, args...)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		return res
+	}
+	vm.SetProperty("app.mode", "test")
+	if res := call("get", vm.InternString("app.mode")); res != vm.InternString("test") {
+		t.Error(vm.ToGo(res))
+	}
+	for key, want := range map[string]string{"line.separator": "\n", "java.class.path": "classes", "app.mode": "test"} {
+		if res := call("view", vm.InternString(key)); vm.ToGo(res) != want {
+			t.Error(key, vm.ToGo(res))
+		}
+	}
+	if res := call("get", vm.InternString("absent")); res != nil {
+		t.Error(res)
+	}
+	if res := call("orDefault", vm.InternString("absent")); vm.ToGo(res) != "none" {
+		t.Error(vm.ToGo(res))
+	}
+	call("set", vm.InternString("app.name"), vm.InternString("demo"))
+	if v, ok := vm.Property("app.name"); !ok || v != "demo" {
+		t.Error(v, ok)
+	}
+	vm.ClearProperty("app.name")
+	if _, ok := vm.Property("app.name"); ok {
+		t.Error("app.name not cleared")
+	}
+	var exc *Exception
+	if _, err := vm.Call("Config", "get", vm.InternString("")); !errors.As(err, &exc) ||
+		exc.Error() != "java/lang/IllegalArgumentException: key can't be empty" {
+		t.Error(err)
+	}
+}
+
+func TestGetenv(t *testing.T) {
+	for name, v := range map[string]string{"TOJVM_PORT": "8080", "TOJVM_MODE": "dev", "TOJVM_SECRET": "hunter2"} {
+		t.Setenv(name, v)
+	}
+	// class Env { static String get(String name) { return System.getenv(name); } }
+	a := &Assembler{}
+	a.Aload(0).Invoke(0xB8, "java/lang/System", "getenv", "(Ljava/lang/String;)Ljava/lang/String;").Areturn().
+		Method(0x0008, "get", "(Ljava/lang/String;)Ljava/lang/String;", 1, 1)
+	a.Invoke(0xB8, "java/lang/System", "getenv", "()Ljava/util/Map;").Areturn().
+		Method(0x0008, "all", "()Ljava/util/Map;", 1, 0)
+	vm := New()
+	vm.Env = HostEnv("TOJVM_PORT", "TOJVM_MODE", "TOJVM_UNSET")
+	if _, err := vm.DefineClass(a.Class(0x0020, "Env", "java/lang/Object")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]Value{"TOJVM_PORT": "8080", "TOJVM_MODE": "dev", "TOJVM_SECRET": nil, "TOJVM_UNSET": nil} {
+		res, err := vm.Call("Env", "get", vm.InternString(name))
+		if err != nil || vm.ToGo(res) != want {
+			t.Error(name, vm.ToGo(res), err)
+		}
+	}
+	var exc *Exception
+	if _, err := vm.Call("Env", "all"); !errors.As(err, &exc) || exc.Object.Name != "java/lang/UnsupportedOperationException" {
+		t.Error(err)
+	}
+}
+
+func TestThrowUserClass(t *testing.T) {
+	// class MyError extends Exception {}
+	e := &Assembler{}
+	e.Aload(0).Invoke(0xB7, "java/lang/Exception", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	// class Thrower {
+	//   static native void fail();
+	//   static int run() { try { fail(); return 1; } catch (MyError e) { return 0; } }
+	// }
+	a := &Assembler{}
+	a.Method(0x0109, "fail", "()V", 0, 0)
+	start, end, handler := a.Label(), a.Label(), a.Label()
+	a.Mark(start).Invoke(0xB8, "Thrower", "fail", "()V").Iconst(1).Mark(end).Ireturn()
+	a.Mark(handler).Pop().Iconst(0).Ireturn()
+	a.Catch(start, end, handler, "MyError")
+	a.Method(0x0009, "run", "()I", 1, 0)
+	vm := New()
+	for _, c := range []Class{e.Class(0x0021, "MyError", "java/lang/Exception"), a.Class(0x0021, "Thrower", "java/lang/Object")} {
+		if _, err := vm.DefineClass(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm.RegisterNativeFunc("Thrower", "fail", "()V", func(ctx *NativeContext, args ...Value) (Value, error) {
+		return nil, ctx.VM.Throw("MyError", "x")
+	})
+	if res, err := vm.Call("Thrower", "run"); err != nil || res != int32(0) {
+		t.Error(res, err)
+	}
+	err := vm.Throw("MyError", "x")
+	if exc, ok := err.(*Exception); !ok || exc.Error() != "MyError: x" {
+		t.Error(err)
+	}
+	if err := vm.Throw("com/example/MyError", "x"); err == nil {
+		t.Error("unknown class thrown")
+	} else if _, ok := err.(*Exception); ok {
+		t.Error(err)
+	}
+	if err := vm.Throw("java/lang/String", "x"); err == nil || err.Error() != "java/lang/String is not a java/lang/Throwable" {
+		t.Error(err)
+	}
+}
+
+func TestResetStartedThread(t *testing.T) {
+	// class Worker implements Runnable {
+	//   static native void block();
+	//   public void run() { block(); }
+	//   static void spawn() { new Thread(new Worker()).start(); }
+	// }
+	a := &Assembler{}
+	a.Aload(0).Invoke(0xB7, "java/lang/Object", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	a.Method(0x0109, "block", "()V", 0, 0)
+	a.Invoke(0xB8, "Worker", "block", "()V").Return().Method(0x0001, "run", "()V", 0, 1)
+	a.New("java/lang/Thread").Dup().New("Worker").Dup().Invoke(0xB7, "Worker", "<init>", "()V").
+		Invoke(0xB7, "java/lang/Thread", "<init>", "(Ljava/lang/Runnable;)V").
+		Invoke(0xB6, "java/lang/Thread", "start", "()V").Return().
+		Method(0x0009, "spawn", "()V", 4, 0)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Worker", "java/lang/Object", "java/lang/Runnable")); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	vm.RegisterNative("Worker", "block", "()V", func(args ...Value) Value {
+		<-release
+		return nil
+	})
+	if _, err := vm.Call("Worker", "spawn"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Reset(); err == nil {
+		t.Error("reset with a started thread")
+	}
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for vm.Reset() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("thread still running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	a := &Assembler{}
+	// static int bad() { return 1; <opcode 0xca> }, which the raw interpreter never reaches
+	a.Iconst(1).Ireturn().Op(0xCA).Method(0x0009, "bad", "()I", 1, 0)
+	vm := New()
+	c, err := vm.DefineClass(a.Class(0x0021, "Bad", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := c.codeOf(c.Methods[0])
+	if code.instructions != nil || code.err != nil {
+		t.Error("decoded before the first call")
+	}
+	if res, err := vm.Call("Bad", "bad"); err != nil || res != int32(1) {
+		t.Error(res, err)
+	}
+	if code.err == nil || code.err.Error() != "bad opcode 0xca at 2" {
+		t.Error(code.err)
+	}
+	vm.StrictOpcodes = true
+	if _, err := vm.Call("Bad", "bad"); err == nil || !strings.Contains(err.Error(), "can't decode Bad.bad()I: bad opcode 0xca at 2") {
+		t.Error(err)
+	}
+}
+
+func TestEmptyArrayIdentity(t *testing.T) {
+	// class Empty {
+	//   static int[] x, y, z;
+	//   static { x = new int[0]; y = new int[0]; z = x; }
+	//   static int same() { if (x == y) return 1; if (x == z) return 2; return 0; }
+	// }
+	a := &Assembler{}
+	a.Field(0x0008, "x", "[I").Field(0x0008, "y", "[I").Field(0x0008, "z", "[I")
+	a.Iconst(0).Newarray(10).Dup().Putstatic("Empty", "x", "[I").Putstatic("Empty", "z", "[I")
+	a.Iconst(0).Newarray(10).Putstatic("Empty", "y", "[I")
+	a.Return().Method(0x0008, "<clinit>", "()V", 2, 0)
+	notY, notZ := a.Label(), a.Label()
+	a.Getstatic("Empty", "x", "[I").Getstatic("Empty", "y", "[I").Branch(0xA6, notY).Iconst(1).Ireturn() // IF_ACMPNE
+	a.Mark(notY).Getstatic("Empty", "x", "[I").Getstatic("Empty", "z", "[I").Branch(0xA6, notZ).Iconst(2).Ireturn()
+	a.Mark(notZ).Iconst(0).Ireturn().Method(0x0008, "same", "()I", 2, 0)
+	vm := New()
+	c, err := vm.DefineClass(a.Class(0x0020, "Empty", "java/lang/Object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Empty", "same"); err != nil || res != int32(2) {
+		t.Error(res, err)
+	}
+	s, err := vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := vm.Call("Empty", "same"); err != nil || res != int32(2) {
+		t.Error("restored", res, err)
+	}
+	if x := c.Field("x"); sameRef(x, c.Field("y")) || !sameRef(x, c.Field("z")) {
+		t.Error(x, c.Field("y"), c.Field("z"))
+	}
+
+	x, _ := goHeap{}.AllocArray("[I", 0)
+	y, _ := goHeap{}.AllocArray("[I", 0)
+	if sameRef(x, y) || !sameRef(x, x) || sameRef(x, cloneArray(x)) {
+		t.Error("new int[0] arrays are the same")
+	}
+	if v := []Value{}; sameRef(v, cloneArray(v)) || sameRef([]int32{}, []int32{}) {
+		t.Error("empty slices are the same")
+	}
+	if v := ownArray([]int32{}); !sameRef(v, v) {
+		t.Error(v)
+	}
+}
+
+func TestArrayMonitor(t *testing.T) {
+	// class Bump extends Thread {
+	//   static Object lock; static int[] a;
+	//   public void run() { for (int i = 0; i < 1000; i++) synchronized (lock) { a[0]++; } }
+	//   static int count(Object lock) {
+	//     Bump.lock = lock; a = new int[1]; Bump x = new Bump(), y = new Bump();
+	//     x.start(); y.start(); x.join(); y.join(); return a[0];
+	//   }
+	//   static void signal(Object o) { synchronized (o) { o.notifyAll(); } }
+	// }
+	a := &Assembler{}
+	a.Field(0x0008, "lock", "Ljava/lang/Object;").Field(0x0008, "a", "[I")
+	a.Aload(0).Invoke(0xB7, "java/lang/Thread", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	loop, done := a.Label(), a.Label()
+	a.Iconst(0).Istore(1).
+		Mark(loop).Iload(1).Iconst(1000).Branch(0xA2, done).
+		Getstatic("Bump", "lock", "Ljava/lang/Object;").Dup().Astore(2).Op(0xC2).
+		Getstatic("Bump", "a", "[I").Iconst(0).Op(0x5C).Op(0x2E).Iconst(1).Iadd().Op(0x4F). // DUP2, IALOAD, IASTORE
+		Aload(2).Op(0xC3).
+		Iinc(1, 1).Goto(loop).
+		Mark(done).Return().
+		Method(0x0001, "run", "()V", 4, 3)
+	a.Aload(0).Putstatic("Bump", "lock", "Ljava/lang/Object;").
+		Iconst(1).Newarray(10).Putstatic("Bump", "a", "[I")
+	for i := 1; i <= 2; i++ {
+		a.New("Bump").Dup().Invoke(0xB7, "Bump", "<init>", "()V").Astore(i)
+	}
+	for _, m := range []string{"start", "join"} {
+		a.Aload(1).Invoke(0xB6, "Bump", m, "()V").Aload(2).Invoke(0xB6, "Bump", m, "()V")
+	}
+	a.Getstatic("Bump", "a", "[I").Iconst(0).Op(0x2E).Ireturn().
+		Method(0x0009, "count", "(Ljava/lang/Object;)I", 2, 3)
+	a.Aload(0).Dup().Astore(1).Op(0xC2).
+		Aload(0).Invoke(0xB6, "java/lang/Object", "notifyAll", "()V").
+		Aload(1).Op(0xC3).Return().
+		Method(0x0009, "signal", "(Ljava/lang/Object;)V", 2, 2)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Bump", "java/lang/Thread")); err != nil {
+		t.Fatal(err)
+	}
+	for _, lock := range []Value{make([]int32, 1), []Value{nil}, &Array{Desc: "[Ljava/lang/Object;", Values: []Value{nil}}} {
+		if res, err := vm.Call("Bump", "count", lock); err != nil || res != int32(2000) {
+			t.Errorf("%T: %v %v", lock, res, err)
+		}
+		if _, err := vm.Call("Bump", "signal", lock); err != nil {
+			t.Errorf("%T: %v", lock, err)
+		}
+	}
+	monitorsMu.Lock()
+	defer monitorsMu.Unlock()
+	if len(arrayMonitors) != 0 {
+		t.Error(arrayMonitors)
+	}
+}
+
+func TestFieldRace(t *testing.T) {
+	// class Racer extends Thread {
+	//   static Racer shared; static int s; int a, b;
+	//   public void run() { for (int i = 0; i < 10000; i++) { shared.a = i; shared.b = shared.a; s = i; } }
+	//   static int race() {
+	//     shared = new Racer(); Racer[] rs = new Racer[4];
+	//     for (int i = 0; i < 4; i++) { rs[i] = new Racer(); rs[i].start(); }
+	//     for (int i = 0; i < 4; i++) rs[i].join();
+	//     return shared.b;
+	//   }
+	// }
+	a := &Assembler{}
+	a.Field(0x0008, "shared", "LRacer;").Field(0x0008, "s", "I").Field(0, "a", "I").Field(0, "b", "I")
+	a.Aload(0).Invoke(0xB7, "java/lang/Thread", "<init>", "()V").Return().Method(0x0001, "<init>", "()V", 1, 1)
+	loop, done := a.Label(), a.Label()
+	a.Iconst(0).Istore(1).
+		Mark(loop).Iload(1).Iconst(10000).Branch(0xA2, done).
+		Getstatic("Racer", "shared", "LRacer;").Iload(1).Putfield("Racer", "a", "I").
+		Getstatic("Racer", "shared", "LRacer;").Dup().Getfield("Racer", "a", "I").Putfield("Racer", "b", "I").
+		Iload(1).Putstatic("Racer", "s", "I").
+		Iinc(1, 1).Goto(loop).
+		Mark(done).Return().
+		Method(0x0001, "run", "()V", 2, 2)
+	a.New("Racer").Dup().Invoke(0xB7, "Racer", "<init>", "()V").Putstatic("Racer", "shared", "LRacer;").
+		Iconst(4).Anewarray("Racer").Astore(0)
+	for _, m := range []string{"start", "join"} {
+		loop, done := a.Label(), a.Label()
+		a.Iconst(0).Istore(1).Mark(loop).Iload(1).Iconst(4).Branch(0xA2, done)
+		if m == "start" {
+			a.Aload(0).Iload(1).New("Racer").Dup().Invoke(0xB7, "Racer", "<init>", "()V").Op(0x53) // AASTORE
+		}
+		a.Aload(0).Iload(1).Op(0x32) // AALOAD
+		a.Invoke(0xB6, "Racer", m, "()V").Iinc(1, 1).Goto(loop).Mark(done)
+	}
+	a.Getstatic("Racer", "shared", "LRacer;").Getfield("Racer", "b", "I").Ireturn().
+		Method(0x0009, "race", "()I", 5, 2)
+	vm := New()
+	if _, err := vm.DefineClass(a.Class(0x0021, "Racer", "java/lang/Thread")); err != nil {
+		t.Fatal(err)
+	}
+	// the values read back race, but the process survives
+	if res, err := vm.Call("Racer", "race"); err != nil {
+		t.Error(err)
+	} else if n, ok := res.(int32); !ok || n < 0 || n >= 10000 {
+		t.Error(res)
+	}
+}